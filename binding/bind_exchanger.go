@@ -2,6 +2,7 @@ package binding
 
 import (
 	log "github.com/blackbeans/log4go"
+	"github.com/blackbeans/turbo"
 	"sort"
 	"strings"
 	"sync"
@@ -13,34 +14,96 @@ type BindExchanger struct {
 	exchanger   map[string] /*topic*/ map[string] /*groupId*/ []*Binding //保存的订阅关系
 	topics      []string                                                 //当前服务器可投递的topic类型
 	lock        sync.RWMutex
-	zkmanager   *ZKManager
+	registry    IRegistry
 	kiteqserver string
+	resyncFlow  *turbo.Flow   //全量同步修正的次数
+	drainDelay  time.Duration //关闭时等待客户端感知broker下线的时长
+	closeChan   chan bool
 }
 
-func NewBindExchanger(zkhost string, kiteQServer string) *BindExchanger {
+//全量同步订阅关系的默认周期
+const RESYNC_PERIOD = 1 * time.Minute
+
+//关闭时默认等待客户端感知broker下线的时长
+const DEFAULT_DRAIN_DELAY = 10 * time.Second
+
+//registryUri 为注册中心地址 zk://、etcd://、file://、mem://
+func NewBindExchanger(registryUri string, kiteQServer string) *BindExchanger {
 
 	ex := &BindExchanger{
 		exchanger: make(map[string]map[string][]*Binding, 100),
-		topics:    make([]string, 0, 50)}
-	zkmanager := NewZKManager(zkhost, ex)
-	ex.zkmanager = zkmanager
+		topics:    make([]string, 0, 50),
+		closeChan: make(chan bool, 1)}
+	registry := NewRegistry(registryUri, ex)
+	ex.registry = registry
 	ex.kiteqserver = kiteQServer
+	//进程内的注册中心同步通知客户端,不需要等待
+	if !strings.HasPrefix(registryUri, SCHEMA_MEM) && !strings.HasPrefix(registryUri, SCHEMA_FILE) &&
+		!strings.HasPrefix(registryUri, SCHEMA_STATIC) {
+		ex.drainDelay = DEFAULT_DRAIN_DELAY
+	}
 	return ex
 }
 
+//设置关闭时等待客户端感知broker下线的时长,<=0不等待
+func (self *BindExchanger) SetDrainDelay(delay time.Duration) {
+	self.drainDelay = delay
+}
+
 //推送Qserver到配置中心
 func (self *BindExchanger) PushQServer(hostport string, topics []string) bool {
-	err := self.zkmanager.PublishQServer(hostport, topics)
+	err := self.registry.PublishQServer(hostport, topics)
 	if nil != err {
 		log.Error("BindExchanger|PushQServer|FAIL|%s|%s|%s\n", err, hostport, topics)
 		return false
 	}
 	log.Info("BindExchanger|PushQServer|SUCC|%s|%s\n", hostport, topics)
-	self.topics = append(self.topics, topics...)
-	sort.Strings(self.topics)
+
+	self.lock.Lock()
+	for _, topic := range topics {
+		if !hasTopic(self.topics, topic) {
+			self.topics = append(self.topics, topic)
+			sort.Strings(self.topics)
+		}
+	}
+	current := make([]string, len(self.topics))
+	copy(current, self.topics)
+	self.lock.Unlock()
 
 	//订阅订阅关系变更
-	return self.subscribeBinds(self.topics)
+	return self.subscribeBinds(current)
+}
+
+//从配置中心移除topic对应的Qserver,并清理对应的订阅关系
+func (self *BindExchanger) UnpushQServer(hostport string, topics []string) {
+	self.registry.UnpushlishQServer(hostport, topics)
+
+	removed := make([]string, len(topics))
+	copy(removed, topics)
+	sort.Strings(removed)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	remain := make([]string, 0, len(self.topics))
+	for _, topic := range self.topics {
+		if !hasTopic(removed, topic) {
+			remain = append(remain, topic)
+		}
+	}
+	self.topics = remain
+	for _, topic := range topics {
+		delete(self.exchanger, topic)
+	}
+	log.Info("BindExchanger|UnpushQServer|SUCC|%s|%s\n", hostport, topics)
+}
+
+//当前可以投递的topic
+func (self *BindExchanger) Topics() []string {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	topics := make([]string, len(self.topics))
+	copy(topics, self.topics)
+	return topics
 }
 
 //监听topics的对应的订阅关系的变更
@@ -48,7 +111,7 @@ func (self *BindExchanger) subscribeBinds(topics []string) bool {
 	self.lock.Lock()
 	defer self.lock.Unlock()
 	for _, topic := range topics {
-		binds, err := self.zkmanager.GetBindAndWatch(topic)
+		binds, err := self.registry.GetBindAndWatch(topic)
 		if nil != err {
 			log.Error("BindExchanger|SubscribeBinds|FAIL|%s|%s\n", err, topic)
 			return false
@@ -116,7 +179,7 @@ func (self *BindExchanger) NodeChange(path string, eventType ZkEvent, childNode
 		switch eventType {
 		case Created, Child:
 
-			bm, err := self.zkmanager.GetBindAndWatch(topic)
+			bm, err := self.registry.GetBindAndWatch(topic)
 			if nil != err {
 				log.Error("BindExchanger|NodeChange|获取订阅关系失败|%s|%s\n", path, childNode)
 			}
@@ -126,6 +189,12 @@ func (self *BindExchanger) NodeChange(path string, eventType ZkEvent, childNode
 				for groupId, bs := range bm {
 					self.onBindChanged(topic, groupId, bs)
 				}
+				//删除已经取消订阅的分组
+				for groupId := range self.exchanger[topic] {
+					if _, ok := bm[groupId]; !ok {
+						self.onBindChanged(topic, groupId, nil)
+					}
+				}
 			} else {
 				//删除具体某个分组
 				self.onBindChanged(topic, "", nil)
@@ -145,7 +214,8 @@ func (self *BindExchanger) DataChange(path string, binds []*Binding) {
 		split := strings.Split(path, "/")
 		//获取topic
 		topic := split[3]
-		groupId := split[4]
+		//去掉分组后面的-bind
+		groupId := strings.TrimSuffix(split[4], "-bind")
 		self.lock.Lock()
 		defer self.lock.Unlock()
 		//开始处理变化的订阅关系
@@ -166,7 +236,7 @@ func (self *BindExchanger) onBindChanged(topic, groupId string, newbinds []*Bind
 	}
 
 	//不是当前服务可以处理的topic则直接丢地啊哦
-	if sort.SearchStrings(self.topics, topic) == len(self.topics) {
+	if !hasTopic(self.topics, topic) {
 		log.Warn("BindExchanger|onBindChanged|UnAccept Bindings|%s|%s|%s\n", topic, self.topics, newbinds)
 		return
 	}
@@ -184,6 +254,68 @@ func (self *BindExchanger) onBindChanged(topic, groupId string, newbinds []*Bind
 	}
 }
 
+//zk的watcher无法保证可靠,周期性的全量拉取订阅关系修正内存中的数据
+func (self *BindExchanger) StartResync(period time.Duration, flow *turbo.Flow) {
+	self.resyncFlow = flow
+	go func() {
+		t := time.NewTicker(period)
+		defer t.Stop()
+		for {
+			select {
+			case <-self.closeChan:
+				return
+			case <-t.C:
+				self.resync()
+			}
+		}
+	}()
+}
+
+//对比注册中心与内存中的订阅关系,修正差异
+func (self *BindExchanger) resync() {
+	self.lock.RLock()
+	topics := make([]string, len(self.topics))
+	copy(topics, self.topics)
+	self.lock.RUnlock()
+
+	for _, topic := range topics {
+		binds, err := self.registry.GetBindAndWatch(topic)
+		if nil != err {
+			log.Error("BindExchanger|resync|GetBindAndWatch|FAIL|%s|%s\n", err, topic)
+			continue
+		}
+
+		self.lock.Lock()
+		groups := self.exchanger[topic]
+		//注册中心存在而内存中缺失或者不一致的
+		for groupId, bs := range binds {
+			old, ok := groups[groupId]
+			if ok && equalBinds(old, bs) {
+				continue
+			}
+			self.onBindChanged(topic, groupId, bs)
+			self.incrResync()
+			log.Warn("BindExchanger|resync|UPDATE|%s|%s|%v|%v\n", topic, groupId, old, bs)
+		}
+
+		//内存中存在而注册中心已经删除的
+		for groupId, old := range groups {
+			if _, ok := binds[groupId]; !ok {
+				self.onBindChanged(topic, groupId, nil)
+				self.incrResync()
+				log.Warn("BindExchanger|resync|DELETE|%s|%s|%v\n", topic, groupId, old)
+			}
+		}
+		self.lock.Unlock()
+	}
+}
+
+func (self *BindExchanger) incrResync() {
+	if nil != self.resyncFlow {
+		self.resyncFlow.Incr(1)
+	}
+}
+
 //当zk断开链接时
 func (self *BindExchanger) OnSessionExpired() {
 	self.PushQServer(self.kiteqserver, self.topics)
@@ -192,9 +324,18 @@ func (self *BindExchanger) OnSessionExpired() {
 
 //关闭掉exchanger
 func (self *BindExchanger) Shutdown() {
+	close(self.closeChan)
 	//删除掉当前的QServer
-	self.zkmanager.UnpushlishQServer(self.kiteqserver, self.topics)
-	time.Sleep(10 * time.Second)
-	self.zkmanager.Close()
+	self.registry.UnpushlishQServer(self.kiteqserver, self.topics)
+	if self.drainDelay > 0 {
+		time.Sleep(self.drainDelay)
+	}
+	self.registry.Close()
 	log.Info("BindExchanger|Shutdown...")
 }
+
+//有序的topic列表中是否存在该topic
+func hasTopic(topics []string, topic string) bool {
+	idx := sort.SearchStrings(topics, topic)
+	return idx < len(topics) && topics[idx] == topic
+}
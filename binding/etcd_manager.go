@@ -0,0 +1,376 @@
+package binding
+
+import (
+	"context"
+	log "github.com/blackbeans/log4go"
+	"go.etcd.io/etcd/client/v3"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ETCD_SESSION_TTL = 10 //etcd租约的时长(秒),等同zk的session超时
+)
+
+//基于etcd的注册中心,key的组织方式与zk的路径一致
+//  /kiteq/server/${topic}/ip:port 绑定在租约上,相当于zk的临时节点
+type EtcdManager struct {
+	endpoints string
+	watcher   IWatcher
+	client    *clientv3.Client
+	lease     clientv3.LeaseID
+	ctx       context.Context
+	cancel    context.CancelFunc
+	watched   map[string]bool //已经添加watch的前缀
+	lock      sync.Mutex
+	closeChan chan struct{} //Close时关闭,通知续约协程退出
+}
+
+func NewEtcdManager(endpoints string, watcher IWatcher) *EtcdManager {
+	etcdmanager := &EtcdManager{endpoints: endpoints, watcher: watcher}
+	etcdmanager.Start()
+	return etcdmanager
+}
+
+func (self *EtcdManager) Start() {
+	if len(self.endpoints) <= 0 {
+		log.Warn("使用默认etcd！|localhost:2379\n")
+		self.endpoints = "localhost:2379"
+	} else {
+		log.Info("使用etcd:[%s]！\n", self.endpoints)
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   strings.Split(self.endpoints, ","),
+		DialTimeout: 5 * time.Second})
+	if nil != err {
+		panic("连接etcd失败..." + err.Error())
+	}
+
+	self.client = client
+	self.ctx, self.cancel = context.WithCancel(context.Background())
+	self.watched = make(map[string]bool, 10)
+	self.closeChan = make(chan struct{})
+
+	err = self.keepAlive()
+	if nil != err {
+		client.Close()
+		panic("创建etcd租约失败..." + err.Error())
+	}
+}
+
+//申请租约并保持心跳,租约失效时回调OnSessionExpired
+func (self *EtcdManager) keepAlive() error {
+	ctx, cancel := context.WithTimeout(self.ctx, 5*time.Second)
+	resp, err := self.client.Grant(ctx, ETCD_SESSION_TTL)
+	cancel()
+	if nil != err {
+		return err
+	}
+
+	kctx, kcancel := context.WithCancel(self.ctx)
+	ch, err := self.client.KeepAlive(kctx, resp.ID)
+	if nil != err {
+		kcancel()
+		return err
+	}
+	self.lock.Lock()
+	self.lease = resp.ID
+	self.lock.Unlock()
+
+	go func() {
+		defer kcancel()
+		for alive := true; alive; {
+			select {
+			case <-self.closeChan:
+				//关闭时停止续约
+				return
+			case _, alive = <-ch:
+			}
+		}
+
+		//租约丢失则重新申请并推送
+		for {
+			select {
+			case <-self.closeChan:
+				return
+			default:
+			}
+
+			err := self.keepAlive()
+			if nil != err {
+				log.Error("EtcdManager|keepAlive|FAIL|%s\n", err)
+				select {
+				case <-self.closeChan:
+					return
+				case <-time.After(time.Second):
+				}
+				continue
+			}
+			log.Warn("EtcdManager|OnSessionExpired!")
+			self.watcher.OnSessionExpired()
+			return
+		}
+	}()
+	return nil
+}
+
+func (self *EtcdManager) currentLease() clientv3.LeaseID {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.lease
+}
+
+//去除掉当前的KiteQServer
+func (self *EtcdManager) UnpushlishQServer(hostport string, topics []string) {
+	for _, topic := range topics {
+		qpath := KITEQ_SERVER + "/" + topic + "/" + hostport
+		_, err := self.client.Delete(self.ctx, qpath)
+		if nil != err {
+			log.Error("EtcdManager|UnpushlishQServer|FAIL|%s|%s\n", err, qpath)
+		} else {
+			log.Info("EtcdManager|UnpushlishQServer|SUCC|%s\n", qpath)
+		}
+	}
+}
+
+//发布topic对应的server
+func (self *EtcdManager) PublishQServer(hostport string, topics []string) error {
+	for _, topic := range topics {
+		qpath := KITEQ_SERVER + "/" + topic + "/" + hostport
+		_, err := self.client.Put(self.ctx, qpath, "", clientv3.WithLease(self.currentLease()))
+		if nil != err {
+			log.Error("EtcdManager|PublishQServer|FAIL|%s|%s\n", err, qpath)
+			return err
+		}
+		log.Info("EtcdManager|PublishQServer|SUCC|%s\n", qpath)
+	}
+	return nil
+}
+
+//发布可以使用的topic类型的publisher
+func (self *EtcdManager) PublishTopics(topics []string, groupId string, hostport string) error {
+	for _, topic := range topics {
+		pubPath := KITEQ_PUB + "/" + topic + "/" + groupId + "/" + hostport
+		_, err := self.client.Put(self.ctx, pubPath, "")
+		if nil != err {
+			log.Error("EtcdManager|PublishTopic|FAIL|%s|%s\n", err, pubPath)
+			return err
+		}
+		log.Info("EtcdManager|PublishTopic|SUCC|%s\n", pubPath)
+	}
+	return nil
+}
+
+//删除当前进程的publisher
+func (self *EtcdManager) UnpublishTopics(topics []string, groupId string, hostport string) error {
+	for _, topic := range topics {
+		pubPath := KITEQ_PUB + "/" + topic + "/" + groupId + "/" + hostport
+		_, err := self.client.Delete(self.ctx, pubPath)
+		if nil != err {
+			log.Error("EtcdManager|UnpublishTopics|FAIL|%s|%s\n", err, pubPath)
+			return err
+		}
+		log.Info("EtcdManager|UnpublishTopics|SUCC|%s\n", pubPath)
+	}
+	return nil
+}
+
+//发布订阅关系
+func (self *EtcdManager) PublishBindings(groupId string, bindings []*Binding) error {
+	groupBind := groupBindings(groupId, bindings)
+	for topic, binds := range groupBind {
+		data, err := MarshalBinds(binds)
+		if nil != err {
+			log.Error("EtcdManager|PublishBindings|MarshalBind|FAIL|%s|%s|%s\n", err, groupId, binds)
+			return err
+		}
+
+		path := KITEQ_SUB + "/" + topic + "/" + groupId + "-bind"
+		_, err = self.client.Put(self.ctx, path, string(data))
+		if nil != err {
+			log.Error("EtcdManager|PublishBindings|FAIL|%s|%s|%s\n", err, path, binds)
+			return err
+		}
+		log.Info("EtcdManager|PublishBindings|SUCC|%s|%s\n", path, binds)
+	}
+	return nil
+}
+
+//删除分组在topic下的订阅关系
+func (self *EtcdManager) UnpublishBindings(groupId string, topics []string) error {
+	for _, topic := range topics {
+		path := KITEQ_SUB + "/" + topic + "/" + groupId + "-bind"
+		_, err := self.client.Delete(self.ctx, path)
+		if nil != err {
+			log.Error("EtcdManager|UnpublishBindings|FAIL|%s|%s\n", err, path)
+			return err
+		}
+		log.Info("EtcdManager|UnpublishBindings|SUCC|%s\n", path)
+	}
+	return nil
+}
+
+//发布订阅分组的实例,绑定在租约上
+func (self *EtcdManager) PublishSubscriber(groupId string, instance string) error {
+	path := KITEQ_SUBSCRIBER + "/" + groupId + "/" + instance
+	_, err := self.client.Put(self.ctx, path, "", clientv3.WithLease(self.currentLease()))
+	if nil != err {
+		log.Error("EtcdManager|PublishSubscriber|FAIL|%s|%s\n", err, path)
+		return err
+	}
+	log.Info("EtcdManager|PublishSubscriber|SUCC|%s\n", path)
+	return nil
+}
+
+//删除订阅分组的实例
+func (self *EtcdManager) UnpublishSubscriber(groupId string, instance string) error {
+	path := KITEQ_SUBSCRIBER + "/" + groupId + "/" + instance
+	_, err := self.client.Delete(self.ctx, path)
+	if nil != err {
+		log.Error("EtcdManager|UnpublishSubscriber|FAIL|%s|%s\n", err, path)
+		return err
+	}
+	log.Info("EtcdManager|UnpublishSubscriber|SUCC|%s\n", path)
+	return nil
+}
+
+//获取订阅分组存活的实例
+func (self *EtcdManager) GetSubscribers(groupId string) ([]string, error) {
+	path := KITEQ_SUBSCRIBER + "/" + groupId
+	children, _, err := self.children(path)
+	if nil != err {
+		log.Error("EtcdManager|GetSubscribers|FAIL|%s|%s\n", err, path)
+		return nil, err
+	}
+	return children, nil
+}
+
+//获取前缀下的直接子节点
+func (self *EtcdManager) children(path string) ([]string, map[string][]byte, error) {
+	resp, err := self.client.Get(self.ctx, path+"/", clientv3.WithPrefix())
+	if nil != err {
+		return nil, nil, err
+	}
+
+	children := make([]string, 0, len(resp.Kvs))
+	data := make(map[string][]byte, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		child := strings.TrimPrefix(string(kv.Key), path+"/")
+		//只取直接子节点
+		if idx := strings.Index(child, "/"); idx >= 0 {
+			child = child[:idx]
+		}
+		if _, ok := data[child]; !ok {
+			children = append(children, child)
+		}
+		data[child] = kv.Value
+	}
+	sort.Strings(children)
+	return children, data, nil
+}
+
+//获取QServer并添加watcher
+func (self *EtcdManager) GetQServerAndWatch(topic string) ([]string, error) {
+	path := KITEQ_SERVER + "/" + topic
+	children, _, err := self.children(path)
+	if nil != err {
+		log.Error("EtcdManager|GetQServerAndWatch|FAIL|%s|%s\n", err, path)
+		return nil, err
+	}
+	self.watch(path)
+	return children, nil
+}
+
+//获取订阅关系并添加watcher
+func (self *EtcdManager) GetBindAndWatch(topic string) (map[string][]*Binding, error) {
+	path := KITEQ_SUB + "/" + topic
+	groupIds, data, err := self.children(path)
+	if nil != err {
+		log.Error("EtcdManager|GetBindAndWatch|GroupID|FAIL|%s|%s\n", err, path)
+		return nil, err
+	}
+	self.watch(path)
+
+	hps := make(map[string][]*Binding, len(groupIds))
+	for _, groupId := range groupIds {
+		binds, err := unmarshalBindData(data[groupId])
+		if nil != err {
+			log.Error("EtcdManager|GetBindAndWatch|UmarshalBind|FAIL|%s|%s\n", path+"/"+groupId, err)
+			continue
+		}
+		//去掉分组后面的-bind
+		gid := strings.TrimSuffix(groupId, "-bind")
+		hps[gid] = binds
+	}
+	return hps, nil
+}
+
+//监听前缀的变更,转换为与zk一致的事件
+func (self *EtcdManager) watch(path string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.watched[path] {
+		return
+	}
+	self.watched[path] = true
+
+	wch := self.client.Watch(self.ctx, path+"/", clientv3.WithPrefix())
+	go func() {
+		for resp := range wch {
+			if nil != resp.Err() {
+				log.Error("EtcdManager|watch|FAIL|%s|%s\n", resp.Err(), path)
+				continue
+			}
+
+			childChanged := false
+			for _, ev := range resp.Events {
+				key := string(ev.Kv.Key)
+				//订阅关系的数据变更
+				if ev.Type == clientv3.EventTypePut && !ev.IsCreate() &&
+					strings.HasPrefix(key, KITEQ_SUB) && strings.HasSuffix(key, "-bind") {
+					binds, err := unmarshalBindData(ev.Kv.Value)
+					if nil != err {
+						log.Error("EtcdManager|watch|Changed|Get DATA|FAIL|%s|%s\n", err, key)
+						continue
+					}
+					self.watcher.DataChange(key, binds)
+				} else if ev.Type == clientv3.EventTypeDelete {
+					//与zk一致,订阅分组节点删除时先通知节点删除
+					if strings.HasPrefix(key, KITEQ_SUB) {
+						self.watcher.NodeChange(key, Deleted, []string{})
+					}
+					childChanged = true
+				} else {
+					childChanged = true
+				}
+			}
+
+			if childChanged {
+				children, _, err := self.children(path)
+				if nil != err {
+					log.Error("EtcdManager|watch|CD|%s|%s\n", err, path)
+					continue
+				}
+				self.watcher.NodeChange(path, Child, children)
+			}
+		}
+	}()
+}
+
+func (self *EtcdManager) Close() {
+	close(self.closeChan)
+	self.client.Revoke(context.Background(), self.currentLease())
+	self.cancel()
+	self.client.Close()
+}
+
+//解析订阅关系数据
+func unmarshalBindData(bindData []byte) ([]*Binding, error) {
+	if nil == bindData || len(bindData) <= 0 {
+		return []*Binding{}, nil
+	}
+	return UmarshalBinds(bindData)
+}
@@ -57,6 +57,11 @@ func (self *Binding) conflict(bind *Binding) bool {
 	return false
 }
 
+//同一个分组下两个订阅关系是否有交叉
+func (self *Binding) Conflict(bind *Binding) bool {
+	return self.conflict(bind)
+}
+
 //是否与当前bind匹配
 func (self *Binding) matches(topic string, messageType string) bool {
 	if self.BindType == BIND_FANOUT {
@@ -74,6 +79,19 @@ func (self *Binding) matches(topic string, messageType string) bool {
 	}
 }
 
+//两组订阅关系是否完全一致
+func equalBinds(a, b []*Binding) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if *a[i] != *b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func UmarshalBinds(bind []byte) ([]*Binding, error) {
 	var b []*Binding
 	err := json.Unmarshal(bind, &b)
@@ -0,0 +1,103 @@
+package binding
+
+import (
+	"net/url"
+	"strings"
+)
+
+// registry schema
+//  zookeeper  zk://localhost:2181,localhost:2182  (不带schema时默认为zookeeper,兼容 localhost:2181)
+//             zk://localhost:2181?root=/kiteq-prod&digest=user:password  (自定义根路径及digest认证)
+//  etcd       etcd://localhost:2379,localhost:22379
+//  file       file:///etc/kiteq/registry.json     (静态文件初始化,进程内维护)
+//  memory     mem://cluster-a                     (进程内共享,同名的注册中心互相可见)
+//  static     static://trade=localhost:13800,localhost:13801&feed=localhost:13800  (固定的broker列表,不依赖任何注册中心)
+const (
+	SCHEMA_ZK     = "zk://"
+	SCHEMA_ETCD   = "etcd://"
+	SCHEMA_FILE   = "file://"
+	SCHEMA_MEM    = "mem://"
+	SCHEMA_STATIC = "static://"
+)
+
+//注册中心,维护broker、发送方、订阅方的关系
+//所有的实现都按照zk的路径组织数据并回调IWatcher
+//  KiteServer : /kiteq/server/${topic}/ip:port
+//  Producer   : /kiteq/pub/${topic}/${groupId}/ip:port
+//  Consumer   : /kiteq/sub/${topic}/${groupId}-bind/#$data(bind)
+//  Subscriber : /kiteq/subscriber/${groupId}/instance
+type IRegistry interface {
+	Start()
+	Close()
+
+	//发布topic对应的server
+	PublishQServer(hostport string, topics []string) error
+	//去除掉当前的KiteQServer
+	UnpushlishQServer(hostport string, topics []string)
+	//发布可以使用的topic类型的publisher
+	PublishTopics(topics []string, groupId string, hostport string) error
+	//删除当前进程的publisher
+	UnpublishTopics(topics []string, groupId string, hostport string) error
+	//发布订阅关系
+	PublishBindings(groupId string, bindings []*Binding) error
+	//删除分组在topic下的订阅关系
+	UnpublishBindings(groupId string, topics []string) error
+	//发布订阅分组的实例,实例下线后自动删除
+	PublishSubscriber(groupId string, instance string) error
+	//删除订阅分组的实例
+	UnpublishSubscriber(groupId string, instance string) error
+	//获取订阅分组存活的实例
+	GetSubscribers(groupId string) ([]string, error)
+
+	//获取QServer并添加watcher
+	GetQServerAndWatch(topic string) ([]string, error)
+	//获取订阅关系并添加watcher
+	GetBindAndWatch(topic string) (map[string][]*Binding, error)
+}
+
+//根据地址创建注册中心
+func NewRegistry(uri string, watcher IWatcher) IRegistry {
+	if strings.HasPrefix(uri, SCHEMA_ETCD) {
+		return NewEtcdManager(strings.TrimPrefix(uri, SCHEMA_ETCD), watcher)
+	} else if strings.HasPrefix(uri, SCHEMA_FILE) || strings.HasPrefix(uri, SCHEMA_MEM) {
+		return NewStaticRegistry(uri, watcher)
+	} else if strings.HasPrefix(uri, SCHEMA_STATIC) {
+		return NewBrokerRegistry(ParseBrokers(strings.TrimPrefix(uri, SCHEMA_STATIC)), watcher)
+	}
+	return NewZKManager(strings.TrimPrefix(uri, SCHEMA_ZK), watcher)
+}
+
+//解析topic对应的broker列表 trade=localhost:13800,localhost:13801&feed=localhost:13800
+func ParseBrokers(brokers string) map[string][]string {
+	params, err := url.ParseQuery(brokers)
+	if nil != err {
+		panic("解析broker列表失败..." + err.Error())
+	}
+
+	hosts := make(map[string][]string, len(params))
+	for topic, values := range params {
+		for _, v := range values {
+			for _, h := range strings.Split(v, ",") {
+				if len(h) > 0 {
+					hosts[topic] = append(hosts[topic], h)
+				}
+			}
+		}
+	}
+	return hosts
+}
+
+//按topic对订阅关系分组
+func groupBindings(groupId string, bindings []*Binding) map[string][]*Binding {
+	groupBind := make(map[string][]*Binding, 10)
+	for _, b := range bindings {
+		g, ok := groupBind[b.Topic]
+		if !ok {
+			g = make([]*Binding, 0, 2)
+		}
+		b.GroupId = groupId
+		g = append(g, b)
+		groupBind[b.Topic] = g
+	}
+	return groupBind
+}
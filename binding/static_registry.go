@@ -0,0 +1,463 @@
+package binding
+
+import (
+	"encoding/json"
+	log "github.com/blackbeans/log4go"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//静态配置文件格式
+//{
+//  "servers": {"trade": ["localhost:13800"]},
+//  "bindings": {"trade": {"s-trade-a": [{"groupId":"s-trade-a","topic":"trade","messageType":"pay-succ","bindType":0}]}}
+//}
+type staticConfig struct {
+	Servers  map[string] /*topic*/ []string                           `json:"servers"`
+	Bindings map[string] /*topic*/ map[string] /*groupId*/ []*Binding `json:"bindings"`
+}
+
+//进程内的注册数据,相同uri的StaticRegistry共享
+type staticTree struct {
+	servers  map[string] /*topic*/ map[string] /*hostport*/ *StaticRegistry //注册者,静态配置的为nil
+	pubs     map[string] /*topic*/ map[string] /*groupId*/ []string
+	binds    map[string] /*topic*/ map[string] /*groupId*/ []*Binding
+	subs     map[string] /*groupId*/ map[string] /*instance*/ *StaticRegistry
+	sessions map[*StaticRegistry]bool
+	lock     sync.RWMutex
+}
+
+var staticTrees = make(map[string]*staticTree, 2)
+var staticLock sync.Mutex
+
+//变更事件
+type staticEvent struct {
+	path      string
+	eventType ZkEvent
+	children  []string
+	binds     []*Binding
+}
+
+//进程内的注册中心,不依赖zookeeper
+//file:// 从静态文件加载broker列表和订阅关系, mem:// 完全由进程内的publish维护
+type StaticRegistry struct {
+	uri       string
+	watcher   IWatcher
+	tree      *staticTree
+	eventChan chan *staticEvent
+	closeChan chan bool
+	isClose   bool
+}
+
+func NewStaticRegistry(uri string, watcher IWatcher) *StaticRegistry {
+	registry := &StaticRegistry{uri: uri, watcher: watcher}
+	registry.Start()
+	return registry
+}
+
+//固定broker列表的注册中心,不与其他实例共享
+//broker的健康检查及重连由客户端的心跳完成
+func NewBrokerRegistry(brokers map[string] /*topic*/ []string, watcher IWatcher) *StaticRegistry {
+	tree := newStaticTree()
+	for topic, hosts := range brokers {
+		servers := make(map[string]*StaticRegistry, len(hosts))
+		for _, h := range hosts {
+			servers[h] = nil
+		}
+		tree.servers[topic] = servers
+	}
+
+	registry := &StaticRegistry{uri: SCHEMA_STATIC, watcher: watcher, tree: tree}
+	registry.Start()
+	return registry
+}
+
+func newStaticTree() *staticTree {
+	return &staticTree{
+		servers:  make(map[string]map[string]*StaticRegistry, 10),
+		pubs:     make(map[string]map[string][]string, 10),
+		binds:    make(map[string]map[string][]*Binding, 10),
+		subs:     make(map[string]map[string]*StaticRegistry, 10),
+		sessions: make(map[*StaticRegistry]bool, 2)}
+}
+
+func (self *StaticRegistry) Start() {
+	if nil == self.tree {
+		staticLock.Lock()
+		tree, ok := staticTrees[self.uri]
+		if !ok {
+			tree = newStaticTree()
+			if strings.HasPrefix(self.uri, SCHEMA_FILE) {
+				err := tree.load(strings.TrimPrefix(self.uri, SCHEMA_FILE))
+				if nil != err {
+					staticLock.Unlock()
+					panic("加载静态注册中心失败..." + err.Error())
+				}
+			}
+			staticTrees[self.uri] = tree
+		}
+		staticLock.Unlock()
+		self.tree = tree
+	}
+
+	tree := self.tree
+	self.eventChan = make(chan *staticEvent, 1000)
+	self.closeChan = make(chan bool, 1)
+	self.isClose = false
+
+	tree.lock.Lock()
+	tree.sessions[self] = true
+	tree.lock.Unlock()
+
+	go self.listenEvent()
+	log.Info("StaticRegistry|Start|SUCC|%s\n", self.uri)
+}
+
+//加载静态配置
+func (self *staticTree) load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if nil != err {
+		return err
+	}
+
+	var conf staticConfig
+	err = json.Unmarshal(data, &conf)
+	if nil != err {
+		return err
+	}
+
+	for topic, hosts := range conf.Servers {
+		servers := make(map[string]*StaticRegistry, len(hosts))
+		for _, h := range hosts {
+			servers[h] = nil
+		}
+		self.servers[topic] = servers
+	}
+
+	for topic, groups := range conf.Bindings {
+		binds := make(map[string][]*Binding, len(groups))
+		for groupId, bs := range groups {
+			binds[groupId] = copyBinds(groupId, bs)
+		}
+		self.binds[topic] = binds
+	}
+	return nil
+}
+
+//顺序回调watcher,与zk的事件通知保持一致
+func (self *StaticRegistry) listenEvent() {
+	for {
+		select {
+		case <-self.closeChan:
+			return
+		case event := <-self.eventChan:
+			if nil != event.binds {
+				self.watcher.DataChange(event.path, event.binds)
+			} else {
+				self.watcher.NodeChange(event.path, event.eventType, event.children)
+			}
+		}
+	}
+}
+
+//向所有的session广播变更
+func (self *StaticRegistry) fire(events ...*staticEvent) {
+	self.tree.lock.RLock()
+	sessions := make([]*StaticRegistry, 0, len(self.tree.sessions))
+	for s := range self.tree.sessions {
+		sessions = append(sessions, s)
+	}
+	self.tree.lock.RUnlock()
+
+	for _, s := range sessions {
+		for _, e := range events {
+			select {
+			case s.eventChan <- e:
+			case <-s.closeChan:
+			}
+		}
+	}
+}
+
+//去除掉当前的KiteQServer
+func (self *StaticRegistry) UnpushlishQServer(hostport string, topics []string) {
+	events := make([]*staticEvent, 0, len(topics))
+	self.tree.lock.Lock()
+	for _, topic := range topics {
+		servers, ok := self.tree.servers[topic]
+		if !ok {
+			continue
+		}
+		delete(servers, hostport)
+		events = append(events, &staticEvent{
+			path:      KITEQ_SERVER + "/" + topic,
+			eventType: Child,
+			children:  self.tree.qservers(topic)})
+		log.Info("StaticRegistry|UnpushlishQServer|SUCC|%s|%s\n", topic, hostport)
+	}
+	self.tree.lock.Unlock()
+	self.fire(events...)
+}
+
+//发布topic对应的server
+func (self *StaticRegistry) PublishQServer(hostport string, topics []string) error {
+	events := make([]*staticEvent, 0, len(topics))
+	self.tree.lock.Lock()
+	for _, topic := range topics {
+		servers, ok := self.tree.servers[topic]
+		if !ok {
+			servers = make(map[string]*StaticRegistry, 2)
+			self.tree.servers[topic] = servers
+		}
+		servers[hostport] = self
+		events = append(events, &staticEvent{
+			path:      KITEQ_SERVER + "/" + topic,
+			eventType: Child,
+			children:  self.tree.qservers(topic)})
+		log.Info("StaticRegistry|PublishQServer|SUCC|%s|%s\n", topic, hostport)
+	}
+	self.tree.lock.Unlock()
+	self.fire(events...)
+	return nil
+}
+
+//发布可以使用的topic类型的publisher
+func (self *StaticRegistry) PublishTopics(topics []string, groupId string, hostport string) error {
+	self.tree.lock.Lock()
+	defer self.tree.lock.Unlock()
+	for _, topic := range topics {
+		groups, ok := self.tree.pubs[topic]
+		if !ok {
+			groups = make(map[string][]string, 2)
+			self.tree.pubs[topic] = groups
+		}
+
+		exist := false
+		for _, h := range groups[groupId] {
+			if h == hostport {
+				exist = true
+				break
+			}
+		}
+		if !exist {
+			groups[groupId] = append(groups[groupId], hostport)
+		}
+		log.Info("StaticRegistry|PublishTopic|SUCC|%s|%s|%s\n", topic, groupId, hostport)
+	}
+	return nil
+}
+
+//删除当前进程的publisher
+func (self *StaticRegistry) UnpublishTopics(topics []string, groupId string, hostport string) error {
+	self.tree.lock.Lock()
+	defer self.tree.lock.Unlock()
+	for _, topic := range topics {
+		groups, ok := self.tree.pubs[topic]
+		if !ok {
+			continue
+		}
+		hosts := make([]string, 0, len(groups[groupId]))
+		for _, h := range groups[groupId] {
+			if h != hostport {
+				hosts = append(hosts, h)
+			}
+		}
+		if len(hosts) > 0 {
+			groups[groupId] = hosts
+		} else {
+			delete(groups, groupId)
+		}
+		log.Info("StaticRegistry|UnpublishTopics|SUCC|%s|%s|%s\n", topic, groupId, hostport)
+	}
+	return nil
+}
+
+//发布订阅关系
+func (self *StaticRegistry) PublishBindings(groupId string, bindings []*Binding) error {
+	groupBind := groupBindings(groupId, bindings)
+
+	events := make([]*staticEvent, 0, len(groupBind))
+	self.tree.lock.Lock()
+	for topic, binds := range groupBind {
+		groups, ok := self.tree.binds[topic]
+		if !ok {
+			groups = make(map[string][]*Binding, 2)
+			self.tree.binds[topic] = groups
+		}
+
+		_, exist := groups[groupId]
+		groups[groupId] = copyBinds(groupId, binds)
+		if exist {
+			//已经存在的分组则为数据变更
+			events = append(events, &staticEvent{
+				path:  KITEQ_SUB + "/" + topic + "/" + groupId + "-bind",
+				binds: copyBinds(groupId, binds)})
+		} else {
+			events = append(events, &staticEvent{
+				path:      KITEQ_SUB + "/" + topic,
+				eventType: Child,
+				children:  self.tree.bindGroups(topic)})
+		}
+		log.Info("StaticRegistry|PublishBindings|SUCC|%s|%s|%s\n", topic, groupId, binds)
+	}
+	self.tree.lock.Unlock()
+	self.fire(events...)
+	return nil
+}
+
+//删除分组在topic下的订阅关系
+func (self *StaticRegistry) UnpublishBindings(groupId string, topics []string) error {
+	events := make([]*staticEvent, 0, len(topics))
+	self.tree.lock.Lock()
+	for _, topic := range topics {
+		groups, ok := self.tree.binds[topic]
+		if !ok {
+			continue
+		}
+		if _, exist := groups[groupId]; !exist {
+			continue
+		}
+		delete(groups, groupId)
+		events = append(events, &staticEvent{
+			path:      KITEQ_SUB + "/" + topic,
+			eventType: Child,
+			children:  self.tree.bindGroups(topic)})
+		log.Info("StaticRegistry|UnpublishBindings|SUCC|%s|%s\n", topic, groupId)
+	}
+	self.tree.lock.Unlock()
+	self.fire(events...)
+	return nil
+}
+
+//发布订阅分组的实例,关闭时一并删除
+func (self *StaticRegistry) PublishSubscriber(groupId string, instance string) error {
+	self.tree.lock.Lock()
+	defer self.tree.lock.Unlock()
+	instances, ok := self.tree.subs[groupId]
+	if !ok {
+		instances = make(map[string]*StaticRegistry, 2)
+		self.tree.subs[groupId] = instances
+	}
+	instances[instance] = self
+	log.Info("StaticRegistry|PublishSubscriber|SUCC|%s|%s\n", groupId, instance)
+	return nil
+}
+
+//删除订阅分组的实例
+func (self *StaticRegistry) UnpublishSubscriber(groupId string, instance string) error {
+	self.tree.lock.Lock()
+	defer self.tree.lock.Unlock()
+	if instances, ok := self.tree.subs[groupId]; ok {
+		delete(instances, instance)
+		if len(instances) <= 0 {
+			delete(self.tree.subs, groupId)
+		}
+	}
+	log.Info("StaticRegistry|UnpublishSubscriber|SUCC|%s|%s\n", groupId, instance)
+	return nil
+}
+
+//获取订阅分组存活的实例
+func (self *StaticRegistry) GetSubscribers(groupId string) ([]string, error) {
+	self.tree.lock.RLock()
+	defer self.tree.lock.RUnlock()
+	instances := self.tree.subs[groupId]
+	children := make([]string, 0, len(instances))
+	for instance := range instances {
+		children = append(children, instance)
+	}
+	sort.Strings(children)
+	return children, nil
+}
+
+//获取QServer并添加watcher
+func (self *StaticRegistry) GetQServerAndWatch(topic string) ([]string, error) {
+	self.tree.lock.RLock()
+	defer self.tree.lock.RUnlock()
+	return self.tree.qservers(topic), nil
+}
+
+//获取订阅关系并添加watcher
+func (self *StaticRegistry) GetBindAndWatch(topic string) (map[string][]*Binding, error) {
+	self.tree.lock.RLock()
+	defer self.tree.lock.RUnlock()
+	groups := self.tree.binds[topic]
+	hps := make(map[string][]*Binding, len(groups))
+	for groupId, binds := range groups {
+		hps[groupId] = copyBinds(groupId, binds)
+	}
+	return hps, nil
+}
+
+//关闭后本实例注册的KiteQServer和订阅实例一并删除,等同zk的临时节点
+func (self *StaticRegistry) Close() {
+	events := make([]*staticEvent, 0, 2)
+	self.tree.lock.Lock()
+	delete(self.tree.sessions, self)
+	for groupId, instances := range self.tree.subs {
+		for instance, owner := range instances {
+			if owner == self {
+				delete(instances, instance)
+			}
+		}
+		if len(instances) <= 0 {
+			delete(self.tree.subs, groupId)
+		}
+	}
+	for topic, servers := range self.tree.servers {
+		changed := false
+		for hostport, owner := range servers {
+			if owner == self {
+				delete(servers, hostport)
+				changed = true
+			}
+		}
+		if changed {
+			events = append(events, &staticEvent{
+				path:      KITEQ_SERVER + "/" + topic,
+				eventType: Child,
+				children:  self.tree.qservers(topic)})
+		}
+	}
+	self.tree.lock.Unlock()
+
+	self.isClose = true
+	close(self.closeChan)
+	self.fire(events...)
+	log.Info("StaticRegistry|Close|%s\n", self.uri)
+}
+
+//topic下的server列表
+func (self *staticTree) qservers(topic string) []string {
+	servers := self.servers[topic]
+	hosts := make([]string, 0, len(servers))
+	for h := range servers {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+//topic下的订阅分组节点
+func (self *staticTree) bindGroups(topic string) []string {
+	groups := self.binds[topic]
+	children := make([]string, 0, len(groups))
+	for groupId := range groups {
+		children = append(children, groupId+"-bind")
+	}
+	sort.Strings(children)
+	return children
+}
+
+//复制订阅关系,避免多个session共享同一个对象
+func copyBinds(groupId string, binds []*Binding) []*Binding {
+	cbinds := make([]*Binding, 0, len(binds))
+	for _, b := range binds {
+		cb := *b
+		cb.GroupId = groupId
+		cbinds = append(cbinds, &cb)
+	}
+	return cbinds
+}
@@ -0,0 +1,227 @@
+package binding
+
+import (
+	"github.com/blackbeans/turbo"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStaticPublishQServer(t *testing.T) {
+	registry := NewStaticRegistry("mem://TestStaticPublishQServer", &MockWatcher{})
+	defer registry.Close()
+
+	topics := []string{"trade", "feed", "comment"}
+	err := registry.PublishQServer("localhost:13800", topics)
+	if nil != err {
+		t.Fail()
+		t.Log(err)
+		return
+	}
+
+	for _, topic := range topics {
+		servers, err := registry.GetQServerAndWatch(topic)
+		if nil != err || len(servers) != 1 {
+			t.Fail()
+			t.Logf("%s|%s|%s", err, topic, servers)
+		}
+	}
+
+	registry.UnpushlishQServer("localhost:13800", []string{"trade"})
+	servers, _ := registry.GetQServerAndWatch("trade")
+	if len(servers) != 0 {
+		t.Fail()
+		t.Logf("TestStaticPublishQServer|UnpushlishQServer|%s\n", servers)
+	}
+}
+
+//关闭后注册的server应该被删除
+func TestStaticRegistryClose(t *testing.T) {
+	uri := "mem://TestStaticRegistryClose"
+	server := NewStaticRegistry(uri, &MockWatcher{})
+	server.PublishQServer("localhost:13800", []string{"trade"})
+
+	client := NewStaticRegistry(uri, &MockWatcher{})
+	defer client.Close()
+	servers, _ := client.GetQServerAndWatch("trade")
+	if len(servers) != 1 {
+		t.Fail()
+		t.Logf("TestStaticRegistryClose|GetQServerAndWatch|%s\n", servers)
+	}
+
+	server.Close()
+	servers, _ = client.GetQServerAndWatch("trade")
+	if len(servers) != 0 {
+		t.Fail()
+		t.Logf("TestStaticRegistryClose|Close|%s\n", servers)
+	}
+}
+
+func TestStaticRegistryFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "kiteq-registry")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"servers":{"trade":["localhost:13800","localhost:13801"]},
+		"bindings":{"trade":{"s-trade-a":[{"topic":"trade","messageType":"pay-succ","bindType":0}]}}}`)
+	f.Close()
+
+	registry := NewStaticRegistry(SCHEMA_FILE+f.Name(), &MockWatcher{})
+	defer registry.Close()
+
+	servers, _ := registry.GetQServerAndWatch("trade")
+	if len(servers) != 2 {
+		t.Fail()
+		t.Logf("TestStaticRegistryFile|GetQServerAndWatch|%s\n", servers)
+	}
+
+	binds, _ := registry.GetBindAndWatch("trade")
+	if len(binds["s-trade-a"]) != 1 || binds["s-trade-a"][0].GroupId != "s-trade-a" {
+		t.Fail()
+		t.Logf("TestStaticRegistryFile|GetBindAndWatch|%v\n", binds)
+	}
+}
+
+//订阅关系的变更通过watcher通知到BindExchanger
+func TestStaticBindExchanger(t *testing.T) {
+	uri := "mem://TestStaticBindExchanger"
+	exchanger := NewBindExchanger(uri, "localhost:13800")
+	defer exchanger.Shutdown()
+	exchanger.PushQServer("localhost:13800", []string{"trade"})
+
+	consumer := NewRegistry(uri, &MockWatcher{})
+	defer consumer.Close()
+	consumer.PublishBindings("s-trade-a", []*Binding{Bind_Direct("s-trade-a", "trade", "pay-succ", 1000, true)})
+	time.Sleep(100 * time.Millisecond)
+
+	binds := exchanger.FindBinds("trade", "pay-succ", func(b *Binding) bool { return false })
+	if len(binds) != 1 {
+		t.Fail()
+		t.Logf("TestStaticBindExchanger|Created|%v\n", binds)
+	}
+
+	//修改订阅关系
+	consumer.PublishBindings("s-trade-a", []*Binding{Bind_Direct("s-trade-a", "trade", "pay-fail", 1000, true)})
+	time.Sleep(100 * time.Millisecond)
+
+	binds = exchanger.FindBinds("trade", "pay-succ", func(b *Binding) bool { return false })
+	if len(binds) != 0 {
+		t.Fail()
+		t.Logf("TestStaticBindExchanger|DataChange|%v\n", binds)
+	}
+	binds = exchanger.FindBinds("trade", "pay-fail", func(b *Binding) bool { return false })
+	if len(binds) != 1 {
+		t.Fail()
+		t.Logf("TestStaticBindExchanger|DataChange|%v\n", binds)
+	}
+}
+
+//全量同步修正内存中的订阅关系
+func TestStaticBindExchangerResync(t *testing.T) {
+	uri := "mem://TestStaticBindExchangerResync"
+	exchanger := NewBindExchanger(uri, "localhost:13800")
+	defer exchanger.registry.Close()
+	exchanger.PushQServer("localhost:13800", []string{"trade"})
+	exchanger.resyncFlow = &turbo.Flow{}
+
+	consumer := NewRegistry(uri, &MockWatcher{})
+	defer consumer.Close()
+	consumer.PublishBindings("s-trade-a", []*Binding{Bind_Direct("s-trade-a", "trade", "pay-succ", 1000, true)})
+	time.Sleep(100 * time.Millisecond)
+
+	//模拟丢失的watcher事件
+	exchanger.lock.Lock()
+	delete(exchanger.exchanger["trade"], "s-trade-a")
+	exchanger.exchanger["trade"]["s-trade-b"] = []*Binding{Bind_Direct("s-trade-b", "trade", "pay-succ", 1000, true)}
+	exchanger.lock.Unlock()
+
+	exchanger.resync()
+	binds := exchanger.FindBinds("trade", "pay-succ", func(b *Binding) bool { return false })
+	if len(binds) != 1 || binds[0].GroupId != "s-trade-a" {
+		t.Fail()
+		t.Logf("TestStaticBindExchangerResync|%v\n", binds)
+	}
+}
+
+//运行时新增和删除topic
+func TestStaticBindExchangerTopics(t *testing.T) {
+	uri := "mem://TestStaticBindExchangerTopics"
+	exchanger := NewBindExchanger(uri, "localhost:13800")
+	defer exchanger.registry.Close()
+	exchanger.PushQServer("localhost:13800", []string{"trade"})
+
+	consumer := NewRegistry(uri, &MockWatcher{})
+	defer consumer.Close()
+	consumer.PublishBindings("s-feed-a", []*Binding{Bind_Direct("s-feed-a", "feed", "feed-add", 1000, true)})
+	time.Sleep(100 * time.Millisecond)
+
+	exchanger.PushQServer("localhost:13800", []string{"feed", "trade"})
+	topics := exchanger.Topics()
+	binds := exchanger.FindBinds("feed", "feed-add", func(b *Binding) bool { return false })
+	servers, _ := consumer.GetQServerAndWatch("feed")
+	if len(topics) != 2 || len(binds) != 1 || len(servers) != 1 {
+		t.Fail()
+		t.Logf("TestStaticBindExchangerTopics|PushQServer|%s|%v|%s\n", topics, binds, servers)
+	}
+
+	exchanger.UnpushQServer("localhost:13800", []string{"feed"})
+	topics = exchanger.Topics()
+	binds = exchanger.FindBinds("feed", "feed-add", func(b *Binding) bool { return false })
+	servers, _ = consumer.GetQServerAndWatch("feed")
+	if len(topics) != 1 || topics[0] != "trade" || len(binds) != 0 || len(servers) != 0 {
+		t.Fail()
+		t.Logf("TestStaticBindExchangerTopics|UnpushQServer|%s|%v|%s\n", topics, binds, servers)
+	}
+}
+
+//固定broker列表
+func TestBrokerRegistry(t *testing.T) {
+	registry := NewRegistry("static://trade=localhost:13800,localhost:13801&feed=localhost:13802", &MockWatcher{})
+	defer registry.Close()
+
+	servers, _ := registry.GetQServerAndWatch("trade")
+	if len(servers) != 2 || servers[0] != "localhost:13800" || servers[1] != "localhost:13801" {
+		t.Fail()
+		t.Logf("TestBrokerRegistry|trade|%s\n", servers)
+	}
+
+	servers, _ = registry.GetQServerAndWatch("feed")
+	if len(servers) != 1 {
+		t.Fail()
+		t.Logf("TestBrokerRegistry|feed|%s\n", servers)
+	}
+
+	//不与其他实例共享
+	other := NewBrokerRegistry(map[string][]string{"trade": []string{"localhost:13900"}}, &MockWatcher{})
+	defer other.Close()
+	servers, _ = other.GetQServerAndWatch("trade")
+	if len(servers) != 1 || servers[0] != "localhost:13900" {
+		t.Fail()
+		t.Logf("TestBrokerRegistry|NewBrokerRegistry|%s\n", servers)
+	}
+}
+
+//取消订阅后broker删除该分组的订阅关系
+func TestStaticUnpublishBindings(t *testing.T) {
+	uri := "mem://TestStaticUnpublishBindings"
+	exchanger := NewBindExchanger(uri, "localhost:13800")
+	defer exchanger.Shutdown()
+	exchanger.PushQServer("localhost:13800", []string{"trade"})
+
+	consumer := NewRegistry(uri, &MockWatcher{})
+	defer consumer.Close()
+	consumer.PublishBindings("s-trade-a", []*Binding{Bind_Direct("s-trade-a", "trade", "pay-succ", 1000, true)})
+	consumer.PublishBindings("s-trade-b", []*Binding{Bind_Direct("s-trade-b", "trade", "pay-succ", 1000, true)})
+	time.Sleep(100 * time.Millisecond)
+
+	consumer.UnpublishBindings("s-trade-a", []string{"trade"})
+	time.Sleep(100 * time.Millisecond)
+
+	binds := exchanger.FindBinds("trade", "pay-succ", func(b *Binding) bool { return false })
+	if len(binds) != 1 || binds[0].GroupId != "s-trade-b" {
+		t.Fail()
+		t.Logf("TestStaticUnpublishBindings|%v\n", binds)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/blackbeans/go-zookeeper/zk"
 	log "github.com/blackbeans/log4go"
 	_ "net"
+	"net/url"
 	"strings"
 	"time"
 )
@@ -13,10 +14,20 @@ const (
 	KITEQ_SERVER = KITEQ + "/server" // 临时节点 # /kiteq/server/${topic}/ip:port
 	KITEQ_PUB    = KITEQ + "/pub"    // 临时节点 # /kiteq/pub/${topic}/${groupId}/ip:port
 	KITEQ_SUB    = KITEQ + "/sub"    // 持久订阅/或者临时订阅 # /kiteq/sub/${topic}/${groupId}-bind/#$data(bind)
+
+	KITEQ_SUBSCRIBER = KITEQ + "/subscriber" // 临时节点 # /kiteq/subscriber/${groupId}/instance
 )
 
+//zkhosts 支持在地址后面携带参数
+//  localhost:2181,localhost:2182?root=/kiteq-prod&digest=user:password
+//  root   : zk上的根路径,默认为/kiteq,不同集群可以共用一套zk
+//  digest : digest认证,创建的节点只有自己可以修改,其他人只读
 type ZKManager struct {
 	zkhosts   string
+	root      string   //zk上的根路径
+	digest    string   //user:password
+	acl       []zk.ACL //叶子节点的权限
+	parentAcl []zk.ACL //中间节点的权限,需要允许其他分组创建子节点
 	watcher   IWatcher
 	session   *zk.Conn
 	eventChan <-chan zk.Event
@@ -42,17 +53,49 @@ type IWatcher interface {
 }
 
 func NewZKManager(zkhosts string, watcher IWatcher) *ZKManager {
-	zkmanager := &ZKManager{zkhosts: zkhosts, watcher: watcher}
+	zkmanager := &ZKManager{watcher: watcher, root: KITEQ}
+	zkmanager.parseHosts(zkhosts)
 	zkmanager.Start()
 	return zkmanager
 }
 
+//解析zk地址上的root和digest参数
+func (self *ZKManager) parseHosts(zkhosts string) {
+	self.zkhosts = zkhosts
+	idx := strings.Index(zkhosts, "?")
+	if idx < 0 {
+		return
+	}
+
+	self.zkhosts = zkhosts[:idx]
+	params, err := url.ParseQuery(zkhosts[idx+1:])
+	if nil != err {
+		panic("解析zk参数失败..." + err.Error())
+	}
+
+	root := strings.TrimSuffix(params.Get("root"), "/")
+	if len(root) > 0 {
+		if !strings.HasPrefix(root, "/") {
+			root = "/" + root
+		}
+		self.root = root
+	}
+
+	digest := params.Get("digest")
+	if len(digest) > 0 {
+		if strings.Index(digest, ":") <= 0 {
+			panic("zk digest格式错误,应为 user:password ...")
+		}
+		self.digest = digest
+	}
+}
+
 func (self *ZKManager) Start() {
 	if len(self.zkhosts) <= 0 {
 		log.Warn("使用默认zkhosts！|localhost:2181\n")
 		self.zkhosts = "localhost:2181"
 	} else {
-		log.Info("使用zkhosts:[%s]！\n", self.zkhosts)
+		log.Info("使用zkhosts:[%s]|root:[%s]！\n", self.zkhosts, self.root)
 	}
 
 	ss, eventChan, err := zk.Connect(strings.Split(self.zkhosts, ","), 5*time.Second)
@@ -61,29 +104,44 @@ func (self *ZKManager) Start() {
 		return
 	}
 
-	exist, _, err := ss.Exists(KITEQ)
-	if nil != err {
-		ss.Close()
-		panic("无法创建KITEQ " + err.Error())
-
-	}
-
-	if !exist {
-		resp, err := ss.Create(KITEQ, nil, zk.CreatePersistent, zk.WorldACL(zk.PermAll))
+	if len(self.digest) > 0 {
+		err = ss.AddAuth("digest", []byte(self.digest))
 		if nil != err {
 			ss.Close()
-			panic("NewZKManager|CREATE ROOT PATH|FAIL|" + KITEQ + "|" + err.Error())
-		} else {
-			log.Info("NewZKManager|CREATE ROOT PATH|SUCC|%s", resp)
+			panic("zk digest认证失败..." + err.Error())
 		}
+		split := strings.SplitN(self.digest, ":", 2)
+		//自己拥有全部权限,其他人只能读取;中间节点允许其他人创建和删除自己的子节点
+		self.acl = append(zk.DigestACL(zk.PermAll, split[0], split[1]), zk.WorldACL(zk.PermRead)...)
+		self.parentAcl = append(zk.DigestACL(zk.PermAll, split[0], split[1]),
+			zk.WorldACL(zk.PermRead|zk.PermCreate|zk.PermDelete)...)
+	} else {
+		self.acl = zk.WorldACL(zk.PermAll)
+		self.parentAcl = zk.WorldACL(zk.PermAll)
 	}
 
 	self.session = ss
+	err = self.traverseCreatePath(self.root, nil, zk.CreatePersistent)
+	if nil != err {
+		ss.Close()
+		panic("NewZKManager|CREATE ROOT PATH|FAIL|" + self.root + "|" + err.Error())
+	}
+
 	self.isClose = false
 	self.eventChan = eventChan
 	go self.listenEvent()
 }
 
+//逻辑路径/kiteq/...转换为zk上的实际路径
+func (self *ZKManager) realPath(path string) string {
+	return self.root + strings.TrimPrefix(path, KITEQ)
+}
+
+//zk上的实际路径转换为逻辑路径/kiteq/...
+func (self *ZKManager) logicPath(path string) string {
+	return KITEQ + strings.TrimPrefix(path, self.root)
+}
+
 //监听数据变更
 func (self *ZKManager) listenEvent() {
 	for !self.isClose {
@@ -100,19 +158,19 @@ func (self *ZKManager) listenEvent() {
 			}
 		case zk.EventNodeDeleted:
 			self.session.ExistsW(path)
-			self.watcher.NodeChange(path, ZkEvent(change.Type), []string{})
+			self.watcher.NodeChange(self.logicPath(path), ZkEvent(change.Type), []string{})
 			// log.Info("ZKManager|listenEvent|%s|%s\n", path, change)
 		case zk.EventNodeCreated, zk.EventNodeChildrenChanged:
 			childnodes, _, _, err := self.session.ChildrenW(path)
 			if nil != err {
 				log.Error("ZKManager|listenEvent|CD|%s|%s|%t\n", err, path, change.Type)
 			} else {
-				self.watcher.NodeChange(path, ZkEvent(change.Type), childnodes)
+				self.watcher.NodeChange(self.logicPath(path), ZkEvent(change.Type), childnodes)
 				// log.Info("ZKManager|listenEvent|%s|%s|%s\n", path, change, childnodes)
 			}
 
 		case zk.EventNodeDataChanged:
-			split := strings.Split(path, "/")
+			split := strings.Split(self.logicPath(path), "/")
 			//如果不是bind级别的变更则忽略
 			if len(split) < 5 || strings.LastIndex(split[4], "-bind") <= 0 {
 				continue
@@ -124,7 +182,7 @@ func (self *ZKManager) listenEvent() {
 				//忽略
 				continue
 			}
-			self.watcher.DataChange(path, binds)
+			self.watcher.DataChange(self.logicPath(path), binds)
 			// log.Info("ZKManager|listenEvent|%s|%s|%s\n", path, change, binds)
 
 		}
@@ -137,7 +195,7 @@ func (self *ZKManager) listenEvent() {
 func (self *ZKManager) UnpushlishQServer(hostport string, topics []string) {
 	for _, topic := range topics {
 
-		qpath := KITEQ_SERVER + "/" + topic + "/" + hostport
+		qpath := self.realPath(KITEQ_SERVER + "/" + topic + "/" + hostport)
 
 		//删除当前该Topic下的本机
 		err := self.session.Delete(qpath, -1)
@@ -154,9 +212,9 @@ func (self *ZKManager) PublishQServer(hostport string, topics []string) error {
 
 	for _, topic := range topics {
 
-		qpath := KITEQ_SERVER + "/" + topic
-		spath := KITEQ_SUB + "/" + topic
-		ppath := KITEQ_PUB + "/" + topic
+		qpath := self.realPath(KITEQ_SERVER + "/" + topic)
+		spath := self.realPath(KITEQ_SUB + "/" + topic)
+		ppath := self.realPath(KITEQ_PUB + "/" + topic)
 
 		//创建发送和订阅的根节点
 		self.traverseCreatePath(ppath, nil, zk.CreatePersistent)
@@ -180,7 +238,7 @@ func (self *ZKManager) PublishQServer(hostport string, topics []string) error {
 func (self *ZKManager) PublishTopics(topics []string, groupId string, hostport string) error {
 
 	for _, topic := range topics {
-		pubPath := KITEQ_PUB + "/" + topic + "/" + groupId
+		pubPath := self.realPath(KITEQ_PUB + "/" + topic + "/" + groupId)
 		path, err := self.registePath(pubPath, hostport, zk.CreatePersistent, nil)
 		if nil != err {
 			log.Error("ZKManager|PublishTopic|FAIL|%s|%s/%s\n", err, pubPath, hostport)
@@ -191,20 +249,25 @@ func (self *ZKManager) PublishTopics(topics []string, groupId string, hostport s
 	return nil
 }
 
+//删除当前进程的publisher
+func (self *ZKManager) UnpublishTopics(topics []string, groupId string, hostport string) error {
+	for _, topic := range topics {
+		path := self.realPath(KITEQ_PUB + "/" + topic + "/" + groupId + "/" + hostport)
+		err := self.session.Delete(path, -1)
+		if nil != err && err != zk.ErrNoNode {
+			log.Error("ZKManager|UnpublishTopics|FAIL|%s|%s\n", err, path)
+			return err
+		}
+		log.Info("ZKManager|UnpublishTopics|SUCC|%s\n", path)
+	}
+	return nil
+}
+
 //发布订阅关系
 func (self *ZKManager) PublishBindings(groupId string, bindings []*Binding) error {
 
 	//按topic分组
-	groupBind := make(map[string][]*Binding, 10)
-	for _, b := range bindings {
-		g, ok := groupBind[b.Topic]
-		if !ok {
-			g = make([]*Binding, 0, 2)
-		}
-		b.GroupId = groupId
-		g = append(g, b)
-		groupBind[b.Topic] = g
-	}
+	groupBind := groupBindings(groupId, bindings)
 
 	for topic, binds := range groupBind {
 		data, err := MarshalBinds(binds)
@@ -215,7 +278,7 @@ func (self *ZKManager) PublishBindings(groupId string, bindings []*Binding) erro
 
 		createType := zk.CreatePersistent
 
-		path := KITEQ_SUB + "/" + topic
+		path := self.realPath(KITEQ_SUB + "/" + topic)
 		//注册对应topic的groupId //注册订阅信息
 		succpath, err := self.registePath(path, groupId+"-bind", createType, data)
 		if nil != err {
@@ -228,11 +291,62 @@ func (self *ZKManager) PublishBindings(groupId string, bindings []*Binding) erro
 	return nil
 }
 
+//删除分组在topic下的订阅关系
+func (self *ZKManager) UnpublishBindings(groupId string, topics []string) error {
+	for _, topic := range topics {
+		path := self.realPath(KITEQ_SUB + "/" + topic + "/" + groupId + "-bind")
+		err := self.session.Delete(path, -1)
+		if nil != err && err != zk.ErrNoNode {
+			log.Error("ZKManager|UnpublishBindings|FAIL|%s|%s\n", err, path)
+			return err
+		}
+		log.Info("ZKManager|UnpublishBindings|SUCC|%s\n", path)
+	}
+	return nil
+}
+
+//发布订阅分组的实例
+func (self *ZKManager) PublishSubscriber(groupId string, instance string) error {
+	subPath := self.realPath(KITEQ_SUBSCRIBER + "/" + groupId)
+	path, err := self.registePath(subPath, instance, zk.CreateEphemeral, nil)
+	if nil != err {
+		log.Error("ZKManager|PublishSubscriber|FAIL|%s|%s/%s\n", err, subPath, instance)
+		return err
+	}
+	log.Info("ZKManager|PublishSubscriber|SUCC|%s\n", path)
+	return nil
+}
+
+//删除订阅分组的实例
+func (self *ZKManager) UnpublishSubscriber(groupId string, instance string) error {
+	path := self.realPath(KITEQ_SUBSCRIBER + "/" + groupId + "/" + instance)
+	err := self.session.Delete(path, -1)
+	if nil != err && err != zk.ErrNoNode {
+		log.Error("ZKManager|UnpublishSubscriber|FAIL|%s|%s\n", err, path)
+		return err
+	}
+	log.Info("ZKManager|UnpublishSubscriber|SUCC|%s\n", path)
+	return nil
+}
+
+//获取订阅分组存活的实例
+func (self *ZKManager) GetSubscribers(groupId string) ([]string, error) {
+	path := self.realPath(KITEQ_SUBSCRIBER + "/" + groupId)
+	children, _, err := self.session.Children(path)
+	if err == zk.ErrNoNode {
+		return []string{}, nil
+	} else if nil != err {
+		log.Error("ZKManager|GetSubscribers|FAIL|%s|%s\n", err, path)
+		return nil, err
+	}
+	return children, nil
+}
+
 //注册当前进程节点
 func (self *ZKManager) registePath(path string, childpath string, createType zk.CreateType, data []byte) (string, error) {
 	err := self.traverseCreatePath(path, nil, zk.CreatePersistent)
 	if nil == err {
-		err := self.innerCreatePath(path+"/"+childpath, data, createType)
+		err := self.innerCreatePath(path+"/"+childpath, data, createType, self.acl)
 		if nil != err {
 			log.Error("ZKManager|registePath|CREATE CHILD|FAIL|%s|%s\n", err, path+"/"+childpath)
 			return "", err
@@ -253,7 +367,7 @@ func (self *ZKManager) traverseCreatePath(path string, data []byte, createType z
 		if i >= len(split)-1 {
 			break
 		}
-		err := self.innerCreatePath(tmppath, nil, zk.CreatePersistent)
+		err := self.innerCreatePath(tmppath, nil, zk.CreatePersistent, self.parentAcl)
 		if nil != err {
 			log.Error("ZKManager|traverseCreatePath|FAIL|%s\n", err)
 			return err
@@ -263,14 +377,14 @@ func (self *ZKManager) traverseCreatePath(path string, data []byte, createType z
 	}
 
 	//对叶子节点创建及添加数据
-	return self.innerCreatePath(tmppath, data, createType)
+	return self.innerCreatePath(tmppath, data, createType, self.parentAcl)
 }
 
 //内部创建节点的方法
-func (self *ZKManager) innerCreatePath(tmppath string, data []byte, createType zk.CreateType) error {
+func (self *ZKManager) innerCreatePath(tmppath string, data []byte, createType zk.CreateType, acl []zk.ACL) error {
 	exist, _, _, err := self.session.ExistsW(tmppath)
 	if nil == err && !exist {
-		_, err := self.session.Create(tmppath, data, createType, zk.WorldACL(zk.PermAll))
+		_, err := self.session.Create(tmppath, data, createType, acl)
 		if nil != err {
 			log.Error("ZKManager|innerCreatePath|FAIL|%s|%s\n", err, tmppath)
 			return err
@@ -304,7 +418,7 @@ func (self *ZKManager) innerCreatePath(tmppath string, data []byte, createType z
 //获取QServer并添加watcher
 func (self *ZKManager) GetQServerAndWatch(topic string) ([]string, error) {
 
-	path := KITEQ_SERVER + "/" + topic
+	path := self.realPath(KITEQ_SERVER + "/" + topic)
 
 	exist, _, _, _ := self.session.ExistsW(path)
 	if !exist {
@@ -322,7 +436,7 @@ func (self *ZKManager) GetQServerAndWatch(topic string) ([]string, error) {
 //获取订阅关系并添加watcher
 func (self *ZKManager) GetBindAndWatch(topic string) (map[string][]*Binding, error) {
 
-	path := KITEQ_SUB + "/" + topic
+	path := self.realPath(KITEQ_SUB + "/" + topic)
 
 	exist, _, _, err := self.session.ExistsW(path)
 	if !exist {
@@ -145,3 +145,68 @@ func TestSubscribeTopic(t *testing.T) {
 	time.Sleep(10 * time.Second)
 	zkmanager.Close()
 }
+
+//不同digest的分组在同一个topic下发布后都可以删除自己的节点
+func TestZKDigestUnpublish(t *testing.T) {
+	owner := NewZKManager("localhost:2181?root=/kiteq-acl&digest=owner:owner", &MockWatcher{})
+	other := NewZKManager("localhost:2181?root=/kiteq-acl&digest=other:other", &MockWatcher{})
+	defer owner.Close()
+	defer other.Close()
+
+	//owner先创建topic的中间节点
+	for _, m := range []*ZKManager{owner, other} {
+		groupId := "s-trade-" + m.digest[:5]
+		err := m.PublishBindings(groupId, []*Binding{Bind_Direct(groupId, "trade", "trade-succ", -1, true)})
+		if nil == err {
+			err = m.PublishTopics([]string{"trade"}, "p-"+groupId, "localhost:13800")
+		}
+		if nil == err {
+			err = m.PublishSubscriber(groupId, "localhost:13800")
+		}
+		if nil != err {
+			t.Fatalf("TestZKDigestUnpublish|Publish|%s|%s\n", err, groupId)
+		}
+	}
+
+	groupId := "s-trade-other"
+	err := other.UnpublishBindings(groupId, []string{"trade"})
+	if nil == err {
+		err = other.UnpublishTopics([]string{"trade"}, "p-"+groupId, "localhost:13800")
+	}
+	if nil == err {
+		err = other.UnpublishSubscriber(groupId, "localhost:13800")
+	}
+	if nil != err {
+		t.Fatalf("TestZKDigestUnpublish|Unpublish|%s\n", err)
+	}
+
+	bindings, err := owner.GetBindAndWatch("trade")
+	if _, ok := bindings[groupId]; nil != err || ok || len(bindings) != 1 {
+		t.Fatalf("TestZKDigestUnpublish|GetBindAndWatch|%s|%v\n", err, bindings)
+	}
+	cleanUp(t, owner, "/kiteq-acl")
+}
+
+//测试zk地址参数解析
+func TestZKParseHosts(t *testing.T) {
+	zkmanager := &ZKManager{root: KITEQ}
+	zkmanager.parseHosts("localhost:2181,localhost:2182?root=kiteq-prod/&digest=user:password")
+	if zkmanager.zkhosts != "localhost:2181,localhost:2182" ||
+		zkmanager.root != "/kiteq-prod" || zkmanager.digest != "user:password" {
+		t.Fail()
+		t.Logf("TestZKParseHosts|%s|%s|%s\n", zkmanager.zkhosts, zkmanager.root, zkmanager.digest)
+	}
+
+	path := zkmanager.realPath(KITEQ_SUB + "/trade")
+	if path != "/kiteq-prod/sub/trade" || zkmanager.logicPath(path) != KITEQ_SUB+"/trade" {
+		t.Fail()
+		t.Logf("TestZKParseHosts|realPath|%s\n", path)
+	}
+
+	zkmanager = &ZKManager{root: KITEQ}
+	zkmanager.parseHosts("localhost:2181")
+	if zkmanager.zkhosts != "localhost:2181" || zkmanager.root != KITEQ || len(zkmanager.digest) > 0 {
+		t.Fail()
+		t.Logf("TestZKParseHosts|default|%s|%s\n", zkmanager.zkhosts, zkmanager.root)
+	}
+}
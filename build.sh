@@ -5,6 +5,9 @@ go get  github.com/blackbeans/go-uuid
 go get  github.com/go-sql-driver/mysql
 go get  github.com/blackbeans/log4go
 go get -u github.com/blackbeans/go-zookeeper/zk
+go get  go.etcd.io/etcd/client/v3
+go get  go.etcd.io/bbolt
+go get  github.com/mattn/go-sqlite3
 go get -u  github.com/blackbeans/turbo
 
 
@@ -17,6 +20,7 @@ go build -a kiteq/store
 go build -a kiteq/store/mysql
 go build -a kiteq/store/file
 go build -a kiteq/store/memory
+go build -a kiteq/store/bolt
 go build -a kiteq/handler
 go build -a kiteq/client/chandler
 go build -a kiteq/server
@@ -31,6 +35,7 @@ go install kiteq/store
 go install kiteq/store/mysql
 go install kiteq/store/memory
 go install kiteq/store/file
+go install kiteq/store/bolt
 go install kiteq/handler
 go install kiteq/client/chandler
 go install kiteq/server
@@ -48,6 +53,7 @@ go build  -a -o ./$PROJ $PROJ.go
 
 go build -a kite_benchmark_producer.go
 go build -a kite_benchmark_consumer.go
+go build -a -o ./kiteq-fsck kiteq_fsck.go
 
 
 
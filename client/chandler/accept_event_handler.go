@@ -2,11 +2,13 @@ package chandler
 
 import (
 	"errors"
+	log "github.com/blackbeans/log4go"
 	c "github.com/blackbeans/turbo/client"
 	"github.com/blackbeans/turbo/packet"
 	. "github.com/blackbeans/turbo/pipe"
 	"kiteq/client/listener"
 	"kiteq/protocol"
+	"sync/atomic"
 )
 
 //接受消息事件
@@ -30,6 +32,10 @@ func newAcceptEvent(msgType uint8, msg interface{}, remoteClient *c.RemotingClie
 type AcceptHandler struct {
 	BaseForwardHandler
 	listener listener.IListener
+	txLookup func(messageId string) (protocol.TxStatus, string, bool) //本地事务日志的查询
+	executor *ConsumerExecutor                                        //消费线程池,为空时同步回调listener
+	stopped  int32                                                    //1:不再接收推送
+	inflight int32                                                    //处理中的消息
 }
 
 func NewAcceptHandler(name string, listener listener.IListener) *AcceptHandler {
@@ -39,6 +45,26 @@ func NewAcceptHandler(name string, listener listener.IListener) *AcceptHandler {
 	return ahandler
 }
 
+//设置本地事务日志的查询,事务回查时优先使用本地记录的结果
+func (self *AcceptHandler) SetTxLookup(txLookup func(messageId string) (protocol.TxStatus, string, bool)) {
+	self.txLookup = txLookup
+}
+
+//设置消费线程池
+func (self *AcceptHandler) SetExecutor(executor *ConsumerExecutor) {
+	self.executor = executor
+}
+
+//不再接收新的推送,之后到达的消息直接NACK
+func (self *AcceptHandler) Stop() {
+	atomic.StoreInt32(&self.stopped, 1)
+}
+
+//处理中的消息数量
+func (self *AcceptHandler) Inflight() int32 {
+	return atomic.LoadInt32(&self.inflight)
+}
+
 func (self *AcceptHandler) TypeAssert(event IEvent) bool {
 	_, ok := self.cast(event)
 	return ok
@@ -68,9 +94,19 @@ func (self *AcceptHandler) Process(ctx *DefaultPipelineContext, event IEvent) er
 		txPacket := acceptEvent.msg.(*protocol.TxACKPacket)
 		header := txPacket.GetHeader()
 		tx := protocol.NewTxResponse(header)
-		err := self.listener.OnMessageCheck(tx)
-		if nil != err {
-			tx.Unknown(err.Error())
+		status, feedback, ok := protocol.TX_UNKNOWN, "", false
+		if nil != self.txLookup {
+			status, feedback, ok = self.txLookup(header.GetMessageId())
+		}
+		if ok && status == protocol.TX_COMMIT {
+			tx.Commit()
+		} else if ok && status == protocol.TX_ROLLBACK {
+			tx.Rollback(feedback)
+		} else {
+			err := self.listener.OnMessageCheck(tx)
+			if nil != err {
+				tx.Unknown(err.Error())
+			}
 		}
 		//发起一个向后的处理时间发送出去
 		//填充条件
@@ -91,15 +127,28 @@ func (self *AcceptHandler) Process(ctx *DefaultPipelineContext, event IEvent) er
 
 		message := protocol.NewQMessage(acceptEvent.msg)
 
-		succ := self.listener.OnMessage(message)
-
-		dpacket := protocol.MarshalDeliverAckPacket(message.GetHeader(), succ)
-
-		respPacket := packet.NewRespPacket(acceptEvent.opaque, protocol.CMD_DELIVER_ACK, dpacket)
+		atomic.AddInt32(&self.inflight, 1)
+		if atomic.LoadInt32(&self.stopped) == 1 {
+			//正在关闭,由服务端重投
+			self.sendDeliverAck(ctx, acceptEvent, message.GetHeader(), false)
+			atomic.AddInt32(&self.inflight, -1)
+			break
+		}
 
-		remotingEvent := NewRemotingEvent(respPacket, []string{acceptEvent.remoteClient.RemoteAddr()})
+		if nil == self.executor {
+			self.onMessage(ctx, acceptEvent, message)
+			break
+		}
 
-		ctx.SendForward(remotingEvent)
+		succ := self.executor.Submit(message.GetHeader().GetTopic(), func() {
+			self.onMessage(ctx, acceptEvent, message)
+		})
+		if !succ {
+			//队列已满直接NACK,由服务端按照重投策略稍后投递
+			log.Warn("AcceptHandler|Process|QUEUE FULL|%s|%s\n", message.GetHeader().GetTopic(), message.GetHeader().GetMessageId())
+			self.sendDeliverAck(ctx, acceptEvent, message.GetHeader(), false)
+			atomic.AddInt32(&self.inflight, -1)
+		}
 
 	default:
 		return INVALID_MSG_TYPE_ERROR
@@ -108,3 +157,20 @@ func (self *AcceptHandler) Process(ctx *DefaultPipelineContext, event IEvent) er
 	return nil
 
 }
+
+//回调消息监听器然后发送处理结果
+func (self *AcceptHandler) onMessage(ctx *DefaultPipelineContext, acceptEvent *acceptEvent, message *protocol.QMessage) {
+	defer atomic.AddInt32(&self.inflight, -1)
+	succ := self.listener.OnMessage(message)
+	self.sendDeliverAck(ctx, acceptEvent, message.GetHeader(), succ)
+}
+
+func (self *AcceptHandler) sendDeliverAck(ctx *DefaultPipelineContext, acceptEvent *acceptEvent, header *protocol.Header, succ bool) {
+	dpacket := protocol.MarshalDeliverAckPacket(header, succ)
+
+	respPacket := packet.NewRespPacket(acceptEvent.opaque, protocol.CMD_DELIVER_ACK, dpacket)
+
+	remotingEvent := NewRemotingEvent(respPacket, []string{acceptEvent.remoteClient.RemoteAddr()})
+
+	ctx.SendForward(remotingEvent)
+}
@@ -0,0 +1,150 @@
+package chandler
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+var ERROR_EXECUTOR_CLOSED = errors.New("CONSUMER EXECUTOR CLOSED !")
+
+//消费消息的线程池,每个topic独立的worker和有界队列
+//队列满时Submit直接返回false,由调用方NACK让服务端稍后重投
+type ConsumerExecutor struct {
+	workers      int //默认每个topic的worker数量
+	queueSize    int //默认每个topic的队列长度
+	topicConfigs map[string] /*topic*/ [2]int
+	pools        map[string] /*topic*/ *workerPool
+	lock         sync.RWMutex
+	closed       bool
+	wg           sync.WaitGroup
+}
+
+type workerPool struct {
+	queue    chan func()
+	rejected int64
+}
+
+func NewConsumerExecutor(workers, queueSize int) *ConsumerExecutor {
+	if workers <= 0 {
+		workers = 1
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	return &ConsumerExecutor{
+		workers:      workers,
+		queueSize:    queueSize,
+		topicConfigs: make(map[string][2]int, 10),
+		pools:        make(map[string]*workerPool, 10)}
+}
+
+//单独设置某个topic的worker数量和队列长度,需要在该topic的第一条消息之前设置
+func (self *ConsumerExecutor) SetTopicWorkers(topic string, workers, queueSize int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.topicConfigs[topic] = [2]int{workers, queueSize}
+}
+
+func (self *ConsumerExecutor) pool(topic string) (*workerPool, error) {
+	self.lock.RLock()
+	p, ok := self.pools[topic]
+	closed := self.closed
+	self.lock.RUnlock()
+	if closed {
+		return nil, ERROR_EXECUTOR_CLOSED
+	} else if ok {
+		return p, nil
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		return nil, ERROR_EXECUTOR_CLOSED
+	}
+	p, ok = self.pools[topic]
+	if ok {
+		return p, nil
+	}
+
+	workers, queueSize := self.workers, self.queueSize
+	if c, ok := self.topicConfigs[topic]; ok {
+		if c[0] > 0 {
+			workers = c[0]
+		}
+		if c[1] >= 0 {
+			queueSize = c[1]
+		}
+	}
+	p = &workerPool{queue: make(chan func(), queueSize)}
+	self.pools[topic] = p
+	for i := 0; i < workers; i++ {
+		self.wg.Add(1)
+		go func() {
+			defer self.wg.Done()
+			for task := range p.queue {
+				task()
+			}
+		}()
+	}
+	return p, nil
+}
+
+//提交消费任务,队列已满或者已经关闭时返回false
+func (self *ConsumerExecutor) Submit(topic string, task func()) bool {
+	p, err := self.pool(topic)
+	if nil != err {
+		return false
+	}
+
+	//持有读锁保证不会写入已经关闭的队列
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	if self.closed {
+		return false
+	}
+	select {
+	case p.queue <- task:
+		return true
+	default:
+		atomic.AddInt64(&p.rejected, 1)
+		return false
+	}
+}
+
+//各个topic队列中等待消费的消息数量
+func (self *ConsumerExecutor) QueueDepth() map[string]int {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	depth := make(map[string]int, len(self.pools))
+	for topic, p := range self.pools {
+		depth[topic] = len(p.queue)
+	}
+	return depth
+}
+
+//各个topic因为队列已满被拒绝的消息数量
+func (self *ConsumerExecutor) Rejected() map[string]int64 {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	rejected := make(map[string]int64, len(self.pools))
+	for topic, p := range self.pools {
+		rejected[topic] = atomic.LoadInt64(&p.rejected)
+	}
+	return rejected
+}
+
+//不再接收新的任务,等待队列中的任务消费完成
+func (self *ConsumerExecutor) Close() {
+	self.lock.Lock()
+	if self.closed {
+		self.lock.Unlock()
+		return
+	}
+	self.closed = true
+	for _, p := range self.pools {
+		close(p.queue)
+	}
+	self.lock.Unlock()
+	self.wg.Wait()
+}
@@ -0,0 +1,56 @@
+package chandler
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//队列满时拒绝新的任务
+func TestConsumerExecutorReject(t *testing.T) {
+	executor := NewConsumerExecutor(1, 2)
+	block := make(chan bool)
+	executor.Submit("trade", func() { <-block })
+	time.Sleep(50 * time.Millisecond)
+
+	if !executor.Submit("trade", func() {}) || !executor.Submit("trade", func() {}) {
+		t.Fatal("TestConsumerExecutorReject|Submit|FAIL")
+	}
+	if executor.Submit("trade", func() {}) {
+		t.Fatal("TestConsumerExecutorReject|QUEUE FULL|NOT REJECTED")
+	}
+	if executor.QueueDepth()["trade"] != 2 || executor.Rejected()["trade"] != 1 {
+		t.Fail()
+		t.Logf("TestConsumerExecutorReject|%v|%v\n", executor.QueueDepth(), executor.Rejected())
+	}
+
+	//其他topic不受影响
+	if !executor.Submit("feed", func() {}) {
+		t.Fail()
+		t.Log("TestConsumerExecutorReject|feed|REJECTED")
+	}
+	close(block)
+	executor.Close()
+	if executor.Submit("trade", func() {}) {
+		t.Fail()
+		t.Log("TestConsumerExecutorReject|Close|NOT REJECTED")
+	}
+}
+
+//关闭时等待队列中的任务执行完成
+func TestConsumerExecutorClose(t *testing.T) {
+	executor := NewConsumerExecutor(4, 100)
+	executor.SetTopicWorkers("trade", 2, 10)
+	var count int32
+	for i := 0; i < 10; i++ {
+		executor.Submit("trade", func() {
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&count, 1)
+		})
+	}
+	executor.Close()
+	if atomic.LoadInt32(&count) != 10 {
+		t.Fail()
+		t.Logf("TestConsumerExecutorClose|%d\n", count)
+	}
+}
@@ -14,6 +14,7 @@ type HeartbeatHandler struct {
 	clientMangager   *c.ClientManager
 	heartbeatPeriod  time.Duration
 	heartbeatTimeout time.Duration
+	onRTT            func(hostport string, rtt time.Duration) //心跳测量的延迟
 }
 
 //------创建heartbeat
@@ -28,6 +29,11 @@ func NewHeartbeatHandler(name string, heartbeatPeriod time.Duration,
 	return phandler
 }
 
+//设置心跳延迟的回调
+func (self *HeartbeatHandler) SetRTTListener(onRTT func(hostport string, rtt time.Duration)) {
+	self.onRTT = onRTT
+}
+
 func (self *HeartbeatHandler) keepAlive() {
 
 	for {
@@ -48,7 +54,11 @@ func (self *HeartbeatHandler) keepAlive() {
 						if c.Idle() {
 							for ; i < 3; i++ {
 								hp := packet.NewPacket(protocol.CMD_HEARTBEAT, p)
+								start := time.Now()
 								err := c.Ping(hp, time.Duration(self.heartbeatTimeout))
+								if nil == err && nil != self.onRTT {
+									self.onRTT(h, time.Since(start))
+								}
 								//如果有错误则需要记录
 								if nil != err {
 									log.Warn("HeartbeatHandler|KeepAlive|FAIL|%s|local:%s|remote:%s|%d\n", err, c.LocalAddr(), h, id)
@@ -87,6 +87,14 @@ func (self *PacketHandler) handlePacket(pevent *PacketEvent) (IEvent, error) {
 			pevent.RemoteClient.Attach(packet.Opaque, &pesisteAck)
 			event = eventSunk
 		}
+		//批量消息持久化
+	case protocol.CMD_BATCH_STORE_ACK:
+		var batchAck protocol.BatchStoreAck
+		err = protocol.UnmarshalPbMessage(packet.Data, &batchAck)
+		if nil == err {
+			pevent.RemoteClient.Attach(packet.Opaque, &batchAck)
+			event = eventSunk
+		}
 
 	case protocol.CMD_TX_ACK:
 		var txAck protocol.TxACKPacket
@@ -11,7 +11,16 @@ import (
 )
 
 type kiteClient struct {
-	remotec *c.RemotingClient
+	remotec remotingClient
+	batch   bool //服务端是否支持批量发送
+}
+
+//kiteClient使用的远程连接
+type remotingClient interface {
+	RemoteAddr() string
+	IsClosed() bool
+	Write(p packet.Packet) (chan interface{}, error)
+	WriteAndGet(p packet.Packet, timeout time.Duration) (interface{}, error)
 }
 
 func newKitClient(remoteClient *c.RemotingClient) *kiteClient {
@@ -23,44 +32,71 @@ func newKitClient(remoteClient *c.RemotingClient) *kiteClient {
 }
 
 //发送事务的确认,无需等待服务器反馈
-func (self *kiteClient) sendTxAck(message *protocol.QMessage,
+func (self *kiteClient) sendTxAck(header *protocol.Header,
 	txstatus protocol.TxStatus, feedback string) error {
-	txpacket := protocol.MarshalTxACKPacket(message.GetHeader(), txstatus, feedback)
+	txpacket := protocol.MarshalTxACKPacket(header, txstatus, feedback)
 	return self.innerSendMessage(protocol.CMD_TX_ACK, txpacket, 0)
 }
 
-func (self *kiteClient) sendMessage(message *protocol.QMessage) error {
-
-	data, err := protocol.MarshalPbMessage(message.GetPbMessage())
-	if nil != err {
-		return err
-	}
-	timeout := 3 * time.Second
-	return self.innerSendMessage(message.GetMsgType(), data, timeout)
-}
-
 var TIMEOUT_ERROR = errors.New("WAIT RESPONSE TIMEOUT ")
 
 func (self *kiteClient) innerSendMessage(cmdType uint8, p []byte, timeout time.Duration) error {
 
-	msgpacket := packet.NewPacket(cmdType, p)
-
 	//如果是需要等待结果的则等待
 	if timeout <= 0 {
+		msgpacket := packet.NewPacket(cmdType, p)
 		_, err := self.remotec.Write(*msgpacket)
 		return err
 	} else {
-		resp, err := self.remotec.WriteAndGet(*msgpacket, timeout)
-		if nil != err {
-			return err
-		} else {
-			storeAck, ok := resp.(*protocol.MessageStoreAck)
-			if !ok || !storeAck.GetStatus() {
-				return errors.New(fmt.Sprintf("kiteClient|SendMessage|FAIL|%s\n", resp))
-			} else {
-				// log.Debug("kiteClient|SendMessage|SUCC|%s|%s\n", storeAck.GetMessageId(), storeAck.GetFeedback())
-				return nil
-			}
+		_, err := self.writeAndGetAck(cmdType, p, timeout)
+		return err
+	}
+}
+
+//发送并等待服务端的存储结果
+func (self *kiteClient) writeAndGetAck(cmdType uint8, p []byte, timeout time.Duration) (*protocol.MessageStoreAck, error) {
+	resp, err := self.write(cmdType, p)
+	if nil != err {
+		return nil, err
+	}
+	select {
+	case r, ok := <-resp:
+		if !ok {
+			return nil, ERROR_CONNECTION_CLOSED
 		}
+		// log.Debug("kiteClient|SendMessage|SUCC|%s|%s\n", storeAck.GetMessageId(), storeAck.GetFeedback())
+		return storeAckOf(r)
+	case <-time.After(timeout):
+		return nil, TIMEOUT_ERROR
+	}
+}
+
+//只写出不等待,服务端的响应从返回的channel中获取
+func (self *kiteClient) write(cmdType uint8, p []byte) (chan interface{}, error) {
+	msgpacket := packet.NewPacket(cmdType, p)
+	return self.remotec.Write(*msgpacket)
+}
+
+//服务端返回的存储失败
+type storeAckError struct {
+	ack *protocol.MessageStoreAck
+}
+
+func (self *storeAckError) Error() string {
+	return fmt.Sprintf("kiteClient|SendMessage|FAIL|%s\n", self.ack)
+}
+
+//解析服务端的存储结果
+func storeAckOf(resp interface{}) (*protocol.MessageStoreAck, error) {
+	if err, ok := resp.(error); ok {
+		return nil, err
+	}
+	storeAck, ok := resp.(*protocol.MessageStoreAck)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("kiteClient|SendMessage|FAIL|%s\n", resp))
+	}
+	if !storeAck.GetStatus() {
+		return storeAck, &storeAckError{ack: storeAck}
 	}
+	return storeAck, nil
 }
@@ -0,0 +1,395 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/blackbeans/log4go"
+	"kiteq/protocol"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var ERROR_INFLIGHT_LIMIT = errors.New("TOO MANY INFLIGHT MESSAGES !")
+var ERROR_CONNECTION_CLOSED = errors.New("CONNECTION CLOSED BEFORE RESPONSE !")
+var ERROR_BATCH_ACK_MISSING = errors.New("NO STORE ACK IN BATCH RESPONSE !")
+
+//异步发送检查响应超时的间隔
+const ASYNC_TIMEOUT_TICK = 10 * time.Millisecond
+
+//异步发送完成的回调,ack为服务端的存储结果,网络错误或者超时时ack为nil
+//开启spool时发送失败的消息写入本地文件,此时ack和err都为nil
+type SendCallback func(ack *protocol.MessageStoreAck, err error)
+
+//异步发送的结果
+type SendFuture struct {
+	ack  *protocol.MessageStoreAck
+	err  error
+	done chan bool
+}
+
+func newSendFuture() *SendFuture {
+	return &SendFuture{done: make(chan bool)}
+}
+
+func (self *SendFuture) complete(ack *protocol.MessageStoreAck, err error, callback SendCallback) {
+	self.ack = ack
+	self.err = err
+	close(self.done)
+	if nil != callback {
+		callback(ack, err)
+	}
+}
+
+//等待发送结果
+func (self *SendFuture) Get() (*protocol.MessageStoreAck, error) {
+	<-self.done
+	return self.ack, self.err
+}
+
+//发送完成时关闭,可用于select
+func (self *SendFuture) Done() <-chan bool {
+	return self.done
+}
+
+//设置发送等待服务端确认的超时时间
+func (self *KiteClientManager) SetSendTimeout(timeout time.Duration) {
+	self.sendTimeout = timeout
+}
+
+//设置异步发送的最大未完成数,需要在发送之前设置
+func (self *KiteClientManager) SetMaxInflight(maxInflight int) {
+	self.maxInflight = make(chan byte, maxInflight)
+}
+
+//当前异步发送未完成的消息数
+func (self *KiteClientManager) Inflight() int {
+	return len(self.maxInflight)
+}
+
+//异步发送消息,调用方不需要等待服务端的确认
+//timeout<=0时使用默认的超时时间;未完成的消息超过上限时直接失败
+//callback可以为nil,在异步发送的分发goroutine中回调,不能阻塞
+func (self *KiteClientManager) SendMessageAsync(msg *protocol.QMessage, timeout time.Duration, callback SendCallback) *SendFuture {
+	future := newSendFuture()
+	if self.isClosing() {
+		future.complete(nil, ERROR_CLIENT_CLOSED, callback)
+		return future
+	}
+	if timeout <= 0 {
+		timeout = self.sendTimeout
+	}
+
+	if spooled, err := self.spoolIfPending(msg); spooled {
+		future.complete(nil, err, callback)
+		return future
+	}
+	c, err := self.selectKiteClient(msg.GetHeader())
+	if nil != err {
+		future.complete(nil, self.spoolOnFail(msg, err), callback)
+		return future
+	}
+
+	select {
+	case self.maxInflight <- 1:
+	default:
+		log.Warn("KiteClientManager|SendMessageAsync|INFLIGHT LIMIT|%d|%s\n", cap(self.maxInflight), msg.GetHeader().GetMessageId())
+		future.complete(nil, ERROR_INFLIGHT_LIMIT, callback)
+		return future
+	}
+
+	self.sendAsync(c, msg, timeout, future, callback)
+	return future
+}
+
+//已经获取到inflight配额后发送,由分发器等待响应,完成后释放配额
+func (self *KiteClientManager) sendAsync(c *kiteClient, msg *protocol.QMessage, timeout time.Duration,
+	future *SendFuture, callback SendCallback) {
+	s := &asyncSend{
+		msg:      msg,
+		cmd:      msg.GetMsgType(),
+		c:        c,
+		exclude:  make(map[string]bool, 2),
+		timeout:  timeout,
+		inflight: self.maxInflight,
+		future:   future,
+		callback: callback}
+	data, err := protocol.MarshalPbMessage(msg.GetPbMessage())
+	if nil != err {
+		s.finish(nil, err)
+		return
+	}
+	s.data = data
+	self.sendDispatcher().submit(s)
+}
+
+func (self *KiteClientManager) sendDispatcher() *sendDispatcher {
+	self.dispatchOnce.Do(func() {
+		self.dispatcher = newSendDispatcher(self)
+		go self.dispatcher.run()
+	})
+	return self.dispatcher
+}
+
+//异步发送中的消息,batch不为空时为一次批量发送
+type asyncSend struct {
+	msg      *protocol.QMessage
+	cmd      uint8
+	data     []byte
+	batch    []*asyncSend
+	c        *kiteClient
+	hostport string
+	exclude  map[string]bool //已经失败过的broker
+	attempt  int             //已经重试的次数
+	lastErr  error
+	timeout  time.Duration
+	deadline time.Time        //等待响应的截止时间
+	retryAt  time.Time        //不为零时等待重试
+	resp     chan interface{} //服务端的响应
+	err      error            //写出失败
+	inflight chan byte
+	future   *SendFuture
+	callback SendCallback
+}
+
+//写出到当前选择的broker
+func (self *asyncSend) write(now time.Time) {
+	self.hostport = self.c.remotec.RemoteAddr()
+	self.retryAt = time.Time{}
+	self.deadline = now.Add(self.timeout)
+	if nil == self.data {
+		//批量发送失败后单条重试时才需要
+		self.data, self.err = protocol.MarshalPbMessage(self.msg.GetPbMessage())
+		if nil != self.err {
+			return
+		}
+	}
+	self.resp, self.err = self.c.write(self.cmd, self.data)
+}
+
+func (self *asyncSend) finish(ack *protocol.MessageStoreAck, err error) {
+	if nil != self.batch {
+		for _, e := range self.batch {
+			e.finish(nil, err)
+		}
+		return
+	}
+	<-self.inflight
+	self.future.complete(ack, err, self.callback)
+}
+
+//异步发送的分发器,在一个goroutine中等待所有未完成发送的响应并检查超时
+type sendDispatcher struct {
+	manager  *KiteClientManager
+	incoming []*asyncSend //新提交的发送
+	wake     chan bool
+	closed   bool
+	lock     sync.Mutex
+	pending  []*asyncSend
+	cases    []reflect.SelectCase //wake、超时检查、closeChan以及与pending一一对应的响应
+}
+
+//cases中pending之前的固定个数
+const dispatchFixedCases = 3
+
+func newSendDispatcher(manager *KiteClientManager) *sendDispatcher {
+	return &sendDispatcher{
+		manager:  manager,
+		incoming: make([]*asyncSend, 0, 100),
+		wake:     make(chan bool, 1),
+		pending:  make([]*asyncSend, 0, 100),
+		cases:    make([]reflect.SelectCase, 0, 100+dispatchFixedCases)}
+}
+
+//在调用方的goroutine中写出后交给分发器等待响应
+//不会阻塞,可以在回调中继续发送
+func (self *sendDispatcher) submit(s *asyncSend) {
+	s.write(time.Now())
+	self.lock.Lock()
+	if self.closed {
+		self.lock.Unlock()
+		s.finish(nil, ERROR_CLIENT_CLOSED)
+		return
+	}
+	self.incoming = append(self.incoming, s)
+	self.lock.Unlock()
+	select {
+	case self.wake <- true:
+	default:
+	}
+}
+
+func (self *sendDispatcher) run() {
+	ticker := time.NewTicker(ASYNC_TIMEOUT_TICK)
+	defer ticker.Stop()
+	self.cases = append(self.cases,
+		reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(self.wake)},
+		reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ticker.C)},
+		reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(self.manager.closeChan)})
+	for {
+		chosen, v, ok := reflect.Select(self.cases)
+		switch chosen {
+		case 0:
+			self.lock.Lock()
+			incoming := self.incoming
+			self.incoming = make([]*asyncSend, 0, cap(incoming))
+			self.lock.Unlock()
+			for _, s := range incoming {
+				self.watch(s)
+			}
+		case 1:
+			self.expire(time.Now())
+		case 2:
+			//客户端已经关闭,未完成的发送直接失败
+			self.lock.Lock()
+			self.closed = true
+			incoming := self.incoming
+			self.incoming = nil
+			self.lock.Unlock()
+			for _, s := range incoming {
+				s.finish(nil, ERROR_CLIENT_CLOSED)
+			}
+			for len(self.pending) > 0 {
+				self.remove(0).finish(nil, ERROR_CLIENT_CLOSED)
+			}
+			return
+		default:
+			s := self.remove(chosen - dispatchFixedCases)
+			var resp interface{} = ERROR_CONNECTION_CLOSED
+			if ok {
+				resp = v.Interface()
+			}
+			self.response(s, resp)
+		}
+	}
+}
+
+//等待响应或者重试
+func (self *sendDispatcher) watch(s *asyncSend) {
+	if nil != s.err {
+		err := s.err
+		s.err = nil
+		self.response(s, err)
+		return
+	}
+	self.pending = append(self.pending, s)
+	self.cases = append(self.cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(s.resp)})
+}
+
+func (self *sendDispatcher) remove(idx int) *asyncSend {
+	s := self.pending[idx]
+	last := len(self.pending) - 1
+	self.pending[idx] = self.pending[last]
+	self.pending[last] = nil
+	self.pending = self.pending[:last]
+	self.cases[idx+dispatchFixedCases] = self.cases[last+dispatchFixedCases]
+	self.cases = self.cases[:last+dispatchFixedCases]
+	return s
+}
+
+//超时的发送按失败处理,到达重试时间的重新发送
+func (self *sendDispatcher) expire(now time.Time) {
+	for i := 0; i < len(self.pending); {
+		s := self.pending[i]
+		if !s.retryAt.IsZero() {
+			if now.Before(s.retryAt) {
+				i++
+				continue
+			}
+			self.remove(i)
+			self.resend(s, now)
+		} else if now.After(s.deadline) {
+			self.remove(i)
+			self.response(s, TIMEOUT_ERROR)
+		} else {
+			i++
+		}
+	}
+}
+
+//服务端的响应、超时或者写出失败
+func (self *sendDispatcher) response(s *asyncSend, resp interface{}) {
+	if nil != s.batch {
+		self.batchResult(s, resp)
+		return
+	}
+	ack, err := storeAckOf(resp)
+	self.result(s, ack, err)
+}
+
+//处理发送结果,失败时按照重试策略换broker重试
+func (self *sendDispatcher) result(s *asyncSend, ack *protocol.MessageStoreAck, err error) {
+	if nil == err {
+		self.manager.breaker(s.hostport).succ()
+		s.finish(ack, nil)
+		return
+	}
+	self.retry(s, err, self.manager.sendFailed(s.hostport, s.msg, s.attempt, err))
+}
+
+//批量发送的结果逐条返回,失败的消息按照重试策略以单条发送重试
+//整个批次失败时只计一次broker的失败
+func (self *sendDispatcher) batchResult(s *asyncSend, resp interface{}) {
+	batchAck, ok := resp.(*protocol.BatchStoreAck)
+	if !ok {
+		err, ok := resp.(error)
+		if !ok {
+			err = errors.New(fmt.Sprintf("kiteClient|SendBatch|FAIL|%s\n", resp))
+		}
+		retry := self.manager.sendFailed(s.hostport, s.batch[0].msg, 0, err)
+		for _, e := range s.batch {
+			e.hostport = s.hostport
+			self.retry(e, err, retry)
+		}
+		return
+	}
+
+	acks := make(map[string]*protocol.MessageStoreAck, len(batchAck.GetAcks()))
+	for _, ack := range batchAck.GetAcks() {
+		acks[ack.GetMessageId()] = ack
+	}
+	for _, e := range s.batch {
+		e.hostport = s.hostport
+		ack, ok := acks[e.msg.GetHeader().GetMessageId()]
+		if !ok {
+			self.result(e, nil, ERROR_BATCH_ACK_MISSING)
+			continue
+		}
+		ack, err := storeAckOf(ack)
+		self.result(e, ack, err)
+	}
+}
+
+//retry为false时直接完成,否则换broker重试
+func (self *sendDispatcher) retry(s *asyncSend, err error, retry bool) {
+	manager := self.manager
+	if !retry {
+		s.finish(nil, manager.spoolOnFail(s.msg, err))
+		return
+	}
+
+	s.attempt++
+	s.lastErr = err
+	s.exclude[s.hostport] = true
+	s.resp = nil
+	now := time.Now()
+	interval := manager.retryPolicy.RetryInterval
+	if interval <= 0 {
+		self.resend(s, now)
+		return
+	}
+	s.retryAt = now.Add(interval)
+	self.watch(s)
+}
+
+func (self *sendDispatcher) resend(s *asyncSend, now time.Time) {
+	c, err := self.manager.selectKiteClientExclude(s.msg.GetHeader(), s.exclude)
+	if nil != err {
+		//没有可以重试的broker时返回最后一次的错误
+		s.finish(nil, self.manager.spoolOnFail(s.msg, s.lastErr))
+		return
+	}
+	s.c = c
+	s.write(now)
+	self.watch(s)
+}
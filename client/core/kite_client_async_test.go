@@ -0,0 +1,227 @@
+package core
+
+import (
+	"github.com/blackbeans/turbo/packet"
+	"github.com/golang/protobuf/proto"
+	"kiteq/protocol"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+//没有可用的broker时future和callback都应该返回错误
+func TestSendMessageAsyncNoClient(t *testing.T) {
+	manager := &KiteClientManager{
+		kiteClients: make(map[string][]*kiteClient, 1),
+		sendTimeout: DEFAULT_SEND_TIMEOUT,
+		maxInflight: make(chan byte, 1)}
+
+	called := make(chan error, 1)
+	msg := protocol.NewQMessage(buildStringMessage(true))
+	future := manager.SendMessageAsync(msg, 0, func(ack *protocol.MessageStoreAck, err error) {
+		called <- err
+	})
+
+	<-future.Done()
+	ack, err := future.Get()
+	if nil != ack || nil == err {
+		t.Fail()
+		t.Logf("TestSendMessageAsyncNoClient|Get|%v|%v\n", ack, err)
+	}
+
+	if cerr := <-called; cerr != err {
+		t.Fail()
+		t.Logf("TestSendMessageAsyncNoClient|Callback|%v\n", cerr)
+	}
+
+	if manager.Inflight() != 0 {
+		t.Fail()
+		t.Logf("TestSendMessageAsyncNoClient|Inflight|%d\n", manager.Inflight())
+	}
+}
+
+//测试用的broker连接,reply为nil时不响应
+type mockRemoting struct {
+	addr    string
+	reply   func(p packet.Packet) interface{}
+	packets []packet.Packet
+	lock    sync.Mutex
+}
+
+func (self *mockRemoting) RemoteAddr() string { return self.addr }
+func (self *mockRemoting) IsClosed() bool     { return false }
+
+func (self *mockRemoting) Write(p packet.Packet) (chan interface{}, error) {
+	self.lock.Lock()
+	self.packets = append(self.packets, p)
+	self.lock.Unlock()
+	ch := make(chan interface{}, 1)
+	if nil != self.reply {
+		ch <- self.reply(p)
+	}
+	return ch, nil
+}
+
+func (self *mockRemoting) WriteAndGet(p packet.Packet, timeout time.Duration) (interface{}, error) {
+	ch, _ := self.Write(p)
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-time.After(timeout):
+		return nil, TIMEOUT_ERROR
+	}
+}
+
+//写出的消息
+func (self *mockRemoting) sent() []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	ids := make([]string, 0, len(self.packets))
+	for _, p := range self.packets {
+		ids = append(ids, messageIdOf(p))
+	}
+	return ids
+}
+
+func messageIdOf(p packet.Packet) string {
+	var msg protocol.StringMessage
+	protocol.UnmarshalPbMessage(p.Data, &msg)
+	return msg.GetHeader().GetMessageId()
+}
+
+//写出的包的类型
+func (self *mockRemoting) cmds() []uint8 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	cmds := make([]uint8, 0, len(self.packets))
+	for _, p := range self.packets {
+		cmds = append(cmds, p.CmdType)
+	}
+	return cmds
+}
+
+//批量消息按照fail决定每条消息的存储结果
+func replyStoreAck(succ bool, feedback string) func(p packet.Packet) interface{} {
+	return replyBatchAck(func(messageId string) bool { return !succ }, feedback)
+}
+
+func replyBatchAck(fail func(messageId string) bool, feedback string) func(p packet.Packet) interface{} {
+	ack := func(messageId string) *protocol.MessageStoreAck {
+		return &protocol.MessageStoreAck{
+			MessageId: proto.String(messageId),
+			Status:    proto.Bool(!fail(messageId)),
+			Feedback:  proto.String(feedback)}
+	}
+	return func(p packet.Packet) interface{} {
+		if p.CmdType != protocol.CMD_BATCH_MESSAGE {
+			return ack(messageIdOf(p))
+		}
+		var batch protocol.BatchMessage
+		protocol.UnmarshalPbMessage(p.Data, &batch)
+		acks := make([]*protocol.MessageStoreAck, 0, len(batch.GetStringMessages()))
+		for _, m := range batch.GetStringMessages() {
+			acks = append(acks, ack(m.GetHeader().GetMessageId()))
+		}
+		return &protocol.BatchStoreAck{Acks: acks}
+	}
+}
+
+func mockManager(maxInflight int, remotes ...*mockRemoting) *KiteClientManager {
+	clients := make([]*kiteClient, 0, len(remotes))
+	for _, r := range remotes {
+		clients = append(clients, &kiteClient{remotec: r})
+	}
+	return &KiteClientManager{
+		kiteClients: map[string][]*kiteClient{"trade": clients},
+		closeChan:   make(chan bool, 1),
+		sendTimeout: DEFAULT_SEND_TIMEOUT,
+		maxInflight: make(chan byte, maxInflight),
+		retryPolicy: DEFAULT_RETRY_POLICY,
+		breakers:    make(map[string]*circuitBreaker, 2),
+		router:      &RandomRouter{}}
+}
+
+func TestSendMessageAsyncSucc(t *testing.T) {
+	manager := mockManager(10, &mockRemoting{addr: "localhost:13800", reply: replyStoreAck(true, "")})
+	defer close(manager.closeChan)
+
+	called := make(chan *protocol.MessageStoreAck, 1)
+	msg := protocol.NewQMessage(buildStringMessage(true))
+	future := manager.SendMessageAsync(msg, 0, func(ack *protocol.MessageStoreAck, err error) {
+		if nil != err {
+			t.Errorf("TestSendMessageAsyncSucc|Callback|%s\n", err)
+		}
+		called <- ack
+	})
+
+	ack, err := future.Get()
+	if nil != err || ack.GetMessageId() != msg.GetHeader().GetMessageId() {
+		t.Fatalf("TestSendMessageAsyncSucc|Get|%v|%v\n", ack, err)
+	}
+	if cack := <-called; cack != ack {
+		t.Fatalf("TestSendMessageAsyncSucc|Callback|%v\n", cack)
+	}
+	if manager.Inflight() != 0 {
+		t.Fatalf("TestSendMessageAsyncSucc|Inflight|%d\n", manager.Inflight())
+	}
+}
+
+//超过inflight上限直接失败,关闭时未完成的发送返回错误
+func TestSendMessageAsyncInflightLimit(t *testing.T) {
+	manager := mockManager(2, &mockRemoting{addr: "localhost:13800"})
+
+	futures := make([]*SendFuture, 0, 2)
+	for i := 0; i < 2; i++ {
+		futures = append(futures, manager.SendMessageAsync(protocol.NewQMessage(buildStringMessage(true)), time.Minute, nil))
+	}
+	_, err := manager.SendMessageAsync(protocol.NewQMessage(buildStringMessage(true)), time.Minute, nil).Get()
+	if err != ERROR_INFLIGHT_LIMIT || manager.Inflight() != 2 {
+		t.Fatalf("TestSendMessageAsyncInflightLimit|%v|%d\n", err, manager.Inflight())
+	}
+
+	close(manager.closeChan)
+	for _, f := range futures {
+		if _, err := f.Get(); err != ERROR_CLIENT_CLOSED {
+			t.Fatalf("TestSendMessageAsyncInflightLimit|Close|%v\n", err)
+		}
+	}
+	if manager.Inflight() != 0 {
+		t.Fatalf("TestSendMessageAsyncInflightLimit|Inflight|%d\n", manager.Inflight())
+	}
+}
+
+//未响应的发送按照各自的超时时间失败,且不为每个发送创建goroutine
+func TestSendMessageAsyncTimeout(t *testing.T) {
+	manager := mockManager(200, &mockRemoting{addr: "localhost:13800"})
+	defer close(manager.closeChan)
+	manager.sendDispatcher()
+	goroutines := runtime.NumGoroutine()
+
+	futures := make([]*SendFuture, 0, 100)
+	for i := 0; i < 100; i++ {
+		futures = append(futures, manager.SendMessageAsync(protocol.NewQMessage(buildStringMessage(true)), time.Second, nil))
+	}
+	short := manager.SendMessageAsync(protocol.NewQMessage(buildStringMessage(true)), 50*time.Millisecond, nil)
+	if n := runtime.NumGoroutine() - goroutines; n > 5 {
+		t.Fatalf("TestSendMessageAsyncTimeout|Goroutines|%d\n", n)
+	}
+
+	now := time.Now()
+	if _, err := short.Get(); err != TIMEOUT_ERROR || time.Since(now) > 500*time.Millisecond {
+		t.Fatalf("TestSendMessageAsyncTimeout|Short|%v|%s\n", err, time.Since(now))
+	}
+	select {
+	case <-futures[0].Done():
+		t.Fatal("TestSendMessageAsyncTimeout|timeout too early")
+	default:
+	}
+	for _, f := range futures {
+		if _, err := f.Get(); err != TIMEOUT_ERROR {
+			t.Fatalf("TestSendMessageAsyncTimeout|%v\n", err)
+		}
+	}
+	if manager.Inflight() != 0 {
+		t.Fatalf("TestSendMessageAsyncTimeout|Inflight|%d\n", manager.Inflight())
+	}
+}
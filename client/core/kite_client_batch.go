@@ -0,0 +1,189 @@
+package core
+
+import (
+	"errors"
+	log "github.com/blackbeans/log4go"
+	"kiteq/protocol"
+	"sync"
+	"time"
+)
+
+var ERROR_PRODUCER_CLOSED = errors.New("BATCH PRODUCER IS CLOSED !")
+
+//同一个topic和broker下攒批的消息
+type messageBatch struct {
+	key     string
+	c       *kiteClient
+	entries []*asyncSend
+}
+
+//攒批发送,按topic和broker缓存消息,达到maxBatchSize或者等待linger后以一个批量命令发往该broker
+//每条消息的结果通过各自的future或callback返回,失败的消息按照重试策略以单条发送重试
+//broker不支持批量发送时退化为逐条发送
+type BatchProducer struct {
+	manager      *KiteClientManager
+	maxBatchSize int
+	linger       time.Duration
+	timeout      time.Duration
+	batches      map[string] /*topic|broker*/ *messageBatch
+	lock         sync.Mutex
+	isClose      bool
+}
+
+//创建攒批发送的producer
+func (self *KiteClientManager) NewBatchProducer(maxBatchSize int, linger time.Duration) *BatchProducer {
+	if maxBatchSize <= 0 {
+		maxBatchSize = 1
+	}
+	return &BatchProducer{
+		manager:      self,
+		maxBatchSize: maxBatchSize,
+		linger:       linger,
+		timeout:      self.sendTimeout,
+		batches:      make(map[string]*messageBatch, 10)}
+}
+
+func (self *BatchProducer) SendStringMessage(msg *protocol.StringMessage, callback SendCallback) *SendFuture {
+	return self.Send(protocol.NewQMessage(msg), callback)
+}
+
+func (self *BatchProducer) SendBytesMessage(msg *protocol.BytesMessage, callback SendCallback) *SendFuture {
+	return self.Send(protocol.NewQMessage(msg), callback)
+}
+
+//加入批次,callback可以为nil,在异步发送的分发goroutine中回调
+//未完成的消息达到inflight上限时直接失败,不阻塞调用方
+func (self *BatchProducer) Send(msg *protocol.QMessage, callback SendCallback) *SendFuture {
+	future := newSendFuture()
+
+	self.lock.Lock()
+	if self.isClose {
+		self.lock.Unlock()
+		future.complete(nil, ERROR_PRODUCER_CLOSED, callback)
+		return future
+	}
+	if self.manager.isClosing() {
+		self.lock.Unlock()
+		future.complete(nil, ERROR_CLIENT_CLOSED, callback)
+		return future
+	}
+
+	//加入批次时就选定broker
+	c, err := self.manager.selectKiteClient(msg.GetHeader())
+	if nil != err {
+		self.lock.Unlock()
+		future.complete(nil, self.manager.spoolOnFail(msg, err), callback)
+		return future
+	}
+
+	select {
+	case self.manager.maxInflight <- 1:
+	default:
+		self.lock.Unlock()
+		log.Warn("BatchProducer|Send|INFLIGHT LIMIT|%d|%s\n", cap(self.manager.maxInflight), msg.GetHeader().GetMessageId())
+		future.complete(nil, ERROR_INFLIGHT_LIMIT, callback)
+		return future
+	}
+
+	key := msg.GetHeader().GetTopic() + "|" + c.remotec.RemoteAddr()
+	b, ok := self.batches[key]
+	if !ok {
+		b = &messageBatch{key: key, c: c, entries: make([]*asyncSend, 0, self.maxBatchSize)}
+		self.batches[key] = b
+		//第一条消息加入时开始计时
+		if self.linger > 0 {
+			time.AfterFunc(self.linger, func() {
+				self.flushBatch(b)
+			})
+		}
+	}
+	b.entries = append(b.entries, &asyncSend{
+		msg:      msg,
+		cmd:      msg.GetMsgType(),
+		c:        c,
+		exclude:  make(map[string]bool, 2),
+		timeout:  self.timeout,
+		inflight: self.manager.maxInflight,
+		future:   future,
+		callback: callback})
+
+	var full *messageBatch
+	if len(b.entries) >= self.maxBatchSize || self.linger <= 0 {
+		delete(self.batches, key)
+		full = b
+	}
+	self.lock.Unlock()
+
+	if nil != full {
+		self.dispatch(full)
+	}
+	return future
+}
+
+//linger到期,批次还未被发送则发送
+func (self *BatchProducer) flushBatch(b *messageBatch) {
+	self.lock.Lock()
+	if self.batches[b.key] != b {
+		self.lock.Unlock()
+		return
+	}
+	delete(self.batches, b.key)
+	self.lock.Unlock()
+	self.dispatch(b)
+}
+
+//立即发送所有批次
+func (self *BatchProducer) Flush() {
+	self.lock.Lock()
+	batches := self.batches
+	self.batches = make(map[string]*messageBatch, 10)
+	self.lock.Unlock()
+
+	for _, b := range batches {
+		self.dispatch(b)
+	}
+}
+
+//发送剩余的消息,之后的发送直接失败
+func (self *BatchProducer) Close() {
+	self.lock.Lock()
+	self.isClose = true
+	self.lock.Unlock()
+	self.Flush()
+}
+
+//整个批次以一个批量命令发往同一个broker,broker不支持时逐条发送
+func (self *BatchProducer) dispatch(b *messageBatch) {
+	dispatcher := self.manager.sendDispatcher()
+	if len(b.entries) == 1 || !b.c.batch {
+		for _, e := range b.entries {
+			dispatcher.submit(e)
+		}
+		return
+	}
+
+	batch := &protocol.BatchMessage{}
+	for _, e := range b.entries {
+		switch m := e.msg.GetPbMessage().(type) {
+		case *protocol.BytesMessage:
+			batch.BytesMessages = append(batch.BytesMessages, m)
+		case *protocol.StringMessage:
+			batch.StringMessages = append(batch.StringMessages, m)
+		}
+	}
+	data, err := protocol.MarshalPbMessage(batch)
+	if nil != err {
+		log.Error("BatchProducer|dispatch|MARSHAL|FAIL|%s|%s|%d\n", err, b.key, len(b.entries))
+		for _, e := range b.entries {
+			e.finish(nil, err)
+		}
+		return
+	}
+
+	dispatcher.submit(&asyncSend{
+		cmd:     protocol.CMD_BATCH_MESSAGE,
+		data:    data,
+		batch:   b.entries,
+		c:       b.c,
+		timeout: self.timeout})
+}
@@ -0,0 +1,150 @@
+package core
+
+import (
+	"kiteq/protocol"
+	"testing"
+	"time"
+)
+
+func waitFutures(t *testing.T, fs []*SendFuture, timeout time.Duration) {
+	for _, f := range fs {
+		select {
+		case <-f.Done():
+		case <-time.After(timeout):
+			t.Fatal("waitFutures|timeout")
+		}
+	}
+}
+
+func TestBatchProducerFlush(t *testing.T) {
+	broker := &mockRemoting{addr: "localhost:13800", reply: replyStoreAck(true, "")}
+	manager := mockManager(10, broker)
+	manager.kiteClients["trade"][0].batch = true
+	defer close(manager.closeChan)
+
+	producer := manager.NewBatchProducer(3, 100*time.Millisecond)
+	results := make(chan error, 10)
+	callback := func(ack *protocol.MessageStoreAck, err error) {
+		results <- err
+	}
+
+	//未达到批次大小,等待linger
+	f1 := producer.SendStringMessage(buildStringMessage(true), callback)
+	f2 := producer.SendStringMessage(buildStringMessage(true), callback)
+	select {
+	case <-f1.Done():
+		t.Fatal("TestBatchProducerFlush|flushed before linger")
+	default:
+	}
+
+	//linger到期后以一个批量命令发送,每条消息都单独返回结果
+	waitFutures(t, []*SendFuture{f1, f2}, time.Second)
+	for _, f := range []*SendFuture{f1, f2} {
+		if ack, err := f.Get(); nil != err || !ack.GetStatus() {
+			t.Fatalf("TestBatchProducerFlush|linger|%v|%v\n", ack, err)
+		}
+	}
+	if ack, _ := f1.Get(); ack.GetMessageId() == "" {
+		t.Fatal("TestBatchProducerFlush|ack not matched")
+	}
+
+	//达到批次大小立即发送
+	fs := make([]*SendFuture, 0, 3)
+	for i := 0; i < 3; i++ {
+		fs = append(fs, producer.SendStringMessage(buildStringMessage(true), callback))
+	}
+	waitFutures(t, fs, 50*time.Millisecond)
+
+	cmds := broker.cmds()
+	if len(cmds) != 2 || cmds[0] != protocol.CMD_BATCH_MESSAGE || cmds[1] != protocol.CMD_BATCH_MESSAGE {
+		t.Fatalf("TestBatchProducerFlush|packets|%v\n", cmds)
+	}
+	if len(results) != 5 || manager.Inflight() != 0 {
+		t.Fatalf("TestBatchProducerFlush|callback|%d|%d\n", len(results), manager.Inflight())
+	}
+
+	producer.Close()
+	_, err := producer.SendStringMessage(buildStringMessage(true), nil).Get()
+	if err != ERROR_PRODUCER_CLOSED {
+		t.Fatalf("TestBatchProducerFlush|Close|%v\n", err)
+	}
+}
+
+//broker不支持批量发送时逐条发送
+func TestBatchProducerFallback(t *testing.T) {
+	broker := &mockRemoting{addr: "localhost:13800", reply: replyStoreAck(true, "")}
+	manager := mockManager(10, broker)
+	defer close(manager.closeChan)
+
+	producer := manager.NewBatchProducer(3, time.Minute)
+	fs := make([]*SendFuture, 0, 3)
+	for i := 0; i < 3; i++ {
+		fs = append(fs, producer.SendStringMessage(buildStringMessage(true), nil))
+	}
+	waitFutures(t, fs, time.Second)
+	for _, f := range fs {
+		if _, err := f.Get(); nil != err {
+			t.Fatalf("TestBatchProducerFallback|%s\n", err)
+		}
+	}
+	cmds := broker.cmds()
+	if len(cmds) != 3 || cmds[0] != protocol.CMD_STRING_MESSAGE {
+		t.Fatalf("TestBatchProducerFallback|packets|%v\n", cmds)
+	}
+}
+
+//批次中部分消息存储失败只影响该消息
+func TestBatchProducerPartialFail(t *testing.T) {
+	msgs := []*protocol.StringMessage{buildStringMessage(true), buildStringMessage(true), buildStringMessage(true)}
+	failId := msgs[1].GetHeader().GetMessageId()
+	broker := &mockRemoting{addr: "localhost:13800", reply: replyBatchAck(func(messageId string) bool {
+		return messageId == failId
+	}, "")}
+	manager := mockManager(10, broker)
+	manager.kiteClients["trade"][0].batch = true
+	defer close(manager.closeChan)
+
+	producer := manager.NewBatchProducer(3, time.Minute)
+	fs := make([]*SendFuture, 0, 3)
+	for _, m := range msgs {
+		fs = append(fs, producer.SendStringMessage(m, nil))
+	}
+	waitFutures(t, fs, time.Second)
+	for i, f := range fs {
+		if _, err := f.Get(); (nil != err) != (i == 1) {
+			t.Fatalf("TestBatchProducerPartialFail|%d|%v\n", i, err)
+		}
+	}
+}
+
+//达到inflight上限时直接失败而不阻塞调用方
+func TestBatchProducerInflightLimit(t *testing.T) {
+	manager := mockManager(2, &mockRemoting{addr: "localhost:13800", reply: replyStoreAck(true, "")})
+	manager.kiteClients["trade"][0].batch = true
+	defer close(manager.closeChan)
+
+	producer := manager.NewBatchProducer(10, time.Minute)
+	fs := []*SendFuture{
+		producer.SendStringMessage(buildStringMessage(true), nil),
+		producer.SendStringMessage(buildStringMessage(true), nil)}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := producer.SendStringMessage(buildStringMessage(true), nil).Get()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != ERROR_INFLIGHT_LIMIT {
+			t.Fatalf("TestBatchProducerInflightLimit|%v\n", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("TestBatchProducerInflightLimit|Send blocked")
+	}
+
+	producer.Close()
+	waitFutures(t, fs, time.Second)
+	if manager.Inflight() != 0 {
+		t.Fatalf("TestBatchProducerInflightLimit|Inflight|%d\n", manager.Inflight())
+	}
+}
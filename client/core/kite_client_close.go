@@ -0,0 +1,144 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/blackbeans/log4go"
+	"kiteq/binding"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var ERROR_CLIENT_CLOSED = errors.New("KITE CLIENT IS CLOSED !")
+
+var instanceSeq int32
+
+//hostname:pid:序号,同一进程内的多个客户端也互不相同
+func newInstanceId() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d:%d", hostname, os.Getpid(), atomic.AddInt32(&instanceSeq, 1))
+}
+
+//是否已经开始关闭
+func (self *KiteClientManager) isClosing() bool {
+	return atomic.LoadInt32(&self.closing) == 1
+}
+
+//优雅关闭:
+//1.不再接收新的推送,新到的消息直接NACK由服务端重投
+//2.删除本实例的publisher,分组的最后一个实例删除非持久的订阅关系
+//3.等待处理中的消息、事务消息的txack以及异步发送完成
+//4.关闭连接和注册中心
+//ctx超时后不再等待直接关闭,返回ctx.Err()
+func (self *KiteClientManager) Close(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&self.closing, 0, 1) {
+		return nil
+	}
+
+	self.acceptHandler.Stop()
+	self.unregister()
+
+	err := self.waitInflight(ctx)
+	if nil != err {
+		log.Warn("KiteClientManager|Close|WAIT INFLIGHT|%s|accept:%d|tx:%d|async:%d\n", err,
+			self.acceptHandler.Inflight(), atomic.LoadInt32(&self.txInflight), len(self.maxInflight))
+	}
+
+	close(self.closeChan)
+	if nil != self.executor {
+		if nil == err {
+			self.executor.Close()
+		} else {
+			//超时时不再等待队列中的消息
+			go self.executor.Close()
+		}
+	}
+	self.clientManager.Shutdown()
+	if nil != self.registry {
+		self.registry.Close()
+	}
+	if nil != self.txJournal {
+		self.txJournal.Close()
+	}
+	if nil != self.spool {
+		self.spool.Close()
+	}
+	log.Info("KiteClientManager|Close|SUCC|%s\n", self.ga.GroupId)
+	return err
+}
+
+//删除本实例的publisher;订阅关系为分组共享,
+//只有分组没有其他存活的实例时才删除非持久的订阅
+func (self *KiteClientManager) unregister() {
+	if nil == self.registry {
+		return
+	}
+
+	self.subLock.Lock()
+	defer self.subLock.Unlock()
+
+	hostname, _ := os.Hostname()
+	err := self.registry.UnpublishTopics(self.pubTopics, self.ga.GroupId, hostname)
+	if nil != err {
+		log.Error("KiteClientManager|Close|UnpublishTopics|FAIL|%s|%s\n", err, self.pubTopics)
+	}
+
+	err = self.registry.UnpublishSubscriber(self.ga.GroupId, self.instance)
+	if nil != err {
+		log.Error("KiteClientManager|Close|UnpublishSubscriber|FAIL|%s|%s\n", err, self.instance)
+	}
+	instances, err := self.registry.GetSubscribers(self.ga.GroupId)
+	if nil != err {
+		//无法确认时保留订阅关系
+		log.Error("KiteClientManager|Close|GetSubscribers|FAIL|%s|%s\n", err, self.ga.GroupId)
+		return
+	}
+	if len(instances) > 0 {
+		log.Info("KiteClientManager|Close|KEEP BINDINGS|%s|%s\n", self.ga.GroupId, instances)
+		return
+	}
+
+	topics := make(map[string][]*binding.Binding, len(self.binds))
+	for _, b := range self.binds {
+		if _, ok := topics[b.Topic]; !ok {
+			topics[b.Topic] = make([]*binding.Binding, 0, 2)
+		}
+		if b.Persistent {
+			topics[b.Topic] = append(topics[b.Topic], b)
+		}
+	}
+
+	for topic, persistent := range topics {
+		if len(persistent) == len(topicBinds(self.binds, topic)) {
+			continue
+		}
+		if len(persistent) > 0 {
+			err = self.registry.PublishBindings(self.ga.GroupId, persistent)
+		} else {
+			err = self.registry.UnpublishBindings(self.ga.GroupId, []string{topic})
+		}
+		if nil != err {
+			log.Error("KiteClientManager|Close|Unsubscribe|FAIL|%s|%s\n", err, topic)
+		}
+	}
+}
+
+//等待处理中的消息、txack以及异步发送完成
+func (self *KiteClientManager) waitInflight(ctx context.Context) error {
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+	for {
+		if self.acceptHandler.Inflight() <= 0 &&
+			atomic.LoadInt32(&self.txInflight) <= 0 &&
+			len(self.maxInflight) <= 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package core
+
+import (
+	"context"
+	"kiteq/binding"
+	"kiteq/client/listener"
+	"kiteq/protocol"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClose(t *testing.T) {
+	uri := "mem://TestClose"
+	manager := NewKiteClientManager(uri, "s-trade-a", "123456", &listener.MockListener{})
+	manager.registry = binding.NewRegistry(uri, manager)
+	manager.SetBindings([]*binding.Binding{
+		binding.Bind_Direct("", "trade", "pay-succ", 1000, true),
+		binding.Bind_Direct("", "trade", "pay-fail", 1000, false),
+		binding.Bind_Direct("", "feed", "feed-add", 1000, false)})
+	manager.registry.PublishBindings("s-trade-a", manager.binds)
+
+	observer := binding.NewRegistry(uri, NewKiteClientManager(uri, "s-trade-b", "123456", &listener.MockListener{}))
+	defer observer.Close()
+
+	//未完成的事务消息超时
+	atomic.AddInt32(&manager.txInflight, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := manager.Close(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fail()
+		t.Logf("TestClose|waitInflight|%s\n", err)
+	}
+
+	//只保留持久订阅
+	binds, _ := observer.GetBindAndWatch("trade")
+	if len(binds["s-trade-a"]) != 1 || binds["s-trade-a"][0].MessageType != "pay-succ" {
+		t.Fail()
+		t.Logf("TestClose|trade|%v\n", binds)
+	}
+	binds, _ = observer.GetBindAndWatch("feed")
+	if _, ok := binds["s-trade-a"]; ok {
+		t.Fail()
+		t.Logf("TestClose|feed|%v\n", binds)
+	}
+
+	msg := protocol.NewQMessage(buildStringMessage(true))
+	if manager.SendMessage(msg) != ERROR_CLIENT_CLOSED {
+		t.Fail()
+		t.Log("TestClose|SendMessage|NOT CLOSED")
+	}
+	if nil != manager.Close(context.Background()) {
+		t.Fail()
+		t.Log("TestClose|Close twice")
+	}
+}
+
+//分组还有其他实例时保留非持久的订阅,Close和Destory可以重复调用
+func TestCloseSharedGroup(t *testing.T) {
+	uri := "mem://TestCloseSharedGroup"
+	binds := []*binding.Binding{
+		binding.Bind_Direct("", "trade", "pay-succ", 1000, true),
+		binding.Bind_Direct("", "trade", "pay-fail", 1000, false)}
+
+	managers := make([]*KiteClientManager, 0, 2)
+	for i := 0; i < 2; i++ {
+		manager := NewKiteClientManager(uri, "s-trade-a", "123456", &listener.MockListener{})
+		manager.registry = binding.NewRegistry(uri, manager)
+		manager.SetBindings(binds)
+		manager.registry.PublishBindings("s-trade-a", manager.binds)
+		manager.registry.PublishSubscriber("s-trade-a", manager.instance)
+		managers = append(managers, manager)
+	}
+
+	observer := binding.NewRegistry(uri, NewKiteClientManager(uri, "s-trade-b", "123456", &listener.MockListener{}))
+	defer observer.Close()
+
+	managers[0].Close(context.Background())
+	managers[0].Destory()
+	group, _ := observer.GetBindAndWatch("trade")
+	if len(group["s-trade-a"]) != 2 {
+		t.Fatalf("TestCloseSharedGroup|first|%v\n", group)
+	}
+
+	managers[1].Destory()
+	managers[1].Close(context.Background())
+	group, _ = observer.GetBindAndWatch("trade")
+	if len(group["s-trade-a"]) != 1 || group["s-trade-a"][0].MessageType != "pay-succ" {
+		t.Fatalf("TestCloseSharedGroup|last|%v\n", group)
+	}
+}
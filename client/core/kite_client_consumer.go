@@ -0,0 +1,31 @@
+package core
+
+import (
+	log "github.com/blackbeans/log4go"
+	"kiteq/client/chandler"
+)
+
+//开启消费线程池,需要在Start之前设置
+//每个topic独立workers个消费线程和长度为queueSize的队列,队列满时NACK由服务端稍后重投
+func (self *KiteClientManager) SetConsumerWorkers(workers, queueSize int) {
+	self.executor = chandler.NewConsumerExecutor(workers, queueSize)
+	self.acceptHandler.SetExecutor(self.executor)
+	log.Info("KiteClientManager|SetConsumerWorkers|SUCC|%d|%d\n", workers, queueSize)
+}
+
+//单独设置某个topic的消费线程数和队列长度,需要先调用SetConsumerWorkers
+func (self *KiteClientManager) SetTopicConsumerWorkers(topic string, workers, queueSize int) {
+	if nil == self.executor {
+		log.Warn("KiteClientManager|SetTopicConsumerWorkers|NO EXECUTOR|%s\n", topic)
+		return
+	}
+	self.executor.SetTopicWorkers(topic, workers, queueSize)
+}
+
+//各个topic消费队列中等待处理的消息数量
+func (self *KiteClientManager) ConsumerQueueDepth() map[string]int {
+	if nil == self.executor {
+		return map[string]int{}
+	}
+	return self.executor.QueueDepth()
+}
@@ -11,6 +11,12 @@ import (
 
 //握手包
 func handshake(ga *c.GroupAuth, remoteClient *c.RemotingClient) (bool, error) {
+	_, err := handshakeAck(ga, remoteClient)
+	return nil == err, err
+}
+
+//握手并返回服务端的确认,其中包含服务端支持的能力
+func handshakeAck(ga *c.GroupAuth, remoteClient *c.RemotingClient) (*protocol.ConnAuthAck, error) {
 
 	for i := 0; i < 3; i++ {
 		p := protocol.MarshalConnMeta(ga.GroupId, ga.SecretKey)
@@ -23,18 +29,18 @@ func handshake(ga *c.GroupAuth, remoteClient *c.RemotingClient) (bool, error) {
 		} else {
 			authAck, ok := resp.(*protocol.ConnAuthAck)
 			if !ok {
-				return false, errors.New("Unmatches Handshake Ack Type! ")
+				return nil, errors.New("Unmatches Handshake Ack Type! ")
 			} else {
 				if authAck.GetStatus() {
-					log.Info("kiteClient|handShake|SUCC|%s|%s\n", ga.GroupId, authAck.GetFeedback())
-					return true, nil
+					log.Info("kiteClient|handShake|SUCC|%s|%s|batch:%t\n", ga.GroupId, authAck.GetFeedback(), authAck.GetBatch())
+					return authAck, nil
 				} else {
 					log.Warn("kiteClient|handShake|FAIL|%s|%s\n", ga.GroupId, authAck.GetFeedback())
-					return false, errors.New("Auth FAIL![" + authAck.GetFeedback() + "]")
+					return authAck, errors.New("Auth FAIL![" + authAck.GetFeedback() + "]")
 				}
 			}
 		}
 	}
 
-	return false, errors.New("handshake fail! [" + remoteClient.RemoteAddr() + "]")
+	return nil, errors.New("handshake fail! [" + remoteClient.RemoteAddr() + "]")
 }
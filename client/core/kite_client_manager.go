@@ -1,7 +1,7 @@
 package core
 
 import (
-	"errors"
+	"context"
 	log "github.com/blackbeans/log4go"
 	"github.com/blackbeans/turbo"
 	c "github.com/blackbeans/turbo/client"
@@ -14,8 +14,9 @@ import (
 	"math/rand"
 	"net"
 	"os"
-
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,21 +25,49 @@ type DoTranscation func(message *protocol.QMessage) (bool, error)
 
 const MAX_CLIENT_CONN = 10
 
+const (
+	DEFAULT_SEND_TIMEOUT = 3 * time.Second //默认的发送超时时间
+	DEFAULT_MAX_INFLIGHT = 1000            //默认异步发送的最大未完成数
+)
+
+//固定broker列表时重连未连接broker的周期
+const STATIC_RESYNC_PERIOD = 10 * time.Second
+
 type KiteClientManager struct {
 	ga            *c.GroupAuth
-	zkAddr        string
-	topics        []string
+	instance      string             //本实例在分组中的唯一标识
+	registryUri   string             //注册中心地址 zk://、etcd://、file://、mem://
+	topics        []string           //需要连接broker的topic
+	pubTopics     []string           //可以发送的topic
 	binds         []*binding.Binding //订阅的关系
+	subLock       sync.Mutex         //运行时订阅关系变更串行执行
 	clientManager *c.ClientManager
 	kiteClients   map[string] /*topic*/ []*kiteClient //topic对应的kiteclient
-	zkManager     *binding.ZKManager
+	registry      binding.IRegistry
 	pipeline      *pipe.DefaultPipeline
 	lock          sync.RWMutex
 	rc            *turbo.RemotingConfig
 	flowstat      *stat.FlowStat
+	closeChan     chan bool
+	sendTimeout   time.Duration //发送等待服务端确认的超时时间
+	maxInflight   chan byte     //异步发送未完成的消息
+	dispatcher    *sendDispatcher
+	dispatchOnce  sync.Once
+	retryPolicy   RetryPolicy
+	breakers      map[string] /*hostport*/ *circuitBreaker
+	breakerLock   sync.Mutex
+	listener      listener.IListener
+	acceptHandler *chandler.AcceptHandler
+	txJournal     *TxJournal //本地事务日志,可选
+	router        IRouter    //broker的路由策略
+	latency       *LatencyStat
+	executor      *chandler.ConsumerExecutor //消费线程池,可选
+	spool         *Spool                     //发送失败消息的本地spool,可选
+	closing       int32                      //1:正在关闭
+	txInflight    int32                      //未完成的事务消息
 }
 
-func NewKiteClientManager(zkAddr, groupId, secretKey string, listen listener.IListener) *KiteClientManager {
+func NewKiteClientManager(registryUri, groupId, secretKey string, listen listener.IListener) *KiteClientManager {
 
 	flowstat := stat.NewFlowStat("kiteclient-" + groupId)
 	rc := turbo.NewRemotingConfig(
@@ -54,19 +83,33 @@ func NewKiteClientManager(zkAddr, groupId, secretKey string, listen listener.ILi
 	pipeline := pipe.NewDefaultPipeline()
 	clientm := c.NewClientManager(reconnManager)
 	pipeline.RegisteHandler("kiteclient-packet", chandler.NewPacketHandler("kiteclient-packet"))
-	pipeline.RegisteHandler("kiteclient-heartbeat", chandler.NewHeartbeatHandler("kiteclient-heartbeat", 10*time.Second, 5*time.Second, clientm))
-	pipeline.RegisteHandler("kiteclient-accept", chandler.NewAcceptHandler("kiteclient-accept", listen))
+	latency := NewLatencyStat()
+	heartbeat := chandler.NewHeartbeatHandler("kiteclient-heartbeat", 10*time.Second, 5*time.Second, clientm)
+	heartbeat.SetRTTListener(latency.Update)
+	pipeline.RegisteHandler("kiteclient-heartbeat", heartbeat)
+	acceptHandler := chandler.NewAcceptHandler("kiteclient-accept", listen)
+	pipeline.RegisteHandler("kiteclient-accept", acceptHandler)
 	pipeline.RegisteHandler("kiteclient-remoting", pipe.NewRemotingHandler("kiteclient-remoting", clientm))
 
 	manager := &KiteClientManager{
 		ga:            c.NewGroupAuth(groupId, secretKey),
+		instance:      newInstanceId(),
 		kiteClients:   make(map[string][]*kiteClient, 10),
 		topics:        make([]string, 0, 10),
 		pipeline:      pipeline,
 		clientManager: clientm,
 		rc:            rc,
 		flowstat:      flowstat,
-		zkAddr:        zkAddr}
+		registryUri:   registryUri,
+		closeChan:     make(chan bool, 1),
+		sendTimeout:   DEFAULT_SEND_TIMEOUT,
+		maxInflight:   make(chan byte, DEFAULT_MAX_INFLIGHT),
+		retryPolicy:   DEFAULT_RETRY_POLICY,
+		breakers:      make(map[string]*circuitBreaker, 10),
+		listener:      listen,
+		acceptHandler: acceptHandler,
+		router:        &RandomRouter{},
+		latency:       latency}
 	//开启流量统计
 	manager.remointflow()
 	manager.flowstat.Start()
@@ -86,30 +129,37 @@ func (self *KiteClientManager) remointflow() {
 //启动
 func (self *KiteClientManager) Start() {
 
-	self.zkManager = binding.NewZKManager(self.zkAddr, self)
+	//session过期重新推送时复用已有的注册中心
+	if nil == self.registry {
+		self.registry = binding.NewRegistry(self.registryUri, self)
+		//定期全量同步QServer列表
+		if self.isStatic() {
+			self.startResync(STATIC_RESYNC_PERIOD)
+		} else {
+			self.startResync(binding.RESYNC_PERIOD)
+		}
+	}
 
 	hostname, _ := os.Hostname()
 	//推送本机到
-	err := self.zkManager.PublishTopics(self.topics, self.ga.GroupId, hostname)
+	err := self.registry.PublishTopics(self.pubTopics, self.ga.GroupId, hostname)
 	if nil != err {
-		log.Crashf("KiteClientManager|PublishTopics|FAIL|%s|%s\n", err, self.topics)
+		log.Crashf("KiteClientManager|PublishTopics|FAIL|%s|%s\n", err, self.pubTopics)
 	} else {
-		log.Info("KiteClientManager|PublishTopics|SUCC|%s\n", self.topics)
+		log.Info("KiteClientManager|PublishTopics|SUCC|%s\n", self.pubTopics)
 	}
 
-outter:
+	self.lock.Lock()
 	for _, b := range self.binds {
-		for _, t := range self.topics {
-			if t == b.Topic {
-				continue outter
-			}
+		if !containsTopic(self.topics, b.Topic) {
+			self.topics = append(self.topics, b.Topic)
 		}
-		self.topics = append(self.topics, b.Topic)
 	}
+	self.lock.Unlock()
 
-	for _, topic := range self.topics {
+	for _, topic := range self.currentTopics() {
 
-		hosts, err := self.zkManager.GetQServerAndWatch(topic)
+		hosts, err := self.registry.GetQServerAndWatch(topic)
 		if nil != err {
 			log.Crashf("KiteClientManager|GetQServerAndWatch|FAIL|%s|%s\n", err, topic)
 		} else {
@@ -119,12 +169,28 @@ outter:
 	}
 
 	if len(self.kiteClients) <= 0 {
-		log.Crashf("KiteClientManager|Start|NO VALID KITESERVER|%s\n", self.topics)
+		if self.isStatic() {
+			//固定broker列表时等待broker恢复后重连
+			log.Error("KiteClientManager|Start|NO VALID KITESERVER|%s\n", self.topics)
+		} else {
+			log.Crashf("KiteClientManager|Start|NO VALID KITESERVER|%s\n", self.topics)
+		}
+	}
+
+	//补发崩溃前未完成的事务
+	if nil != self.txJournal {
+		go self.recoverTx()
+	}
+
+	//注册本实例,关闭时判断是否为分组的最后一个实例
+	err = self.registry.PublishSubscriber(self.ga.GroupId, self.instance)
+	if nil != err {
+		log.Error("KiteClientManager|PublishSubscriber|FAIL|%s|%s\n", err, self.instance)
 	}
 
 	if len(self.binds) > 0 {
 		//订阅关系推送，并拉取QServer
-		err = self.zkManager.PublishBindings(self.ga.GroupId, self.binds)
+		err = self.registry.PublishBindings(self.ga.GroupId, self.binds)
 		if nil != err {
 			log.Crashf("KiteClientManager|PublishBindings|FAIL|%s|%s\n", err, self.binds)
 		}
@@ -132,6 +198,11 @@ outter:
 
 }
 
+//是否为固定broker列表模式
+func (self *KiteClientManager) isStatic() bool {
+	return strings.HasPrefix(self.registryUri, binding.SCHEMA_STATIC)
+}
+
 //创建物理连接
 func dial(hostport string) (*net.TCPConn, error) {
 	//连接
@@ -151,6 +222,7 @@ func dial(hostport string) (*net.TCPConn, error) {
 
 func (self *KiteClientManager) SetPublishTopics(topics []string) {
 	self.topics = append(self.topics, topics...)
+	self.pubTopics = append(self.pubTopics, topics...)
 }
 
 func (self *KiteClientManager) SetBindings(bindings []*binding.Binding) {
@@ -163,17 +235,44 @@ func (self *KiteClientManager) SetBindings(bindings []*binding.Binding) {
 
 //发送事务消息
 func (self *KiteClientManager) SendTxMessage(msg *protocol.QMessage, doTranscation DoTranscation) (err error) {
+	return self.SendTxMessageContext(context.Background(), msg, doTranscation)
+}
+
+//发送事务消息,ctx用于控制消息发送的超时和取消
+//本地事务执行后无论ctx是否已经取消都会发送txack,避免服务端回查
+func (self *KiteClientManager) SendTxMessageContext(ctx context.Context, msg *protocol.QMessage, doTranscation DoTranscation) (err error) {
+	//关闭时等待txack发送完成
+	atomic.AddInt32(&self.txInflight, 1)
+	defer atomic.AddInt32(&self.txInflight, -1)
+	if self.isClosing() {
+		return ERROR_CLIENT_CLOSED
+	}
+
 	//路由选择策略
 	c, err := self.selectKiteClient(msg.GetHeader())
 	if nil != err {
 		return err
 	}
 
+	//发送前记录到本地事务日志
+	if nil != self.txJournal {
+		err = self.txJournal.Pending(msg.GetHeader())
+		if nil != err {
+			return err
+		}
+	}
+
 	//先发送消息
-	err = c.sendMessage(msg)
+	c, _, err = self.sendWithRetry(ctx, c, msg, self.sendTimeout)
 	if nil != err {
+		if nil != self.txJournal {
+			self.txJournal.Resolve(msg.GetHeader().GetMessageId(), protocol.TX_ROLLBACK, err.Error())
+		}
 		return err
 	}
+	if nil != self.txJournal {
+		self.txJournal.Stored(msg.GetHeader().GetMessageId(), c.remotec.RemoteAddr())
+	}
 
 	//执行本地事务返回succ为成功则提交、其余条件包括错误、失败都属于回滚
 	feedback := ""
@@ -189,22 +288,55 @@ func (self *KiteClientManager) SendTxMessage(msg *protocol.QMessage, doTranscati
 			feedback = err.Error()
 		}
 	}
+	if nil != self.txJournal {
+		self.txJournal.Resolve(msg.GetHeader().GetMessageId(), txstatus, feedback)
+	}
+
 	//发送txack到服务端
-	c.sendTxAck(msg, txstatus, feedback)
+	ackErr := c.sendTxAck(msg.GetHeader(), txstatus, feedback)
+	if nil == ackErr && nil != self.txJournal {
+		self.txJournal.Acked(msg.GetHeader().GetMessageId())
+	}
 	return err
 }
 
 //发送消息
 func (self *KiteClientManager) SendMessage(msg *protocol.QMessage) error {
+	return self.SendMessageContext(context.Background(), msg)
+}
+
+//发送消息,ctx的deadline小于发送超时时间时以deadline为准
+//开启spool时发送失败的消息写入本地文件并返回nil,broker恢复后重放;
+//topic在spool中还有等待重放的消息时新的消息同样写入spool,保证发送顺序
+func (self *KiteClientManager) SendMessageContext(ctx context.Context, msg *protocol.QMessage) error {
+	if self.isClosing() {
+		return ERROR_CLIENT_CLOSED
+	}
+	if spooled, err := self.spoolIfPending(msg); spooled {
+		return err
+	}
 	c, err := self.selectKiteClient(msg.GetHeader())
 	if nil != err {
-		return err
+		return self.spoolOnFail(msg, err)
 	}
-	return c.sendMessage(msg)
+	_, _, err = self.sendWithRetry(ctx, c, msg, self.sendTimeout)
+	return self.spoolOnFail(msg, err)
 }
 
 //kiteclient路由选择策略
 func (self *KiteClientManager) selectKiteClient(header *protocol.Header) (*kiteClient, error) {
+	return self.selectKiteClientExclude(header, nil)
+}
+
+//topic下没有可用的broker
+type noClientError string
+
+func (self noClientError) Error() string {
+	return string(self)
+}
+
+//排除掉已经失败过的broker进行选择
+func (self *KiteClientManager) selectKiteClientExclude(header *protocol.Header, exclude map[string]bool) (*kiteClient, error) {
 
 	self.lock.RLock()
 	defer self.lock.RUnlock()
@@ -212,13 +344,46 @@ func (self *KiteClientManager) selectKiteClient(header *protocol.Header) (*kiteC
 	clients, ok := self.kiteClients[header.GetTopic()]
 	if !ok || len(clients) <= 0 {
 		// 	log.Warn("KiteClientManager|selectKiteClient|FAIL|NO Remote Client|%s\n", header.GetTopic())
-		return nil, errors.New("NO KITE CLIENT ! [" + header.GetTopic() + "]")
+		return nil, noClientError("NO KITE CLIENT ! [" + header.GetTopic() + "]")
+	}
+
+	//连接已经断开或者已经失败过的broker不参与选择
+	now := time.Now()
+	alive := make(map[string]*kiteClient, len(clients))
+	aliveHosts := make([]string, 0, len(clients))
+	available := make([]string, 0, len(clients))
+	for _, kc := range clients {
+		hostport := kc.remotec.RemoteAddr()
+		if kc.remotec.IsClosed() || exclude[hostport] {
+			continue
+		}
+		alive[hostport] = kc
+		aliveHosts = append(aliveHosts, hostport)
+		if self.breaker(hostport).allow(now) {
+			available = append(available, hostport)
+		}
+	}
+	if len(alive) <= 0 {
+		return nil, noClientError("NO ALIVE KITE CLIENT ! [" + header.GetTopic() + "]")
 	}
 
-	c := clients[rand.Intn(len(clients))]
+	//全部熔断时仍然尝试存活的broker
+	if len(available) <= 0 {
+		log.Warn("KiteClientManager|selectKiteClient|ALL BREAKER OPEN|%s\n", header.GetTopic())
+		available = aliveHosts
+	}
+
+	c, ok := alive[self.router.Select(header, available)]
+	if !ok {
+		//自定义的路由返回了不存在的broker
+		c = alive[available[rand.Intn(len(available))]]
+	}
 	return c, nil
 }
 
+//立即关闭,不等待处理中的消息
 func (self *KiteClientManager) Destory() {
-	self.zkManager.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	self.Close(ctx)
 }
@@ -0,0 +1,167 @@
+package core
+
+import (
+	"context"
+	log "github.com/blackbeans/log4go"
+	"kiteq/protocol"
+	"sync"
+	"time"
+)
+
+//发送失败的重试策略
+type RetryPolicy struct {
+	MaxRetries       int           //超时或者存储失败时换broker重试的次数,0为不重试
+	RetryInterval    time.Duration //重试的间隔
+	BreakerThreshold int           //连续失败多少次后熔断该broker,<=0不熔断
+	BreakerTimeout   time.Duration //熔断的时长,到期后允许重新尝试
+}
+
+//默认不重试,连续失败5次熔断30s
+var DEFAULT_RETRY_POLICY = RetryPolicy{
+	MaxRetries:       0,
+	RetryInterval:    100 * time.Millisecond,
+	BreakerThreshold: 5,
+	BreakerTimeout:   30 * time.Second}
+
+//broker的熔断状态
+type circuitBreaker struct {
+	failures  int
+	openUntil time.Time
+	lock      sync.Mutex
+}
+
+//是否允许发送,熔断到期后放行进行探测
+func (self *circuitBreaker) allow(now time.Time) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return now.After(self.openUntil)
+}
+
+func (self *circuitBreaker) succ() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.failures = 0
+	self.openUntil = time.Time{}
+}
+
+//返回是否触发了熔断
+func (self *circuitBreaker) fail(threshold int, timeout time.Duration) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.failures++
+	if threshold > 0 && self.failures >= threshold {
+		self.openUntil = time.Now().Add(timeout)
+		return true
+	}
+	return false
+}
+
+//设置重试策略
+func (self *KiteClientManager) SetRetryPolicy(policy RetryPolicy) {
+	self.retryPolicy = policy
+}
+
+func (self *KiteClientManager) breaker(hostport string) *circuitBreaker {
+	self.breakerLock.Lock()
+	defer self.breakerLock.Unlock()
+	b, ok := self.breakers[hostport]
+	if !ok {
+		b = &circuitBreaker{}
+		self.breakers[hostport] = b
+	}
+	return b
+}
+
+//服务端因为消息本身拒绝存储,换broker重试也无法成功
+var rejectedFeedbacks = map[string]bool{
+	protocol.FEEDBACK_INVALID_MESSAGEID: true,
+	protocol.FEEDBACK_EXPIRED_MESSAGE:   true,
+	protocol.FEEDBACK_FLY_UNCOMMITTED:   true}
+
+//只有等待响应超时和服务端存储失败时换broker重试
+//序列化失败、写出失败或者服务端拒绝的消息直接返回,也不计入broker的熔断
+func retryable(err error) bool {
+	if ackErr, ok := err.(*storeAckError); ok {
+		return !rejectedFeedbacks[ackErr.ack.GetFeedback()]
+	}
+	return err == TIMEOUT_ERROR || err == ERROR_CONNECTION_CLOSED || err == ERROR_BATCH_ACK_MISSING
+}
+
+//发送消息,失败时保持messageId不变换其他broker重试
+//c为首选的broker,返回最终发送成功的broker;ctx取消或者到期后不再重试
+func (self *KiteClientManager) sendWithRetry(ctx context.Context, c *kiteClient, msg *protocol.QMessage,
+	timeout time.Duration) (*kiteClient, *protocol.MessageStoreAck, error) {
+	policy := self.retryPolicy
+	data, err := protocol.MarshalPbMessage(msg.GetPbMessage())
+	if nil != err {
+		return nil, nil, err
+	}
+	exclude := make(map[string]bool, policy.MaxRetries+1)
+	var lastErr error
+	for i := 0; ; i++ {
+		if err := ctx.Err(); nil != err {
+			return nil, nil, err
+		}
+
+		if nil == c {
+			var err error
+			c, err = self.selectKiteClientExclude(msg.GetHeader(), exclude)
+			if nil != err {
+				if nil != lastErr {
+					return nil, nil, lastErr
+				}
+				return nil, nil, err
+			}
+		}
+
+		//剩余时间不足时以ctx的deadline为准
+		t := timeout
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < t {
+			t = time.Until(deadline)
+		}
+
+		hostport := c.remotec.RemoteAddr()
+		ack, err := c.writeAndGetAck(msg.GetMsgType(), data, t)
+		if nil == err {
+			self.breaker(hostport).succ()
+			return c, ack, nil
+		}
+
+		//ctx到期导致的失败不计入broker的熔断
+		if nil != ctx.Err() {
+			return nil, ack, ctx.Err()
+		}
+
+		lastErr = err
+		if !self.sendFailed(hostport, msg, i, err) {
+			return nil, ack, err
+		}
+		exclude[hostport] = true
+		c = nil
+		if policy.RetryInterval > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			case <-time.After(policy.RetryInterval):
+			}
+		}
+	}
+}
+
+//记录broker的发送失败,返回是否需要换broker重试
+//attempt为已经重试的次数
+func (self *KiteClientManager) sendFailed(hostport string, msg *protocol.QMessage, attempt int, err error) bool {
+	policy := self.retryPolicy
+	if !retryable(err) {
+		log.Warn("KiteClientManager|sendWithRetry|NOT RETRYABLE|%s|%s|%s\n", hostport, msg.GetHeader().GetMessageId(), err)
+		return false
+	}
+	if self.breaker(hostport).fail(policy.BreakerThreshold, policy.BreakerTimeout) {
+		log.Warn("KiteClientManager|sendWithRetry|BREAKER OPEN|%s|%s\n", hostport, policy.BreakerTimeout)
+	}
+	if attempt >= policy.MaxRetries {
+		return false
+	}
+	log.Warn("KiteClientManager|sendWithRetry|RETRY|%s|%s|%d|%s\n", hostport, msg.GetHeader().GetMessageId(), attempt+1, err)
+	return true
+}
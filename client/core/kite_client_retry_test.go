@@ -0,0 +1,82 @@
+package core
+
+import (
+	"context"
+	"github.com/blackbeans/turbo/packet"
+	"kiteq/protocol"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := &circuitBreaker{}
+	now := time.Now()
+	if !b.allow(now) {
+		t.Fail()
+		t.Log("TestCircuitBreaker|init not allow")
+	}
+
+	//未达到阈值不熔断
+	if b.fail(2, 100*time.Millisecond) || !b.allow(time.Now()) {
+		t.Fail()
+		t.Log("TestCircuitBreaker|open before threshold")
+	}
+
+	if !b.fail(2, 100*time.Millisecond) || b.allow(time.Now()) {
+		t.Fail()
+		t.Log("TestCircuitBreaker|not open")
+	}
+
+	//熔断到期后放行探测
+	if !b.allow(time.Now().Add(200 * time.Millisecond)) {
+		t.Fail()
+		t.Log("TestCircuitBreaker|not half open")
+	}
+
+	b.succ()
+	if !b.allow(time.Now()) || b.failures != 0 {
+		t.Fail()
+		t.Log("TestCircuitBreaker|succ not reset")
+	}
+}
+
+//超时或者存储失败时保持messageId换broker重试,服务端拒绝的消息不重试也不计入熔断
+func TestSendWithRetry(t *testing.T) {
+	cases := []struct {
+		reply func(p packet.Packet) interface{}
+		retry bool
+	}{
+		{replyStoreAck(false, ""), true},
+		{nil, true},
+		{replyStoreAck(false, protocol.FEEDBACK_EXPIRED_MESSAGE), false},
+	}
+	for i, c := range cases {
+		first := &mockRemoting{addr: "localhost:13800", reply: c.reply}
+		second := &mockRemoting{addr: "localhost:13801", reply: replyStoreAck(true, "")}
+		manager := mockManager(10, first, second)
+		manager.SetRetryPolicy(RetryPolicy{MaxRetries: 1, BreakerThreshold: 5, BreakerTimeout: time.Second})
+
+		msg := protocol.NewQMessage(buildStringMessage(true))
+		messageId := msg.GetHeader().GetMessageId()
+		sent, ack, err := manager.sendWithRetry(context.Background(), manager.kiteClients["trade"][0], msg, 50*time.Millisecond)
+
+		if ids := first.sent(); len(ids) != 1 || ids[0] != messageId {
+			t.Fatalf("TestSendWithRetry|%d|first|%v\n", i, ids)
+		}
+		if !c.retry {
+			if nil == err || len(second.sent()) != 0 || manager.breaker(first.addr).failures != 0 {
+				t.Fatalf("TestSendWithRetry|%d|retried|%v\n", i, err)
+			}
+			continue
+		}
+		if nil != err || sent.remotec != second || ack.GetMessageId() != messageId {
+			t.Fatalf("TestSendWithRetry|%d|%v|%v\n", i, ack, err)
+		}
+		if ids := second.sent(); len(ids) != 1 || ids[0] != messageId {
+			t.Fatalf("TestSendWithRetry|%d|second|%v\n", i, ids)
+		}
+		if manager.breaker(first.addr).failures != 1 {
+			t.Fatalf("TestSendWithRetry|%d|breaker|%d\n", i, manager.breaker(first.addr).failures)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package core
+
+import (
+	"hash/crc32"
+	"kiteq/protocol"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//broker的路由选择策略,可以自定义实现
+type IRouter interface {
+	//从可用的broker中选择一个,brokers不为空
+	Select(header *protocol.Header, brokers []string /*ip:port*/) string
+}
+
+//随机选择
+type RandomRouter struct {
+}
+
+func (self *RandomRouter) Select(header *protocol.Header, brokers []string) string {
+	return brokers[rand.Intn(len(brokers))]
+}
+
+//轮询
+type RoundRobinRouter struct {
+	idx uint32
+}
+
+func (self *RoundRobinRouter) Select(header *protocol.Header, brokers []string) string {
+	idx := atomic.AddUint32(&self.idx, 1)
+	return brokers[int(idx%uint32(len(brokers)))]
+}
+
+//按照header中的属性做一致性hash,相同key的消息发往同一个broker
+//broker上下线时只影响该broker上的key;消息没有该属性时随机选择
+type HashRouter struct {
+	key      string
+	replicas int
+	rings    map[string] /*brokers*/ *hashRing
+	lock     sync.RWMutex
+}
+
+type hashRing struct {
+	hashes []uint32
+	nodes  map[uint32]string
+}
+
+func NewHashRouter(key string) *HashRouter {
+	return &HashRouter{
+		key:      key,
+		replicas: 100,
+		rings:    make(map[string]*hashRing, 4)}
+}
+
+func (self *HashRouter) Select(header *protocol.Header, brokers []string) string {
+	value, ok := headerProperty(header, self.key)
+	if !ok {
+		return brokers[rand.Intn(len(brokers))]
+	}
+
+	ring := self.ring(brokers)
+	h := crc32.ChecksumIEEE([]byte(value))
+	idx := sort.Search(len(ring.hashes), func(i int) bool { return ring.hashes[i] >= h })
+	if idx >= len(ring.hashes) {
+		idx = 0
+	}
+	return ring.nodes[ring.hashes[idx]]
+}
+
+//相同的broker列表复用hash环
+func (self *HashRouter) ring(brokers []string) *hashRing {
+	sorted := make([]string, len(brokers))
+	copy(sorted, brokers)
+	sort.Strings(sorted)
+	id := strings.Join(sorted, ",")
+
+	self.lock.RLock()
+	ring, ok := self.rings[id]
+	self.lock.RUnlock()
+	if ok {
+		return ring
+	}
+
+	ring = &hashRing{
+		hashes: make([]uint32, 0, len(sorted)*self.replicas),
+		nodes:  make(map[uint32]string, len(sorted)*self.replicas)}
+	for _, b := range sorted {
+		for i := 0; i < self.replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(b + "#" + strconv.Itoa(i)))
+			ring.hashes = append(ring.hashes, h)
+			ring.nodes[h] = b
+		}
+	}
+	sort.Slice(ring.hashes, func(i, j int) bool { return ring.hashes[i] < ring.hashes[j] })
+
+	self.lock.Lock()
+	//broker列表变化频率很低,超过上限直接清空
+	if len(self.rings) >= 16 {
+		self.rings = make(map[string]*hashRing, 4)
+	}
+	self.rings[id] = ring
+	self.lock.Unlock()
+	return ring
+}
+
+func headerProperty(header *protocol.Header, key string) (string, bool) {
+	for _, e := range header.GetProperties() {
+		if e.GetKey() == key {
+			return e.GetValue(), true
+		}
+	}
+	return "", false
+}
+
+//按照broker的延迟加权随机,延迟越低被选中的概率越高
+type LatencyRouter struct {
+	stat *LatencyStat
+}
+
+func NewLatencyRouter(stat *LatencyStat) *LatencyRouter {
+	return &LatencyRouter{stat: stat}
+}
+
+func (self *LatencyRouter) Select(header *protocol.Header, brokers []string) string {
+	rtts := make([]float64, len(brokers))
+	known, sum := 0, 0.0
+	for i, b := range brokers {
+		if rtt, ok := self.stat.Get(b); ok {
+			rtts[i] = float64(rtt)
+			sum += rtts[i]
+			known++
+		}
+	}
+	if known <= 0 {
+		return brokers[rand.Intn(len(brokers))]
+	}
+
+	//没有测量过的broker按照平均延迟计算
+	avg := sum / float64(known)
+	weights := make([]float64, len(brokers))
+	total := 0.0
+	for i := range brokers {
+		rtt := rtts[i]
+		if rtt <= 0 {
+			rtt = avg
+		}
+		weights[i] = 1 / (rtt + 1)
+		total += weights[i]
+	}
+
+	r := rand.Float64() * total
+	for i, w := range weights {
+		r -= w
+		if r <= 0 {
+			return brokers[i]
+		}
+	}
+	return brokers[len(brokers)-1]
+}
+
+//broker的延迟统计,指数加权平均
+type LatencyStat struct {
+	rtts map[string] /*ip:port*/ float64
+	lock sync.RWMutex
+}
+
+func NewLatencyStat() *LatencyStat {
+	return &LatencyStat{rtts: make(map[string]float64, 10)}
+}
+
+func (self *LatencyStat) Update(hostport string, rtt time.Duration) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	old, ok := self.rtts[hostport]
+	if !ok {
+		self.rtts[hostport] = float64(rtt)
+	} else {
+		self.rtts[hostport] = old*0.7 + float64(rtt)*0.3
+	}
+}
+
+func (self *LatencyStat) Get(hostport string) (time.Duration, bool) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	rtt, ok := self.rtts[hostport]
+	return time.Duration(rtt), ok
+}
+
+//设置broker的路由策略,默认随机
+func (self *KiteClientManager) SetRouter(router IRouter) {
+	self.router = router
+}
+
+//heartbeat测量的broker延迟
+func (self *KiteClientManager) LatencyStat() *LatencyStat {
+	return self.latency
+}
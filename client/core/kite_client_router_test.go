@@ -0,0 +1,71 @@
+package core
+
+import (
+	"github.com/golang/protobuf/proto"
+	"kiteq/protocol"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func routerHeader(key, value string) *protocol.Header {
+	return &protocol.Header{
+		MessageId: proto.String("1"),
+		Topic:     proto.String("trade"),
+		Properties: []*protocol.Entry{
+			&protocol.Entry{Key: proto.String(key), Value: proto.String(value)}}}
+}
+
+func TestRoundRobinRouter(t *testing.T) {
+	router := &RoundRobinRouter{}
+	brokers := []string{"a:1", "b:1", "c:1"}
+	counts := make(map[string]int, 3)
+	for i := 0; i < 30; i++ {
+		counts[router.Select(routerHeader("k", "v"), brokers)]++
+	}
+	for _, b := range brokers {
+		if counts[b] != 10 {
+			t.Fail()
+			t.Logf("TestRoundRobinRouter|%v\n", counts)
+		}
+	}
+}
+
+//相同key选择相同的broker,broker下线只影响该broker上的key
+func TestHashRouter(t *testing.T) {
+	router := NewHashRouter("orderId")
+	brokers := []string{"a:1", "b:1", "c:1"}
+	before := make(map[string]string, 100)
+	for i := 0; i < 100; i++ {
+		key := "order-" + strconv.Itoa(i)
+		before[key] = router.Select(routerHeader("orderId", key), brokers)
+		if router.Select(routerHeader("orderId", key), []string{"c:1", "b:1", "a:1"}) != before[key] {
+			t.Fail()
+			t.Logf("TestHashRouter|ORDER|%s\n", key)
+		}
+	}
+
+	for key, b := range before {
+		after := router.Select(routerHeader("orderId", key), []string{"a:1", "c:1"})
+		if b != "b:1" && after != b {
+			t.Fail()
+			t.Logf("TestHashRouter|REMAP|%s|%s|%s\n", key, b, after)
+		}
+	}
+}
+
+func TestLatencyRouter(t *testing.T) {
+	stat := NewLatencyStat()
+	stat.Update("a:1", time.Millisecond)
+	stat.Update("b:1", 100*time.Millisecond)
+	router := NewLatencyRouter(stat)
+
+	counts := make(map[string]int, 2)
+	for i := 0; i < 1000; i++ {
+		counts[router.Select(routerHeader("k", "v"), []string{"a:1", "b:1"})]++
+	}
+	if counts["a:1"] < 900 {
+		t.Fail()
+		t.Logf("TestLatencyRouter|%v\n", counts)
+	}
+}
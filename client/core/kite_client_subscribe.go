@@ -0,0 +1,227 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/blackbeans/log4go"
+	"kiteq/binding"
+	"os"
+)
+
+var ERROR_NOT_STARTED = errors.New("KITE CLIENT NOT STARTED !")
+
+//当前需要连接broker的topic
+func (self *KiteClientManager) currentTopics() []string {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	topics := make([]string, len(self.topics))
+	copy(topics, self.topics)
+	return topics
+}
+
+func containsTopic(topics []string, topic string) bool {
+	for _, t := range topics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+//运行时增加订阅关系,推送到注册中心并连接新topic的broker
+//与已有订阅关系冲突时返回错误,重复的订阅关系忽略
+func (self *KiteClientManager) Subscribe(bindings []*binding.Binding) error {
+	self.subLock.Lock()
+	defer self.subLock.Unlock()
+	if nil == self.registry {
+		return ERROR_NOT_STARTED
+	}
+
+	binds := make([]*binding.Binding, len(self.binds), len(self.binds)+len(bindings))
+	copy(binds, self.binds)
+	changed := make(map[string]bool, 2)
+outter:
+	for _, nb := range bindings {
+		b := *nb
+		b.GroupId = self.ga.GroupId
+		for _, exist := range binds {
+			if *exist == b {
+				continue outter
+			}
+			if exist.Conflict(&b) {
+				return fmt.Errorf("binding conflict : %s:%s with %s:%s", b.Topic, b.MessageType,
+					exist.Topic, exist.MessageType)
+			}
+		}
+		binds = append(binds, &b)
+		changed[b.Topic] = true
+	}
+	if len(changed) <= 0 {
+		return nil
+	}
+
+	//先连接broker再推送订阅关系,避免broker投递时没有可用的连接
+	for topic := range changed {
+		self.watchTopic(topic)
+	}
+
+	for topic := range changed {
+		err := self.registry.PublishBindings(self.ga.GroupId, topicBinds(binds, topic))
+		if nil != err {
+			log.Error("KiteClientManager|Subscribe|PublishBindings|FAIL|%s|%s\n", err, topic)
+			return err
+		}
+	}
+	self.binds = binds
+	log.Info("KiteClientManager|Subscribe|SUCC|%v\n", bindings)
+	return nil
+}
+
+//运行时取消订阅关系,按照topic+messageType+bindType匹配
+//topic下没有订阅关系并且不再发送时断开该topic的broker
+func (self *KiteClientManager) Unsubscribe(bindings []*binding.Binding) error {
+	self.subLock.Lock()
+	defer self.subLock.Unlock()
+	if nil == self.registry {
+		return ERROR_NOT_STARTED
+	}
+
+	binds := make([]*binding.Binding, 0, len(self.binds))
+	changed := make(map[string]bool, 2)
+	for _, exist := range self.binds {
+		removed := false
+		for _, b := range bindings {
+			if exist.Topic == b.Topic && exist.MessageType == b.MessageType && exist.BindType == b.BindType {
+				removed = true
+				break
+			}
+		}
+		if removed {
+			changed[exist.Topic] = true
+		} else {
+			binds = append(binds, exist)
+		}
+	}
+
+	for topic := range changed {
+		remain := topicBinds(binds, topic)
+		var err error
+		if len(remain) > 0 {
+			err = self.registry.PublishBindings(self.ga.GroupId, remain)
+		} else {
+			err = self.registry.UnpublishBindings(self.ga.GroupId, []string{topic})
+		}
+		if nil != err {
+			log.Error("KiteClientManager|Unsubscribe|FAIL|%s|%s\n", err, topic)
+			return err
+		}
+	}
+	self.binds = binds
+
+	for topic := range changed {
+		if len(topicBinds(binds, topic)) <= 0 && !containsTopic(self.pubTopics, topic) {
+			self.unwatchTopic(topic)
+		}
+	}
+	log.Info("KiteClientManager|Unsubscribe|SUCC|%v\n", bindings)
+	return nil
+}
+
+//运行时增加可以发送的topic
+func (self *KiteClientManager) AddPublishTopic(topics []string) error {
+	self.subLock.Lock()
+	defer self.subLock.Unlock()
+	if nil == self.registry {
+		return ERROR_NOT_STARTED
+	}
+
+	added := make([]string, 0, len(topics))
+	for _, topic := range topics {
+		if !containsTopic(self.pubTopics, topic) && !containsTopic(added, topic) {
+			added = append(added, topic)
+		}
+	}
+	if len(added) <= 0 {
+		return nil
+	}
+
+	hostname, _ := os.Hostname()
+	err := self.registry.PublishTopics(added, self.ga.GroupId, hostname)
+	if nil != err {
+		log.Error("KiteClientManager|AddPublishTopic|FAIL|%s|%s\n", err, added)
+		return err
+	}
+
+	for _, topic := range added {
+		self.watchTopic(topic)
+	}
+	self.pubTopics = append(self.pubTopics, added...)
+	log.Info("KiteClientManager|AddPublishTopic|SUCC|%s\n", added)
+	return nil
+}
+
+//连接topic对应的broker
+func (self *KiteClientManager) watchTopic(topic string) {
+	if containsTopic(self.currentTopics(), topic) {
+		return
+	}
+
+	hosts, err := self.registry.GetQServerAndWatch(topic)
+	if nil != err {
+		log.Error("KiteClientManager|watchTopic|GetQServerAndWatch|FAIL|%s|%s\n", err, topic)
+	}
+
+	self.lock.Lock()
+	topics := make([]string, len(self.topics), len(self.topics)+1)
+	copy(topics, self.topics)
+	self.topics = append(topics, topic)
+	self.lock.Unlock()
+
+	self.onQServerChanged(topic, hosts)
+	log.Info("KiteClientManager|watchTopic|SUCC|%s|%s\n", topic, hosts)
+}
+
+//断开只有该topic使用的broker
+func (self *KiteClientManager) unwatchTopic(topic string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	topics := make([]string, 0, len(self.topics))
+	for _, t := range self.topics {
+		if t != topic {
+			topics = append(topics, t)
+		}
+	}
+	self.topics = topics
+
+	clients := self.kiteClients[topic]
+	delete(self.kiteClients, topic)
+
+	//其他topic仍在使用的broker保留连接
+	inuse := make(map[string]bool, 10)
+	for _, cs := range self.kiteClients {
+		for _, c := range cs {
+			inuse[c.remotec.RemoteAddr()] = true
+		}
+	}
+	del := make([]string, 0, len(clients))
+	for _, c := range clients {
+		if !inuse[c.remotec.RemoteAddr()] {
+			del = append(del, c.remotec.RemoteAddr())
+		}
+	}
+	if len(del) > 0 {
+		self.clientManager.DeleteClients(del...)
+	}
+	log.Info("KiteClientManager|unwatchTopic|SUCC|%s|%s\n", topic, del)
+}
+
+func topicBinds(binds []*binding.Binding, topic string) []*binding.Binding {
+	tbinds := make([]*binding.Binding, 0, 2)
+	for _, b := range binds {
+		if b.Topic == topic {
+			tbinds = append(tbinds, b)
+		}
+	}
+	return tbinds
+}
@@ -0,0 +1,54 @@
+package core
+
+import (
+	"kiteq/binding"
+	"kiteq/client/listener"
+	"testing"
+)
+
+func TestSubscribe(t *testing.T) {
+	uri := "mem://TestSubscribe"
+	manager := NewKiteClientManager(uri, "s-trade-a", "123456", &listener.MockListener{})
+	if manager.Subscribe([]*binding.Binding{binding.Bind_Direct("", "trade", "pay-succ", 1000, true)}) != ERROR_NOT_STARTED {
+		t.Fatal("TestSubscribe|NOT STARTED")
+	}
+	manager.registry = binding.NewRegistry(uri, manager)
+	defer manager.registry.Close()
+
+	observer := binding.NewRegistry(uri, NewKiteClientManager(uri, "s-trade-b", "123456", &listener.MockListener{}))
+	defer observer.Close()
+
+	err := manager.Subscribe([]*binding.Binding{
+		binding.Bind_Direct("", "trade", "pay-succ", 1000, true),
+		binding.Bind_Direct("", "trade", "pay-fail", 1000, true)})
+	if nil != err {
+		t.Fatal(err)
+	}
+	binds, _ := observer.GetBindAndWatch("trade")
+	if len(binds["s-trade-a"]) != 2 || !containsTopic(manager.currentTopics(), "trade") {
+		t.Fail()
+		t.Logf("TestSubscribe|Subscribe|%v|%s\n", binds, manager.currentTopics())
+	}
+
+	//与已有订阅冲突
+	err = manager.Subscribe([]*binding.Binding{binding.Bind_Regx("", "trade", "pay-.*", 1000, true)})
+	if nil == err {
+		t.Fail()
+		t.Log("TestSubscribe|Conflict|NOT DETECTED")
+	}
+
+	manager.Unsubscribe([]*binding.Binding{binding.Bind_Direct("", "trade", "pay-succ", 1000, true)})
+	binds, _ = observer.GetBindAndWatch("trade")
+	if len(binds["s-trade-a"]) != 1 || binds["s-trade-a"][0].MessageType != "pay-fail" {
+		t.Fail()
+		t.Logf("TestSubscribe|Unsubscribe|%v\n", binds)
+	}
+
+	//topic下没有订阅关系后删除节点并断开broker
+	manager.Unsubscribe([]*binding.Binding{binding.Bind_Direct("", "trade", "pay-fail", 1000, true)})
+	binds, _ = observer.GetBindAndWatch("trade")
+	if _, ok := binds["s-trade-a"]; ok || containsTopic(manager.currentTopics(), "trade") {
+		t.Fail()
+		t.Logf("TestSubscribe|Unsubscribe|ALL|%v|%s\n", binds, manager.currentTopics())
+	}
+}
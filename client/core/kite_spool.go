@@ -0,0 +1,470 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	log "github.com/blackbeans/log4go"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"kiteq/protocol"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ERROR_SPOOL_FULL = errors.New("SPOOL IS FULL !")
+
+const (
+	SPOOL_SUFFIX        = ".spool"
+	SPOOL_REPLAY_SUFFIX = ".replay" //正在重放的文件
+	SPOOL_RECORD_HEADER = 4 + 4 + 1 //length+crc32+msgType
+)
+
+//无法发送的消息写入本地的追加文件,broker恢复后按照写入顺序重放
+//每个topic一个文件,记录格式 length(4)|crc32(4)|msgType(1)|pb
+type Spool struct {
+	dir      string
+	maxBytes int64
+	size     int64 //当前spool的总字节数
+	topics   map[string]*topicSpool
+	lock     sync.Mutex
+}
+
+type topicSpool struct {
+	path      string
+	file      *os.File
+	size      int64 //包括正在重放的消息
+	replaying int32
+	lock      sync.Mutex
+}
+
+//打开spool目录,加载上次未重放完成的消息
+func OpenSpool(dir string, maxBytes int64) (*Spool, error) {
+	err := os.MkdirAll(dir, 0755)
+	if nil != err {
+		return nil, err
+	}
+
+	spool := &Spool{
+		dir:      dir,
+		maxBytes: maxBytes,
+		topics:   make(map[string]*topicSpool, 10)}
+
+	files, err := ioutil.ReadDir(dir)
+	if nil != err {
+		return nil, err
+	}
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasSuffix(name, SPOOL_SUFFIX) && !strings.HasSuffix(name, SPOOL_REPLAY_SUFFIX) {
+			continue
+		}
+		topic, err := url.PathUnescape(strings.TrimSuffix(strings.TrimSuffix(name, SPOOL_REPLAY_SUFFIX), SPOOL_SUFFIX))
+		if nil != err {
+			continue
+		}
+		if _, ok := spool.topics[topic]; ok {
+			continue
+		}
+		_, err = spool.topic(topic)
+		if nil != err {
+			return nil, err
+		}
+	}
+	log.Info("Spool|Open|SUCC|%s|%d|%v\n", dir, spool.Size(), spool.Topics())
+	return spool, nil
+}
+
+//打开topic的spool文件,崩溃前未重放完成的消息合并到文件头部
+func (self *Spool) topic(topic string) (*topicSpool, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	ts, ok := self.topics[topic]
+	if ok {
+		return ts, nil
+	}
+
+	path := filepath.Join(self.dir, url.PathEscape(topic)+SPOOL_SUFFIX)
+	replay := strings.TrimSuffix(path, SPOOL_SUFFIX) + SPOOL_REPLAY_SUFFIX
+	if _, err := os.Stat(replay); nil == err {
+		err = mergeFiles(path, replay, path)
+		if nil != err {
+			return nil, err
+		}
+		os.Remove(replay)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if nil != err {
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if nil != err {
+		file.Close()
+		return nil, err
+	}
+
+	ts = &topicSpool{path: path, file: file, size: stat.Size()}
+	self.topics[topic] = ts
+	atomic.AddInt64(&self.size, stat.Size())
+	return ts, nil
+}
+
+//按顺序合并first和second写入到target
+func mergeFiles(target, first, second string) error {
+	tmp := target + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if nil != err {
+		return err
+	}
+	for _, src := range []string{first, second} {
+		err = appendFile(f, src)
+		if nil != err {
+			f.Close()
+			return err
+		}
+	}
+	err = f.Sync()
+	f.Close()
+	if nil != err {
+		return err
+	}
+	return os.Rename(tmp, target)
+}
+
+func appendFile(w io.Writer, path string) error {
+	src, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if nil != err {
+		return err
+	}
+	defer src.Close()
+	_, err = io.Copy(w, src)
+	return err
+}
+
+func encodeSpoolRecord(msg *protocol.QMessage) ([]byte, error) {
+	data, err := protocol.MarshalPbMessage(msg.GetPbMessage())
+	if nil != err {
+		return nil, err
+	}
+	record := make([]byte, SPOOL_RECORD_HEADER+len(data))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(data))
+	record[8] = msg.GetMsgType()
+	copy(record[SPOOL_RECORD_HEADER:], data)
+	return record, nil
+}
+
+//读取spool文件中的消息,末尾不完整或者校验失败的记录丢弃
+func readSpoolFile(path string) ([]*protocol.QMessage, []int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	} else if nil != err {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	msgs := make([]*protocol.QMessage, 0, 100)
+	sizes := make([]int, 0, 100)
+	header := make([]byte, SPOOL_RECORD_HEADER)
+	for {
+		_, err := io.ReadFull(r, header)
+		if err == io.EOF {
+			break
+		} else if nil != err {
+			log.Warn("Spool|read|TORN RECORD|%s|%s\n", path, err)
+			break
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		data := make([]byte, length)
+		_, err = io.ReadFull(r, data)
+		if nil != err || crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+			log.Warn("Spool|read|CORRUPT RECORD|%s|%s\n", path, err)
+			break
+		}
+
+		var msg *protocol.QMessage
+		switch header[8] {
+		case protocol.CMD_STRING_MESSAGE:
+			sm := &protocol.StringMessage{}
+			err = protocol.UnmarshalPbMessage(data, sm)
+			msg = protocol.NewQMessage(sm)
+		case protocol.CMD_BYTES_MESSAGE:
+			bm := &protocol.BytesMessage{}
+			err = protocol.UnmarshalPbMessage(data, bm)
+			msg = protocol.NewQMessage(bm)
+		}
+		if nil != err || nil == msg {
+			log.Warn("Spool|read|INVALID MESSAGE|%s|%d|%s\n", path, header[8], err)
+			continue
+		}
+		msgs = append(msgs, msg)
+		sizes = append(sizes, SPOOL_RECORD_HEADER+int(length))
+	}
+	return msgs, sizes, nil
+}
+
+//写入无法发送的消息
+func (self *Spool) Append(msg *protocol.QMessage) error {
+	record, err := encodeSpoolRecord(msg)
+	if nil != err {
+		return err
+	}
+	if self.maxBytes > 0 && atomic.LoadInt64(&self.size)+int64(len(record)) > self.maxBytes {
+		return ERROR_SPOOL_FULL
+	}
+
+	ts, err := self.topic(msg.GetHeader().GetTopic())
+	if nil != err {
+		return err
+	}
+
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	_, err = ts.file.Write(record)
+	if nil == err {
+		err = ts.file.Sync()
+	}
+	if nil != err {
+		log.Error("Spool|Append|FAIL|%s|%s\n", err, msg.GetHeader().GetMessageId())
+		return err
+	}
+	atomic.AddInt64(&self.size, int64(len(record)))
+	atomic.AddInt64(&ts.size, int64(len(record)))
+	return nil
+}
+
+//topic下是否还有等待重放的消息
+func (self *Spool) Pending(topic string) bool {
+	self.lock.Lock()
+	ts, ok := self.topics[topic]
+	self.lock.Unlock()
+	return ok && atomic.LoadInt64(&ts.size) > 0
+}
+
+//按照写入顺序重放topic下的消息,发送失败时停止,剩余的消息保留到下次重放
+//重放期间新写入的消息追加到剩余消息之后;过期的消息直接丢弃
+func (self *Spool) Replay(topic string, send func(msg *protocol.QMessage) error) (int, error) {
+	self.lock.Lock()
+	ts, ok := self.topics[topic]
+	self.lock.Unlock()
+	if !ok || !atomic.CompareAndSwapInt32(&ts.replaying, 0, 1) {
+		return 0, nil
+	}
+	defer atomic.StoreInt32(&ts.replaying, 0)
+
+	//切换到新的文件,重放期间不阻塞写入
+	//上次重放失败遗留的文件在前,合并后一起重放
+	replay := strings.TrimSuffix(ts.path, SPOOL_SUFFIX) + SPOOL_REPLAY_SUFFIX
+	ts.lock.Lock()
+	stat, err := ts.file.Stat()
+	if nil != err {
+		ts.lock.Unlock()
+		return 0, err
+	}
+	_, staleErr := os.Stat(replay)
+	stale := nil == staleErr
+	if stat.Size() <= 0 && !stale {
+		ts.lock.Unlock()
+		return 0, nil
+	}
+	if stat.Size() > 0 {
+		ts.file.Close()
+		if stale {
+			err = mergeFiles(replay, replay, ts.path)
+			if nil == err {
+				err = os.Remove(ts.path)
+			}
+		} else {
+			err = os.Rename(ts.path, replay)
+		}
+		//失败时原文件仍然完整,继续追加
+		file, openErr := os.OpenFile(ts.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if nil == openErr {
+			ts.file = file
+		} else if nil == err {
+			err = openErr
+		}
+	}
+	var replaySize int64
+	if nil == err {
+		stat, err = os.Stat(replay)
+		if nil == err {
+			replaySize = stat.Size()
+		}
+	}
+	ts.lock.Unlock()
+	if nil != err {
+		return 0, err
+	}
+
+	msgs, sizes, err := readSpoolFile(replay)
+	if nil != err {
+		return 0, err
+	}
+
+	now := time.Now().Unix()
+	sent := 0
+	var sendErr error
+	for ; sent < len(msgs); sent++ {
+		header := msgs[sent].GetHeader()
+		if header.GetExpiredTime() > 0 && header.GetExpiredTime() <= now {
+			log.Warn("Spool|Replay|EXPIRED|%s|%s\n", topic, header.GetMessageId())
+			continue
+		}
+		sendErr = send(msgs[sent])
+		if nil != sendErr {
+			break
+		}
+	}
+
+	//剩余未发送的消息放回文件头部
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	remain := int64(0)
+	if sent < len(msgs) {
+		tmp := replay + ".remain"
+		f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+		if nil != err {
+			return sent, err
+		}
+		w := bufio.NewWriter(f)
+		for i := sent; i < len(msgs); i++ {
+			record, _ := encodeSpoolRecord(msgs[i])
+			w.Write(record)
+			remain += int64(sizes[i])
+		}
+		w.Flush()
+		f.Close()
+
+		ts.file.Close()
+		err = mergeFiles(ts.path, tmp, ts.path)
+		os.Remove(tmp)
+		ts.file, _ = os.OpenFile(ts.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if nil != err {
+			log.Error("Spool|Replay|MERGE|FAIL|%s|%s\n", err, topic)
+			return sent, err
+		}
+	}
+	os.Remove(replay)
+	atomic.AddInt64(&self.size, remain-replaySize)
+	atomic.AddInt64(&ts.size, remain-replaySize)
+	log.Info("Spool|Replay|%s|sent:%d|remain:%d|%s\n", topic, sent, len(msgs)-sent, sendErr)
+	return sent, sendErr
+}
+
+//spool中消息的总字节数
+func (self *Spool) Size() int64 {
+	return atomic.LoadInt64(&self.size)
+}
+
+//有spool文件的topic
+func (self *Spool) Topics() []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	topics := make([]string, 0, len(self.topics))
+	for topic := range self.topics {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+func (self *Spool) Close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, ts := range self.topics {
+		ts.lock.Lock()
+		ts.file.Close()
+		ts.lock.Unlock()
+	}
+}
+
+//开启发送失败消息的本地spool,需要在Start之前设置
+//没有可用的broker或者重试后仍然失败的消息写入dir,broker恢复后按顺序重放;maxBytes<=0时不限制大小
+func (self *KiteClientManager) SetSpool(dir string, maxBytes int64) error {
+	spool, err := OpenSpool(dir, maxBytes)
+	if nil != err {
+		log.Error("KiteClientManager|SetSpool|FAIL|%s|%s\n", err, dir)
+		return err
+	}
+	self.spool = spool
+	return nil
+}
+
+//spool中等待重放的字节数
+func (self *KiteClientManager) SpooledBytes() int64 {
+	if nil == self.spool {
+		return 0
+	}
+	return self.spool.Size()
+}
+
+//没有可用的broker或者可以重试的失败时写入spool,写入成功返回nil
+//服务端拒绝的消息重放也会被拒绝,直接返回给调用方
+func (self *KiteClientManager) spoolOnFail(msg *protocol.QMessage, err error) error {
+	if nil == err || nil == self.spool || !spoolable(err) {
+		return err
+	}
+	//未提交的事务消息需要回查,不能延后发送
+	if !msg.GetHeader().GetCommit() {
+		return err
+	}
+	spoolErr := self.spool.Append(msg)
+	if nil != spoolErr {
+		log.Error("KiteClientManager|spool|FAIL|%s|%s|%s\n", spoolErr, err, msg.GetHeader().GetMessageId())
+		return err
+	}
+	log.Warn("KiteClientManager|spool|SUCC|%s|%s\n", err, msg.GetHeader().GetMessageId())
+	return nil
+}
+
+func spoolable(err error) bool {
+	_, noClient := err.(noClientError)
+	return noClient || retryable(err)
+}
+
+//topic在spool中还有等待重放的消息时,新的消息追加到spool之后,保证发送顺序
+//返回是否已经交给spool
+func (self *KiteClientManager) spoolIfPending(msg *protocol.QMessage) (bool, error) {
+	if nil == self.spool || !msg.GetHeader().GetCommit() || !self.spool.Pending(msg.GetHeader().GetTopic()) {
+		return false, nil
+	}
+	err := self.spool.Append(msg)
+	if nil != err {
+		log.Error("KiteClientManager|spoolIfPending|FAIL|%s|%s\n", err, msg.GetHeader().GetMessageId())
+	}
+	return true, err
+}
+
+//broker恢复后重放topic下的消息,重放期间新写入的消息一并重放
+func (self *KiteClientManager) replaySpool(topic string) {
+	for {
+		sent, err := self.spool.Replay(topic, func(msg *protocol.QMessage) error {
+			c, err := self.selectKiteClient(msg.GetHeader())
+			if nil != err {
+				return err
+			}
+			_, _, err = self.sendWithRetry(context.Background(), c, msg, self.sendTimeout)
+			if nil != err && !spoolable(err) {
+				//被拒绝的消息丢弃,否则会一直阻塞在spool头部
+				log.Error("KiteClientManager|replaySpool|DROP|%s|%s\n", err, msg.GetHeader().GetMessageId())
+				return nil
+			}
+			return err
+		})
+		if nil != err || sent <= 0 || !self.spool.Pending(topic) || self.isClosing() {
+			return
+		}
+	}
+}
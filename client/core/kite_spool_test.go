@@ -0,0 +1,234 @@
+package core
+
+import (
+	"errors"
+	"io/ioutil"
+	"kiteq/protocol"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSpoolReplay(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kiteq-spool")
+	defer os.RemoveAll(dir)
+
+	spool, err := OpenSpool(dir, 0)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	ids := make([]string, 0, 5)
+	for i := 0; i < 5; i++ {
+		msg := protocol.NewQMessage(buildStringMessage(true))
+		ids = append(ids, msg.GetHeader().GetMessageId())
+		if err := spool.Append(msg); nil != err {
+			t.Fatal(err)
+		}
+	}
+	if spool.Size() <= 0 {
+		t.Fatalf("spool size %d", spool.Size())
+	}
+
+	//发送2条后失败,重放期间写入新的消息
+	var late *protocol.QMessage
+	sent := make([]string, 0, 5)
+	n, err := spool.Replay("trade", func(msg *protocol.QMessage) error {
+		if len(sent) == 2 {
+			late = protocol.NewQMessage(buildStringMessage(true))
+			spool.Append(late)
+			return errors.New("broker down")
+		}
+		sent = append(sent, msg.GetHeader().GetMessageId())
+		return nil
+	})
+	if n != 2 || nil == err {
+		t.Fatalf("replay sent %d %v", n, err)
+	}
+
+	//剩余的消息在重放期间写入的消息之前
+	expect := append(ids[2:], late.GetHeader().GetMessageId())
+	sent = sent[:0]
+	n, err = spool.Replay("trade", func(msg *protocol.QMessage) error {
+		sent = append(sent, msg.GetHeader().GetMessageId())
+		return nil
+	})
+	if nil != err || n != len(expect) {
+		t.Fatalf("replay sent %d %v", n, err)
+	}
+	for i, id := range expect {
+		if sent[i] != id {
+			t.Fatalf("replay order %d %s != %s", i, sent[i], id)
+		}
+	}
+	if spool.Size() != 0 {
+		t.Fatalf("spool size after replay %d", spool.Size())
+	}
+}
+
+func TestSpoolFullAndReopen(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kiteq-spool")
+	defer os.RemoveAll(dir)
+
+	msg := protocol.NewQMessage(buildStringMessage(true))
+	record, _ := encodeSpoolRecord(msg)
+	spool, err := OpenSpool(dir, int64(len(record)*2))
+	if nil != err {
+		t.Fatal(err)
+	}
+	spool.Append(msg)
+	spool.Append(protocol.NewQMessage(buildStringMessage(true)))
+	if err := spool.Append(protocol.NewQMessage(buildStringMessage(true))); err != ERROR_SPOOL_FULL {
+		t.Fatalf("expect spool full %v", err)
+	}
+	size := spool.Size()
+	spool.Close()
+
+	spool, err = OpenSpool(dir, 0)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	if spool.Size() != size {
+		t.Fatalf("reopen size %d != %d", spool.Size(), size)
+	}
+	if topics := spool.Topics(); len(topics) != 1 || topics[0] != "trade" {
+		t.Fatalf("reopen topics %v", topics)
+	}
+	n, err := spool.Replay("trade", func(m *protocol.QMessage) error { return nil })
+	if nil != err || n != 2 {
+		t.Fatalf("replay after reopen %d %v", n, err)
+	}
+}
+
+//上次重放失败遗留的文件不会被覆盖,合并在新写入的消息之前
+func TestSpoolReplayStale(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kiteq-spool")
+	defer os.RemoveAll(dir)
+
+	spool, err := OpenSpool(dir, 0)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	ids := make([]string, 0, 4)
+	for i := 0; i < 3; i++ {
+		msg := protocol.NewQMessage(buildStringMessage(true))
+		ids = append(ids, msg.GetHeader().GetMessageId())
+		spool.Append(msg)
+	}
+
+	//剩余消息无法写回,.replay文件保留
+	remain := filepath.Join(dir, "trade"+SPOOL_REPLAY_SUFFIX+".remain")
+	os.Mkdir(remain, 0755)
+	_, err = spool.Replay("trade", func(msg *protocol.QMessage) error {
+		if msg.GetHeader().GetMessageId() == ids[1] {
+			return errors.New("broker down")
+		}
+		return nil
+	})
+	if nil == err || !spool.Pending("trade") {
+		t.Fatalf("replay should fail %v", err)
+	}
+	os.Remove(remain)
+
+	msg := protocol.NewQMessage(buildStringMessage(true))
+	ids = append(ids, msg.GetHeader().GetMessageId())
+	spool.Append(msg)
+
+	sent := make([]string, 0, 4)
+	_, err = spool.Replay("trade", func(msg *protocol.QMessage) error {
+		sent = append(sent, msg.GetHeader().GetMessageId())
+		return nil
+	})
+	if nil != err || len(sent) != len(ids) {
+		t.Fatalf("replay stale %v %v", sent, err)
+	}
+	for i, id := range ids {
+		if sent[i] != id {
+			t.Fatalf("replay order %d %s != %s", i, sent[i], id)
+		}
+	}
+	if spool.Size() != 0 || spool.Pending("trade") {
+		t.Fatalf("spool size after replay %d", spool.Size())
+	}
+}
+
+//spool中还有等待重放的消息时,新消息写入spool之后而不是直接发送
+func TestSendMessageSpoolPending(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kiteq-spool")
+	defer os.RemoveAll(dir)
+
+	broker := &mockRemoting{addr: "localhost:13800", reply: replyStoreAck(true, "")}
+	manager := mockManager(10, broker)
+	defer close(manager.closeChan)
+	if err := manager.SetSpool(dir, 0); nil != err {
+		t.Fatal(err)
+	}
+	defer manager.spool.Close()
+
+	old := protocol.NewQMessage(buildStringMessage(true))
+	manager.spool.Append(old)
+
+	msg := protocol.NewQMessage(buildStringMessage(true))
+	if err := manager.SendMessage(msg); nil != err {
+		t.Fatal(err)
+	}
+	if _, err := manager.SendMessageAsync(protocol.NewQMessage(buildStringMessage(true)), 0, nil).Get(); nil != err {
+		t.Fatal(err)
+	}
+	if len(broker.sent()) != 0 {
+		t.Fatalf("sent before spool replay %v", broker.sent())
+	}
+
+	manager.replaySpool("trade")
+	sent := broker.sent()
+	if len(sent) != 3 || sent[0] != old.GetHeader().GetMessageId() || sent[1] != msg.GetHeader().GetMessageId() {
+		t.Fatalf("replay order %v", sent)
+	}
+	if manager.spool.Pending("trade") {
+		t.Fatalf("spool pending after replay %d", manager.SpooledBytes())
+	}
+}
+
+//被服务端拒绝的消息返回给调用方,不写入spool也不阻塞后续的发送
+func TestSendMessageSpoolRejected(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kiteq-spool")
+	defer os.RemoveAll(dir)
+
+	rejected := protocol.NewQMessage(buildStringMessage(true))
+	broker := &mockRemoting{addr: "localhost:13800", reply: replyBatchAck(func(messageId string) bool {
+		return messageId == rejected.GetHeader().GetMessageId()
+	}, protocol.FEEDBACK_EXPIRED_MESSAGE)}
+	manager := mockManager(10, broker)
+	defer close(manager.closeChan)
+	if err := manager.SetSpool(dir, 0); nil != err {
+		t.Fatal(err)
+	}
+	defer manager.spool.Close()
+
+	if err := manager.SendMessage(rejected); nil == err || manager.spool.Pending("trade") {
+		t.Fatalf("rejected message spooled %v", err)
+	}
+	msg := protocol.NewQMessage(buildStringMessage(true))
+	if err := manager.SendMessage(msg); nil != err {
+		t.Fatal(err)
+	}
+	if sent := broker.sent(); len(sent) != 2 || sent[1] != msg.GetHeader().GetMessageId() {
+		t.Fatalf("send after rejected %v", sent)
+	}
+
+	//旧版本spool中被拒绝的消息重放时丢弃
+	next := protocol.NewQMessage(buildStringMessage(true))
+	manager.spool.Append(rejected)
+	manager.spool.Append(next)
+	manager.replaySpool("trade")
+	if sent := broker.sent(); len(sent) != 4 || sent[3] != next.GetHeader().GetMessageId() {
+		t.Fatalf("replay after rejected %v", sent)
+	}
+	if manager.spool.Pending("trade") {
+		t.Fatalf("spool pending after replay %d", manager.SpooledBytes())
+	}
+}
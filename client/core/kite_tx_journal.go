@@ -0,0 +1,391 @@
+package core
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	log "github.com/blackbeans/log4go"
+	"kiteq/protocol"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TX_OP_PENDING = "P" //消息发送前记录 P messageId time header
+	TX_OP_STORED  = "K" //broker已经确认存储 K messageId time hostport
+	TX_OP_STATUS  = "S" //本地事务完成 S messageId time status feedback
+	TX_OP_ACKED   = "A" //txack已经发出 A messageId time
+
+	DEFAULT_TX_RETENTION = 24 * time.Hour //已经完成的事务保留时长,用于OnMessageCheck查询
+)
+
+//事务日志的记录
+type txRecord struct {
+	header   *protocol.Header
+	status   protocol.TxStatus
+	feedback string
+	stored   bool   //broker是否已经确认存储
+	hostport string //存储消息的broker,txack只能由它处理
+	resolved bool   //本地事务是否已经有结果
+	acked    bool   //txack是否已经发出
+	time     int64
+}
+
+//客户端本地的事务日志,每条记录写入后fsync
+//进程在发送消息和txack之间崩溃时,重启后根据日志补发txack;
+//本地事务结果未知的通过listener.OnMessageCheck确认
+type TxJournal struct {
+	path      string
+	file      *os.File
+	records   map[string] /*messageId*/ *txRecord
+	retention time.Duration
+	lock      sync.Mutex
+	closeChan chan bool
+}
+
+//打开事务日志,加载并压缩历史记录
+func OpenTxJournal(path string, retention time.Duration) (*TxJournal, error) {
+	if retention <= 0 {
+		retention = DEFAULT_TX_RETENTION
+	}
+	journal := &TxJournal{
+		path:      path,
+		records:   make(map[string]*txRecord, 100),
+		retention: retention,
+		closeChan: make(chan bool, 1)}
+
+	err := journal.replay()
+	if nil != err {
+		return nil, err
+	}
+
+	err = journal.compact()
+	if nil != err {
+		return nil, err
+	}
+	go journal.compactLoop()
+	return journal, nil
+}
+
+//定期清理过期的记录
+func (self *TxJournal) compactLoop() {
+	t := time.NewTicker(time.Hour)
+	defer t.Stop()
+	for {
+		select {
+		case <-self.closeChan:
+			return
+		case <-t.C:
+			self.lock.Lock()
+			err := self.compact()
+			self.lock.Unlock()
+			if nil != err {
+				log.Error("TxJournal|compact|FAIL|%s|%s\n", err, self.path)
+			}
+		}
+	}
+}
+
+//重放日志,最后一行不完整时忽略
+func (self *TxJournal) replay() error {
+	f, err := os.Open(self.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if nil != err {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		split := strings.Split(scanner.Text(), "\t")
+		if len(split) < 3 {
+			log.Warn("TxJournal|replay|INVALID LINE|%s|%d\n", self.path, line)
+			continue
+		}
+		op, messageId := split[0], split[1]
+		ts, _ := strconv.ParseInt(split[2], 10, 64)
+
+		switch op {
+		case TX_OP_PENDING:
+			if len(split) < 4 {
+				continue
+			}
+			data, err := base64.StdEncoding.DecodeString(split[3])
+			if nil != err {
+				log.Warn("TxJournal|replay|INVALID HEADER|%s|%d|%s\n", self.path, line, err)
+				continue
+			}
+			header := &protocol.Header{}
+			err = protocol.UnmarshalPbMessage(data, header)
+			if nil != err {
+				log.Warn("TxJournal|replay|INVALID HEADER|%s|%d|%s\n", self.path, line, err)
+				continue
+			}
+			self.records[messageId] = &txRecord{header: header, time: ts}
+		case TX_OP_STORED:
+			if r, ok := self.records[messageId]; ok {
+				r.stored = true
+				if len(split) >= 4 {
+					r.hostport = split[3]
+				}
+			}
+		case TX_OP_STATUS:
+			r, ok := self.records[messageId]
+			if !ok || len(split) < 5 {
+				continue
+			}
+			status, _ := strconv.Atoi(split[3])
+			feedback, _ := base64.StdEncoding.DecodeString(split[4])
+			r.status = protocol.TxStatus(status)
+			r.feedback = string(feedback)
+			r.resolved = true
+			r.time = ts
+		case TX_OP_ACKED:
+			if r, ok := self.records[messageId]; ok {
+				r.acked = true
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+//丢弃过期的记录并重写日志
+//新日志rename成功后才替换当前的文件,失败时继续使用原来的文件
+func (self *TxJournal) compact() error {
+	expired := time.Now().Add(-self.retention).Unix()
+	tmp := self.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_APPEND|os.O_WRONLY, 0644)
+	if nil != err {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for messageId, r := range self.records {
+		//已经完成或者broker未确认存储的,超过保留时长后不再需要
+		if (!r.stored || r.resolved && r.acked) && r.time < expired {
+			delete(self.records, messageId)
+			continue
+		}
+		w.WriteString(pendingLine(messageId, r.time, r.header))
+		if r.stored {
+			w.WriteString(storedLine(messageId, r.time, r.hostport))
+		}
+		if r.resolved {
+			w.WriteString(statusLine(messageId, r.time, r.status, r.feedback))
+		}
+		if r.acked {
+			w.WriteString(ackedLine(messageId, r.time))
+		}
+	}
+
+	err = w.Flush()
+	if nil == err {
+		err = f.Sync()
+	}
+	if nil == err {
+		err = os.Rename(tmp, self.path)
+	}
+	if nil != err {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	//f已经指向新的日志,直接用于追加
+	if nil != self.file {
+		self.file.Close()
+	}
+	self.file = f
+	return nil
+}
+
+func pendingLine(messageId string, ts int64, header *protocol.Header) string {
+	data, _ := protocol.MarshalPbMessage(header)
+	return fmt.Sprintf("%s\t%s\t%d\t%s\n", TX_OP_PENDING, messageId, ts, base64.StdEncoding.EncodeToString(data))
+}
+
+func storedLine(messageId string, ts int64, hostport string) string {
+	return fmt.Sprintf("%s\t%s\t%d\t%s\n", TX_OP_STORED, messageId, ts, hostport)
+}
+
+func statusLine(messageId string, ts int64, status protocol.TxStatus, feedback string) string {
+	return fmt.Sprintf("%s\t%s\t%d\t%d\t%s\n", TX_OP_STATUS, messageId, ts, status,
+		base64.StdEncoding.EncodeToString([]byte(feedback)))
+}
+
+func ackedLine(messageId string, ts int64) string {
+	return fmt.Sprintf("%s\t%s\t%d\n", TX_OP_ACKED, messageId, ts)
+}
+
+//追加并fsync
+func (self *TxJournal) append(line string) error {
+	_, err := self.file.WriteString(line)
+	if nil != err {
+		return err
+	}
+	return self.file.Sync()
+}
+
+//发送事务消息前记录
+func (self *TxJournal) Pending(header *protocol.Header) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	now := time.Now().Unix()
+	err := self.append(pendingLine(header.GetMessageId(), now, header))
+	if nil != err {
+		log.Error("TxJournal|Pending|FAIL|%s|%s\n", err, header.GetMessageId())
+		return err
+	}
+	self.records[header.GetMessageId()] = &txRecord{header: header, time: now}
+	return nil
+}
+
+//hostport的broker已经确认存储消息
+func (self *TxJournal) Stored(messageId string, hostport string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	r, ok := self.records[messageId]
+	if !ok {
+		return nil
+	}
+	err := self.append(storedLine(messageId, time.Now().Unix(), hostport))
+	if nil != err {
+		log.Error("TxJournal|Stored|FAIL|%s|%s\n", err, messageId)
+		return err
+	}
+	r.stored = true
+	r.hostport = hostport
+	return nil
+}
+
+//记录本地事务的结果
+func (self *TxJournal) Resolve(messageId string, status protocol.TxStatus, feedback string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	r, ok := self.records[messageId]
+	if !ok {
+		return nil
+	}
+	now := time.Now().Unix()
+	err := self.append(statusLine(messageId, now, status, feedback))
+	if nil != err {
+		log.Error("TxJournal|Resolve|FAIL|%s|%s\n", err, messageId)
+		return err
+	}
+	r.status = status
+	r.feedback = feedback
+	r.resolved = true
+	r.time = now
+	return nil
+}
+
+//txack已经发出
+func (self *TxJournal) Acked(messageId string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	r, ok := self.records[messageId]
+	if !ok {
+		return nil
+	}
+	err := self.append(ackedLine(messageId, time.Now().Unix()))
+	if nil != err {
+		log.Error("TxJournal|Acked|FAIL|%s|%s\n", err, messageId)
+		return err
+	}
+	r.acked = true
+	return nil
+}
+
+//查询本地事务的结果,未记录或者未完成时返回false
+func (self *TxJournal) Lookup(messageId string) (protocol.TxStatus, string, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	r, ok := self.records[messageId]
+	if !ok || !r.resolved {
+		return protocol.TX_UNKNOWN, "", false
+	}
+	return r.status, r.feedback, true
+}
+
+//需要补发txack的记录
+//broker没有确认存储的消息可能根本没有到达broker,不需要补发
+func (self *TxJournal) unacked() []*txRecord {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	records := make([]*txRecord, 0, 10)
+	for _, r := range self.records {
+		if r.stored && !r.acked {
+			cr := *r
+			records = append(records, &cr)
+		}
+	}
+	return records
+}
+
+func (self *TxJournal) Close() error {
+	close(self.closeChan)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.file.Close()
+}
+
+//开启本地事务日志,需要在Start之前设置
+func (self *KiteClientManager) SetTxJournal(path string, retention time.Duration) error {
+	journal, err := OpenTxJournal(path, retention)
+	if nil != err {
+		log.Error("KiteClientManager|SetTxJournal|FAIL|%s|%s\n", err, path)
+		return err
+	}
+	self.txJournal = journal
+	self.acceptHandler.SetTxLookup(journal.Lookup)
+	log.Info("KiteClientManager|SetTxJournal|SUCC|%s\n", path)
+	return nil
+}
+
+//查询本地事务日志中的结果
+func (self *KiteClientManager) LookupTx(messageId string) (protocol.TxStatus, string, bool) {
+	if nil == self.txJournal {
+		return protocol.TX_UNKNOWN, "", false
+	}
+	return self.txJournal.Lookup(messageId)
+}
+
+//重启后处理broker已经确认存储但未完成的事务:结果未知的通过OnMessageCheck确认,再补发txack
+func (self *KiteClientManager) recoverTx() {
+	for _, r := range self.txJournal.unacked() {
+		messageId := r.header.GetMessageId()
+		if !r.resolved {
+			tx := protocol.NewTxResponse(r.header)
+			err := self.listener.OnMessageCheck(tx)
+			if nil != err || tx.GetStatus() == protocol.TX_UNKNOWN {
+				//留给服务端回查
+				log.Warn("KiteClientManager|recoverTx|UNKNOWN|%s|%s\n", messageId, err)
+				continue
+			}
+			r.status = tx.GetStatus()
+			r.feedback = tx.GetFeedback()
+			self.txJournal.Resolve(messageId, r.status, r.feedback)
+		}
+
+		//只有存储消息的broker能处理txack,broker不在时留给服务端回查
+		c := self.findKiteClient(r.header.GetTopic(), r.hostport)
+		if nil == c {
+			log.Warn("KiteClientManager|recoverTx|NO BROKER|%s|%s\n", messageId, r.hostport)
+			continue
+		}
+		err := c.sendTxAck(r.header, r.status, r.feedback)
+		if nil != err {
+			log.Error("KiteClientManager|recoverTx|sendTxAck|FAIL|%s|%s\n", err, messageId)
+			continue
+		}
+		self.txJournal.Acked(messageId)
+		log.Info("KiteClientManager|recoverTx|SUCC|%s|%d\n", messageId, r.status)
+	}
+}
@@ -0,0 +1,162 @@
+package core
+
+import (
+	"io/ioutil"
+	"kiteq/protocol"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTxJournalReplay(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kiteq-txjournal")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tx.log")
+
+	journal, err := OpenTxJournal(path, time.Hour)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	commit := buildStringMessage(false).GetHeader()
+	pending := buildStringMessage(false).GetHeader()
+	unacked := buildStringMessage(false).GetHeader()
+	unstored := buildStringMessage(false).GetHeader()
+	journal.Pending(commit)
+	journal.Pending(pending)
+	journal.Pending(unacked)
+	journal.Pending(unstored)
+	journal.Stored(commit.GetMessageId(), "localhost:13800")
+	journal.Stored(pending.GetMessageId(), "localhost:13800")
+	journal.Stored(unacked.GetMessageId(), "localhost:13800")
+	journal.Resolve(commit.GetMessageId(), protocol.TX_COMMIT, "")
+	journal.Acked(commit.GetMessageId())
+	journal.Resolve(unacked.GetMessageId(), protocol.TX_ROLLBACK, "rollback")
+	journal.Close()
+
+	//模拟崩溃后的不完整写入
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString("S\t" + pending.GetMessageId())
+	f.Close()
+
+	journal, err = OpenTxJournal(path, time.Hour)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+
+	status, _, ok := journal.Lookup(commit.GetMessageId())
+	if !ok || status != protocol.TX_COMMIT {
+		t.Fail()
+		t.Logf("TestTxJournalReplay|commit|%d|%v\n", status, ok)
+	}
+
+	status, feedback, ok := journal.Lookup(unacked.GetMessageId())
+	if !ok || status != protocol.TX_ROLLBACK || feedback != "rollback" {
+		t.Fail()
+		t.Logf("TestTxJournalReplay|rollback|%d|%s|%v\n", status, feedback, ok)
+	}
+
+	if _, _, ok := journal.Lookup(pending.GetMessageId()); ok {
+		t.Fail()
+		t.Log("TestTxJournalReplay|pending resolved")
+	}
+
+	//未发出txack的需要在重启后补发,broker没有确认存储的不补发
+	records := journal.unacked()
+	if len(records) != 2 {
+		t.Fail()
+		t.Logf("TestTxJournalReplay|unacked|%d\n", len(records))
+	}
+	for _, r := range records {
+		if r.header.GetTopic() != "trade" || r.header.GetMessageId() == unstored.GetMessageId() {
+			t.Fail()
+			t.Logf("TestTxJournalReplay|header|%v\n", r.header)
+		}
+	}
+}
+
+//压缩失败时继续使用原来的日志
+func TestTxJournalCompactFail(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kiteq-txjournal")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tx.log")
+
+	journal, err := OpenTxJournal(path, time.Hour)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+
+	header := buildStringMessage(false).GetHeader()
+	journal.Pending(header)
+
+	//临时文件无法创建
+	os.Mkdir(path+".tmp", 0755)
+	if err := journal.compact(); nil == err {
+		t.Fatal("TestTxJournalCompactFail|compact succ")
+	}
+	if err := journal.Resolve(header.GetMessageId(), protocol.TX_COMMIT, ""); nil != err {
+		t.Fatalf("TestTxJournalCompactFail|Resolve|%s\n", err)
+	}
+
+	os.Remove(path + ".tmp")
+	if err := journal.compact(); nil != err {
+		t.Fatalf("TestTxJournalCompactFail|compact|%s\n", err)
+	}
+	if err := journal.Acked(header.GetMessageId()); nil != err {
+		t.Fatalf("TestTxJournalCompactFail|Acked|%s\n", err)
+	}
+
+	replay := &TxJournal{path: path, records: make(map[string]*txRecord, 1)}
+	if err := replay.replay(); nil != err {
+		t.Fatal(err)
+	}
+	r, ok := replay.records[header.GetMessageId()]
+	if !ok || !r.resolved || !r.acked {
+		t.Fatalf("TestTxJournalCompactFail|replay|%v\n", r)
+	}
+}
+
+//重启后txack只补发给存储消息的broker,broker不在时留给服务端回查
+func TestRecoverTxStoredBroker(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kiteq-txjournal")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tx.log")
+
+	journal, err := OpenTxJournal(path, time.Hour)
+	if nil != err {
+		t.Fatal(err)
+	}
+	stored := buildStringMessage(false).GetHeader()
+	gone := buildStringMessage(false).GetHeader()
+	journal.Pending(stored)
+	journal.Pending(gone)
+	journal.Stored(stored.GetMessageId(), "localhost:13801")
+	journal.Stored(gone.GetMessageId(), "localhost:13802")
+	journal.Resolve(stored.GetMessageId(), protocol.TX_COMMIT, "")
+	journal.Resolve(gone.GetMessageId(), protocol.TX_COMMIT, "")
+	journal.Close()
+
+	journal, err = OpenTxJournal(path, time.Hour)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+
+	other := &mockRemoting{addr: "localhost:13800"}
+	broker := &mockRemoting{addr: "localhost:13801"}
+	manager := mockManager(10, other, broker)
+	defer close(manager.closeChan)
+	manager.txJournal = journal
+	manager.recoverTx()
+
+	if cmds := broker.cmds(); len(cmds) != 1 || cmds[0] != protocol.CMD_TX_ACK || len(other.cmds()) != 0 {
+		t.Fatalf("TestRecoverTxStoredBroker|txack|%v|%v\n", cmds, other.cmds())
+	}
+	records := journal.unacked()
+	if len(records) != 1 || records[0].header.GetMessageId() != gone.GetMessageId() {
+		t.Fatalf("TestRecoverTxStoredBroker|unacked|%d\n", len(records))
+	}
+}
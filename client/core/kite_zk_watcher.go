@@ -6,8 +6,8 @@ import (
 	"github.com/blackbeans/turbo/packet"
 	"github.com/blackbeans/turbo/pipe"
 	"kiteq/binding"
-	"sort"
 	"strings"
+	"time"
 )
 
 func (self *KiteClientManager) NodeChange(path string, eventType binding.ZkEvent, children []string) {
@@ -24,7 +24,7 @@ func (self *KiteClientManager) NodeChange(path string, eventType binding.ZkEvent
 		//获取topic
 		topic := split[3]
 		//不是当前服务可以处理的topic则直接丢地啊哦
-		if sort.SearchStrings(self.topics, topic) == len(self.topics) {
+		if !containsTopic(self.currentTopics(), topic) {
 			log.Warn("BindExchanger|ChildWatcher|REFUSE SERVER PATH |%s|%t\n", path, children)
 			return
 		}
@@ -40,6 +40,7 @@ func (self *KiteClientManager) onQServerChanged(topic string, hosts []string) {
 	for _, host := range hosts {
 		//如果能查到remoteClient 则直接复用
 		remoteClient := self.clientManager.FindRemoteClient(host)
+		batch := self.supportBatch(host)
 		if nil == remoteClient {
 			//这里就新建一个remote客户端连接
 			conn, err := dial(host)
@@ -56,17 +57,19 @@ func (self *KiteClientManager) onQServerChanged(topic string, hosts []string) {
 					}
 				}, self.rc)
 			remoteClient.Start()
-			auth, err := handshake(self.ga, remoteClient)
-			if !auth || nil != err {
+			ack, err := handshakeAck(self.ga, remoteClient)
+			if nil != err {
 				remoteClient.Shutdown()
-				log.Error("KiteClientManager|onQServerChanged|HANDSHAKE|FAIL|%s|%s\n", err, auth)
+				log.Error("KiteClientManager|onQServerChanged|HANDSHAKE|FAIL|%s|%s\n", err, host)
 				continue
 			}
 			self.clientManager.Auth(self.ga, remoteClient)
+			batch = ack.GetBatch()
 		}
 
 		//创建kiteClient
 		kiteClient := newKitClient(remoteClient)
+		kiteClient.batch = batch
 		clients = append(clients, kiteClient)
 		log.Info("KiteClientManager|onQServerChanged|newKitClient|SUCC|%s\n", host)
 	}
@@ -92,6 +95,98 @@ func (self *KiteClientManager) onQServerChanged(topic string, hosts []string) {
 			self.clientManager.DeleteClients(del...)
 		}
 	}
+
+	//broker恢复后重放spool中的消息
+	if nil != self.spool && len(clients) > 0 {
+		go self.replaySpool(topic)
+	}
+}
+
+//zk的watcher无法保证可靠,周期性的全量拉取QServer列表修正本地的连接
+func (self *KiteClientManager) startResync(period time.Duration) {
+	go func() {
+		t := time.NewTicker(period)
+		defer t.Stop()
+		for {
+			select {
+			case <-self.closeChan:
+				return
+			case <-t.C:
+				self.resync()
+			}
+		}
+	}()
+}
+
+//对比注册中心与本地的QServer列表,不一致则重建
+func (self *KiteClientManager) resync() {
+	for _, topic := range self.currentTopics() {
+		hosts, err := self.registry.GetQServerAndWatch(topic)
+		if nil != err {
+			log.Error("KiteClientManager|resync|GetQServerAndWatch|FAIL|%s|%s\n", err, topic)
+			continue
+		}
+
+		self.lock.RLock()
+		clients := self.kiteClients[topic]
+		current := make(map[string]bool, len(clients))
+		for _, c := range clients {
+			current[c.remotec.RemoteAddr()] = true
+		}
+		self.lock.RUnlock()
+
+		drift := len(hosts) != len(current)
+		for _, h := range hosts {
+			if !current[h] {
+				drift = true
+				break
+			}
+		}
+
+		if drift {
+			self.flowstat.ResyncFlow.Incr(1)
+			log.Warn("KiteClientManager|resync|QServer Changed|%s|%v|%v\n", topic, current, hosts)
+			self.onQServerChanged(topic, hosts)
+		} else if nil != self.spool && len(clients) > 0 && self.spool.Pending(topic) {
+			//重放失败后broker没有变化时定期重试
+			go self.replaySpool(topic)
+		}
+	}
+
+	self.resyncBindings()
+}
+
+//本分组的订阅关系在注册中心丢失或者被修改则重新推送
+func (self *KiteClientManager) resyncBindings() {
+	self.subLock.Lock()
+	defer self.subLock.Unlock()
+	topics := make(map[string][]*binding.Binding, len(self.binds))
+	for _, b := range self.binds {
+		topics[b.Topic] = append(topics[b.Topic], b)
+	}
+
+	for topic, binds := range topics {
+		groups, err := self.registry.GetBindAndWatch(topic)
+		if nil != err {
+			log.Error("KiteClientManager|resync|GetBindAndWatch|FAIL|%s|%s\n", err, topic)
+			continue
+		}
+
+		remote := groups[self.ga.GroupId]
+		drift := len(remote) != len(binds)
+		for i := 0; !drift && i < len(binds); i++ {
+			drift = *remote[i] != *binds[i]
+		}
+
+		if drift {
+			self.flowstat.ResyncFlow.Incr(1)
+			log.Warn("KiteClientManager|resync|Bindings Changed|%s|%v|%v\n", topic, remote, binds)
+			err = self.registry.PublishBindings(self.ga.GroupId, binds)
+			if nil != err {
+				log.Error("KiteClientManager|resync|PublishBindings|FAIL|%s|%s\n", err, topic)
+			}
+		}
+	}
 }
 
 func (self *KiteClientManager) DataChange(path string, binds []*binding.Binding) {
@@ -104,3 +199,29 @@ func (self *KiteClientManager) OnSessionExpired() {
 
 	log.Info("KiteClientManager|OnSessionExpired|Restart...")
 }
+
+//topic下指定broker的连接,不存在或者已经断开时返回nil
+func (self *KiteClientManager) findKiteClient(topic string, hostport string) *kiteClient {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	for _, c := range self.kiteClients[topic] {
+		if c.remotec.RemoteAddr() == hostport && !c.remotec.IsClosed() {
+			return c
+		}
+	}
+	return nil
+}
+
+//复用的连接沿用握手时服务端是否支持批量发送
+func (self *KiteClientManager) supportBatch(hostport string) bool {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	for _, clients := range self.kiteClients {
+		for _, c := range clients {
+			if c.remotec.RemoteAddr() == hostport {
+				return c.batch
+			}
+		}
+	}
+	return false
+}
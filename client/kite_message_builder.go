@@ -0,0 +1,128 @@
+package client
+
+import (
+	"github.com/golang/protobuf/proto"
+	"kiteq/protocol"
+	"kiteq/store"
+	"strconv"
+	"time"
+)
+
+const (
+	DEFAULT_MESSAGE_TTL   = 24 * time.Hour //消息默认的过期时间
+	DEFAULT_DELIVER_LIMIT = 100            //消息默认的投递次数上限
+)
+
+//消息构造器,自动填充messageId、groupId、过期时间和投递次数
+//  msg := kiteClient.NewMessage("trade", "pay-succ").Property("orderId", "123").StringMessage("hello")
+type MessageBuilder struct {
+	header     *protocol.Header
+	ttl        time.Duration
+	properties map[string]string
+	keys       []string //保持属性的设置顺序
+}
+
+//创建消息构造器,groupId为发送方分组
+func NewMessageBuilder(groupId, topic, messageType string) *MessageBuilder {
+	return &MessageBuilder{
+		header: &protocol.Header{
+			Topic:        proto.String(topic),
+			MessageType:  proto.String(messageType),
+			GroupId:      proto.String(groupId),
+			DeliverLimit: proto.Int32(DEFAULT_DELIVER_LIMIT),
+			Commit:       proto.Bool(true),
+			Fly:          proto.Bool(false)},
+		ttl:        DEFAULT_MESSAGE_TTL,
+		properties: make(map[string]string, 4),
+		keys:       make([]string, 0, 4)}
+}
+
+//使用当前client的分组创建消息构造器
+func (self *KiteQClient) NewMessage(topic, messageType string) *MessageBuilder {
+	return NewMessageBuilder(self.groupId, topic, messageType)
+}
+
+//指定messageId,默认使用store.MessageId生成
+func (self *MessageBuilder) MessageId(messageId string) *MessageBuilder {
+	self.header.MessageId = proto.String(messageId)
+	return self
+}
+
+//消息的存活时长
+func (self *MessageBuilder) TTL(ttl time.Duration) *MessageBuilder {
+	self.ttl = ttl
+	return self
+}
+
+//投递次数上限
+func (self *MessageBuilder) DeliverLimit(limit int32) *MessageBuilder {
+	self.header.DeliverLimit = proto.Int32(limit)
+	return self
+}
+
+//是否提交,事务消息为false,由本地事务的结果决定提交或者回滚
+func (self *MessageBuilder) Commit(commit bool) *MessageBuilder {
+	self.header.Commit = proto.Bool(commit)
+	return self
+}
+
+//飞行模式,不存储直接投递
+func (self *MessageBuilder) Fly(fly bool) *MessageBuilder {
+	self.header.Fly = proto.Bool(fly)
+	return self
+}
+
+//自定义属性,重复设置时覆盖
+func (self *MessageBuilder) Property(key, value string) *MessageBuilder {
+	if _, ok := self.properties[key]; !ok {
+		self.keys = append(self.keys, key)
+	}
+	self.properties[key] = value
+	return self
+}
+
+func (self *MessageBuilder) IntProperty(key string, value int64) *MessageBuilder {
+	return self.Property(key, strconv.FormatInt(value, 10))
+}
+
+func (self *MessageBuilder) FloatProperty(key string, value float64) *MessageBuilder {
+	return self.Property(key, strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+func (self *MessageBuilder) BoolProperty(key string, value bool) *MessageBuilder {
+	return self.Property(key, strconv.FormatBool(value))
+}
+
+//时间属性按照unix秒存储
+func (self *MessageBuilder) TimeProperty(key string, value time.Time) *MessageBuilder {
+	return self.IntProperty(key, value.Unix())
+}
+
+//生成消息头,每次调用未指定messageId时生成新的id
+func (self *MessageBuilder) buildHeader() *protocol.Header {
+	header := *self.header
+	if nil == header.MessageId {
+		header.MessageId = proto.String(store.MessageId())
+	}
+	header.ExpiredTime = proto.Int64(time.Now().Add(self.ttl).Unix())
+
+	header.Properties = make([]*protocol.Entry, 0, len(self.keys))
+	for _, key := range self.keys {
+		header.Properties = append(header.Properties, &protocol.Entry{
+			Key:   proto.String(key),
+			Value: proto.String(self.properties[key])})
+	}
+	return &header
+}
+
+func (self *MessageBuilder) StringMessage(body string) *protocol.StringMessage {
+	return &protocol.StringMessage{
+		Header: self.buildHeader(),
+		Body:   proto.String(body)}
+}
+
+func (self *MessageBuilder) BytesMessage(body []byte) *protocol.BytesMessage {
+	return &protocol.BytesMessage{
+		Header: self.buildHeader(),
+		Body:   body}
+}
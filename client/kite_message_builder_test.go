@@ -0,0 +1,41 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMessageBuilder(t *testing.T) {
+	builder := NewMessageBuilder("ps-trade-a", "trade", "pay-succ").
+		TTL(time.Hour).
+		Property("orderId", "123").
+		IntProperty("amount", 100).
+		BoolProperty("vip", true).
+		Property("orderId", "456")
+
+	msg := builder.StringMessage("hello")
+	h := msg.GetHeader()
+	if len(h.GetMessageId()) != 32 || h.GetGroupId() != "ps-trade-a" || !h.GetCommit() ||
+		h.GetDeliverLimit() != DEFAULT_DELIVER_LIMIT || msg.GetBody() != "hello" {
+		t.Fail()
+		t.Logf("TestMessageBuilder|%s\n", msg)
+	}
+
+	if h.GetExpiredTime() <= time.Now().Add(59*time.Minute).Unix() {
+		t.Fail()
+		t.Logf("TestMessageBuilder|ExpiredTime|%d\n", h.GetExpiredTime())
+	}
+
+	props := h.GetProperties()
+	if len(props) != 3 || props[0].GetValue() != "456" || props[1].GetValue() != "100" || props[2].GetValue() != "true" {
+		t.Fail()
+		t.Logf("TestMessageBuilder|Properties|%v\n", props)
+	}
+
+	//每次生成新的messageId
+	bmsg := builder.Commit(false).BytesMessage([]byte("hello"))
+	if bmsg.GetHeader().GetMessageId() == h.GetMessageId() || bmsg.GetHeader().GetCommit() {
+		t.Fail()
+		t.Logf("TestMessageBuilder|BytesMessage|%s\n", bmsg)
+	}
+}
@@ -1,23 +1,57 @@
 package client
 
 import (
+	"context"
 	"kiteq/binding"
 	"kiteq/client/core"
 	"kiteq/client/listener"
 	"kiteq/protocol"
+	"net/url"
+	"strings"
+	"time"
 )
 
 type KiteQClient struct {
 	kclientManager *core.KiteClientManager
+	groupId        string
+	router         *listener.RouterListener
 }
 
 func (self *KiteQClient) Start() {
+	//订阅关系由router注册的handler生成
+	if nil != self.router {
+		binds := self.router.Bindings(self.groupId)
+		if len(binds) > 0 {
+			self.kclientManager.SetBindings(binds)
+		}
+	}
 	self.kclientManager.Start()
 }
 
-func NewKiteQClient(zkAddr, groupId, secretKey string, listener listener.IListener) *KiteQClient {
+//registryUri 注册中心地址,兼容zk的 localhost:2181 ,也可以为 etcd://localhost:2379 、file:///path/registry.json
+//zk可以指定根路径和digest认证 zk://localhost:2181?root=/kiteq-prod&digest=user:password
+func NewKiteQClient(registryUri, groupId, secretKey string, listener listener.IListener) *KiteQClient {
 	return &KiteQClient{
-		kclientManager: core.NewKiteClientManager(zkAddr, groupId, secretKey, listener)}
+		kclientManager: core.NewKiteClientManager(registryUri, groupId, secretKey, listener),
+		groupId:        groupId}
+}
+
+//按照topic+messageType分发消息,Start时根据router中注册的handler生成订阅关系
+func NewKiteQClientWithRouter(registryUri, groupId, secretKey string, router *listener.RouterListener) *KiteQClient {
+	client := NewKiteQClient(registryUri, groupId, secretKey, router)
+	client.router = router
+	return client
+}
+
+//不依赖注册中心,直接使用固定的broker列表 topic->[ip:port]
+//broker通过心跳检测健康状况,断开的broker会自动重连并在发送时故障转移到其他broker
+//注意:该模式下订阅关系无法推送给broker,需要在broker端的注册中心配置
+func NewKiteQClientWithBrokers(brokers map[string] /*topic*/ []string, groupId, secretKey string, listener listener.IListener) *KiteQClient {
+	params := url.Values{}
+	for topic, hosts := range brokers {
+		params.Set(topic, strings.Join(hosts, ","))
+	}
+	return NewKiteQClient(binding.SCHEMA_STATIC+params.Encode(), groupId, secretKey, listener)
 }
 
 func (self *KiteQClient) SetTopics(topics []string) {
@@ -29,6 +63,21 @@ func (self *KiteQClient) SetBindings(bindings []*binding.Binding) {
 
 }
 
+//运行时增加订阅关系,Start之后调用;与已有订阅关系冲突时返回错误
+func (self *KiteQClient) Subscribe(bindings []*binding.Binding) error {
+	return self.kclientManager.Subscribe(bindings)
+}
+
+//运行时取消订阅关系,按照topic+messageType+bindType匹配
+func (self *KiteQClient) Unsubscribe(bindings []*binding.Binding) error {
+	return self.kclientManager.Unsubscribe(bindings)
+}
+
+//运行时增加可以发送的topic,Start之后调用
+func (self *KiteQClient) AddPublishTopic(topics []string) error {
+	return self.kclientManager.AddPublishTopic(topics)
+}
+
 func (self *KiteQClient) SendTxStringMessage(msg *protocol.StringMessage, transcation core.DoTranscation) error {
 	message := protocol.NewQMessage(msg)
 	return self.kclientManager.SendTxMessage(message, transcation)
@@ -49,6 +98,117 @@ func (self *KiteQClient) SendBytesMessage(msg *protocol.BytesMessage) error {
 	return self.kclientManager.SendMessage(message)
 }
 
+//ctx可以传递超时和取消,deadline小于发送超时时间时以deadline为准
+func (self *KiteQClient) SendStringMessageContext(ctx context.Context, msg *protocol.StringMessage) error {
+	message := protocol.NewQMessage(msg)
+	return self.kclientManager.SendMessageContext(ctx, message)
+}
+
+func (self *KiteQClient) SendBytesMessageContext(ctx context.Context, msg *protocol.BytesMessage) error {
+	message := protocol.NewQMessage(msg)
+	return self.kclientManager.SendMessageContext(ctx, message)
+}
+
+//ctx只控制消息的发送,本地事务执行后总会发送txack
+func (self *KiteQClient) SendTxStringMessageContext(ctx context.Context, msg *protocol.StringMessage, transcation core.DoTranscation) error {
+	message := protocol.NewQMessage(msg)
+	return self.kclientManager.SendTxMessageContext(ctx, message, transcation)
+}
+
+func (self *KiteQClient) SendTxBytesMessageContext(ctx context.Context, msg *protocol.BytesMessage, transcation core.DoTranscation) error {
+	message := protocol.NewQMessage(msg)
+	return self.kclientManager.SendTxMessageContext(ctx, message, transcation)
+}
+
+//设置发送等待服务端确认的超时时间,默认3s
+func (self *KiteQClient) SetSendTimeout(timeout time.Duration) {
+	self.kclientManager.SetSendTimeout(timeout)
+}
+
+//设置发送失败的重试及熔断策略,重试时messageId保持不变
+func (self *KiteQClient) SetRetryPolicy(policy core.RetryPolicy) {
+	self.kclientManager.SetRetryPolicy(policy)
+}
+
+//开启消费线程池,需要在Start之前设置,默认在网络线程中同步回调OnMessage
+//每个topic独立workers个消费线程和长度为queueSize的队列,队列满时NACK由服务端稍后重投
+func (self *KiteQClient) SetConsumerWorkers(workers, queueSize int) {
+	self.kclientManager.SetConsumerWorkers(workers, queueSize)
+}
+
+//单独设置某个topic的消费线程数和队列长度
+func (self *KiteQClient) SetTopicConsumerWorkers(topic string, workers, queueSize int) {
+	self.kclientManager.SetTopicConsumerWorkers(topic, workers, queueSize)
+}
+
+//各个topic消费队列中等待处理的消息数量
+func (self *KiteQClient) ConsumerQueueDepth() map[string]int {
+	return self.kclientManager.ConsumerQueueDepth()
+}
+
+//开启发送失败消息的本地spool,需要在Start之前设置
+//没有可用的broker或者重试后仍然失败的消息写入dir并返回成功,broker恢复后按写入顺序重放
+//maxBytes为spool的大小上限,<=0时不限制;事务消息不会写入spool
+func (self *KiteQClient) SetSpool(dir string, maxBytes int64) error {
+	return self.kclientManager.SetSpool(dir, maxBytes)
+}
+
+//spool中等待重放的字节数
+func (self *KiteQClient) SpooledBytes() int64 {
+	return self.kclientManager.SpooledBytes()
+}
+
+//设置broker的路由策略,默认随机选择
+//可选core.RoundRobinRouter、core.NewHashRouter(key)按照消息属性一致性hash、
+//core.NewLatencyRouter(client.LatencyStat())按照心跳延迟加权,也可以实现core.IRouter自定义
+func (self *KiteQClient) SetRouter(router core.IRouter) {
+	self.kclientManager.SetRouter(router)
+}
+
+//心跳测量的broker延迟
+func (self *KiteQClient) LatencyStat() *core.LatencyStat {
+	return self.kclientManager.LatencyStat()
+}
+
+//开启本地事务日志,需要在Start之前设置
+//进程在发送事务消息和txack之间崩溃时,重启后根据日志补发txack,事务回查时优先使用日志中的结果
+//retention为已完成事务的保留时长,<=0时默认24小时
+func (self *KiteQClient) SetTxJournal(path string, retention time.Duration) error {
+	return self.kclientManager.SetTxJournal(path, retention)
+}
+
+//在OnMessageCheck中查询本地事务日志记录的结果
+func (self *KiteQClient) LookupTx(messageId string) (protocol.TxStatus, string, bool) {
+	return self.kclientManager.LookupTx(messageId)
+}
+
+//设置异步发送的最大未完成数,需要在Start之前设置
+func (self *KiteQClient) SetMaxInflight(maxInflight int) {
+	self.kclientManager.SetMaxInflight(maxInflight)
+}
+
+//异步发送,通过返回的future或者callback获取服务端的存储结果
+func (self *KiteQClient) SendStringMessageAsync(msg *protocol.StringMessage, timeout time.Duration, callback core.SendCallback) *core.SendFuture {
+	message := protocol.NewQMessage(msg)
+	return self.kclientManager.SendMessageAsync(message, timeout, callback)
+}
+
+func (self *KiteQClient) SendBytesMessageAsync(msg *protocol.BytesMessage, timeout time.Duration, callback core.SendCallback) *core.SendFuture {
+	message := protocol.NewQMessage(msg)
+	return self.kclientManager.SendMessageAsync(message, timeout, callback)
+}
+
+//攒批发送,达到maxBatchSize条或者等待linger后发送
+func (self *KiteQClient) NewBatchProducer(maxBatchSize int, linger time.Duration) *core.BatchProducer {
+	return self.kclientManager.NewBatchProducer(maxBatchSize, linger)
+}
+
+//优雅关闭:不再接收推送,注销本实例的publisher和非持久订阅,
+//等待处理中的消息、txack和异步发送完成后关闭连接;ctx超时后直接关闭
+func (self *KiteQClient) Close(ctx context.Context) error {
+	return self.kclientManager.Close(ctx)
+}
+
 func (self *KiteQClient) Destory() {
 	self.kclientManager.Destory()
 }
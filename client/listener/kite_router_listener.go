@@ -0,0 +1,169 @@
+package listener
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/blackbeans/log4go"
+	"kiteq/binding"
+	"kiteq/protocol"
+	"regexp"
+	"sync"
+)
+
+//处理消息,返回false时服务端会重投
+type MessageHandler func(msg *protocol.QMessage) bool
+
+//事务回查
+type TxCheckHandler func(tx *protocol.TxResponse) error
+
+var ERROR_NO_TX_CHECK_HANDLER = errors.New("NO TX CHECK HANDLER !")
+
+type route struct {
+	bind    *binding.Binding
+	regx    *regexp.Regexp
+	handler MessageHandler
+}
+
+//按照topic+messageType分发消息的listener
+//注册方式与binding.Bind_Direct/Bind_Regx/Bind_Fanout一致,订阅关系由注册的handler生成
+//匹配顺序:直接订阅 > 正则订阅(按注册顺序) > 广播订阅 > fallback
+type RouterListener struct {
+	routes     []*route
+	txChecks   map[string] /*topic*/ TxCheckHandler
+	fallback   MessageHandler
+	txFallback TxCheckHandler
+	lock       sync.RWMutex
+}
+
+func NewRouterListener() *RouterListener {
+	return &RouterListener{
+		routes:   make([]*route, 0, 10),
+		txChecks: make(map[string]TxCheckHandler, 10)}
+}
+
+//直接订阅topic下的messageType
+func (self *RouterListener) Direct(topic, messageType string, watermark int32, persistent bool, handler MessageHandler) error {
+	return self.handle(binding.Bind_Direct("", topic, messageType, watermark, persistent), handler)
+}
+
+//正则订阅topic下的messageType
+func (self *RouterListener) Regx(topic, messageType string, watermark int32, persistent bool, handler MessageHandler) error {
+	return self.handle(binding.Bind_Regx("", topic, messageType, watermark, persistent), handler)
+}
+
+//订阅topic下的所有消息
+func (self *RouterListener) Fanout(topic string, watermark int32, persistent bool, handler MessageHandler) error {
+	return self.handle(binding.Bind_Fanout("", topic, watermark, persistent), handler)
+}
+
+func (self *RouterListener) handle(bind *binding.Binding, handler MessageHandler) error {
+	r := &route{bind: bind, handler: handler}
+	if bind.BindType == binding.BIND_REGX {
+		regx, err := regexp.Compile(bind.MessageType)
+		if nil != err {
+			return err
+		}
+		r.regx = regx
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, exist := range self.routes {
+		if exist.bind.Conflict(bind) {
+			return fmt.Errorf("binding conflict : %s:%s with %s:%s", bind.Topic, bind.MessageType,
+				exist.bind.Topic, exist.bind.MessageType)
+		}
+	}
+	self.routes = append(self.routes, r)
+	return nil
+}
+
+//没有匹配的handler时调用,未设置时返回false
+func (self *RouterListener) Fallback(handler MessageHandler) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.fallback = handler
+}
+
+//设置topic的事务回查handler
+func (self *RouterListener) TxCheck(topic string, handler TxCheckHandler) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.txChecks[topic] = handler
+}
+
+//没有对应topic的事务回查handler时调用,未设置时事务状态为未知
+func (self *RouterListener) TxFallback(handler TxCheckHandler) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.txFallback = handler
+}
+
+//根据注册的handler生成该分组的订阅关系
+func (self *RouterListener) Bindings(groupId string) []*binding.Binding {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	binds := make([]*binding.Binding, 0, len(self.routes))
+	for _, r := range self.routes {
+		b := *r.bind
+		b.GroupId = groupId
+		binds = append(binds, &b)
+	}
+	return binds
+}
+
+func (self *RouterListener) match(topic, messageType string) MessageHandler {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	var regx, fanout MessageHandler
+	for _, r := range self.routes {
+		if r.bind.Topic != topic {
+			continue
+		}
+		switch r.bind.BindType {
+		case binding.BIND_DIRECT:
+			if r.bind.MessageType == messageType {
+				return r.handler
+			}
+		case binding.BIND_REGX:
+			if nil == regx && r.regx.MatchString(messageType) {
+				regx = r.handler
+			}
+		case binding.BIND_FANOUT:
+			if nil == fanout {
+				fanout = r.handler
+			}
+		}
+	}
+	if nil != regx {
+		return regx
+	} else if nil != fanout {
+		return fanout
+	}
+	return self.fallback
+}
+
+func (self *RouterListener) OnMessage(msg *protocol.QMessage) bool {
+	header := msg.GetHeader()
+	handler := self.match(header.GetTopic(), header.GetMessageType())
+	if nil == handler {
+		log.Warn("RouterListener|OnMessage|NO HANDLER|%s|%s|%s\n", header.GetTopic(), header.GetMessageType(), header.GetMessageId())
+		return false
+	}
+	return handler(msg)
+}
+
+func (self *RouterListener) OnMessageCheck(tx *protocol.TxResponse) error {
+	self.lock.RLock()
+	handler, ok := self.txChecks[tx.Topic]
+	if !ok {
+		handler = self.txFallback
+	}
+	self.lock.RUnlock()
+
+	if nil == handler {
+		log.Warn("RouterListener|OnMessageCheck|NO HANDLER|%s|%s\n", tx.Topic, tx.MessageId)
+		return ERROR_NO_TX_CHECK_HANDLER
+	}
+	return handler(tx)
+}
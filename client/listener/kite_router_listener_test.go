@@ -0,0 +1,81 @@
+package listener
+
+import (
+	"github.com/golang/protobuf/proto"
+	"kiteq/binding"
+	"kiteq/protocol"
+	"testing"
+)
+
+func routerMessage(topic, messageType string) *protocol.QMessage {
+	return protocol.NewQMessage(&protocol.StringMessage{
+		Header: &protocol.Header{
+			MessageId:   proto.String("1"),
+			Topic:       proto.String(topic),
+			MessageType: proto.String(messageType)},
+		Body: proto.String("hello")})
+}
+
+func TestRouterListener(t *testing.T) {
+	router := NewRouterListener()
+	var hit string
+	handler := func(name string) MessageHandler {
+		return func(msg *protocol.QMessage) bool {
+			hit = name
+			return true
+		}
+	}
+	router.Direct("trade", "pay-succ", 1000, true, handler("direct"))
+	router.Regx("trade", "refund-.*", 1000, true, handler("regx"))
+	router.Fanout("feed", 1000, false, handler("fanout"))
+	router.Fallback(handler("fallback"))
+
+	cases := [][3]string{
+		{"trade", "pay-succ", "direct"},
+		{"trade", "refund-succ", "regx"},
+		{"feed", "feed-add", "fanout"},
+		{"trade", "pay-fail", "fallback"},
+		{"comment", "add", "fallback"}}
+	for _, c := range cases {
+		hit = ""
+		router.OnMessage(routerMessage(c[0], c[1]))
+		if hit != c[2] {
+			t.Fail()
+			t.Logf("TestRouterListener|%s|%s|%s\n", c[0], c[1], hit)
+		}
+	}
+
+	//与已有的订阅冲突
+	if nil == router.Direct("trade", "refund-fail", 1000, true, handler("direct")) {
+		t.Fail()
+		t.Log("TestRouterListener|Conflict|NOT DETECTED")
+	}
+
+	binds := router.Bindings("s-trade-a")
+	if len(binds) != 3 || binds[0].GroupId != "s-trade-a" || binds[1].BindType != binding.BIND_REGX ||
+		binds[2].BindType != binding.BIND_FANOUT {
+		t.Fail()
+		t.Logf("TestRouterListener|Bindings|%v\n", binds)
+	}
+}
+
+func TestRouterListenerTxCheck(t *testing.T) {
+	router := NewRouterListener()
+	router.TxCheck("trade", func(tx *protocol.TxResponse) error {
+		tx.Commit()
+		return nil
+	})
+
+	header := routerMessage("trade", "pay-succ").GetHeader()
+	tx := protocol.NewTxResponse(header)
+	if nil != router.OnMessageCheck(tx) || tx.GetStatus() != protocol.TX_COMMIT {
+		t.Fail()
+		t.Log("TestRouterListenerTxCheck|trade|FAIL")
+	}
+
+	header = routerMessage("feed", "feed-add").GetHeader()
+	if router.OnMessageCheck(protocol.NewTxResponse(header)) != ERROR_NO_TX_CHECK_HANDLER {
+		t.Fail()
+		t.Log("TestRouterListenerTxCheck|feed|FAIL")
+	}
+}
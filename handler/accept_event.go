@@ -61,6 +61,9 @@ func (self *AcceptHandler) Process(ctx *pipe.DefaultPipelineContext, event pipe.
 		msg = store.NewMessageEntity(protocol.NewQMessage(ae.msg.(*protocol.BytesMessage)))
 	case protocol.CMD_STRING_MESSAGE:
 		msg = store.NewMessageEntity(protocol.NewQMessage(ae.msg.(*protocol.StringMessage)))
+	case protocol.CMD_BATCH_MESSAGE:
+		self.acceptBatch(ctx, ae)
+		return nil
 	default:
 		//这只是一个bug不支持的数据类型能给你
 		log.Warn("AcceptHandler|Process|%s|%t\n", INVALID_MSG_TYPE_ERROR, ae.msg)
@@ -75,3 +78,30 @@ func (self *AcceptHandler) Process(ctx *pipe.DefaultPipelineContext, event pipe.
 	}
 	return INVALID_MSG_TYPE_ERROR
 }
+
+//批量消息拆分为单条处理,全部存储完成后一次性返回结果
+func (self *AcceptHandler) acceptBatch(ctx *pipe.DefaultPipelineContext, ae *acceptEvent) {
+	batch := ae.msg.(*protocol.BatchMessage)
+	msgs := make([]*store.MessageEntity, 0, len(batch.GetBytesMessages())+len(batch.GetStringMessages()))
+	for _, m := range batch.GetBytesMessages() {
+		msgs = append(msgs, store.NewMessageEntity(protocol.NewQMessage(m)))
+	}
+	for _, m := range batch.GetStringMessages() {
+		msgs = append(msgs, store.NewMessageEntity(protocol.NewQMessage(m)))
+	}
+
+	ack := newBatchAck(ae.opaque, len(msgs))
+	if len(msgs) <= 0 {
+		ctx.SendForward(pipe.NewRemotingEvent(ack.packet(), []string{ae.remoteClient.RemoteAddr()}))
+		return
+	}
+
+	now := time.Now().Unix()
+	for _, msg := range msgs {
+		msg.PublishTime = now
+		msg.KiteServer = self.kiteserver
+		deliver := newPersistentEvent(msg, ae.remoteClient, ae.opaque)
+		deliver.batch = ack
+		ctx.SendForward(deliver)
+	}
+}
@@ -3,9 +3,11 @@ package handler
 import (
 	packet "github.com/blackbeans/turbo/packet"
 	. "github.com/blackbeans/turbo/pipe"
+	"github.com/golang/protobuf/proto"
 	"kiteq/protocol"
 	"regexp"
 	"sort"
+	"sync"
 	"time"
 )
 
@@ -24,17 +26,35 @@ func init() {
 type CheckMessageHandler struct {
 	BaseForwardHandler
 	topics []string
+	lock   sync.RWMutex
 }
 
 //------创建persitehandler
 func NewCheckMessageHandler(name string, topics []string) *CheckMessageHandler {
 	phandler := &CheckMessageHandler{}
 	phandler.BaseForwardHandler = NewBaseForwardHandler(name, phandler)
-	sort.Strings(topics)
-	phandler.topics = topics
+	phandler.SetTopics(topics)
 	return phandler
 }
 
+//运行时替换可以处理的topics
+func (self *CheckMessageHandler) SetTopics(topics []string) {
+	sorted := make([]string, len(topics))
+	copy(sorted, topics)
+	sort.Strings(sorted)
+	self.lock.Lock()
+	self.topics = sorted
+	self.lock.Unlock()
+}
+
+//是否可以处理的topic
+func (self *CheckMessageHandler) accept(topic string) bool {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	idx := sort.SearchStrings(self.topics, topic)
+	return idx < len(self.topics) && self.topics[idx] == topic
+}
+
 func (self *CheckMessageHandler) TypeAssert(event IEvent) bool {
 	_, ok := self.cast(event)
 	return ok
@@ -55,19 +75,12 @@ func (self *CheckMessageHandler) Process(ctx *DefaultPipelineContext, event IEve
 	if nil != pevent.entity {
 
 		//先判断是否是可以处理的topic的消息
-		idx := sort.SearchStrings(self.topics, pevent.entity.Header.GetTopic())
-		if idx == len(self.topics) {
+		if !self.accept(pevent.entity.Header.GetTopic()) {
 			//不存在该消息的处理则直接返回存储失败
-			remoteEvent := NewRemotingEvent(storeAck(pevent.opaque,
-				pevent.entity.Header.GetMessageId(), false, "UnSupport Topic Message!"),
-				[]string{pevent.remoteClient.RemoteAddr()})
-			ctx.SendForward(remoteEvent)
+			sendStoreAck(ctx, pevent, false, "UnSupport Topic Message!")
 		} else if !isUUID(pevent.entity.Header.GetMessageId()) {
 			//不存在该消息的处理则直接返回存储失败
-			remoteEvent := NewRemotingEvent(storeAck(pevent.opaque,
-				pevent.entity.Header.GetMessageId(), false, "Invalid MessageId For UUID!"),
-				[]string{pevent.remoteClient.RemoteAddr()})
-			ctx.SendForward(remoteEvent)
+			sendStoreAck(ctx, pevent, false, protocol.FEEDBACK_INVALID_MESSAGEID)
 		} else {
 			//对头部的数据进行校验设置
 			h := pevent.entity.Header
@@ -78,10 +91,7 @@ func (self *CheckMessageHandler) Process(ctx *DefaultPipelineContext, event IEve
 				h.ExpiredTime = protocol.MarshalInt64(int64(MAX_EXPIRED_TIME))
 			} else if h.GetExpiredTime() > 0 && h.GetExpiredTime() <= time.Now().Unix() {
 				//不存在该消息的处理则直接返回存储失败
-				remoteEvent := NewRemotingEvent(storeAck(pevent.opaque,
-					pevent.entity.Header.GetMessageId(), false, "Expired Message!"),
-					[]string{pevent.remoteClient.RemoteAddr()})
-				ctx.SendForward(remoteEvent)
+				sendStoreAck(ctx, pevent, false, protocol.FEEDBACK_EXPIRED_MESSAGE)
 				return nil
 			}
 			//向后发送
@@ -100,6 +110,54 @@ func isUUID(id string) bool {
 	return true
 }
 
+//返回存储结果,批量消息全部完成后一次性返回
+func sendStoreAck(ctx *DefaultPipelineContext, pevent *persistentEvent, succ bool, feedback string) {
+	messageId := pevent.entity.Header.GetMessageId()
+	var p *packet.Packet
+	if nil != pevent.batch {
+		p = pevent.batch.ack(messageId, succ, feedback)
+		if nil == p {
+			return
+		}
+	} else {
+		p = storeAck(pevent.opaque, messageId, succ, feedback)
+	}
+	ctx.SendForward(NewRemotingEvent(p, []string{pevent.remoteClient.RemoteAddr()}))
+}
+
+//批量消息的存储结果
+type batchAck struct {
+	opaque int32
+	total  int
+	acks   []*protocol.MessageStoreAck
+	lock   sync.Mutex
+}
+
+func newBatchAck(opaque int32, total int) *batchAck {
+	return &batchAck{
+		opaque: opaque,
+		total:  total,
+		acks:   make([]*protocol.MessageStoreAck, 0, total)}
+}
+
+//记录一条消息的结果,全部完成时返回响应包
+func (self *batchAck) ack(messageId string, succ bool, feedback string) *packet.Packet {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.acks = append(self.acks, &protocol.MessageStoreAck{
+		MessageId: proto.String(messageId),
+		Status:    proto.Bool(succ),
+		Feedback:  proto.String(feedback)})
+	if len(self.acks) < self.total {
+		return nil
+	}
+	return self.packet()
+}
+
+func (self *batchAck) packet() *packet.Packet {
+	return packet.NewRespPacket(self.opaque, protocol.CMD_BATCH_STORE_ACK, protocol.MarshalBatchStoreAck(self.acks))
+}
+
 func storeAck(opaque int32, messageid string, succ bool, feedback string) *packet.Packet {
 
 	storeAck := protocol.MarshalMessageStoreAck(messageid, succ, feedback)
@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"context"
 	log "github.com/blackbeans/log4go"
 	packet "github.com/blackbeans/turbo/packet"
 	. "github.com/blackbeans/turbo/pipe"
@@ -14,7 +15,8 @@ import (
 //----------------持久化的handler
 type DeliverPreHandler struct {
 	BaseForwardHandler
-	kitestore      store.IKiteStore
+	kitestore      store.IKiteStoreContext
+	ctx            context.Context //broker关闭时取消未完成的存储
 	exchanger      *binding.BindExchanger
 	maxDeliverNum  chan byte
 	deliverTimeout time.Duration
@@ -27,13 +29,19 @@ func NewDeliverPreHandler(name string, kitestore store.IKiteStore,
 	maxDeliverWorker int) *DeliverPreHandler {
 	phandler := &DeliverPreHandler{}
 	phandler.BaseForwardHandler = NewBaseForwardHandler(name, phandler)
-	phandler.kitestore = kitestore
+	phandler.kitestore = store.WithContext(kitestore)
+	phandler.ctx = context.Background()
 	phandler.exchanger = exchanger
 	phandler.maxDeliverNum = make(chan byte, maxDeliverWorker)
 	phandler.flowstat = flowstat
 	return phandler
 }
 
+//设置存储操作的context
+func (self *DeliverPreHandler) SetContext(ctx context.Context) {
+	self.ctx = ctx
+}
+
 func (self *DeliverPreHandler) TypeAssert(event IEvent) bool {
 	_, ok := self.cast(event)
 	return ok
@@ -87,16 +95,17 @@ func (self *DeliverPreHandler) send0(ctx *DefaultPipelineContext, pevent *delive
 	entity := pevent.entity
 	if nil == entity {
 		//查询消息
-		entity = self.kitestore.Query(pevent.messageId)
+		var err error
+		entity, err = self.kitestore.QueryContext(self.ctx, pevent.messageId)
 		if nil == entity {
-			log.Debug("DeliverPreHandler|send0|Query|FAIL|%s\n", pevent.messageId)
+			log.Debug("DeliverPreHandler|send0|Query|FAIL|%s|%s\n", err, pevent.messageId)
 			return
 		}
 	}
 
 	//check entity need to deliver
 	if !self.checkValid(entity) {
-		self.kitestore.Expired(entity.MessageId)
+		self.kitestore.ExpiredContext(self.ctx, entity.MessageId)
 		return
 	}
 
@@ -106,6 +106,13 @@ func (self *PacketHandler) handlePacket(pevent *PacketEvent) (IEvent, error) {
 		if nil == err {
 			event = newAcceptEvent(protocol.CMD_STRING_MESSAGE, &msg, pevent.RemoteClient, packet.Opaque)
 		}
+	//批量消息
+	case protocol.CMD_BATCH_MESSAGE:
+		var msg protocol.BatchMessage
+		err = protocol.UnmarshalPbMessage(packet.Data, &msg)
+		if nil == err {
+			event = newAcceptEvent(protocol.CMD_BATCH_MESSAGE, &msg, pevent.RemoteClient, packet.Opaque)
+		}
 	}
 
 	return event, err
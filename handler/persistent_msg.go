@@ -1,9 +1,11 @@
 package handler
 
 import (
+	"context"
 	"errors"
-	// log "github.com/blackbeans/log4go"
+	log "github.com/blackbeans/log4go"
 	. "github.com/blackbeans/turbo/pipe"
+	"kiteq/protocol"
 	"kiteq/stat"
 	"kiteq/store"
 	"time"
@@ -14,7 +16,8 @@ var ERROR_PERSISTENT = errors.New("persistent msg error!")
 //----------------持久化的handler
 type PersistentHandler struct {
 	BaseForwardHandler
-	kitestore      store.IKiteStore
+	kitestore      store.IKiteStoreContext
+	ctx            context.Context //broker关闭时取消未完成的存储
 	deliverTimeout time.Duration
 	flowstat       *stat.FlowStat //当前优化是否开启 true为开启，false为关闭
 	fly            bool           //是否开启飞行模式
@@ -25,13 +28,19 @@ func NewPersistentHandler(name string, deliverTimeout time.Duration,
 	kitestore store.IKiteStore, fly bool, flowstat *stat.FlowStat) *PersistentHandler {
 	phandler := &PersistentHandler{}
 	phandler.BaseForwardHandler = NewBaseForwardHandler(name, phandler)
-	phandler.kitestore = kitestore
+	phandler.kitestore = store.WithContext(kitestore)
+	phandler.ctx = context.Background()
 	phandler.deliverTimeout = deliverTimeout
 	phandler.flowstat = flowstat
 	phandler.fly = fly
 	return phandler
 }
 
+//设置存储操作的context
+func (self *PersistentHandler) SetContext(ctx context.Context) {
+	self.ctx = ctx
+}
+
 func (self *PersistentHandler) TypeAssert(event IEvent) bool {
 	_, ok := self.cast(event)
 	return ok
@@ -55,15 +64,11 @@ func (self *PersistentHandler) Process(ctx *DefaultPipelineContext, event IEvent
 			if pevent.entity.Header.GetCommit() {
 				//如果是成功存储的、并且为未提交的消息，则需要发起一个ack的命令
 				//发送存储结果ack
-				remoteEvent := NewRemotingEvent(storeAck(pevent.opaque,
-					pevent.entity.Header.GetMessageId(), true, "FLY NO NEED SAVE"), []string{pevent.remoteClient.RemoteAddr()})
-				ctx.SendForward(remoteEvent)
+				sendStoreAck(ctx, pevent, true, "FLY NO NEED SAVE")
 
 				self.send(ctx, pevent, nil)
 			} else {
-				remoteEvent := NewRemotingEvent(storeAck(pevent.opaque,
-					pevent.entity.Header.GetMessageId(), false, "FLY MUST BE COMMITTED !"), []string{pevent.remoteClient.RemoteAddr()})
-				ctx.SendForward(remoteEvent)
+				sendStoreAck(ctx, pevent, false, protocol.FEEDBACK_FLY_UNCOMMITTED)
 			}
 
 		} else {
@@ -103,24 +108,31 @@ func (self *PersistentHandler) sendUnFlyMessage(ctx *DefaultPipelineContext, pev
 			}
 
 			//写入到持久化存储里面
-			saveSucc = self.kitestore.Save(pevent.entity)
+			saveSucc = self.save(pevent)
 		}
 
 	} else {
 		//写入到持久化存储里面,再投递
-		saveSucc = self.kitestore.Save(pevent.entity)
+		saveSucc = self.save(pevent)
 		if pevent.entity.Commit {
 			self.send(ctx, pevent, nil)
 		}
 	}
 
 	//发送存储结果ack
-	remoteEvent := NewRemotingEvent(storeAck(pevent.opaque,
-		pevent.entity.Header.GetMessageId(), saveSucc, ""), []string{pevent.remoteClient.RemoteAddr()})
-	ctx.SendForward(remoteEvent)
+	sendStoreAck(ctx, pevent, saveSucc, "")
 
 }
 
+func (self *PersistentHandler) save(pevent *persistentEvent) bool {
+	err := self.kitestore.SaveContext(self.ctx, pevent.entity)
+	if nil != err {
+		log.Error("PersistentHandler|save|FAIL|%s|%s\n", err, pevent.entity.MessageId)
+		return false
+	}
+	return true
+}
+
 func (self *PersistentHandler) send(ctx *DefaultPipelineContext, pevent *persistentEvent, ch chan []string) {
 
 	//启动投递当然会重投3次
@@ -83,6 +83,7 @@ type persistentEvent struct {
 	entity       *store.MessageEntity
 	remoteClient *client.RemotingClient
 	opaque       int32
+	batch        *batchAck //批量消息时汇总存储结果
 }
 
 func newPersistentEvent(entity *store.MessageEntity, remoteClient *client.RemotingClient, opaque int32) *persistentEvent {
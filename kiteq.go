@@ -23,11 +23,11 @@ func main() {
 	fly := flag.Bool("fly", false, "-fly=true //开启服务端飞行模式")
 	logxml := flag.String("logxml", "./log/log.xml", "-logxml=./log/log.xml")
 	bindHost := flag.String("bind", ":13800", "-bind=localhost:13800")
-	zkhost := flag.String("zkhost", "localhost:2181", "-zkhost=localhost:2181")
+	zkhost := flag.String("zkhost", "localhost:2181", "-zkhost=localhost:2181 | zk://localhost:2181?root=/kiteq&digest=user:password | etcd://localhost:2379 | file:///etc/kiteq/registry.json")
 	topics := flag.String("topics", "", "-topics=trade,a,b")
 	db := flag.String("db", "memory://initcap=100000&maxcap=200000",
 		"-db=mysql://master:3306,slave:3306?db=kite&username=root&password=root&maxConn=500&batchUpdateSize=1000&batchDelSize=1000&flushPeriod=1000")
-	pprofPort := flag.Int("pport", -1, "pprof port default value is -1 ")
+	pprofPort := flag.Int("pport", -1, "pprof and admin(/kiteq/topics) port default value is -1 ")
 	flag.Parse()
 
 	//加载log4go的配置
@@ -56,6 +56,8 @@ func main() {
 
 	qserver := server.NewKiteQServer(kc)
 	qserver.Start()
+	//管理接口与pprof共用端口
+	http.HandleFunc("/kiteq/topics", qserver.HandleTopics)
 
 	var s = make(chan os.Signal, 1)
 	signal.Notify(s, syscall.SIGKILL, syscall.SIGUSR1)
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"kiteq/store/file"
+	"os"
+)
+
+//离线检查file存储的segment文件
+//退出码 0:正常 1:存在问题 2:检查或修复失败
+func main() {
+	dir := flag.String("dir", ".", "-dir=/path //file:///path中的存储目录,kiteq需要停止")
+	truncate := flag.Bool("truncate", false, "-truncate=true //截断到最后一条完整的记录")
+	export := flag.String("export", "", "-export=./messages.json //按行导出存活的消息")
+	flag.Parse()
+
+	report, err := file.Fsck(*dir + "/snapshot/")
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "kiteq-fsck|FAIL|%s\n", err)
+		os.Exit(2)
+	}
+
+	fmt.Printf("|segment\t|chunks\t|data\t\t|oplogs\t|log\t\t|live\t|\n")
+	for _, s := range report.Segments {
+		fmt.Printf("|%d\t|%d\t|%d/%d\t|%d\t|%d/%d\t|%d\t|\n", s.Sid, s.Chunks,
+			s.DataGood, s.DataSize, s.Oplogs, s.LogGood, s.LogSize, s.Live)
+	}
+	for _, i := range report.Issues {
+		fmt.Println(i)
+	}
+
+	if *truncate {
+		found := len(report.Issues)
+		err := report.Truncate()
+		if nil != err {
+			fmt.Fprintf(os.Stderr, "kiteq-fsck|Truncate|FAIL|%s\n", err)
+			os.Exit(2)
+		}
+		//截断后残留的oplog
+		for _, i := range report.Issues[found:] {
+			fmt.Println(i)
+		}
+		fmt.Println("kiteq-fsck|Truncate|SUCC")
+	}
+
+	if len(*export) > 0 {
+		f, err := os.Create(*export)
+		if nil != err {
+			fmt.Fprintf(os.Stderr, "kiteq-fsck|Export|FAIL|%s\n", err)
+			os.Exit(2)
+		}
+		bw := bufio.NewWriter(f)
+		count, err := report.Export(bw)
+		if nil == err {
+			err = bw.Flush()
+		}
+		f.Close()
+		if nil != err {
+			fmt.Fprintf(os.Stderr, "kiteq-fsck|Export|FAIL|%s\n", err)
+			os.Exit(2)
+		}
+		fmt.Printf("kiteq-fsck|Export|SUCC|%d|%s\n", count, *export)
+	}
+
+	if len(report.Issues) > 0 && !*truncate {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,156 @@
+//进程内启动的KiteQ,用于集成测试,不依赖zookeeper和独立部署的kiteq
+//  broker := kiteqtest.StartBroker("trade")
+//  defer broker.Close()
+//  consumer := broker.NewConsumer("s-trade-a", listener, binding.Bind_Direct("s-trade-a", "trade", "pay-succ", 1000, true))
+//  producer := broker.NewProducer("p-trade-a", nil, "trade")
+package kiteqtest
+
+import (
+	"context"
+	"fmt"
+	log "github.com/blackbeans/log4go"
+	"github.com/blackbeans/turbo"
+	"kiteq/binding"
+	"kiteq/client"
+	"kiteq/client/listener"
+	"kiteq/server"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SECRET_KEY   = "kiteqtest"
+	BIND_TIMEOUT = 3 * time.Second //等待broker收到订阅关系的时长
+	BIND_RETRIES = 5               //端口被占用时重试启动的次数
+)
+
+var brokerSeq int32
+
+type Broker struct {
+	Addr        string //broker的地址 ip:port
+	RegistryUri string //进程内的注册中心 mem://
+	server      *server.KiteQServer
+	clients     []*client.KiteQClient
+	lock        sync.Mutex
+}
+
+//在随机端口启动一个使用内存存储和内存注册中心的broker
+func StartBroker(topics ...string) (*Broker, error) {
+	registryUri := fmt.Sprintf("%skiteqtest-%d-%d", binding.SCHEMA_MEM, time.Now().UnixNano(), atomic.AddInt32(&brokerSeq, 1))
+
+	//remoting只接受地址,探测到的空闲端口在启动前可能被占用,失败时换端口重试
+	var err error
+	for i := 0; i < BIND_RETRIES; i++ {
+		var addr string
+		addr, err = freeAddr()
+		if nil != err {
+			return nil, err
+		}
+
+		rc := turbo.NewRemotingConfig(
+			"remoting-"+addr,
+			100, 16*1024,
+			16*1024, 1000, 1000,
+			10*time.Second, 1000)
+
+		kc := server.NewKiteQConfig("kiteq-"+addr, addr, registryUri, false, 1*time.Second, 100,
+			5*time.Second, topics, "memory://initcap=1000&maxcap=100000", rc)
+		qserver := server.NewKiteQServer(kc)
+		//内存注册中心不需要等待客户端感知broker下线
+		qserver.SetDrainDelay(0)
+		err = qserver.Serve()
+		if nil != err {
+			log.Warn("kiteqtest|StartBroker|RETRY|%s|%s\n", addr, err)
+			qserver.Shutdown()
+			continue
+		}
+		log.Info("kiteqtest|StartBroker|SUCC|%s|%s|%s\n", addr, registryUri, topics)
+
+		return &Broker{
+			Addr:        addr,
+			RegistryUri: registryUri,
+			server:      qserver,
+			clients:     make([]*client.KiteQClient, 0, 4)}, nil
+	}
+	return nil, err
+}
+
+//获取一个空闲的本地端口
+func freeAddr() (string, error) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if nil != err {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+//创建并启动连接到该broker的客户端,有订阅关系时等待broker收到后返回
+//l为nil时使用listener.MockListener
+func (self *Broker) NewClient(groupId string, l listener.IListener, topics []string, binds []*binding.Binding) *client.KiteQClient {
+	if nil == l {
+		l = &listener.MockListener{}
+	}
+
+	kiteClient := client.NewKiteQClient(self.RegistryUri, groupId, SECRET_KEY, l)
+	if len(topics) > 0 {
+		kiteClient.SetTopics(topics)
+	}
+	if len(binds) > 0 {
+		kiteClient.SetBindings(binds)
+	}
+	kiteClient.Start()
+
+	self.lock.Lock()
+	self.clients = append(self.clients, kiteClient)
+	self.lock.Unlock()
+
+	for _, b := range binds {
+		if !self.waitBind(b) {
+			log.Warn("kiteqtest|NewClient|WAIT BIND TIMEOUT|%s|%s|%s\n", b.GroupId, b.Topic, b.MessageType)
+		}
+	}
+	return kiteClient
+}
+
+//只发送消息的客户端
+func (self *Broker) NewProducer(groupId string, l listener.IListener, topics ...string) *client.KiteQClient {
+	return self.NewClient(groupId, l, topics, nil)
+}
+
+//只订阅消息的客户端
+func (self *Broker) NewConsumer(groupId string, l listener.IListener, binds ...*binding.Binding) *client.KiteQClient {
+	return self.NewClient(groupId, l, nil, binds)
+}
+
+//等待broker收到订阅关系
+func (self *Broker) waitBind(b *binding.Binding) bool {
+	deadline := time.Now().Add(BIND_TIMEOUT)
+	for time.Now().Before(deadline) {
+		for _, fb := range self.server.FindBinds(b.Topic, b.MessageType) {
+			if fb.GroupId == b.GroupId {
+				return true
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+//关闭所有客户端和broker
+func (self *Broker) Close() {
+	self.lock.Lock()
+	clients := self.clients
+	self.clients = nil
+	self.lock.Unlock()
+
+	for _, c := range clients {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		c.Close(ctx)
+		cancel()
+	}
+	self.server.Shutdown()
+	log.Info("kiteqtest|Close|SUCC|%s\n", self.Addr)
+}
@@ -0,0 +1,92 @@
+package kiteqtest
+
+import (
+	"kiteq/binding"
+	"kiteq/client/listener"
+	"kiteq/protocol"
+	"testing"
+	"time"
+)
+
+type chanListener struct {
+	listener.MockListener
+	ch chan string
+}
+
+func (self *chanListener) OnMessage(msg *protocol.QMessage) bool {
+	self.ch <- msg.GetHeader().GetMessageId()
+	return true
+}
+
+func TestBrokerPublishSubscribe(t *testing.T) {
+	broker, err := StartBroker("trade")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	l := &chanListener{ch: make(chan string, 10)}
+	broker.NewConsumer("s-trade-a", l, binding.Bind_Direct("s-trade-a", "trade", "pay-succ", 1000, true))
+	producer := broker.NewProducer("p-trade-a", nil, "trade")
+
+	msg := producer.NewMessage("trade", "pay-succ").StringMessage("hello")
+	err = producer.SendStringMessage(msg)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	select {
+	case id := <-l.ch:
+		if id != msg.GetHeader().GetMessageId() {
+			t.Fail()
+			t.Logf("TestBrokerPublishSubscribe|%s|%s\n", id, msg.GetHeader().GetMessageId())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("TestBrokerPublishSubscribe|TIMEOUT")
+	}
+}
+
+func TestBrokerTxMessage(t *testing.T) {
+	broker, err := StartBroker("trade")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	l := &chanListener{ch: make(chan string, 10)}
+	broker.NewConsumer("s-trade-a", l, binding.Bind_Direct("s-trade-a", "trade", "pay-succ", 1000, true))
+	producer := broker.NewProducer("p-trade-a", nil, "trade")
+
+	//回滚的消息不会投递
+	rollback := producer.NewMessage("trade", "pay-succ").Commit(false).StringMessage("rollback")
+	producer.SendTxStringMessage(rollback, func(msg *protocol.QMessage) (bool, error) { return false, nil })
+
+	commit := producer.NewMessage("trade", "pay-succ").Commit(false).StringMessage("commit")
+	err = producer.SendTxStringMessage(commit, func(msg *protocol.QMessage) (bool, error) { return true, nil })
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	select {
+	case id := <-l.ch:
+		if id != commit.GetHeader().GetMessageId() {
+			t.Fail()
+			t.Logf("TestBrokerTxMessage|%s|%s\n", id, commit.GetHeader().GetMessageId())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("TestBrokerTxMessage|TIMEOUT")
+	}
+}
+
+//内存注册中心关闭时不等待客户端感知broker下线
+func TestBrokerCloseFast(t *testing.T) {
+	broker, err := StartBroker("trade")
+	if nil != err {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	broker.Close()
+	if cost := time.Since(now); cost > time.Second {
+		t.Fatalf("TestBrokerCloseFast|%s\n", cost)
+	}
+}
@@ -109,11 +109,13 @@ func MarshalConnMeta(groupId, secretKey string) []byte {
 	return data
 }
 
+//服务端的握手确认,同时告知客户端支持批量发送
 func MarshalConnAuthAck(succ bool, feedback string) []byte {
 
 	data, _ := MarshalPbMessage(&ConnAuthAck{
 		Status:   proto.Bool(succ),
-		Feedback: proto.String(feedback)})
+		Feedback: proto.String(feedback),
+		Batch:    proto.Bool(true)})
 	return data
 }
 
@@ -125,6 +127,11 @@ func MarshalMessageStoreAck(messageId string, succ bool, feedback string) []byte
 	return data
 }
 
+func MarshalBatchStoreAck(acks []*MessageStoreAck) []byte {
+	data, _ := MarshalPbMessage(&BatchStoreAck{Acks: acks})
+	return data
+}
+
 func MarshalTxACKPacket(header *Header, txstatus TxStatus, feedback string) []byte {
 	data, _ := MarshalPbMessage(&TxACKPacket{
 		Header:   header,
@@ -196,6 +203,14 @@ func (self *TxResponse) Commit() {
 	self.status = TX_COMMIT
 }
 
+func (self *TxResponse) GetStatus() TxStatus {
+	return self.status
+}
+
+func (self *TxResponse) GetFeedback() string {
+	return self.feedback
+}
+
 func (self *TxResponse) ConvertTxAckPacket(packet *TxACKPacket) {
 	packet.Status = proto.Int32(int32(self.status))
 	packet.Feedback = proto.String(self.feedback)
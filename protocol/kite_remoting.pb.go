@@ -19,6 +19,8 @@ It has these top-level messages:
 	Header
 	BytesMessage
 	StringMessage
+	BatchStoreAck
+	BatchMessage
 */
 package protocol
 
@@ -75,6 +77,7 @@ func (m *ConnMeta) GetSecretKey() string {
 type ConnAuthAck struct {
 	Status           *bool   `protobuf:"varint,1,req,name=status,def=1" json:"status,omitempty"`
 	Feedback         *string `protobuf:"bytes,2,req,name=feedback" json:"feedback,omitempty"`
+	Batch            *bool   `protobuf:"varint,3,opt,name=batch,def=0" json:"batch,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -98,6 +101,15 @@ func (m *ConnAuthAck) GetFeedback() string {
 	return ""
 }
 
+const Default_ConnAuthAck_Batch bool = false
+
+func (m *ConnAuthAck) GetBatch() bool {
+	if m != nil && m.Batch != nil {
+		return *m.Batch
+	}
+	return Default_ConnAuthAck_Batch
+}
+
 // 消息确认接收数据包
 type MessageStoreAck struct {
 	MessageId        *string `protobuf:"bytes,1,req,name=messageId" json:"messageId,omitempty"`
@@ -377,5 +389,47 @@ func (m *StringMessage) GetBody() string {
 	return ""
 }
 
+// 批量消息的存储确认,与BatchMessage中的消息一一对应
+type BatchStoreAck struct {
+	Acks             []*MessageStoreAck `protobuf:"bytes,1,rep,name=acks" json:"acks,omitempty"`
+	XXX_unrecognized []byte             `json:"-"`
+}
+
+func (m *BatchStoreAck) Reset()         { *m = BatchStoreAck{} }
+func (m *BatchStoreAck) String() string { return proto.CompactTextString(m) }
+func (*BatchStoreAck) ProtoMessage()    {}
+
+func (m *BatchStoreAck) GetAcks() []*MessageStoreAck {
+	if m != nil {
+		return m.Acks
+	}
+	return nil
+}
+
+// 批量发送的消息
+type BatchMessage struct {
+	BytesMessages    []*BytesMessage  `protobuf:"bytes,1,rep,name=bytesMessages" json:"bytesMessages,omitempty"`
+	StringMessages   []*StringMessage `protobuf:"bytes,2,rep,name=stringMessages" json:"stringMessages,omitempty"`
+	XXX_unrecognized []byte           `json:"-"`
+}
+
+func (m *BatchMessage) Reset()         { *m = BatchMessage{} }
+func (m *BatchMessage) String() string { return proto.CompactTextString(m) }
+func (*BatchMessage) ProtoMessage()    {}
+
+func (m *BatchMessage) GetBytesMessages() []*BytesMessage {
+	if m != nil {
+		return m.BytesMessages
+	}
+	return nil
+}
+
+func (m *BatchMessage) GetStringMessages() []*StringMessage {
+	if m != nil {
+		return m.StringMessages
+	}
+	return nil
+}
+
 func init() {
 }
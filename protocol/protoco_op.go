@@ -10,6 +10,7 @@ const (
 	CMD_MESSAGE_STORE_ACK = uint8(0x04) //持久化确认
 	CMD_DELIVER_ACK       = uint8(0x05) //投递确认
 	CMD_TX_ACK            = uint8(0x06) //事务确认
+	CMD_BATCH_STORE_ACK   = uint8(0x07) //批量消息的持久化确认
 
 	//事务处理失败与否
 	TX_UNKNOWN  = TxStatus(0)
@@ -19,9 +20,17 @@ const (
 	//message
 	CMD_BYTES_MESSAGE  = uint8(0x11)
 	CMD_STRING_MESSAGE = uint8(0x12)
+	CMD_BATCH_MESSAGE  = uint8(0x13) //批量消息
 
 	//最大packet的字节数
 	RESP_STATUS_SUCC    = 200
 	RESP_STATUS_FAIL    = 500
 	RESP_STATUS_TIMEOUT = 501
 )
+
+//服务端因为消息本身拒绝存储时的反馈,换broker重试也无法成功
+const (
+	FEEDBACK_INVALID_MESSAGEID = "Invalid MessageId For UUID!"
+	FEEDBACK_EXPIRED_MESSAGE   = "Expired Message!"
+	FEEDBACK_FLY_UNCOMMITTED   = "FLY MUST BE COMMITTED !"
+)
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"encoding/json"
+	log "github.com/blackbeans/log4go"
+	"net/http"
+	"strings"
+)
+
+//管理接口 /kiteq/topics
+//  GET                                当前可以处理的topic列表
+//  POST action=add&topics=a,b         新增topic
+//  POST action=remove&topics=a,b      删除topic
+func (self *KiteQServer) HandleTopics(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		topics := make([]string, 0, 2)
+		for _, t := range strings.Split(req.FormValue("topics"), ",") {
+			t = strings.TrimSpace(t)
+			if len(t) > 0 {
+				topics = append(topics, t)
+			}
+		}
+
+		if len(topics) <= 0 {
+			http.Error(w, "topics is empty !", http.StatusBadRequest)
+			return
+		}
+
+		var err error
+		switch req.FormValue("action") {
+		case "add":
+			err = self.AddTopics(topics)
+		case "remove":
+			err = self.RemoveTopics(topics)
+		default:
+			http.Error(w, "unsupport action ["+req.FormValue("action")+"]", http.StatusBadRequest)
+			return
+		}
+
+		if nil != err {
+			log.Error("KiteQServer|HandleTopics|%s|FAIL|%s|%s\n", req.FormValue("action"), err, topics)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else if req.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, _ := json.Marshal(map[string][]string{"topics": self.Topics()})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
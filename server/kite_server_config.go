@@ -11,7 +11,7 @@ type KiteQConfig struct {
 	flowstat          *stat.FlowStat
 	rc                *turbo.RemotingConfig
 	server            string
-	zkhost            string
+	registryUri       string        //注册中心地址 zk://、etcd://、file://、mem://
 	deliverTimeout    time.Duration //投递超时时间
 	maxDeliverWorkers int           //最大执行实际那
 	recoverPeriod     time.Duration //recover的周期
@@ -19,7 +19,7 @@ type KiteQConfig struct {
 	db                string        //持久层配置
 }
 
-func NewKiteQConfig(name string, server, zkhost string, fly bool, deliverTimeout time.Duration, maxDeliverWorkers int,
+func NewKiteQConfig(name string, server, registryUri string, fly bool, deliverTimeout time.Duration, maxDeliverWorkers int,
 	recoverPeriod time.Duration,
 	topics []string,
 	db string,
@@ -29,7 +29,7 @@ func NewKiteQConfig(name string, server, zkhost string, fly bool, deliverTimeout
 		flowstat:          stat.NewFlowStat(name),
 		rc:                rc,
 		server:            server,
-		zkhost:            zkhost,
+		registryUri:       registryUri,
 		deliverTimeout:    deliverTimeout,
 		maxDeliverWorkers: maxDeliverWorkers,
 		recoverPeriod:     recoverPeriod,
@@ -3,6 +3,7 @@ package server
 import (
 	log "github.com/blackbeans/log4go"
 	"kiteq/store"
+	sb "kiteq/store/bolt"
 	smf "kiteq/store/file"
 	sm "kiteq/store/memory"
 	smq "kiteq/store/mysql"
@@ -15,7 +16,9 @@ import (
 //  mock    mock://
 //  memory  memory://initcap=1000&maxcap=2000
 //  mysql   mysql://master:3306,slave:3306?db=kite&username=root&password=root&maxConn=500&batchUpdateSize=1000&batchDelSize=1000&flushPeriod=1000
-//  file    file:///path?cap=10000000&checkPeriod=60
+//  file    file:///path?cap=10000000&checkPeriod=60&fsync=batch&fsyncPeriod=1&checkpointPeriod=300  fsync:none|always|batch|period
+//  bolt    bolt:///path/kiteq.db?batchSize=100&flushPeriod=1
+//  sqlite  sqlite:///path/kiteq.db?batchUpdateSize=100&batchDelSize=100&flushPeriod=1
 
 func parseDB(kc KiteQConfig) store.IKiteStore {
 	db := kc.db
@@ -182,8 +185,128 @@ func parseDB(kc KiteQConfig) store.IKiteStore {
 			checkPeriod = time.Duration(v * int64(checkPeriod))
 		}
 
-		kitedb = smf.NewKiteFileStore(mp[0], maxcap, checkPeriod)
-		log.Debug("NewKiteQServer|FILESTORE|%s|%d|%d", mp[0], maxcap, checkPeriod.Seconds())
+		//刷盘策略
+		policy, err := smf.ParseFsyncPolicy(params["fsync"])
+		if nil != err {
+			log.Crashf("NewKiteQServer|INVALID|fsync|%s\n", db)
+		}
+		fsyncPeriod := 1 * time.Second
+		sp, ok := params["fsyncPeriod"]
+		if ok {
+			v, e := strconv.ParseInt(sp, 10, 32)
+			if nil != e {
+				log.Crashf("NewKiteQServer|INVALID|fsyncPeriod|%s\n", db)
+			}
+			fsyncPeriod = time.Duration(v * int64(fsyncPeriod))
+		}
+
+		//索引checkpoint周期,0为只在停止时checkpoint
+		cp, ok := params["checkpointPeriod"]
+		checkpointPeriod := smf.CHECKPOINT_PERIOD
+		if ok {
+			v, e := strconv.ParseInt(cp, 10, 32)
+			if nil != e {
+				log.Crashf("NewKiteQServer|INVALID|checkpointPeriod|%s\n", db)
+			}
+			checkpointPeriod = time.Duration(v) * time.Second
+		}
+
+		kfs := smf.NewKiteFileStore(mp[0], maxcap, checkPeriod)
+		kfs.SetFsync(policy, fsyncPeriod)
+		kfs.SetCheckpointPeriod(checkpointPeriod)
+		kitedb = kfs
+		log.Debug("NewKiteQServer|FILESTORE|%s|%d|%d|%s", mp[0], maxcap, checkPeriod.Seconds(), policy)
+	} else if strings.HasPrefix(db, "sqlite://") {
+		url := strings.TrimPrefix(db, "sqlite://")
+		mp := strings.Split(url, "?")
+		params := make(map[string]string, 5)
+		if len(mp) > 1 {
+			split := strings.Split(mp[1], "&")
+			for _, v := range split {
+				p := strings.SplitN(v, "=", 2)
+				params[p[0]] = p[1]
+			}
+		}
+		if len(mp[0]) <= 0 {
+			log.Crashf("NewKiteQServer|INVALID|FilePath|%s\n", db)
+		}
+
+		bus := 100
+		u, ok := params["batchUpdateSize"]
+		if ok {
+			v, e := strconv.ParseInt(u, 10, 32)
+			if nil != e {
+				log.Crashf("NewKiteQServer|INVALID|batchUpdateSize|%s\n", db)
+			}
+			bus = int(v)
+		}
+
+		bds := 100
+		d, ok := params["batchDelSize"]
+		if ok {
+			v, e := strconv.ParseInt(d, 10, 32)
+			if nil != e {
+				log.Crashf("NewKiteQServer|INVALID|batchDelSize|%s\n", db)
+			}
+			bds = int(v)
+		}
+
+		flushPeriod := 1 * time.Second
+		fp, ok := params["flushPeriod"]
+		if ok {
+			v, e := strconv.ParseInt(fp, 10, 32)
+			if nil != e {
+				log.Crashf("NewKiteQServer|INVALID|flushPeriod|%s\n", db)
+			}
+			flushPeriod = time.Duration(v * int64(flushPeriod))
+		}
+
+		kitedb = smq.NewKiteSqlite(smq.SqliteOptions{
+			Path:         mp[0],
+			BatchUpSize:  bus,
+			BatchDelSize: bds,
+			FlushPeriod:  flushPeriod})
+	} else if strings.HasPrefix(db, "bolt://") {
+		url := strings.TrimPrefix(db, "bolt://")
+		mp := strings.Split(url, "?")
+		params := make(map[string]string, 5)
+		if len(mp) > 1 {
+			split := strings.Split(mp[1], "&")
+			for _, v := range split {
+				p := strings.SplitN(v, "=", 2)
+				params[p[0]] = p[1]
+			}
+		}
+		if len(mp[0]) <= 0 {
+			log.Crashf("NewKiteQServer|INVALID|FilePath|%s\n", db)
+		}
+
+		//异步操作批量提交的条数
+		batchSize := 100
+		bs, ok := params["batchSize"]
+		if ok {
+			v, e := strconv.ParseInt(bs, 10, 32)
+			if nil != e {
+				log.Crashf("NewKiteQServer|INVALID|batchSize|%s\n", db)
+			}
+			batchSize = int(v)
+		}
+
+		flushPeriod := 1 * time.Second
+		fp, ok := params["flushPeriod"]
+		if ok {
+			v, e := strconv.ParseInt(fp, 10, 32)
+			if nil != e {
+				log.Crashf("NewKiteQServer|INVALID|flushPeriod|%s\n", db)
+			}
+			flushPeriod = time.Duration(v * int64(flushPeriod))
+		}
+
+		kitedb = sb.NewKiteBoltStore(sb.BoltOptions{
+			Path:        mp[0],
+			BatchSize:   batchSize,
+			FlushPeriod: flushPeriod})
+		log.Debug("NewKiteQServer|BOLTSTORE|%s|%d|%d", mp[0], batchSize, flushPeriod.Seconds())
 	} else {
 		log.Crashf("NewKiteQServer|UNSUPPORT DB PROTOCOL|%s\n", db)
 	}
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"context"
+	"errors"
 	log "github.com/blackbeans/log4go"
 	"github.com/blackbeans/turbo/client"
 	"github.com/blackbeans/turbo/packet"
@@ -10,6 +12,9 @@ import (
 	"kiteq/handler"
 	"kiteq/store"
 	"os"
+	"sort"
+	"sync"
+	"time"
 )
 
 type KiteQServer struct {
@@ -21,6 +26,9 @@ type KiteQServer struct {
 	recoverManager *RecoverManager
 	kc             KiteQConfig
 	kitedb         store.IKiteStore
+	checkHandler   *handler.CheckMessageHandler
+	topicLock      sync.Mutex //topic的变更串行执行
+	cancel         context.CancelFunc
 }
 
 //握手包
@@ -42,7 +50,7 @@ func NewKiteQServer(kc KiteQConfig) *KiteQServer {
 	clientManager := client.NewClientManager(reconnManager)
 
 	// 临时在这里创建的BindExchanger
-	exchanger := binding.NewBindExchanger(kc.zkhost, kc.server)
+	exchanger := binding.NewBindExchanger(kc.registryUri, kc.server)
 
 	//重投策略
 	rw := make([]handler.RedeliveryWindow, 0, 10)
@@ -54,6 +62,15 @@ func NewKiteQServer(kc KiteQConfig) *KiteQServer {
 	rw = append(rw, handler.NewRedeliveryWindow(40, 50, 32*60))
 	rw = append(rw, handler.NewRedeliveryWindow(50, -1, 60*60))
 
+	checkHandler := handler.NewCheckMessageHandler("check_message", kc.topics)
+
+	//关闭时取消未完成的存储操作
+	ctx, cancel := context.WithCancel(context.Background())
+	persistentHandler := handler.NewPersistentHandler("persistent", kc.deliverTimeout, kitedb, kc.fly, kc.flowstat)
+	persistentHandler.SetContext(ctx)
+	deliverPreHandler := handler.NewDeliverPreHandler("deliverpre", kitedb, exchanger, kc.flowstat, kc.maxDeliverWorkers)
+	deliverPreHandler.SetContext(ctx)
+
 	//初始化pipeline
 	pipeline := pipe.NewDefaultPipeline()
 	pipeline.RegisteHandler("packet", handler.NewPacketHandler("packet"))
@@ -61,10 +78,10 @@ func NewKiteQServer(kc KiteQConfig) *KiteQServer {
 	pipeline.RegisteHandler("validate", handler.NewValidateHandler("validate", clientManager))
 	pipeline.RegisteHandler("accept", handler.NewAcceptHandler("accept"))
 	pipeline.RegisteHandler("heartbeat", handler.NewHeartbeatHandler("heartbeat"))
-	pipeline.RegisteHandler("check_message", handler.NewCheckMessageHandler("check_message", kc.topics))
-	pipeline.RegisteHandler("persistent", handler.NewPersistentHandler("persistent", kc.deliverTimeout, kitedb, kc.fly, kc.flowstat))
+	pipeline.RegisteHandler("check_message", checkHandler)
+	pipeline.RegisteHandler("persistent", persistentHandler)
 	pipeline.RegisteHandler("txAck", handler.NewTxAckHandler("txAck", kitedb))
-	pipeline.RegisteHandler("deliverpre", handler.NewDeliverPreHandler("deliverpre", kitedb, exchanger, kc.flowstat, kc.maxDeliverWorkers))
+	pipeline.RegisteHandler("deliverpre", deliverPreHandler)
 	pipeline.RegisteHandler("deliver", handler.NewDeliverHandler("deliver"))
 	pipeline.RegisteHandler("remoting", pipe.NewRemotingHandler("remoting", clientManager))
 	pipeline.RegisteHandler("remote-future", handler.NewRemotingFutureHandler("remote-future"))
@@ -80,11 +97,22 @@ func NewKiteQServer(kc KiteQConfig) *KiteQServer {
 		pipeline:       pipeline,
 		recoverManager: recoverManager,
 		kc:             kc,
-		kitedb:         kitedb}
+		kitedb:         kitedb,
+		checkHandler:   checkHandler,
+		cancel:         cancel}
 
 }
 
+//启动,失败时直接退出
 func (self *KiteQServer) Start() {
+	err := self.Serve()
+	if nil != err {
+		log.Crashf("KiteQServer|Start|FAIL|%s|%s\n", err, self.kc.server)
+	}
+}
+
+//启动,监听端口或者推送QServer失败时返回错误
+func (self *KiteQServer) Serve() error {
 
 	self.remotingServer = server.NewRemotionServer(self.kc.server, self.kc.rc,
 		func(rclient *client.RemotingClient, p *packet.Packet) {
@@ -99,30 +127,104 @@ func (self *KiteQServer) Start() {
 
 	err := self.remotingServer.ListenAndServer()
 	if nil != err {
-		log.Crashf("KiteQServer|RemotionServer|START|FAIL|%s|%s\n", err, self.kc.server)
+		log.Error("KiteQServer|RemotionServer|START|FAIL|%s|%s\n", err, self.kc.server)
+		return err
 	} else {
 		log.Info("KiteQServer|RemotionServer|START|SUCC|%s\n", self.kc.server)
 	}
 	//推送可发送的topic列表并且获取了对应topic下的订阅关系
 	succ := self.exchanger.PushQServer(self.kc.server, self.kc.topics)
 	if !succ {
-		log.Crashf("KiteQServer|PushQServer|FAIL|%s|%s\n", err, self.kc.topics)
+		log.Error("KiteQServer|PushQServer|FAIL|%s\n", self.kc.topics)
+		return errors.New("PUSH QSERVER FAIL !")
 	} else {
 		log.Info("KiteQServer|PushQServer|SUCC|%s\n", self.kc.topics)
 	}
 
+	//定期全量同步订阅关系
+	self.exchanger.StartResync(binding.RESYNC_PERIOD, self.kc.flowstat.ResyncFlow)
+
 	//开启流量统计
 	self.kc.flowstat.Start()
 
 	//开启recover
 	self.recoverManager.Start()
+	return nil
+}
+
+//设置关闭时等待客户端感知broker下线的时长,<=0不等待
+func (self *KiteQServer) SetDrainDelay(delay time.Duration) {
+	self.exchanger.SetDrainDelay(delay)
+}
+
+//当前可以处理的topic列表
+func (self *KiteQServer) Topics() []string {
+	return self.exchanger.Topics()
+}
+
+//当前生效的订阅关系
+func (self *KiteQServer) FindBinds(topic, messageType string) []*binding.Binding {
+	return self.exchanger.FindBinds(topic, messageType, func(b *binding.Binding) bool { return false })
+}
+
+//运行时新增topic,注册到配置中心并拉取订阅关系后才开始接收该topic的消息
+func (self *KiteQServer) AddTopics(topics []string) error {
+	self.topicLock.Lock()
+	defer self.topicLock.Unlock()
+
+	current := self.exchanger.Topics()
+	added := make([]string, 0, len(topics))
+	for _, topic := range topics {
+		idx := sort.SearchStrings(current, topic)
+		if len(topic) > 0 && (idx >= len(current) || current[idx] != topic) {
+			added = append(added, topic)
+		}
+	}
+	if len(added) <= 0 {
+		return nil
+	}
+
+	succ := self.exchanger.PushQServer(self.kc.server, added)
+	if !succ {
+		//回滚已经注册的topic
+		self.exchanger.UnpushQServer(self.kc.server, added)
+		log.Error("KiteQServer|AddTopics|FAIL|%s\n", added)
+		return errors.New("push qserver fail !")
+	}
+
+	self.checkHandler.SetTopics(self.exchanger.Topics())
+	log.Info("KiteQServer|AddTopics|SUCC|%s\n", added)
+	return nil
+}
+
+//运行时删除topic,先拒绝该topic的消息再从配置中心注销
+func (self *KiteQServer) RemoveTopics(topics []string) error {
+	self.topicLock.Lock()
+	defer self.topicLock.Unlock()
+
+	sorted := make([]string, len(topics))
+	copy(sorted, topics)
+	sort.Strings(sorted)
+
+	remain := make([]string, 0, 10)
+	for _, topic := range self.exchanger.Topics() {
+		idx := sort.SearchStrings(sorted, topic)
+		if idx >= len(sorted) || sorted[idx] != topic {
+			remain = append(remain, topic)
+		}
+	}
 
+	self.checkHandler.SetTopics(remain)
+	self.exchanger.UnpushQServer(self.kc.server, topics)
+	log.Info("KiteQServer|RemoveTopics|SUCC|%s\n", topics)
+	return nil
 }
 
 func (self *KiteQServer) Shutdown() {
 	//先关闭exchanger让客户端不要再输送数据
 	self.exchanger.Shutdown()
 	self.recoverManager.Stop()
+	self.cancel()
 	self.kitedb.Stop()
 	self.clientManager.Shutdown()
 	self.remotingServer.Shutdown()
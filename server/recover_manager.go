@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	log "github.com/blackbeans/log4go"
 	packet "github.com/blackbeans/turbo/packet"
@@ -17,6 +18,9 @@ type RecoverManager struct {
 	serverName     string
 	isClose        bool
 	kitestore      store.IKiteStore
+	kitestorec     store.IKiteStoreContext
+	ctx            context.Context //Stop时取消未完成的查询
+	cancel         context.CancelFunc
 	recoverPeriod  time.Duration
 	recoverWorkers chan byte
 }
@@ -24,9 +28,13 @@ type RecoverManager struct {
 //------创建persitehandler
 func NewRecoverManager(serverName string, recoverPeriod time.Duration, pipeline *DefaultPipeline, kitestore store.IKiteStore) *RecoverManager {
 
+	ctx, cancel := context.WithCancel(context.Background())
 	rm := &RecoverManager{
 		serverName:     serverName,
 		kitestore:      kitestore,
+		kitestorec:     store.WithContext(kitestore),
+		ctx:            ctx,
+		cancel:         cancel,
 		isClose:        false,
 		pipeline:       pipeline,
 		recoverPeriod:  recoverPeriod,
@@ -49,13 +57,18 @@ func (self *RecoverManager) startRecoverTask(hashKey string) {
 
 		//开始
 		self.redeliverMsg(hashKey, time.Now())
-		time.Sleep(self.recoverPeriod)
+		select {
+		case <-self.ctx.Done():
+			return
+		case <-time.After(self.recoverPeriod):
+		}
 	}
 
 }
 
 func (self *RecoverManager) Stop() {
 	self.isClose = true
+	self.cancel()
 }
 
 func (self *RecoverManager) redeliverMsg(hashKey string, now time.Time) {
@@ -64,8 +77,12 @@ func (self *RecoverManager) redeliverMsg(hashKey string, now time.Time) {
 	startIdx := 0
 	//开始分页查询未过期的消息实体
 	for !self.isClose && hasMore {
-		more, entities := self.kitestore.PageQueryEntity(hashKey, self.serverName,
+		more, entities, err := self.kitestorec.PageQueryEntityContext(self.ctx, hashKey, self.serverName,
 			now.Unix(), startIdx, 50)
+		if nil != err {
+			log.Error("RecoverManager|redeliverMsg|FAIL|%s|%s\n", err, hashKey)
+			break
+		}
 		// log.Debug("RecoverManager|redeliverMsg|%d|%d\n", now.Unix(), len(entities))
 		if len(entities) <= 0 {
 			break
@@ -14,6 +14,7 @@ type FlowStat struct {
 	OptimzeStatus bool
 	DeliverFlow   *turbo.Flow
 	DeliverPool   *turbo.Flow
+	ResyncFlow    *turbo.Flow //注册中心全量同步修正的次数
 	stop          bool
 }
 
@@ -23,6 +24,7 @@ func NewFlowStat(name string) *FlowStat {
 		OptimzeStatus: true,
 		DeliverFlow:   &turbo.Flow{},
 		DeliverPool:   &turbo.Flow{},
+		ResyncFlow:    &turbo.Flow{},
 		stop:          false}
 	return f
 }
@@ -32,7 +34,7 @@ func (self *FlowStat) Start() {
 	go func() {
 		t := time.NewTicker(1 * time.Second)
 		for !self.stop {
-			line := fmt.Sprintf("%s\tdeliver:%d\tdeliver-go:%d\t", self.name, self.DeliverFlow.Changes(), self.DeliverPool.Count())
+			line := fmt.Sprintf("%s\tdeliver:%d\tdeliver-go:%d\tresync:%d\t", self.name, self.DeliverFlow.Changes(), self.DeliverPool.Count(), self.ResyncFlow.Count())
 			log.Info(line)
 			if nil != self.Kitestore {
 				log.Info(self.Kitestore.Monitor())
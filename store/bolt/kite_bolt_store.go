@@ -0,0 +1,544 @@
+package bolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	log "github.com/blackbeans/log4go"
+	"go.etcd.io/bbolt"
+	"kiteq/protocol"
+	. "kiteq/store"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	CONCURRENT_LEVEL = 16
+)
+
+var (
+	BUCKET_MSG   = []byte("msg") //messageId->消息
+	BUCKET_INDEX = []byte("ndt") //nextDeliverTime|messageId->空,按照下次投递时间排序
+)
+
+//bolt的参数
+type BoltOptions struct {
+	Path        string
+	BatchSize   int           //异步操作批量提交的条数
+	FlushPeriod time.Duration //异步操作最长的提交间隔
+}
+
+//异步批量的操作
+type batchOp struct {
+	op        byte
+	messageId string
+	entity    *MessageEntity
+}
+
+const (
+	BATCH_COMMIT byte = 'C'
+	BATCH_UPDATE byte = 'U'
+	BATCH_DELETE byte = 'D'
+)
+
+//持久化的消息,header用pb序列化,body统一为[]byte
+type boltEntity struct {
+	Header          []byte   `json:"h"`
+	Body            []byte   `json:"b"`
+	MsgType         uint8    `json:"mt"`
+	Topic           string   `json:"t"`
+	MessageType     string   `json:"mtype"`
+	PublishGroup    string   `json:"pg"`
+	Commit          bool     `json:"c"`
+	PublishTime     int64    `json:"pt"`
+	ExpiredTime     int64    `json:"et"`
+	DeliverCount    int32    `json:"dc"`
+	DeliverLimit    int32    `json:"dl"`
+	KiteServer      string   `json:"ks"`
+	FailGroups      []string `json:"fg,omitempty"`
+	SuccGroups      []string `json:"sg,omitempty"`
+	NextDeliverTime int64    `json:"ndt"`
+}
+
+//基于bbolt的单机存储,按照messageId最后一位分为16个bucket
+//每个bucket下msg保存消息,ndt为下次投递时间的索引用于recover分页查询
+type KiteBoltStore struct {
+	db          *bbolt.DB
+	path        string
+	batchSize   int
+	flushPeriod time.Duration
+	batchChan   chan *batchOp
+	closeChan   chan bool
+	wg          sync.WaitGroup
+}
+
+func NewKiteBoltStore(options BoltOptions) *KiteBoltStore {
+	db, err := bbolt.Open(options.Path, 0644, &bbolt.Options{Timeout: 5 * time.Second})
+	if nil != err {
+		log.Crashf("NewKiteBoltStore|Open|FAIL|%s|%s\n", err, options.Path)
+	}
+
+	//创建hash的bucket
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for i := 0; i < CONCURRENT_LEVEL; i++ {
+			b, err := tx.CreateBucketIfNotExists([]byte(fmt.Sprintf("%x", i)))
+			if nil != err {
+				return err
+			}
+			if _, err = b.CreateBucketIfNotExists(BUCKET_MSG); nil != err {
+				return err
+			}
+			if _, err = b.CreateBucketIfNotExists(BUCKET_INDEX); nil != err {
+				return err
+			}
+		}
+		return nil
+	})
+	if nil != err {
+		log.Crashf("NewKiteBoltStore|CreateBucket|FAIL|%s|%s\n", err, options.Path)
+	}
+
+	if options.BatchSize <= 0 {
+		options.BatchSize = 100
+	}
+	if options.FlushPeriod <= 0 {
+		options.FlushPeriod = 1 * time.Second
+	}
+
+	return &KiteBoltStore{
+		db:          db,
+		path:        options.Path,
+		batchSize:   options.BatchSize,
+		flushPeriod: options.FlushPeriod,
+		batchChan:   make(chan *batchOp, options.BatchSize*2),
+		closeChan:   make(chan bool)}
+}
+
+func (self *KiteBoltStore) Start() {
+	self.wg.Add(1)
+	go self.startBatch()
+	log.Info("KiteBoltStore|Start...|%s\n", self.path)
+}
+
+func (self *KiteBoltStore) Stop() {
+	close(self.closeChan)
+	self.wg.Wait()
+	self.db.Close()
+	log.Info("KiteBoltStore|Stop...|%s\n", self.path)
+}
+
+func (self *KiteBoltStore) RecoverNum() int {
+	return CONCURRENT_LEVEL
+}
+
+func (self *KiteBoltStore) Monitor() string {
+	l := 0
+	self.db.View(func(tx *bbolt.Tx) error {
+		for i := 0; i < CONCURRENT_LEVEL; i++ {
+			l += tx.Bucket([]byte(fmt.Sprintf("%x", i))).Bucket(BUCKET_MSG).Stats().KeyN
+		}
+		return nil
+	})
+	return fmt.Sprintf("bolt-length:%d\n", l)
+}
+
+//bbolt同时只有一个写事务,异步的提交、更新、删除合并到一个channel
+//按照写入顺序批量提交,保证同一条消息的操作顺序
+func (self *KiteBoltStore) startBatch() {
+	defer self.wg.Done()
+	ops := make([]*batchOp, 0, self.batchSize)
+	ticker := time.NewTicker(self.flushPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case op := <-self.batchChan:
+			ops = append(ops, op)
+			if len(ops) < self.batchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-self.closeChan:
+			//提交剩余的操作
+		drain:
+			for {
+				select {
+				case op := <-self.batchChan:
+					ops = append(ops, op)
+				default:
+					break drain
+				}
+			}
+			self.flush(ops)
+			return
+		}
+		self.flush(ops)
+		ops = ops[:0]
+	}
+}
+
+func (self *KiteBoltStore) flush(ops []*batchOp) {
+	if len(ops) <= 0 {
+		return
+	}
+	err := self.db.Update(func(tx *bbolt.Tx) error {
+		for _, op := range ops {
+			var err error
+			switch op.op {
+			case BATCH_COMMIT:
+				err = self.commit(tx, op.messageId)
+			case BATCH_UPDATE:
+				err = self.update(tx, op.entity)
+			case BATCH_DELETE:
+				err = self.delete(tx, op.messageId)
+			}
+			if nil != err {
+				log.Error("KiteBoltStore|flush|%c|FAIL|%s|%s\n", op.op, err, op.messageId)
+			}
+		}
+		return nil
+	})
+	if nil != err {
+		log.Error("KiteBoltStore|flush|FAIL|%s|%d\n", err, len(ops))
+	}
+}
+
+//停止后批量提交已经退出,直接返回失败,避免队列满后一直阻塞
+func (self *KiteBoltStore) async(op *batchOp) bool {
+	select {
+	case <-self.closeChan:
+		return false
+	default:
+	}
+	select {
+	case self.batchChan <- op:
+		return true
+	case <-self.closeChan:
+		return false
+	}
+}
+
+func (self *KiteBoltStore) AsyncUpdate(entity *MessageEntity) bool {
+	return self.async(&batchOp{op: BATCH_UPDATE, messageId: entity.MessageId, entity: entity})
+}
+
+func (self *KiteBoltStore) AsyncDelete(messageId string) bool {
+	return self.async(&batchOp{op: BATCH_DELETE, messageId: messageId})
+}
+
+func (self *KiteBoltStore) AsyncCommit(messageId string) bool {
+	return self.async(&batchOp{op: BATCH_COMMIT, messageId: messageId})
+}
+
+//按照messageId的最后一位hash
+func (self *KiteBoltStore) hash(tx *bbolt.Tx, messageid string) (msg *bbolt.Bucket, index *bbolt.Bucket) {
+	id := string(messageid[len(messageid)-1])
+	i, err := strconv.ParseInt(id, CONCURRENT_LEVEL, 8)
+	hashId := int(i)
+	if nil != err {
+		log.Error("KiteBoltStore|hash|INVALID MESSAGEID|%s\n", messageid)
+		hashId = 0
+	} else {
+		hashId = hashId % CONCURRENT_LEVEL
+	}
+
+	b := tx.Bucket([]byte(fmt.Sprintf("%x", hashId)))
+	return b.Bucket(BUCKET_MSG), b.Bucket(BUCKET_INDEX)
+}
+
+//索引的key nextDeliverTime(8)|messageId
+func indexKey(nextDeliverTime int64, messageId string) []byte {
+	key := make([]byte, 8+len(messageId))
+	binary.BigEndian.PutUint64(key, uint64(nextDeliverTime))
+	copy(key[8:], messageId)
+	return key
+}
+
+func (self *KiteBoltStore) get(tx *bbolt.Tx, messageId string) (*boltEntity, error) {
+	msg, _ := self.hash(tx, messageId)
+	data := msg.Get([]byte(messageId))
+	if nil == data {
+		return nil, nil
+	}
+	var be boltEntity
+	err := json.Unmarshal(data, &be)
+	if nil != err {
+		return nil, err
+	}
+	return &be, nil
+}
+
+func (self *KiteBoltStore) put(tx *bbolt.Tx, messageId string, be *boltEntity) error {
+	data, err := json.Marshal(be)
+	if nil != err {
+		return err
+	}
+	msg, _ := self.hash(tx, messageId)
+	return msg.Put([]byte(messageId), data)
+}
+
+func (self *KiteBoltStore) Query(messageId string) *MessageEntity {
+	var entity *MessageEntity
+	err := self.db.View(func(tx *bbolt.Tx) error {
+		be, err := self.get(tx, messageId)
+		if nil != err || nil == be {
+			return err
+		}
+		entity, err = be.toEntity(messageId, true)
+		return err
+	})
+	if nil != err {
+		log.Error("KiteBoltStore|Query|FAIL|%s|%s\n", err, messageId)
+		return nil
+	}
+	return entity
+}
+
+func (self *KiteBoltStore) Save(entity *MessageEntity) bool {
+	be, err := newBoltEntity(entity)
+	if nil != err {
+		log.Error("KiteBoltStore|Save|FAIL|%s|%s\n", err, entity.MessageId)
+		return false
+	}
+
+	err = self.db.Update(func(tx *bbolt.Tx) error {
+		msg, index := self.hash(tx, entity.MessageId)
+		if nil != msg.Get([]byte(entity.MessageId)) {
+			return ERROR_STORE_FAIL
+		}
+		if err := self.put(tx, entity.MessageId, be); nil != err {
+			return err
+		}
+		return index.Put(indexKey(be.NextDeliverTime, entity.MessageId), []byte{})
+	})
+	if nil != err {
+		log.Error("KiteBoltStore|Save|FAIL|%s|%s\n", err, entity.MessageId)
+		return false
+	}
+	return true
+}
+
+func (self *KiteBoltStore) Commit(messageId string) bool {
+	err := self.db.Update(func(tx *bbolt.Tx) error {
+		return self.commit(tx, messageId)
+	})
+	if nil != err {
+		log.Error("KiteBoltStore|Commit|FAIL|%s|%s\n", err, messageId)
+		return false
+	}
+	return true
+}
+
+func (self *KiteBoltStore) commit(tx *bbolt.Tx, messageId string) error {
+	be, err := self.get(tx, messageId)
+	if nil != err {
+		return err
+	} else if nil == be {
+		return ERROR_STORE_FAIL
+	}
+	be.Commit = true
+	return self.put(tx, messageId, be)
+}
+
+func (self *KiteBoltStore) Rollback(messageId string) bool {
+	return self.Delete(messageId)
+}
+
+func (self *KiteBoltStore) UpdateEntity(entity *MessageEntity) bool {
+	err := self.db.Update(func(tx *bbolt.Tx) error {
+		return self.update(tx, entity)
+	})
+	if nil != err {
+		log.Error("KiteBoltStore|UpdateEntity|FAIL|%s|%s\n", err, entity.MessageId)
+		return false
+	}
+	return true
+}
+
+//更新投递状态,消息不存在时忽略
+func (self *KiteBoltStore) update(tx *bbolt.Tx, entity *MessageEntity) error {
+	be, err := self.get(tx, entity.MessageId)
+	if nil != err || nil == be {
+		return err
+	}
+
+	_, index := self.hash(tx, entity.MessageId)
+	if be.NextDeliverTime != entity.NextDeliverTime {
+		if err := index.Delete(indexKey(be.NextDeliverTime, entity.MessageId)); nil != err {
+			return err
+		}
+		if err := index.Put(indexKey(entity.NextDeliverTime, entity.MessageId), []byte{}); nil != err {
+			return err
+		}
+	}
+	be.DeliverCount = entity.DeliverCount
+	be.NextDeliverTime = entity.NextDeliverTime
+	be.SuccGroups = entity.SuccGroups
+	be.FailGroups = entity.FailGroups
+	return self.put(tx, entity.MessageId, be)
+}
+
+func (self *KiteBoltStore) Delete(messageId string) bool {
+	err := self.db.Update(func(tx *bbolt.Tx) error {
+		return self.delete(tx, messageId)
+	})
+	if nil != err {
+		log.Error("KiteBoltStore|Delete|FAIL|%s|%s\n", err, messageId)
+		return false
+	}
+	return true
+}
+
+func (self *KiteBoltStore) delete(tx *bbolt.Tx, messageId string) error {
+	be, err := self.get(tx, messageId)
+	if nil != err || nil == be {
+		return err
+	}
+	msg, index := self.hash(tx, messageId)
+	if err := index.Delete(indexKey(be.NextDeliverTime, messageId)); nil != err {
+		return err
+	}
+	return msg.Delete([]byte(messageId))
+}
+
+func (self *KiteBoltStore) Expired(messageId string) bool {
+	return self.Delete(messageId)
+}
+
+//根据kiteServer名称查询需要重投的消息 返回值为 是否还有更多、和本次返回的数据结果
+//按照下次投递时间的索引顺序扫描,过期或者超过投递次数的消息直接删除
+func (self *KiteBoltStore) PageQueryEntity(hashKey string, kiteServer string, nextDeliveryTime int64, startIdx, limit int) (bool, []*MessageEntity) {
+
+	pe := make([]*MessageEntity, 0, limit+1)
+	var delMessage []string
+	now := time.Now().Unix()
+
+	err := self.db.View(func(tx *bbolt.Tx) error {
+		msg, index := self.hash(tx, hashKey)
+		end := indexKey(nextDeliveryTime+1, "")
+		c := index.Cursor()
+		i := 0
+		for k, _ := c.First(); nil != k && bytes.Compare(k, end) < 0; k, _ = c.Next() {
+			messageId := string(k[8:])
+			data := msg.Get([]byte(messageId))
+			if nil == data {
+				continue
+			}
+			var be boltEntity
+			if err := json.Unmarshal(data, &be); nil != err {
+				log.Error("KiteBoltStore|PageQueryEntity|Unmarshal|FAIL|%s|%s\n", err, messageId)
+				continue
+			}
+
+			if be.DeliverCount >= be.DeliverLimit || be.ExpiredTime < now {
+				if nil == delMessage {
+					delMessage = make([]string, 0, 10)
+				}
+				delMessage = append(delMessage, messageId)
+				continue
+			}
+			if be.KiteServer != kiteServer {
+				continue
+			}
+
+			if startIdx <= i {
+				entity, err := be.toEntity(messageId, false)
+				if nil != err {
+					log.Error("KiteBoltStore|PageQueryEntity|FAIL|%s|%s\n", err, messageId)
+					continue
+				}
+				pe = append(pe, entity)
+			}
+			i++
+			if len(pe) > limit {
+				break
+			}
+		}
+		return nil
+	})
+	if nil != err {
+		log.Error("KiteBoltStore|PageQueryEntity|FAIL|%s|%s|%d\n", err, hashKey, startIdx)
+		return false, nil
+	}
+
+	//删除过期的message
+	for _, messageId := range delMessage {
+		self.AsyncDelete(messageId)
+	}
+
+	if len(pe) > limit {
+		return true, pe[:limit]
+	} else {
+		return false, pe
+	}
+}
+
+func newBoltEntity(entity *MessageEntity) (*boltEntity, error) {
+	header, err := protocol.MarshalPbMessage(entity.Header)
+	if nil != err {
+		return nil, err
+	}
+
+	var body []byte
+	switch entity.MsgType {
+	case protocol.CMD_STRING_MESSAGE:
+		body = []byte(entity.GetBody().(string))
+	case protocol.CMD_BYTES_MESSAGE:
+		body = entity.GetBody().([]byte)
+	default:
+		return nil, fmt.Errorf("UnSupport MESSAGE TYPE %d", entity.MsgType)
+	}
+
+	return &boltEntity{
+		Header:          header,
+		Body:            body,
+		MsgType:         entity.MsgType,
+		Topic:           entity.Topic,
+		MessageType:     entity.MessageType,
+		PublishGroup:    entity.PublishGroup,
+		Commit:          entity.Commit,
+		PublishTime:     entity.PublishTime,
+		ExpiredTime:     entity.ExpiredTime,
+		DeliverCount:    entity.DeliverCount,
+		DeliverLimit:    entity.DeliverLimit,
+		KiteServer:      entity.KiteServer,
+		FailGroups:      entity.FailGroups,
+		SuccGroups:      entity.SuccGroups,
+		NextDeliverTime: entity.NextDeliverTime}, nil
+}
+
+//withBody为false时不反序列化body,用于recover
+func (self *boltEntity) toEntity(messageId string, withBody bool) (*MessageEntity, error) {
+	var header protocol.Header
+	err := protocol.UnmarshalPbMessage(self.Header, &header)
+	if nil != err {
+		return nil, err
+	}
+
+	entity := &MessageEntity{
+		MessageId:       messageId,
+		Header:          &header,
+		MsgType:         self.MsgType,
+		Topic:           self.Topic,
+		MessageType:     self.MessageType,
+		PublishGroup:    self.PublishGroup,
+		Commit:          self.Commit,
+		PublishTime:     self.PublishTime,
+		ExpiredTime:     self.ExpiredTime,
+		DeliverCount:    self.DeliverCount,
+		DeliverLimit:    self.DeliverLimit,
+		KiteServer:      self.KiteServer,
+		FailGroups:      self.FailGroups,
+		SuccGroups:      self.SuccGroups,
+		NextDeliverTime: self.NextDeliverTime}
+
+	if withBody {
+		if self.MsgType == protocol.CMD_STRING_MESSAGE {
+			entity.Body = string(self.Body)
+		} else {
+			entity.Body = self.Body
+		}
+	}
+	return entity, nil
+}
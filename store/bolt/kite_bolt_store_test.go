@@ -0,0 +1,172 @@
+package bolt
+
+import (
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"io/ioutil"
+	"kiteq/protocol"
+	"kiteq/store"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) (*KiteBoltStore, func()) {
+	dir, _ := ioutil.TempDir("", "kiteq-bolt")
+	kb := NewKiteBoltStore(BoltOptions{
+		Path:        dir + "/kiteq.db",
+		BatchSize:   10,
+		FlushPeriod: 10 * time.Millisecond})
+	kb.Start()
+	return kb, func() {
+		kb.Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+func buildEntity(i int, commit bool) *store.MessageEntity {
+	msg := &protocol.StringMessage{}
+	msg.Header = &protocol.Header{
+		MessageId:    proto.String(fmt.Sprintf("%x", i) + "26c03f00665862591f696a980b5ac"),
+		Topic:        proto.String("trade"),
+		MessageType:  proto.String("pay-succ"),
+		ExpiredTime:  proto.Int64(time.Now().Add(10 * time.Minute).Unix()),
+		DeliverLimit: proto.Int32(100),
+		GroupId:      proto.String("go-kite-test"),
+		Commit:       proto.Bool(commit),
+		Fly:          proto.Bool(false)}
+	msg.Body = proto.String("hello world")
+	entity := store.NewMessageEntity(protocol.NewQMessage(msg))
+	entity.KiteServer = "kiteq-server"
+	return entity
+}
+
+func TestBoltStoreSaveQueryCommit(t *testing.T) {
+	kb, clean := newTestStore(t)
+	defer clean()
+
+	entity := buildEntity(1, false)
+	if !kb.Save(entity) {
+		t.Fatal("save fail")
+	}
+	//重复保存失败
+	if kb.Save(entity) {
+		t.Fatal("duplicate save should fail")
+	}
+
+	e := kb.Query(entity.MessageId)
+	if nil == e || e.GetBody().(string) != "hello world" ||
+		e.Header.GetMessageId() != entity.MessageId || e.Commit {
+		t.Fatalf("query %v", e)
+	}
+
+	if !kb.Commit(entity.MessageId) {
+		t.Fatal("commit fail")
+	}
+	if e = kb.Query(entity.MessageId); !e.Commit {
+		t.Fatalf("commit not saved %v", e)
+	}
+
+	kb.Rollback(entity.MessageId)
+	if nil != kb.Query(entity.MessageId) {
+		t.Fatal("rollback not deleted")
+	}
+}
+
+func TestBoltStoreAsync(t *testing.T) {
+	kb, clean := newTestStore(t)
+	defer clean()
+
+	for i := 0; i < 20; i++ {
+		kb.Save(buildEntity(i, false))
+	}
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprintf("%x", i) + "26c03f00665862591f696a980b5ac"
+		kb.AsyncCommit(id)
+		kb.AsyncUpdate(&store.MessageEntity{
+			MessageId:       id,
+			DeliverCount:    1,
+			NextDeliverTime: 100,
+			FailGroups:      []string{"s-mts-test"}})
+		if i%2 == 0 {
+			kb.AsyncDelete(id)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprintf("%x", i) + "26c03f00665862591f696a980b5ac"
+		e := kb.Query(id)
+		if i%2 == 0 {
+			if nil != e {
+				t.Fatalf("async delete %s", id)
+			}
+			continue
+		}
+		if nil == e || !e.Commit || e.DeliverCount != 1 ||
+			e.NextDeliverTime != 100 || e.FailGroups[0] != "s-mts-test" {
+			t.Fatalf("async update %v", e)
+		}
+	}
+}
+
+//停止后的异步操作直接返回失败,不会因为队列满而阻塞
+func TestBoltStoreAsyncAfterStop(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kiteq-bolt")
+	defer os.RemoveAll(dir)
+	kb := NewKiteBoltStore(BoltOptions{Path: dir + "/kiteq.db", BatchSize: 10})
+	kb.Start()
+	kb.Stop()
+
+	done := make(chan bool, 1)
+	go func() {
+		succ := false
+		for i := 0; i < 100; i++ {
+			id := fmt.Sprintf("%x", i) + "26c03f00665862591f696a980b5ac"
+			succ = succ || kb.AsyncCommit(id) || kb.AsyncDelete(id) ||
+				kb.AsyncUpdate(&store.MessageEntity{MessageId: id})
+		}
+		done <- succ
+	}()
+	select {
+	case succ := <-done:
+		if succ {
+			t.Fatal("async op accepted after stop")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("async op blocked after stop")
+	}
+}
+
+func TestBoltStorePageQuery(t *testing.T) {
+	kb, clean := newTestStore(t)
+	defer clean()
+
+	//messageId的最后一位相同,都在同一个hash下,按照下次投递时间排序
+	for i := 0; i < 10; i++ {
+		e := buildEntity(i, true)
+		e.NextDeliverTime = int64(100 - i)
+		kb.Save(e)
+	}
+	other := buildEntity(10, true)
+	other.KiteServer = "other-server"
+	kb.Save(other)
+	late := buildEntity(11, true)
+	late.NextDeliverTime = 1000
+	kb.Save(late)
+
+	more, entities := kb.PageQueryEntity("0c", "kiteq-server", 500, 0, 4)
+	if !more || len(entities) != 4 {
+		t.Fatalf("page query %t %d", more, len(entities))
+	}
+	for i, e := range entities {
+		if e.NextDeliverTime != int64(91+i) || nil != e.Body {
+			t.Fatalf("page query order %d %v", i, e)
+		}
+	}
+
+	more, entities = kb.PageQueryEntity("0c", "kiteq-server", 500, 8, 4)
+	if more || len(entities) != 2 {
+		t.Fatalf("page query tail %t %d", more, len(entities))
+	}
+}
@@ -0,0 +1,235 @@
+package file
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	log "github.com/blackbeans/log4go"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	CHECKPOINT_FILE     = "index.checkpoint"
+	CHECKPOINT_VERSION  = 2
+	CHECKPOINT_PERIOD   = 5 * time.Minute
+	CHECKPOINT_CRC_SIZE = 4 * 1024 //crc of segment log head
+)
+
+//replay position of segment log
+type segmentPosition struct {
+	Sid      int64
+	Position int64          //log byte size
+	Oplogs   int64          //oplog count before position
+	ChunkId  int64          //last chunk id created before position
+	Crc      uint32         //detect the log file replaced with the same segment id
+	live     map[int64]bool //chunks in the recovered index
+}
+
+type segmentPositions []segmentPosition
+
+func (self segmentPositions) Len() int { return len(self) }
+func (self segmentPositions) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
+func (self segmentPositions) Less(i, j int) bool {
+	return self[i].Sid < self[j].Sid
+}
+
+//messageId -> opBody index with the log positions it covers
+type checkpoint struct {
+	Version   int
+	Time      int64
+	Positions segmentPositions
+	Bodies    []*opBody
+}
+
+//crc of the first bytes of log
+func logCrc(path string, size int64) (uint32, error) {
+	if size > CHECKPOINT_CRC_SIZE {
+		size = CHECKPOINT_CRC_SIZE
+	}
+	f, err := os.Open(path)
+	if nil != err {
+		return 0, err
+	}
+	defer f.Close()
+	head := make([]byte, size)
+	_, err = io.ReadFull(f, head)
+	if nil != err {
+		return 0, err
+	}
+	return crc32.ChecksumIEEE(head), nil
+}
+
+//current log positions ,must be taken before the index
+func (self *MessageStore) positions() segmentPositions {
+	//oplog of create is appended under the store lock
+	self.RLock()
+	segs := make(Segments, len(self.segments))
+	copy(segs, self.segments)
+	chunkId := self.chunkId
+	self.RUnlock()
+
+	ps := make(segmentPositions, 0, len(segs))
+	for _, s := range segs {
+		//oplog is flushed on append
+		s.Lock()
+		fi, err := os.Stat(s.slog.path)
+		compacted := s.compacted
+		p := segmentPosition{Sid: s.sid, Oplogs: atomic.LoadInt64(&s.slog.offset), ChunkId: chunkId}
+		s.Unlock()
+		if nil != err || compacted {
+			continue
+		}
+		p.Position = fi.Size()
+		p.Crc, err = logCrc(s.slog.path, fi.Size())
+		if nil != err {
+			continue
+		}
+		ps = append(ps, p)
+	}
+	return ps
+}
+
+//positions whose log still exists unchanged
+func (self *MessageStore) validPositions(ps segmentPositions) map[int64]segmentPosition {
+	valid := make(map[int64]segmentPosition, len(ps))
+	for _, p := range ps {
+		path := self.filePath + fmt.Sprintf("%s-%d", SEGMENT_PREFIX, p.Sid) + SEGMENT_LOG_SUFFIX
+		fi, err := os.Stat(path)
+		if nil != err || fi.Size() < p.Position {
+			continue
+		}
+		crc, err := logCrc(path, p.Position)
+		if nil != err || crc != p.Crc {
+			continue
+		}
+		valid[p.Sid] = p
+	}
+	return valid
+}
+
+//设置checkpoint周期,需要在Start之前调用,小于等于0不做周期checkpoint
+func (self *KiteFileStore) SetCheckpointPeriod(period time.Duration) {
+	self.checkpointPeriod = period
+}
+
+//write index checkpoint
+func (self *KiteFileStore) checkpoint() error {
+	self.cpLock.Lock()
+	defer self.cpLock.Unlock()
+
+	cp := &checkpoint{
+		Version:   CHECKPOINT_VERSION,
+		Time:      time.Now().Unix(),
+		Positions: self.snapshot.positions()}
+
+	//oldest first ,keep the order of loglink
+	for i := 0; i < CONCURRENT_LEVEL; i++ {
+		self.locks[i].RLock()
+		for e := self.loglink[i].Back(); nil != e; e = e.Prev() {
+			ob := *(e.Value.(*opBody))
+			cp.Bodies = append(cp.Bodies, &ob)
+		}
+		self.locks[i].RUnlock()
+	}
+
+	path := self.snapshot.filePath + CHECKPOINT_FILE
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.ModePerm)
+	if nil != err {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	err = gob.NewEncoder(bw).Encode(cp)
+	if nil == err {
+		err = bw.Flush()
+	}
+	if nil == err {
+		err = f.Sync()
+	}
+	f.Close()
+	if nil != err {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, path)
+	if nil != err {
+		return err
+	}
+	if nil != self.snapshot.baseDir {
+		self.snapshot.baseDir.Sync()
+	}
+	log.Info("KiteFileStore|Checkpoint|SUCC|%d|%d", len(cp.Positions), len(cp.Bodies))
+	return nil
+}
+
+//load checkpoint into index ,returns the replay positions
+func (self *KiteFileStore) recoverCheckpoint() map[int64]segmentPosition {
+	f, err := os.Open(self.snapshot.filePath + CHECKPOINT_FILE)
+	if nil != err {
+		return nil
+	}
+	defer f.Close()
+
+	var cp checkpoint
+	err = gob.NewDecoder(bufio.NewReader(f)).Decode(&cp)
+	if nil != err || cp.Version != CHECKPOINT_VERSION {
+		log.Warn("KiteFileStore|recoverCheckpoint|INVALID|%s|%d", err, cp.Version)
+		return nil
+	}
+
+	valid := self.snapshot.validPositions(cp.Positions)
+	ps := cp.Positions
+	sort.Sort(ps)
+	for sid, p := range valid {
+		p.live = make(map[int64]bool, 100)
+		valid[sid] = p
+	}
+	for _, ob := range cp.Bodies {
+		//skip the message in removed or compacted segments
+		idx := sort.Search(len(ps), func(i int) bool { return ps[i].Sid > ob.Id }) - 1
+		if idx < 0 {
+			continue
+		}
+		p, ok := valid[ps[idx].Sid]
+		if !ok {
+			continue
+		}
+		//chunks not in index were deleted or expired before checkpoint
+		p.live[ob.Id] = true
+		l, link, tol := self.hash(ob.MessageId)
+		l.Lock()
+		if e, ok := tol[ob.MessageId]; ok {
+			e.Value = ob
+			link.MoveToFront(e)
+		} else {
+			tol[ob.MessageId] = link.PushFront(ob)
+		}
+		l.Unlock()
+	}
+	log.Info("KiteFileStore|recoverCheckpoint|SUCC|%d/%d|%d", len(valid), len(ps), len(cp.Bodies))
+	return valid
+}
+
+func (self *KiteFileStore) checkpointPeriodically() {
+	ticker := time.NewTicker(self.checkpointPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-self.stopChan:
+			return
+		case <-ticker.C:
+			err := self.checkpoint()
+			if nil != err {
+				log.Error("KiteFileStore|Checkpoint|FAIL|%s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package file
+
+import (
+	"fmt"
+	log "github.com/blackbeans/log4go"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	COMPACT_RATIO          = 0.2             //compact the segment if live chunks ratio <= COMPACT_RATIO
+	COMPACT_PERIOD         = 1 * time.Minute //compaction check period
+	SEGMENT_COMPACT_SUFFIX = ".compact-"     //segment-{newsid}.log.compact-{oldsid}
+)
+
+//copy live chunks of mostly deleted segments into new small segments.
+//compacted segments use negative ids below all existing segments,
+//so they never collide with the ids allocated by Append.
+type compactor struct {
+	store    *MessageStore
+	ratio    float64
+	period   time.Duration
+	last     time.Time
+	closed   bool
+	moved    map[int64]int64 //old chunk id -> new chunk id ,until relocated
+	relocate func(logicId string, oldId, newId int64)
+	lock     sync.RWMutex
+	busy     sync.Mutex
+}
+
+func newCompactor(store *MessageStore, ratio float64, period time.Duration) *compactor {
+	return &compactor{
+		store:  store,
+		ratio:  ratio,
+		period: period,
+		last:   time.Now(),
+		moved:  make(map[int64]int64, 100)}
+}
+
+//translate the chunk id moved by compaction
+func (self *compactor) translate(cid int64) int64 {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	if id, ok := self.moved[cid]; ok {
+		return id
+	}
+	return cid
+}
+
+//compact if period elapsed ,called by evict
+func (self *compactor) tryCompact() {
+	if time.Since(self.last) >= self.period {
+		self.compact()
+		self.last = time.Now()
+	}
+}
+
+//wait for the running compaction
+func (self *compactor) stop() {
+	self.busy.Lock()
+	self.closed = true
+	self.busy.Unlock()
+}
+
+//finish or rollback the compaction interrupted by crash.
+//the old segment log is removed as the commit point.
+func (self *compactor) recover() {
+	dir := self.store.filePath
+	matches, _ := filepath.Glob(dir + SEGMENT_PREFIX + "-*" + SEGMENT_LOG_SUFFIX + SEGMENT_COMPACT_SUFFIX + "*")
+	for _, tmp := range matches {
+		split := strings.SplitN(tmp, SEGMENT_COMPACT_SUFFIX, 2)
+		logpath := split[0]
+		datapath := strings.TrimSuffix(logpath, SEGMENT_LOG_SUFFIX) + SEGMENT_DATA_SUFFIX
+		oldbase := dir + SEGMENT_PREFIX + "-" + split[1]
+
+		if _, err := os.Stat(oldbase + SEGMENT_LOG_SUFFIX); nil == err {
+			//not committed ,rollback
+			os.Remove(tmp)
+			os.Remove(datapath)
+			log.Warn("MessageStore|Compact|Recover|ROLLBACK|%s", tmp)
+		} else {
+			//committed ,finish
+			err := os.Rename(tmp, logpath)
+			if nil != err {
+				log.Error("MessageStore|Compact|Recover|Rename|FAIL|%s|%s", err, tmp)
+				continue
+			}
+			os.Remove(oldbase + SEGMENT_DATA_SUFFIX)
+			log.Info("MessageStore|Compact|Recover|FINISH|%s", logpath)
+		}
+	}
+}
+
+//check all segments except the active one
+func (self *compactor) compact() {
+	self.busy.Lock()
+	defer self.busy.Unlock()
+	if self.closed {
+		return
+	}
+
+	self.store.RLock()
+	segs := make(Segments, len(self.store.segments))
+	copy(segs, self.store.segments)
+	self.store.RUnlock()
+
+	for i := 0; i < len(segs)-1; i++ {
+		s := segs[i]
+		//positive segment ends at the next segment
+		end := int64(-1)
+		if s.sid >= 0 {
+			end = segs[i+1].sid
+		}
+
+		s.RLock()
+		total, live, err := self.stat(s, end)
+		s.RUnlock()
+		if nil != err {
+			log.Warn("MessageStore|Compact|Stat|SKIP|%s|%s", err, s.name)
+			continue
+		}
+
+		if total <= 0 {
+			continue
+		} else if live <= 0 {
+			//all chunks deleted
+			self.store.uncache(s)
+			self.store.remove(s)
+		} else if float64(live)/float64(total) <= self.ratio {
+			err := self.compactSegment(s)
+			if nil != err {
+				log.Error("MessageStore|Compact|FAIL|%s|%s", err, s.name)
+			}
+		}
+	}
+}
+
+//count chunks by segment log ,skip the segment whose chunks are not all created
+func (self *compactor) stat(s *Segment, end int64) (total, live int, err error) {
+	latest := make(map[int64]*oplog, 100)
+	err = s.slog.Scan(func(ol *oplog) {
+		switch ol.Op {
+		case OP_C:
+			total++
+			latest[ol.ChunkId] = ol
+		case OP_U:
+			if _, ok := latest[ol.ChunkId]; ok {
+				latest[ol.ChunkId] = ol
+			}
+		case OP_D, OP_E:
+			delete(latest, ol.ChunkId)
+		}
+	})
+	if nil != err {
+		return 0, 0, err
+	}
+
+	if end >= 0 && int64(total) != end-s.sid {
+		return 0, 0, fmt.Errorf("incomplete segment %d/%d", total, end-s.sid)
+	}
+	return total, len(latest), nil
+}
+
+//copy live chunks into a new segment and swap the old one ,
+//then relocate the index outside of segment lock.
+//the index uses chunk ids only under its own lock ,so once relocated
+//no one holds the old ids and the moved entries can be dropped
+func (self *compactor) compactSegment(s *Segment) error {
+	moved, logicIds, err := self.copySegment(s)
+	if nil != err {
+		return err
+	}
+	for cid, newId := range moved {
+		if nil != self.relocate {
+			self.relocate(logicIds[cid], cid, newId)
+		}
+	}
+	self.lock.Lock()
+	for cid := range moved {
+		delete(self.moved, cid)
+	}
+	self.lock.Unlock()
+	return nil
+}
+
+//copy live chunks into a new segment ,and then swap the old one.
+//return the moved chunk ids and their logic ids
+func (self *compactor) copySegment(s *Segment) (map[int64]int64, map[int64]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.compacted {
+		return nil, nil, nil
+	}
+
+	//latest oplog of live chunks
+	created := 0
+	latest := make(map[int64]*oplog, 100)
+	err := s.slog.Scan(func(ol *oplog) {
+		switch ol.Op {
+		case OP_C:
+			created++
+			latest[ol.ChunkId] = ol
+		case OP_U:
+			if _, ok := latest[ol.ChunkId]; ok {
+				latest[ol.ChunkId] = ol
+			}
+		case OP_D, OP_E:
+			delete(latest, ol.ChunkId)
+		}
+	})
+	if nil != err {
+		return nil, nil, err
+	}
+
+	err = s.Open()
+	if nil != err {
+		return nil, nil, err
+	}
+	//chunks may be still in write channel
+	if len(s.chunks) != created {
+		return nil, nil, fmt.Errorf("unflushed chunks %d/%d", len(s.chunks), created)
+	}
+
+	ids := make([]int64, 0, len(latest))
+	for cid, _ := range latest {
+		if nil != s.Get(cid) {
+			ids = append(ids, cid)
+		}
+	}
+	sort.Sort(int64s(ids))
+
+	//new segment ids are below all existing segments
+	self.store.RLock()
+	low := int64(0)
+	if len(self.store.segments) > 0 && self.store.segments[0].sid < low {
+		low = self.store.segments[0].sid
+	}
+	self.store.RUnlock()
+	newSid := low - int64(len(ids))
+
+	base := self.store.filePath + fmt.Sprintf("%s-%d", SEGMENT_PREFIX, newSid)
+	tmplog := base + SEGMENT_LOG_SUFFIX + SEGMENT_COMPACT_SUFFIX + strconv.FormatInt(s.sid, 10)
+	os.Remove(base + SEGMENT_DATA_SUFFIX)
+	os.Remove(tmplog)
+	news := newSegment(base+SEGMENT_DATA_SUFFIX,
+		fmt.Sprintf("%s-%d", SEGMENT_PREFIX, newSid)+SEGMENT_DATA_SUFFIX, newSid, newSegmentLog(tmplog))
+	err = news.Open()
+	if nil != err {
+		return nil, nil, err
+	}
+
+	rollback := func(err error) error {
+		news.Close()
+		os.Remove(news.path)
+		os.Remove(tmplog)
+		return err
+	}
+
+	moved := make(map[int64]int64, len(ids))
+	chunks := make([]*Chunk, 0, len(ids))
+	for i, cid := range ids {
+		old := s.Get(cid)
+		newId := newSid + int64(i)
+		moved[cid] = newId
+		chunks = append(chunks, &Chunk{
+			length:   old.length,
+			checksum: old.checksum,
+			id:       newId,
+			flag:     NORMAL,
+			data:     old.data})
+	}
+
+	err = news.Append(chunks)
+	if nil == err {
+		err = news.bw.Flush()
+	}
+	if nil == err {
+		err = news.wf.Sync()
+	}
+	if nil != err {
+		return nil, nil, rollback(err)
+	}
+
+	for _, cid := range ids {
+		ol := latest[cid]
+		err = news.slog.Append(newOplog(OP_C, ol.LogicId, moved[cid], ol.Body))
+		if nil != err {
+			return nil, nil, rollback(err)
+		}
+	}
+	err = news.slog.wf.Sync()
+	if nil != err {
+		return nil, nil, rollback(err)
+	}
+
+	//commit point: remove the old segment log
+	s.Close()
+	err = os.Remove(s.slog.path)
+	if nil != err {
+		return nil, nil, rollback(err)
+	}
+	news.slog.Close()
+	err = os.Rename(tmplog, base+SEGMENT_LOG_SUFFIX)
+	if nil != err {
+		//recover will finish the rename at next load
+		log.Error("MessageStore|Compact|Rename|FAIL|%s|%s", err, tmplog)
+	} else {
+		news.slog.path = base + SEGMENT_LOG_SUFFIX
+	}
+	news.slog.Open()
+	os.Remove(s.path)
+
+	//swap segments ,waiters on the old segment retry with moved ids
+	self.lock.Lock()
+	for cid, newId := range moved {
+		self.moved[cid] = newId
+	}
+	self.lock.Unlock()
+	self.store.swap(s, news)
+	s.compacted = true
+
+	logicIds := make(map[int64]string, len(ids))
+	for _, cid := range ids {
+		logicIds[cid] = latest[cid].LogicId
+	}
+
+	log.Info("MessageStore|Compact|SUCC|%s->%s|%d", s.name, news.name, len(ids))
+	return moved, logicIds, nil
+}
+
+type int64s []int64
+
+func (self int64s) Len() int           { return len(self) }
+func (self int64s) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+func (self int64s) Less(i, j int) bool { return self[i] < self[j] }
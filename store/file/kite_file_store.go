@@ -2,6 +2,7 @@ package file
 
 import (
 	"container/list"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	log "github.com/blackbeans/log4go"
@@ -22,17 +23,162 @@ type opBody struct {
 	DeliverCount    int32    `json:"dc"`
 }
 
+//opbody的编码版本,旧版本写入的json以'{'开头
+const (
+	OPBODY_VERSION_BINARY = 0x81
+)
+
+//version(1)|id(varint)|mid(uvarint+n)|commit(1)|ndt(varint)|dc(varint)|fg(uvarint+groups)|sg(uvarint+groups)
+func (self *opBody) marshal() []byte {
+	size := 1 + binary.MaxVarintLen64 + binary.MaxVarintLen64 + len(self.MessageId) + 1 +
+		binary.MaxVarintLen64 + binary.MaxVarintLen64 + groupsSize(self.FailGroups) + groupsSize(self.SuccGroups)
+	b := make([]byte, size)
+	n := 0
+	b[n] = OPBODY_VERSION_BINARY
+	n++
+	n += binary.PutVarint(b[n:], self.Id)
+	n += putString(b[n:], self.MessageId)
+	if self.Commit {
+		b[n] = 1
+	}
+	n++
+	n += binary.PutVarint(b[n:], self.NextDeliverTime)
+	n += binary.PutVarint(b[n:], int64(self.DeliverCount))
+	n += putGroups(b[n:], self.FailGroups)
+	n += putGroups(b[n:], self.SuccGroups)
+	return b[:n]
+}
+
+//旧版本写入的json格式的opbody仍然可以读取
+func (self *opBody) unmarshal(data []byte) error {
+	if len(data) <= 0 || data[0] != OPBODY_VERSION_BINARY {
+		return json.Unmarshal(data, self)
+	}
+
+	r := &bodyReader{data: data[1:]}
+	self.Id = r.varint()
+	self.MessageId = r.string()
+	self.Commit = r.byte() == 1
+	self.NextDeliverTime = r.varint()
+	self.DeliverCount = int32(r.varint())
+	self.FailGroups = r.groups()
+	self.SuccGroups = r.groups()
+	if nil == r.err && len(r.data) > 0 {
+		return ERROR_CORRUPT
+	}
+	return r.err
+}
+
+func groupsSize(groups []string) int {
+	size := binary.MaxVarintLen64
+	for _, g := range groups {
+		size += binary.MaxVarintLen64 + len(g)
+	}
+	return size
+}
+
+func putString(b []byte, s string) int {
+	n := binary.PutUvarint(b, uint64(len(s)))
+	return n + copy(b[n:], s)
+}
+
+func putGroups(b []byte, groups []string) int {
+	n := binary.PutUvarint(b, uint64(len(groups)))
+	for _, g := range groups {
+		n += putString(b[n:], g)
+	}
+	return n
+}
+
+//按顺序读取opbody的字段,出错后后续读取都返回零值
+type bodyReader struct {
+	data []byte
+	err  error
+}
+
+func (self *bodyReader) varint() int64 {
+	if nil != self.err {
+		return 0
+	}
+	v, n := binary.Varint(self.data)
+	if n <= 0 {
+		self.err = ERROR_CORRUPT
+		return 0
+	}
+	self.data = self.data[n:]
+	return v
+}
+
+func (self *bodyReader) uvarint() uint64 {
+	if nil != self.err {
+		return 0
+	}
+	v, n := binary.Uvarint(self.data)
+	if n <= 0 {
+		self.err = ERROR_CORRUPT
+		return 0
+	}
+	self.data = self.data[n:]
+	return v
+}
+
+func (self *bodyReader) byte() byte {
+	if nil != self.err {
+		return 0
+	}
+	if len(self.data) <= 0 {
+		self.err = ERROR_CORRUPT
+		return 0
+	}
+	b := self.data[0]
+	self.data = self.data[1:]
+	return b
+}
+
+func (self *bodyReader) string() string {
+	l := self.uvarint()
+	if nil != self.err {
+		return ""
+	}
+	if uint64(len(self.data)) < l {
+		self.err = ERROR_CORRUPT
+		return ""
+	}
+	s := string(self.data[:l])
+	self.data = self.data[l:]
+	return s
+}
+
+func (self *bodyReader) groups() []string {
+	count := self.uvarint()
+	//每个group至少占一个字节
+	if nil != self.err || count <= 0 {
+		return nil
+	} else if uint64(len(self.data)) < count {
+		self.err = ERROR_CORRUPT
+		return nil
+	}
+	groups := make([]string, 0, count)
+	for i := uint64(0); i < count && nil == self.err; i++ {
+		groups = append(groups, self.string())
+	}
+	return groups
+}
+
 const (
 	CONCURRENT_LEVEL = 16
 )
 
 type KiteFileStore struct {
-	oplogs     []map[string] /*messageId*/ *list.Element //用于oplog的replay
-	loglink    []*list.List                              //*opBody
-	locks      []*sync.RWMutex
-	maxcap     int
-	currentSid int64 // 当前segment的id
-	snapshot   *MessageStore
+	oplogs           []map[string] /*messageId*/ *list.Element //用于oplog的replay
+	loglink          []*list.List                              //*opBody
+	locks            []*sync.RWMutex
+	maxcap           int
+	currentSid       int64 // 当前segment的id
+	snapshot         *MessageStore
+	checkpointPeriod time.Duration //index checkpoint period
+	cpLock           sync.Mutex
+	stopChan         chan bool
 	sync.RWMutex
 }
 
@@ -49,29 +195,54 @@ func NewKiteFileStore(dir string, maxcap int, checkPeriod time.Duration) *KiteFi
 	}
 
 	kms := &KiteFileStore{
-		loglink: loglink,
-		oplogs:  oplogs,
-		locks:   locks,
-		maxcap:  maxcap / CONCURRENT_LEVEL}
+		loglink:          loglink,
+		oplogs:           oplogs,
+		locks:            locks,
+		maxcap:           maxcap / CONCURRENT_LEVEL,
+		checkpointPeriod: CHECKPOINT_PERIOD,
+		stopChan:         make(chan bool)}
 
 	kms.snapshot =
 		NewMessageStore(dir+"/snapshot/", 100, 10, checkPeriod, func(ol *oplog) {
 			kms.replay(ol)
 		})
+	kms.snapshot.compactor.relocate = kms.relocate
 	return kms
 }
 
+//segment压缩后更新消息的chunk id
+func (self *KiteFileStore) relocate(messageId string, oldId, newId int64) {
+	lock, _, ol := self.hash(messageId)
+	lock.Lock()
+	defer lock.Unlock()
+	e, ok := ol[messageId]
+	if ok {
+		v := e.Value.(*opBody)
+		if v.Id == oldId {
+			v.Id = newId
+		}
+	}
+}
+
 //重放当前data的操作日志还原消息状态
 func (self *KiteFileStore) replay(ol *oplog) {
 
 	var body opBody
-	err := json.Unmarshal([]byte(ol.Body), &body)
+	var err error
+	if len(ol.Body) > 0 {
+		err = body.unmarshal(ol.Body)
+	} else {
+		//过期的oplog没有opbody
+		body.MessageId = ol.LogicId
+	}
 	if nil != err {
 		log.Error("KiteFileStore|replay|FAIL|%s|%s", err, ol.Body)
 		return
 	}
 
 	ob := &body
+	//opbody is marshaled before chunk id allocated
+	ob.Id = ol.ChunkId
 	l, link, tol := self.hash(ob.MessageId)
 
 	//如果是更新或者创建，则直接反序列化
@@ -102,9 +273,19 @@ func (self *KiteFileStore) replay(ol *oplog) {
 
 }
 
+//设置刷盘策略,需要在Start之前调用
+func (self *KiteFileStore) SetFsync(policy FsyncPolicy, period time.Duration) {
+	self.snapshot.SetFsync(policy, period)
+}
+
 func (self *KiteFileStore) Start() {
+	//先加载checkpoint,只重放之后的oplog
+	self.snapshot.replayFrom = self.recoverCheckpoint()
 	//start snapshost
 	self.snapshot.Start()
+	if self.checkpointPeriod > 0 {
+		go self.checkpointPeriodically()
+	}
 	log.Info("KiteFileStore|Start...")
 
 }
@@ -112,7 +293,13 @@ func (self *KiteFileStore) Stop() {
 
 	//save queue message into snapshot
 	// self.syncToFile()
+	close(self.stopChan)
 	self.snapshot.Destory()
+	//停止时写入checkpoint加快下次启动
+	err := self.checkpoint()
+	if nil != err {
+		log.Error("KiteFileStore|Stop|Checkpoint|FAIL|%s", err)
+	}
 	log.Info("KiteFileStore|Stop...")
 
 }
@@ -209,7 +396,7 @@ func (self *KiteFileStore) Save(entity *MessageEntity) bool {
 		NextDeliverTime: entity.NextDeliverTime,
 		DeliverCount:    0}
 
-	obd, _ := json.Marshal(ob)
+	obd := ob.marshal()
 	cmd := NewCommand(-1, entity.MessageId, data, obd)
 	//get lock
 
@@ -224,6 +411,12 @@ func (self *KiteFileStore) Save(entity *MessageEntity) bool {
 	ol[entity.MessageId] = e
 	lock.Unlock()
 
+	//等待刷盘后再返回,存储成功的ack在fsync之后发送
+	if !self.snapshot.wait(cmd) {
+		log.Error("KiteFileStore|Save|FSYNC|FAIL|%s", entity.MessageId)
+		self.Delete(entity.MessageId)
+		return false
+	}
 	return true
 }
 func (self *KiteFileStore) Commit(messageId string) bool {
@@ -240,7 +433,7 @@ func (self *KiteFileStore) Commit(messageId string) bool {
 	v.Commit = true
 
 	//write oplog
-	obd, _ := json.Marshal(v)
+	obd := v.marshal()
 	cmd := NewCommand(v.Id, messageId, nil, obd)
 	self.snapshot.Update(cmd)
 	return true
@@ -263,7 +456,7 @@ func (self *KiteFileStore) UpdateEntity(entity *MessageEntity) bool {
 	v.SuccGroups = entity.SuccGroups
 	v.FailGroups = entity.FailGroups
 	//append log
-	obd, _ := json.Marshal(v)
+	obd := v.marshal()
 	cmd := NewCommand(v.Id, entity.MessageId, nil, obd)
 	self.snapshot.Update(cmd)
 	return true
@@ -289,7 +482,7 @@ func (self *KiteFileStore) innerDelete(messageId string, link *list.List,
 	v := link.Remove(e).(*opBody)
 
 	//delete
-	obd, _ := json.Marshal(v)
+	obd := v.marshal()
 	cmd := NewCommand(v.Id, messageId, nil, obd)
 	self.snapshot.Delete(cmd)
 	// log.Info("KiteFileStore|innerDelete|%s\n", messageId)
@@ -1,11 +1,16 @@
 package file
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/golang/protobuf/proto"
+	"io/ioutil"
 	"kiteq/protocol"
 	"kiteq/store"
 	"log"
+	"os"
+	"sync"
 	"testing"
 	"time"
 )
@@ -242,3 +247,413 @@ func TestFileStoreInit(t *testing.T) {
 	fs.Stop()
 	cleanSnapshot("./snapshot/")
 }
+
+func TestFileStoreCompact(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kiteq-compact")
+	defer os.RemoveAll(dir)
+	fs := NewKiteFileStore(dir, 5000000, 1*time.Second)
+	fs.Start()
+
+	//超过MAX_SEGMENT_SIZE滚动出新的segment
+	body := make([]byte, 1024*1024)
+	for i := 0; i < 70; i++ {
+		msg := &protocol.BytesMessage{}
+		msg.Header = &protocol.Header{
+			MessageId:    proto.String(fmt.Sprintf("%x", i) + "26c03f00665862591f696a980b5ac"),
+			Topic:        proto.String("trade"),
+			MessageType:  proto.String("pay-succ"),
+			ExpiredTime:  proto.Int64(time.Now().Add(10 * time.Minute).Unix()),
+			DeliverLimit: proto.Int32(100),
+			GroupId:      proto.String("go-kite-test"),
+			Commit:       proto.Bool(true),
+			Fly:          proto.Bool(false)}
+		msg.Body = body
+		if !fs.Save(store.NewMessageEntity(protocol.NewQMessage(msg))) {
+			t.Fatalf("save fail %d", i)
+		}
+		//segment大小在刷盘后才更新
+		if i%10 == 9 {
+			time.Sleep(600 * time.Millisecond)
+		}
+	}
+	if len(fs.snapshot.segments) < 2 {
+		t.Fatalf("segment not rolled %d", len(fs.snapshot.segments))
+	}
+
+	//第一个segment只保留5条
+	end := int(fs.snapshot.segments[1].sid)
+	for i := 0; i < end; i++ {
+		if i%10 != 0 {
+			fs.Delete(fmt.Sprintf("%x", i) + "26c03f00665862591f696a980b5ac")
+		}
+	}
+	fs.UpdateEntity(&store.MessageEntity{
+		MessageId:    "026c03f00665862591f696a980b5ac",
+		DeliverCount: 3,
+		SuccGroups:   []string{},
+		FailGroups:   []string{"s-mts-test"}})
+
+	fs.snapshot.compactor.compact()
+	if fs.snapshot.segments[0].sid >= 0 {
+		t.Fatalf("segment not compacted %s", fs.snapshot.segments[0])
+	}
+	if _, err := os.Stat(dir + "/snapshot/segment-0.data"); !os.IsNotExist(err) {
+		t.Fatalf("old segment not removed %s", err)
+	}
+	//压缩返回前索引已经更新为新的chunk id
+	if len(fs.snapshot.compactor.moved) != 0 {
+		t.Fatalf("moved ids not relocated %d", len(fs.snapshot.compactor.moved))
+	}
+
+	check := func() {
+		for i := 0; i < 70; i++ {
+			id := fmt.Sprintf("%x", i) + "26c03f00665862591f696a980b5ac"
+			entity := fs.Query(id)
+			if i < end && i%10 != 0 {
+				if nil != entity {
+					t.Fatalf("deleted message found %s", id)
+				}
+			} else if nil == entity {
+				t.Fatalf("query fail %s", id)
+			}
+		}
+		entity := fs.Query("026c03f00665862591f696a980b5ac")
+		if entity.DeliverCount != 3 || entity.FailGroups[0] != "s-mts-test" {
+			t.Fatalf("update lost %v", entity)
+		}
+	}
+	check()
+	fs.Stop()
+
+	//重启后从压缩后的segment恢复
+	fs = NewKiteFileStore(dir, 5000000, 1*time.Second)
+	fs.Start()
+	check()
+	fs.Stop()
+}
+
+func TestFileStoreFsync(t *testing.T) {
+	for _, name := range []string{"always", "batch", "period"} {
+		policy, err := ParseFsyncPolicy(name)
+		if nil != err || policy.String() != name {
+			t.Fatalf("parse fsync policy %s %s", name, err)
+		}
+
+		dir, _ := ioutil.TempDir("", "kiteq-fsync")
+		fs := NewKiteFileStore(dir, 5000000, 1*time.Second)
+		fs.SetFsync(policy, 100*time.Millisecond)
+		fs.Start()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				msg := &protocol.BytesMessage{}
+				msg.Header = &protocol.Header{
+					MessageId:    proto.String(fmt.Sprintf("%x", i) + "26c03f00665862591f696a980b5ac"),
+					Topic:        proto.String("trade"),
+					MessageType:  proto.String("pay-succ"),
+					ExpiredTime:  proto.Int64(time.Now().Add(10 * time.Minute).Unix()),
+					DeliverLimit: proto.Int32(100),
+					GroupId:      proto.String("go-kite-test"),
+					Commit:       proto.Bool(true),
+					Fly:          proto.Bool(false)}
+				msg.Body = []byte("hello world")
+				if !fs.Save(store.NewMessageEntity(protocol.NewQMessage(msg))) {
+					t.Errorf("save fail %s %d", name, i)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		//周期刷盘需要等待一个周期
+		if policy == FSYNC_PERIOD {
+			time.Sleep(300 * time.Millisecond)
+		}
+
+		//返回成功时数据已经写入文件
+		s := fs.snapshot.segments[0]
+		s.RLock()
+		size := s.byteSize
+		chunks := len(s.chunks)
+		s.RUnlock()
+		fi, err := os.Stat(s.path)
+		if nil != err || chunks != 100 || fi.Size() != int64(size) {
+			t.Fatalf("%s not flushed %d/%d %d", name, fi.Size(), size, chunks)
+		}
+		fs.Stop()
+		os.RemoveAll(dir)
+	}
+
+	if _, err := ParseFsyncPolicy("never"); nil == err {
+		t.Fatal("invalid fsync policy parsed")
+	}
+}
+
+//逐条保存时组提交不需要等待攒批或者定时刷盘
+func TestFileStoreGroupCommit(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kiteq-group-commit")
+	defer os.RemoveAll(dir)
+	fs := NewKiteFileStore(dir, 5000000, 1*time.Second)
+	fs.SetFsync(FSYNC_BATCH, 100*time.Millisecond)
+	fs.Start()
+	defer fs.Stop()
+
+	for i := 0; i < 10; i++ {
+		msg := &protocol.BytesMessage{}
+		msg.Header = &protocol.Header{
+			MessageId:    proto.String(fmt.Sprintf("%x", i) + "26c03f00665862591f696a980b5ac"),
+			Topic:        proto.String("trade"),
+			MessageType:  proto.String("pay-succ"),
+			ExpiredTime:  proto.Int64(time.Now().Add(10 * time.Minute).Unix()),
+			DeliverLimit: proto.Int32(100),
+			GroupId:      proto.String("go-kite-test"),
+			Commit:       proto.Bool(true),
+			Fly:          proto.Bool(false)}
+		msg.Body = []byte("hello world")
+		now := time.Now()
+		if !fs.Save(store.NewMessageEntity(protocol.NewQMessage(msg))) {
+			t.Fatalf("save fail %d", i)
+		}
+		if cost := time.Since(now); cost >= 250*time.Millisecond {
+			t.Fatalf("save waits for batch %d %s", i, cost)
+		}
+	}
+}
+
+func TestFileStoreCheckpoint(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kiteq-checkpoint")
+	defer os.RemoveAll(dir)
+	fs := NewKiteFileStore(dir, 5000000, 1*time.Second)
+	fs.Start()
+
+	save := func(i int) {
+		msg := &protocol.BytesMessage{}
+		msg.Header = &protocol.Header{
+			MessageId:    proto.String(fmt.Sprintf("%x", i) + "26c03f00665862591f696a980b5ac"),
+			Topic:        proto.String("trade"),
+			MessageType:  proto.String("pay-succ"),
+			ExpiredTime:  proto.Int64(time.Now().Add(10 * time.Minute).Unix()),
+			DeliverLimit: proto.Int32(100),
+			GroupId:      proto.String("go-kite-test"),
+			Commit:       proto.Bool(false),
+			Fly:          proto.Bool(false)}
+		msg.Body = []byte("hello world")
+		if !fs.Save(store.NewMessageEntity(protocol.NewQMessage(msg))) {
+			t.Fatalf("save fail %d", i)
+		}
+	}
+	id := func(i int) string {
+		return fmt.Sprintf("%x", i) + "26c03f00665862591f696a980b5ac"
+	}
+
+	for i := 0; i < 100; i++ {
+		save(i)
+	}
+	for i := 0; i < 50; i++ {
+		fs.Commit(id(i))
+	}
+	fs.Delete(id(99))
+	//Stop时写入checkpoint
+	fs.Stop()
+
+	fs = NewKiteFileStore(dir, 5000000, 1*time.Second)
+	fs.Start()
+	if len(fs.snapshot.replayFrom) != 1 || fs.snapshot.replayFrom[0].Position <= 0 {
+		t.Fatalf("checkpoint not loaded %v", fs.snapshot.replayFrom)
+	}
+	//checkpoint之前删除的chunk和oplog数量需要恢复
+	checkSegment := func(deleted int32) {
+		s := fs.snapshot.segments[0]
+		oplogs := int64(0)
+		s.slog.Scan(func(ol *oplog) { oplogs++ })
+		s.RLock()
+		_, _, del, _ := s.stat()
+		s.RUnlock()
+		if del != deleted || s.slog.offset != oplogs {
+			t.Fatalf("segment not recovered %d %d/%d", del, s.slog.offset, oplogs)
+		}
+	}
+	checkSegment(1)
+	if nil != fs.Query(id(99)) || !fs.Query(id(0)).Commit || fs.Query(id(50)).Commit {
+		t.Fatal("recover from checkpoint fail")
+	}
+
+	//checkpoint之后的oplog需要重放
+	for i := 100; i < 110; i++ {
+		save(i)
+	}
+	fs.Commit(id(50))
+	fs.Delete(id(0))
+	//模拟没有写入checkpoint的退出
+	close(fs.stopChan)
+	fs.snapshot.Destory()
+
+	fs = NewKiteFileStore(dir, 5000000, 1*time.Second)
+	fs.Start()
+	defer fs.Stop()
+	if nil != fs.Query(id(0)) || nil != fs.Query(id(99)) || !fs.Query(id(50)).Commit ||
+		nil == fs.Query(id(105)) || fs.Query(id(51)).Commit {
+		t.Fatal("replay tail after checkpoint fail")
+	}
+	checkSegment(2)
+	//messageId的最后一位相同,都在同一个hash下
+	_, link, _ := fs.hash(id(1))
+	if link.Len() != 108 {
+		t.Fatalf("recovered index %d", link.Len())
+	}
+}
+
+//二进制的opbody和旧版本的json都可以读取
+func TestOpBodyCompatible(t *testing.T) {
+	ob := &opBody{
+		Id:              -100,
+		MessageId:       "26c03f00665862591f696a980b5ac",
+		Commit:          true,
+		FailGroups:      []string{"s-mts-test", ""},
+		NextDeliverTime: time.Now().Unix(),
+		DeliverCount:    3}
+	data, _ := json.Marshal(ob)
+	for _, b := range [][]byte{ob.marshal(), data} {
+		var v opBody
+		err := v.unmarshal(b)
+		if nil != err || v.Id != ob.Id || v.MessageId != ob.MessageId || !v.Commit ||
+			len(v.FailGroups) != 2 || v.FailGroups[0] != "s-mts-test" || len(v.SuccGroups) != 0 ||
+			v.NextDeliverTime != ob.NextDeliverTime || v.DeliverCount != 3 {
+			t.Fatalf("unmarshal %s|%+v", err, v)
+		}
+	}
+
+	b := ob.marshal()
+	for i := 1; i < len(b); i++ {
+		var v opBody
+		if nil == v.unmarshal(b[:i]) {
+			t.Fatalf("unmarshal truncated opbody %d", i)
+		}
+	}
+}
+
+func BenchmarkOpBodyMarshal(t *testing.B) {
+	ob := &opBody{Id: 100, MessageId: "26c03f00665862591f696a980b5ac", Commit: true, SuccGroups: []string{"s-mts-test"}}
+	for i := 0; i < t.N; i++ {
+		ob.marshal()
+	}
+}
+
+func BenchmarkOpBodyMarshalJson(t *testing.B) {
+	ob := &opBody{Id: 100, MessageId: "26c03f00665862591f696a980b5ac", Commit: true, SuccGroups: []string{"s-mts-test"}}
+	for i := 0; i < t.N; i++ {
+		json.Marshal(ob)
+	}
+}
+
+func BenchmarkOpBodyUnmarshal(t *testing.B) {
+	b := (&opBody{Id: 100, MessageId: "26c03f00665862591f696a980b5ac", Commit: true, SuccGroups: []string{"s-mts-test"}}).marshal()
+	for i := 0; i < t.N; i++ {
+		var ob opBody
+		ob.unmarshal(b)
+	}
+}
+
+func BenchmarkOpBodyUnmarshalJson(t *testing.B) {
+	b, _ := json.Marshal(&opBody{Id: 100, MessageId: "26c03f00665862591f696a980b5ac", Commit: true, SuccGroups: []string{"s-mts-test"}})
+	for i := 0; i < t.N; i++ {
+		var ob opBody
+		ob.unmarshal(b)
+	}
+}
+
+func TestFileStoreFsck(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kiteq-fsck")
+	defer os.RemoveAll(dir)
+	fs := NewKiteFileStore(dir, 5000000, 1*time.Second)
+	fs.Start()
+
+	id := func(i int) string {
+		return fmt.Sprintf("%x", i) + "26c03f00665862591f696a980b5ac"
+	}
+	for i := 0; i < 20; i++ {
+		msg := &protocol.BytesMessage{}
+		msg.Header = &protocol.Header{
+			MessageId:    proto.String(id(i)),
+			Topic:        proto.String("trade"),
+			MessageType:  proto.String("pay-succ"),
+			ExpiredTime:  proto.Int64(time.Now().Add(10 * time.Minute).Unix()),
+			DeliverLimit: proto.Int32(100),
+			GroupId:      proto.String("go-kite-test"),
+			Commit:       proto.Bool(false),
+			Fly:          proto.Bool(false)}
+		msg.Body = []byte("hello world")
+		if !fs.Save(store.NewMessageEntity(protocol.NewQMessage(msg))) {
+			t.Fatalf("save fail %d", i)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		fs.Delete(id(i))
+	}
+	fs.Stop()
+
+	report, err := Fsck(dir + "/snapshot/")
+	if nil != err || len(report.Issues) != 0 || len(report.Segments) != 1 {
+		t.Fatalf("fsck clean store %s|%v", err, report.Issues)
+	}
+	seg := report.Segments[0]
+	if seg.Chunks != 20 || seg.Oplogs != 25 || seg.Live != 15 {
+		t.Fatalf("fsck stat %+v", seg)
+	}
+
+	if _, err := os.Stat(dir + "/snapshot/" + CHECKPOINT_FILE); nil != err {
+		t.Fatalf("checkpoint not written %s", err)
+	}
+
+	//数据文件写了一半的chunk,oplog已经写入
+	df, _ := os.OpenFile(seg.DataPath, os.O_WRONLY|os.O_APPEND, os.ModePerm)
+	df.Write([]byte{0, 0, 1, 0, 1, 2, 3})
+	df.Close()
+	//无法解码的oplog和写了一半的oplog
+	lf, _ := os.OpenFile(seg.LogPath, os.O_WRONLY|os.O_APPEND, os.ModePerm)
+	lf.Write(newOplog(OP_C, id(20), 20, nil).marshal())
+	lf.Write([]byte{0, 0, 0, 10, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	lf.Write([]byte{0, 0, 0, 100, 1, 2, 3})
+	lf.Close()
+
+	report, err = Fsck(dir + "/snapshot/")
+	if nil != err || len(report.Issues) != 4 {
+		t.Fatalf("fsck damaged store %s|%v", err, report.Issues)
+	}
+	kinds := map[string]int{}
+	for _, i := range report.Issues {
+		kinds[i.Kind]++
+	}
+	if kinds[FSCK_TORN_WRITE] != 2 || kinds[FSCK_CORRUPT_OPLOG] != 1 || kinds[FSCK_ORPHAN_OPLOG] != 1 {
+		t.Fatalf("fsck issues %v", report.Issues)
+	}
+
+	//截断后checkpoint可能索引了不存在的chunk,需要删除
+	err = report.Truncate()
+	if nil != err || len(report.Issues) != 4 {
+		t.Fatalf("truncate fail %s|%v", err, report.Issues)
+	}
+	if _, err := os.Stat(dir + "/snapshot/" + CHECKPOINT_FILE); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint not removed %s", err)
+	}
+	report, err = Fsck(dir + "/snapshot/")
+	if nil != err || len(report.Issues) != 1 || report.Issues[0].Kind != FSCK_ORPHAN_OPLOG {
+		t.Fatalf("fsck truncated store %s|%v", err, report.Issues)
+	}
+
+	out := new(bytes.Buffer)
+	count, err := report.Export(out)
+	if nil != err || count != 15 || bytes.Count(out.Bytes(), []byte("\n")) != 15 ||
+		!bytes.Contains(out.Bytes(), []byte(`"mid":"`+id(19)+`"`)) {
+		t.Fatalf("export %s|%d", err, count)
+	}
+
+	fs = NewKiteFileStore(dir, 5000000, 1*time.Second)
+	fs.Start()
+	defer fs.Stop()
+	if nil != fs.Query(id(0)) || nil == fs.Query(id(19)) {
+		t.Fatal("restart after truncate fail")
+	}
+}
@@ -0,0 +1,324 @@
+package file
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//issue kinds found by fsck
+const (
+	FSCK_CORRUPT_CHUNK = "corrupt-chunk"
+	FSCK_TORN_WRITE    = "torn-write"
+	FSCK_CORRUPT_OPLOG = "corrupt-oplog"
+	FSCK_ORPHAN_OPLOG  = "orphan-oplog"
+	FSCK_ORPHAN_FILE   = "orphan-file"
+)
+
+type FsckIssue struct {
+	Kind   string
+	Path   string
+	Offset int64
+	Detail string
+}
+
+func (self FsckIssue) String() string {
+	return fmt.Sprintf("%s\t%s@%d\t%s", self.Kind, self.Path, self.Offset, self.Detail)
+}
+
+//scan result of one segment
+type FsckSegment struct {
+	Sid      int64
+	DataPath string
+	LogPath  string
+	Chunks   int   //good chunks
+	DataSize int64 //file size
+	DataGood int64 //offset after the last good chunk
+	Oplogs   int   //good oplogs
+	LogSize  int64
+	LogGood  int64
+	Live     int //chunks neither deleted nor expired
+}
+
+type FsckReport struct {
+	Dir      string
+	Segments []*FsckSegment
+	Issues   []FsckIssue
+}
+
+//message exported by fsck ,one json per line
+type FsckMessage struct {
+	ChunkId int64           `json:"chunk_id"`
+	LogicId string          `json:"logic_id"`
+	Op      json.RawMessage `json:"op"`
+	Message json.RawMessage `json:"message"`
+}
+
+func (self *FsckReport) issue(kind, path string, offset int64, detail string) {
+	self.Issues = append(self.Issues, FsckIssue{kind, path, offset, detail})
+}
+
+//check segments and segment logs in the snapshot directory offline
+func Fsck(dir string) (*FsckReport, error) {
+	if !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+	if !dirExist(dir) {
+		return nil, fmt.Errorf("no such directory %s", dir)
+	}
+
+	report := &FsckReport{Dir: dir}
+	segs := make(map[int64]*FsckSegment, 10)
+	files, _ := filepath.Glob(dir + SEGMENT_PREFIX + "-*")
+	for _, f := range files {
+		name := filepath.Base(f)
+		split := strings.SplitN(name, ".", 2)
+		sid, err := strconv.ParseInt(strings.TrimPrefix(split[0], SEGMENT_PREFIX+"-"), 10, 64)
+		if nil != err || len(split) < 2 {
+			report.issue(FSCK_ORPHAN_FILE, f, 0, "unknown file")
+			continue
+		}
+
+		seg, ok := segs[sid]
+		if !ok {
+			seg = &FsckSegment{Sid: sid}
+			segs[sid] = seg
+		}
+		switch "." + split[1] {
+		case SEGMENT_DATA_SUFFIX:
+			seg.DataPath = f
+		case SEGMENT_LOG_SUFFIX:
+			seg.LogPath = f
+		default:
+			report.issue(FSCK_ORPHAN_FILE, f, 0, "interrupted compaction ,recovered on next start")
+		}
+	}
+
+	for _, seg := range segs {
+		if len(seg.DataPath) <= 0 && len(seg.LogPath) <= 0 {
+			continue
+		}
+		report.Segments = append(report.Segments, seg)
+	}
+	sort.Sort(fsckSegments(report.Segments))
+
+	for _, seg := range report.Segments {
+		if len(seg.DataPath) <= 0 {
+			report.issue(FSCK_ORPHAN_FILE, seg.LogPath, 0, "segment log without data")
+		} else if len(seg.LogPath) <= 0 {
+			report.issue(FSCK_ORPHAN_FILE, seg.DataPath, 0, "segment data without log")
+		}
+		err := report.scan(seg, nil)
+		if nil != err {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+//scan data and log of segment ,export live messages if do is not nil
+func (self *FsckReport) scan(seg *FsckSegment, do func(m *FsckMessage)) error {
+	chunks := make(map[int64]*Chunk, 1000)
+	if len(seg.DataPath) > 0 {
+		f, err := os.Open(seg.DataPath)
+		if nil != err {
+			return err
+		}
+		fi, _ := f.Stat()
+		seg.DataSize = fi.Size()
+		br := bufio.NewReader(f)
+		offset := int64(0)
+		for {
+			c, err := readChunk(br, seg.DataSize-offset)
+			if io.EOF == err {
+				break
+			} else if ERROR_TORN_WRITE == err {
+				self.issue(FSCK_TORN_WRITE, seg.DataPath, offset, fmt.Sprintf("%d bytes", seg.DataSize-offset))
+				break
+			} else if nil != err {
+				self.issue(FSCK_CORRUPT_CHUNK, seg.DataPath, offset, err.Error())
+				break
+			}
+			offset += int64(c.length)
+			if nil != do {
+				chunks[c.id] = c
+			} else {
+				//keep memory low
+				chunks[c.id] = nil
+			}
+		}
+		f.Close()
+		seg.DataGood = offset
+		seg.Chunks = len(chunks)
+	}
+
+	latest := make(map[int64]*oplog, 1000)
+	if len(seg.LogPath) > 0 {
+		f, err := os.Open(seg.LogPath)
+		if nil != err {
+			return err
+		}
+		fi, _ := f.Stat()
+		seg.LogSize = fi.Size()
+		br := bufio.NewReader(f)
+		offset := int64(0)
+		orphans := make(map[int64]bool, 10)
+		for {
+			ol, n, err := readOplog(br)
+			if io.EOF == err {
+				break
+			} else if ERROR_CORRUPT == err {
+				//skipped by replay
+				self.issue(FSCK_CORRUPT_OPLOG, seg.LogPath, offset, err.Error())
+				offset += int64(n)
+				continue
+			} else if nil != err {
+				self.issue(FSCK_TORN_WRITE, seg.LogPath, offset, fmt.Sprintf("%s,%d bytes", err, seg.LogSize-offset))
+				break
+			}
+			offset += int64(n)
+			seg.LogGood = offset
+			seg.Oplogs++
+
+			if _, ok := chunks[ol.ChunkId]; !ok {
+				if !orphans[ol.ChunkId] {
+					orphans[ol.ChunkId] = true
+					self.issue(FSCK_ORPHAN_OPLOG, seg.LogPath, offset-int64(n),
+						fmt.Sprintf("chunk %d of %s not found", ol.ChunkId, ol.LogicId))
+				}
+				continue
+			}
+			switch ol.Op {
+			case OP_C, OP_U:
+				latest[ol.ChunkId] = ol
+			case OP_D, OP_E:
+				delete(latest, ol.ChunkId)
+			}
+		}
+		f.Close()
+	}
+	seg.Live = len(latest)
+
+	if nil != do {
+		ids := make([]int64, 0, len(latest))
+		for cid, _ := range latest {
+			ids = append(ids, cid)
+		}
+		sort.Sort(int64s(ids))
+		for _, cid := range ids {
+			ol := latest[cid]
+			//binary opbody is exported as json ,the invalid one is reported by export
+			op := ol.Body
+			var ob opBody
+			if nil == ob.unmarshal(ol.Body) {
+				op, _ = json.Marshal(&ob)
+			}
+			do(&FsckMessage{
+				ChunkId: cid,
+				LogicId: ol.LogicId,
+				Op:      json.RawMessage(op),
+				Message: json.RawMessage(chunks[cid].data)})
+		}
+	}
+	return nil
+}
+
+//truncate data and log to the last good record.
+//the checkpoint may index the truncated chunks ,so it is removed for a full replay,
+//and the oplogs of truncated chunks are reported as orphan
+func (self *FsckReport) Truncate() error {
+	truncated := false
+	for _, seg := range self.Segments {
+		if len(seg.DataPath) > 0 && seg.DataGood < seg.DataSize {
+			err := os.Truncate(seg.DataPath, seg.DataGood)
+			if nil != err {
+				return err
+			}
+			seg.DataSize = seg.DataGood
+			truncated = true
+
+			rescan := &FsckReport{Dir: self.Dir}
+			err = rescan.scan(seg, nil)
+			if nil != err {
+				return err
+			}
+			for _, i := range rescan.Issues {
+				if i.Kind == FSCK_ORPHAN_OPLOG && !self.reported(i) {
+					self.Issues = append(self.Issues, i)
+				}
+			}
+		}
+		if len(seg.LogPath) > 0 && seg.LogGood < seg.LogSize {
+			err := os.Truncate(seg.LogPath, seg.LogGood)
+			if nil != err {
+				return err
+			}
+			seg.LogSize = seg.LogGood
+			truncated = true
+		}
+	}
+
+	if truncated {
+		err := os.Remove(self.Dir + CHECKPOINT_FILE)
+		if nil != err && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *FsckReport) reported(issue FsckIssue) bool {
+	for _, i := range self.Issues {
+		if i == issue {
+			return true
+		}
+	}
+	return false
+}
+
+//export live messages as json lines ,returns the number exported
+func (self *FsckReport) Export(w io.Writer) (int, error) {
+	count := 0
+	enc := json.NewEncoder(w)
+	var err error
+	//issues were reported by Fsck
+	rescan := &FsckReport{Dir: self.Dir}
+	for _, seg := range self.Segments {
+		e := rescan.scan(seg, func(m *FsckMessage) {
+			if nil != err {
+				return
+			}
+			if !json.Valid(m.Op) || !json.Valid(m.Message) {
+				self.issue(FSCK_CORRUPT_CHUNK, seg.DataPath, 0, fmt.Sprintf("chunk %d is not json", m.ChunkId))
+				return
+			}
+			err = enc.Encode(m)
+			if nil == err {
+				count++
+			}
+		})
+		if nil != e {
+			return count, e
+		}
+		if nil != err {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+type fsckSegments []*FsckSegment
+
+func (self fsckSegments) Len() int { return len(self) }
+func (self fsckSegments) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
+func (self fsckSegments) Less(i, j int) bool {
+	return self[i].Sid < self[j].Sid
+}
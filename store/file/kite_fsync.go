@@ -0,0 +1,133 @@
+package file
+
+import (
+	"fmt"
+	log "github.com/blackbeans/log4go"
+	"sync/atomic"
+	"time"
+)
+
+//durability policy of the file store
+type FsyncPolicy uint8
+
+const (
+	FSYNC_NONE   FsyncPolicy = iota //leave it to the os
+	FSYNC_ALWAYS                    //fsync every write ,save returns after its own fsync
+	FSYNC_BATCH                     //group commit ,save returns after the batch fsync
+	FSYNC_PERIOD                    //fsync dirty segments periodically
+)
+
+func (self FsyncPolicy) String() string {
+	switch self {
+	case FSYNC_NONE:
+		return "none"
+	case FSYNC_ALWAYS:
+		return "always"
+	case FSYNC_BATCH:
+		return "batch"
+	case FSYNC_PERIOD:
+		return "period"
+	}
+	return ""
+}
+
+//parse policy from the name used in file:// url
+func ParseFsyncPolicy(name string) (FsyncPolicy, error) {
+	switch name {
+	case "", "none":
+		return FSYNC_NONE, nil
+	case "always":
+		return FSYNC_ALWAYS, nil
+	case "batch":
+		return FSYNC_BATCH, nil
+	case "period":
+		return FSYNC_PERIOD, nil
+	}
+	return FSYNC_NONE, fmt.Errorf("unknown fsync policy %s", name)
+}
+
+//flush buffer and fsync data and log ,caller must hold the lock
+func (self *Segment) Sync() error {
+	if atomic.LoadInt32(&self.isOpen) != 1 {
+		return nil
+	}
+	err := self.bw.Flush()
+	if nil == err {
+		err = self.wf.Sync()
+	}
+	if nil != err {
+		log.Error("Segment|Sync|FAIL|%s|%s", err, self.name)
+		return err
+	}
+	return self.slog.Sync()
+}
+
+//flush buffer and fsync log ,caller must hold the lock
+func (self *SegmentLog) Sync() error {
+	if atomic.LoadInt32(&self.isOpen) != 1 {
+		return nil
+	}
+	err := self.bw.Flush()
+	if nil == err {
+		err = self.wf.Sync()
+	}
+	if nil != err {
+		log.Error("SegmentLog|Sync|FAIL|%s|%s", err, self.path)
+	}
+	return err
+}
+
+//remember the segment written since last fsync
+func (self *MessageStore) markDirty(s *Segment) {
+	if self.fsync == FSYNC_NONE {
+		return
+	}
+	self.dirtyLock.Lock()
+	self.dirty[s] = true
+	self.dirtyLock.Unlock()
+}
+
+//fsync all dirty segments
+func (self *MessageStore) fsyncDirty() error {
+	self.dirtyLock.Lock()
+	dirty := self.dirty
+	self.dirty = make(map[*Segment]bool, len(dirty))
+	self.dirtyLock.Unlock()
+
+	var err error
+	for s, _ := range dirty {
+		s.Lock()
+		if e := s.Sync(); nil != e {
+			err = e
+		}
+		s.Unlock()
+	}
+	return err
+}
+
+//periodic fsync
+func (self *MessageStore) fsyncPeriodically() {
+	ticker := time.NewTicker(self.fsyncPeriod)
+	defer ticker.Stop()
+	for self.running {
+		<-ticker.C
+		self.fsyncDirty()
+	}
+}
+
+//wait for the command to be durable
+func (self *MessageStore) wait(cmd *command) bool {
+	if nil == cmd.done {
+		return true
+	}
+	return <-cmd.done
+}
+
+//notify commands waiting for fsync
+func notify(cmds []*command, succ bool) {
+	for _, c := range cmds {
+		if nil != c.done {
+			c.done <- succ
+		}
+	}
+}
@@ -24,6 +24,7 @@ type command struct {
 	msg     []byte
 	opbody  []byte
 	seg     *Segment
+	done    chan bool //notified after fsync
 }
 
 func NewCommand(id int64, logicId string, msg []byte, opbody []byte) *command {
@@ -48,6 +49,12 @@ type MessageStore struct {
 	segmentCache *list.List         //segment cached
 	replay       func(oplog *oplog) //oplog replay
 	checkPeriod  time.Duration
+	compactor    *compactor //merge mostly deleted segments
+	fsync        FsyncPolicy
+	fsyncPeriod  time.Duration
+	dirty        map[*Segment]bool //segments written since last fsync
+	dirtyLock    sync.Mutex
+	replayFrom   map[int64]segmentPosition //sid -> log position recovered from checkpoint
 	sync.RWMutex
 }
 
@@ -64,8 +71,11 @@ func NewMessageStore(filePath string, batchSize int, segcacheSize int,
 		segmentCache: list.New(),
 		waitSync:     &sync.WaitGroup{},
 		replay:       replay,
-		checkPeriod:  checkPeriod}
-
+		checkPeriod:  checkPeriod,
+		fsync:        FSYNC_NONE,
+		fsyncPeriod:  1 * time.Second,
+		dirty:        make(map[*Segment]bool, 10)}
+	ms.compactor = newCompactor(ms, COMPACT_RATIO, COMPACT_PERIOD)
 	return ms
 }
 
@@ -74,9 +84,20 @@ func (self *MessageStore) Start() {
 	self.load()
 	go self.sync()
 	go self.evict()
+	if self.fsync == FSYNC_PERIOD {
+		go self.fsyncPeriodically()
+	}
 	self.waitSync.Add(1)
 }
 
+//set durability policy before start
+func (self *MessageStore) SetFsync(policy FsyncPolicy, period time.Duration) {
+	self.fsync = policy
+	if period > 0 {
+		self.fsyncPeriod = period
+	}
+}
+
 //
 func (self *MessageStore) evict() {
 	//delete segment  if all chunks are deleted
@@ -88,7 +109,8 @@ func (self *MessageStore) evict() {
 		for e := self.segmentCache.Back(); nil != e; e = e.Prev() {
 			if nil != e {
 				s := e.Value.(*Segment)
-				if nil != s {
+				//skip the active segment
+				if nil != s && s != self.activeSegment() {
 					//try open
 					s.RLock()
 					s.Open()
@@ -107,11 +129,57 @@ func (self *MessageStore) evict() {
 		if len(stat) > 0 {
 			log.Info("---------------MessageStore-Stat--------------\n|segment\t\t|total\t|normal\t|delete\t|expired\t|\n%s", stat)
 		}
+
+		//compact mostly deleted segments
+		if self.running {
+			self.compactor.tryCompact()
+		}
+	}
+}
+
+//remove segment from cache
+func (self *MessageStore) uncache(s *Segment) {
+	self.Lock()
+	defer self.Unlock()
+	for e := self.segmentCache.Front(); nil != e; e = e.Next() {
+		if e.Value.(*Segment) == s {
+			self.segmentCache.Remove(e)
+			break
+		}
+	}
+}
+
+//replace the old segment with the compacted one
+func (self *MessageStore) swap(old, news *Segment) {
+	self.Lock()
+	defer self.Unlock()
+	for i, seg := range self.segments {
+		if seg == old {
+			self.segments[i] = news
+			break
+		}
+	}
+	sort.Sort(self.segments)
+	for e := self.segmentCache.Front(); nil != e; e = e.Next() {
+		if e.Value.(*Segment) == old {
+			self.segmentCache.Remove(e)
+			break
+		}
 	}
 }
 
 //remove segment
 func (self *MessageStore) remove(s *Segment) {
+	//remove from segments
+	self.Lock()
+	for i, seg := range self.segments {
+		if seg.sid == s.sid {
+			self.segments = append(self.segments[0:i], self.segments[i+1:]...)
+			break
+		}
+	}
+	self.Unlock()
+
 	s.Lock()
 	defer s.Unlock()
 	s.Close()
@@ -120,17 +188,19 @@ func (self *MessageStore) remove(s *Segment) {
 	//backlog
 	// os.Rename(s.slog.path, s.slog.path+"."+fmt.Sprintf("%d", time.Now().Unix()))
 
-	//remove from segments
-	for i, s := range self.segments {
-		if s.sid == s.sid {
-			self.segments = append(self.segments[0:i], self.segments[i+1:]...)
-			break
-		}
-	}
-
 	log.Info("MessageStore|Remove|Segment|%s", s.path)
 }
 
+//the segment currently appended
+func (self *MessageStore) activeSegment() *Segment {
+	self.RLock()
+	defer self.RUnlock()
+	if len(self.segments) <= 0 {
+		return nil
+	}
+	return self.segments[len(self.segments)-1]
+}
+
 func (self *MessageStore) load() {
 	log.Info("MessageStore|Load Segments ...")
 
@@ -150,6 +220,9 @@ func (self *MessageStore) load() {
 
 	self.baseDir = bashDir
 
+	//finish or rollback the compaction interrupted by crash
+	self.compactor.recover()
+
 	//segment builder
 	segmentBuilder := func(path string, f os.FileInfo) *Segment {
 
@@ -178,6 +251,9 @@ func (self *MessageStore) load() {
 		// log.Info("MessageStore|Walk|%s", path)
 		if nil != f && !f.IsDir() {
 			split := strings.SplitN(f.Name(), ".", 2)
+			if len(split) < 2 {
+				return nil
+			}
 			suffix := split[1]
 			//is data file or logfile
 
@@ -201,7 +277,9 @@ func (self *MessageStore) load() {
 	self.recoverSnapshot()
 
 	//check roll
-	self.checkRoll()
+	self.Lock()
+	self.checkRoll(self.chunkId + 1)
+	self.Unlock()
 
 	//load fixed num  segments into memory
 
@@ -226,13 +304,28 @@ func (self *MessageStore) recoverSnapshot() {
 					panic("MessageStore|Load Last Segment|FAIL|" + err.Error())
 				}
 
-				//set snapshost status
-				if len(s.chunks) > 0 {
+				//set snapshost status ,compacted segments use negative ids
+				if len(s.chunks) > 0 && s.sid >= 0 {
 					self.chunkId = s.chunks[len(s.chunks)-1].id
 				}
 			}
 			//replay segment log
-			s.slog.Replay(self.replay)
+			seg := s
+			//chunk flags are restored from the index of checkpoint ,
+			//deleted and expired ones are not distinguished
+			p, ok := self.replayFrom[seg.sid]
+			for _, c := range seg.chunks {
+				if ok && c.id <= p.ChunkId && !p.live[c.id] {
+					c.flag = DELETE
+				}
+			}
+			seg.slog.ReplayFrom(p.Position, p.Oplogs, func(ol *oplog) {
+				//chunk flags are not persisted, restore them from oplog
+				if ol.Op == OP_D || ol.Op == OP_E {
+					seg.mark(ol.ChunkId, ChunkFlag(ol.Op))
+				}
+				self.replay(ol)
+			})
 
 		}
 
@@ -242,12 +335,10 @@ func (self *MessageStore) recoverSnapshot() {
 //query one chunk by  chunkid
 func (self *MessageStore) Query(cid int64, ins interface{}) error {
 
-	curr := self.indexSegment(cid)
+	curr, cid := self.rlockSegment(cid)
 	if nil == curr {
 		return errors.New(fmt.Sprintf("No Segement For %d", cid))
 	}
-
-	curr.RLock()
 	defer curr.RUnlock()
 	//find chunk
 	c := curr.Get(cid)
@@ -288,6 +379,10 @@ func (self *MessageStore) indexSegment(cid int64) *Segment {
 		if idx >= len(self.segments) || self.segments[idx].sid != cid {
 			idx = idx - 1
 		}
+		if idx < 0 {
+			self.Unlock()
+			return nil
+		}
 
 		//load segment
 		self.loadSegment(idx)
@@ -299,6 +394,45 @@ func (self *MessageStore) indexSegment(cid int64) *Segment {
 	return curr
 }
 
+//index and lock the segment of command,
+//retry if the segment has been replaced by compaction.
+//return nil if the chunk does not exist ,so no oplog of unknown chunk is appended
+func (self *MessageStore) lockSegment(c *command) *Segment {
+	for {
+		c.id = self.compactor.translate(c.id)
+		s := self.indexSegment(c.id)
+		if nil == s {
+			return nil
+		}
+		s.Lock()
+		if s.compacted {
+			s.Unlock()
+			continue
+		}
+		if !s.exists(c.id) {
+			s.Unlock()
+			log.Warn("MessageStore|lockSegment|NO CHUNK|%s|%d|%s", s.name, c.id, c.logicId)
+			return nil
+		}
+		return s
+	}
+}
+
+func (self *MessageStore) rlockSegment(cid int64) (*Segment, int64) {
+	for {
+		cid = self.compactor.translate(cid)
+		s := self.indexSegment(cid)
+		if nil == s {
+			return nil, cid
+		}
+		s.RLock()
+		if !s.compacted {
+			return s, cid
+		}
+		s.RUnlock()
+	}
+}
+
 //return the front chunk
 func (self *MessageStore) loadSegment(idx int) {
 
@@ -332,25 +466,25 @@ func (self *MessageStore) loadSegment(idx int) {
 
 //append log
 func (self *MessageStore) Update(c *command) {
-	s := self.indexSegment(c.id)
+	s := self.lockSegment(c)
 	if nil != s {
-		s.Lock()
 		defer s.Unlock()
 		//append oplog
 		ol := newOplog(OP_U, c.logicId, c.id, c.opbody)
 		s.slog.Append(ol)
+		self.syncLog(s)
 	}
 }
 
 //mark delete
 func (self *MessageStore) Delete(c *command) {
-	s := self.indexSegment(c.id)
+	s := self.lockSegment(c)
 	if nil != s {
-		s.Lock()
 		defer s.Unlock()
 		//append oplog
 		ol := newOplog(OP_D, c.logicId, c.id, c.opbody)
 		s.slog.Append(ol)
+		self.syncLog(s)
 		//mark data delete
 		s.Delete(c.id)
 
@@ -361,13 +495,13 @@ func (self *MessageStore) Delete(c *command) {
 
 //mark data expired
 func (self *MessageStore) Expired(c *command) {
-	s := self.indexSegment(c.id)
+	s := self.lockSegment(c)
 	if nil != s {
-		s.Lock()
 		defer s.Unlock()
 		//append oplog logic delete
 		ol := newOplog(OP_E, c.logicId, c.id, c.opbody)
 		s.slog.Append(ol)
+		self.syncLog(s)
 		//mark data expired
 		s.Expired(c.id)
 
@@ -376,6 +510,15 @@ func (self *MessageStore) Expired(c *command) {
 	}
 }
 
+//fsync oplog of segment ,caller must hold the segment lock
+func (self *MessageStore) syncLog(s *Segment) {
+	if self.fsync == FSYNC_ALWAYS {
+		s.slog.Sync()
+	} else {
+		self.markDirty(s)
+	}
+}
+
 //write
 func (self *MessageStore) Append(cmd *command) int64 {
 
@@ -383,17 +526,24 @@ func (self *MessageStore) Append(cmd *command) int64 {
 		self.Lock()
 		defer self.Unlock()
 		cmd.id = self.cid()
-		seg := self.checkRoll()
+		seg := self.checkRoll(cmd.id)
 		cmd.seg = seg
 		//append log
 		ol := newOplog(OP_C, cmd.logicId, cmd.id, cmd.opbody)
 		seg.Lock()
 		err := seg.slog.Append(ol)
+		if nil == err {
+			seg.allocated = cmd.id
+		}
 		seg.Unlock()
 		if nil != err {
 			log.Error("MessageStore|Append-LOG|FAIL|%s", cmd)
 			return -1
 		}
+		self.markDirty(seg)
+		if self.fsync == FSYNC_ALWAYS || self.fsync == FSYNC_BATCH {
+			cmd.done = make(chan bool, 1)
+		}
 
 		//write to channel for async flush
 		self.writeChannel <- cmd
@@ -404,7 +554,7 @@ func (self *MessageStore) Append(cmd *command) int64 {
 
 }
 
-func flush(s *Segment, b []*Chunk) {
+func flush(s *Segment, b []*Chunk) error {
 	if len(b) > 0 {
 		s.Lock()
 		//complete
@@ -414,12 +564,32 @@ func flush(s *Segment, b []*Chunk) {
 		}
 
 		s.Unlock()
+		return err
 	}
+	return nil
+}
+
+//flush batch ,fsync if required and then notify waiting commands
+func (self *MessageStore) commit(s *Segment, b []*Chunk, cmds []*command) {
+	if nil == s {
+		return
+	}
+	err := flush(s, b)
+	if len(b) > 0 {
+		self.markDirty(s)
+	}
+	if self.fsync == FSYNC_ALWAYS || self.fsync == FSYNC_BATCH {
+		if e := self.fsyncDirty(); nil != e {
+			err = e
+		}
+	}
+	notify(cmds, nil == err)
 }
 
 func (self *MessageStore) sync() {
 
 	batch := make([]*Chunk, 0, self.batchSize)
+	cmds := make([]*command, 0, self.batchSize)
 
 	var cmd *command
 	ticker := time.NewTicker(500 * time.Millisecond)
@@ -431,6 +601,10 @@ func (self *MessageStore) sync() {
 		case cmd = <-self.writeChannel:
 		case <-ticker.C:
 			//no write data flush
+			if len(batch) <= 0 && self.fsync == FSYNC_BATCH {
+				//oplogs of update
+				self.fsyncDirty()
+			}
 		}
 
 		if nil != cmd {
@@ -444,8 +618,9 @@ func (self *MessageStore) sync() {
 			//else flush old data
 			if curr.sid != c.seg.sid {
 				//force flush
-				flush(curr, batch)
+				self.commit(curr, batch, cmds)
 				batch = batch[:0]
+				cmds = cmds[:0]
 				//change curr to  newsegment
 				curr = c.seg
 			}
@@ -458,12 +633,17 @@ func (self *MessageStore) sync() {
 				data:     c.msg,
 				flag:     NORMAL}
 			batch = append(batch, chunk)
+			cmds = append(cmds, c)
 		}
 
-		//force flush
-		if nil == cmd && len(batch) > 0 || len(batch) >= cap(batch) {
-			flush(curr, batch)
+		//force flush ,fsync every write flush one by one,
+		//group commit as soon as no more write is queued
+		if nil == cmd && len(batch) > 0 || len(batch) >= cap(batch) ||
+			self.fsync == FSYNC_ALWAYS && len(batch) > 0 ||
+			self.fsync == FSYNC_BATCH && len(batch) > 0 && len(self.writeChannel) <= 0 {
+			self.commit(curr, batch, cmds)
 			batch = batch[:0]
+			cmds = cmds[:0]
 		}
 		cmd = nil
 	}
@@ -474,9 +654,14 @@ outter:
 		select {
 		case c := <-self.writeChannel:
 			if nil != c {
+				if nil == curr {
+					curr = c.seg
+				}
 				if c.seg.sid != curr.sid {
-					flush(curr, batch)
+					self.commit(curr, batch, cmds)
 					batch = batch[:0]
+					cmds = cmds[:0]
+					curr = c.seg
 				}
 
 				//create chunk
@@ -487,6 +672,7 @@ outter:
 					data:     c.msg,
 					flag:     NORMAL}
 				batch = append(batch, chunk)
+				cmds = append(cmds, c)
 			} else {
 				//channel close
 				break outter
@@ -498,27 +684,26 @@ outter:
 	}
 
 	//last flush
-	flush(curr, batch)
+	self.commit(curr, batch, cmds)
 
 	ticker.Stop()
 	self.waitSync.Done()
 	log.Info("MessageStore|SYNC|CLOSE...")
 }
 
-//check if
-func (self *MessageStore) checkRoll() *Segment {
+//check if ,caller must hold the lock
+//nextId is the first chunk id of the new segment
+func (self *MessageStore) checkRoll(nextId int64) *Segment {
 	//if current segment bytesize is larger than max segment size
 	//create a new segment for storage
 
 	var s *Segment
-	if len(self.segments) <= 0 {
-		news, err := self.createSegment(0)
+	//no segment or only compacted segments left
+	if len(self.segments) <= 0 || self.segments[len(self.segments)-1].sid < 0 {
+		news, err := self.createSegment(nextId)
 		if nil == err {
-			self.Lock()
 			//append new
 			self.segments = append(self.segments, news)
-
-			self.Unlock()
 			s = news
 
 		} else {
@@ -526,12 +711,10 @@ func (self *MessageStore) checkRoll() *Segment {
 			panic(err)
 		}
 	} else {
-		self.Lock()
 		s = self.segments[len(self.segments)-1]
 		if s.byteSize > MAX_SEGMENT_SIZE {
-			nid := s.chunks[len(s.chunks)-1].id + 1
-
-			news, err := self.createSegment(nid)
+			//chunks before nextId may be still in write channel
+			news, err := self.createSegment(nextId)
 			if nil == err {
 				//left segments are larger than cached ,close current
 				if len(self.segments) >= self.segcacheSize {
@@ -543,7 +726,6 @@ func (self *MessageStore) checkRoll() *Segment {
 			}
 
 		}
-		self.Unlock()
 	}
 	return s
 }
@@ -597,6 +779,8 @@ func (self *MessageStore) Remove(sid int64) {
 
 func (self *MessageStore) Destory() {
 	self.running = false
+	//wait for running compaction
+	self.compactor.stop()
 	close(self.writeChannel)
 	self.waitSync.Wait()
 	//close all segment
@@ -1,6 +1,9 @@
 package file
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -117,6 +120,37 @@ func TestDelete(t *testing.T) {
 	cleanSnapshot("./snapshot/")
 }
 
+//oplogs of unknown chunks should not be appended
+func TestUpdateUnknownChunk(t *testing.T) {
+	cleanSnapshot("./snapshot/")
+	snapshot := NewMessageStore("./snapshot/", 1, 10, 1*time.Second, traverse)
+	snapshot.Start()
+	for j := 0; j < 10; j++ {
+		snapshot.Append(NewCommand(-1, fmt.Sprint(j), []byte(fmt.Sprint(j)), nil))
+	}
+	var data int32
+	for i := 0; nil != snapshot.Query(9, &data) && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	snapshot.Delete(NewCommand(3, "3", nil, nil))
+	snapshot.Delete(NewCommand(3, "3", nil, nil))
+	snapshot.Expired(NewCommand(3, "3", nil, nil))
+	snapshot.Update(NewCommand(100, "100", nil, nil))
+	snapshot.Update(NewCommand(-5, "-5", nil, nil))
+	slog := snapshot.segments[0].slog
+	snapshot.Destory()
+
+	ops := make(map[byte]int, 2)
+	err := slog.Scan(func(ol *oplog) {
+		ops[ol.Op]++
+	})
+	if nil != err || ops[OP_C] != 10 || ops[OP_D] != 1 || len(ops) != 2 {
+		t.Fatalf("TestUpdateUnknownChunk|%s|%v", err, ops)
+	}
+	cleanSnapshot("./snapshot/")
+}
+
 func TestQuery(t *testing.T) {
 
 	cleanSnapshot("./snapshot/")
@@ -256,6 +290,104 @@ func BenchmarkQuery(t *testing.B) {
 
 }
 
+//oplog encoded by old versions
+func gobOplog(ol *oplog) []byte {
+	buff := new(bytes.Buffer)
+	binary.Write(buff, binary.BigEndian, int32(0))
+	gob.NewEncoder(buff).Encode(ol)
+	b := buff.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(buff.Len()))
+	return b
+}
+
+func TestOplogCompatible(t *testing.T) {
+	cleanSnapshot("./snapshot/")
+	defer cleanSnapshot("./snapshot/")
+	os.MkdirAll("./snapshot/", os.ModePerm)
+	path := "./snapshot/segment-0.log"
+
+	//gob oplogs followed by binary oplogs after upgrade
+	f, _ := os.Create(path)
+	for i := 0; i < 10; i++ {
+		f.Write(gobOplog(newOplog(OP_C, fmt.Sprint(i), int64(i), []byte(fmt.Sprintf("{\"id\":%d}", i)))))
+	}
+	f.Close()
+	slog := newSegmentLog(path)
+	slog.Open()
+	for i := 10; i < 20; i++ {
+		slog.Append(newOplog(OP_U, fmt.Sprint(i), int64(-i), []byte(fmt.Sprintf("{\"id\":%d}", i))))
+	}
+	slog.Append(newOplog(OP_D, "", 20, nil))
+
+	i := 0
+	slog.Replay(func(ol *oplog) {
+		if i < 20 && (ol.LogicId != fmt.Sprint(i) || string(ol.Body) != fmt.Sprintf("{\"id\":%d}", i)) {
+			t.Errorf("replay %d|%+v", i, ol)
+		}
+		if i >= 10 && i < 20 && (ol.Op != OP_U || ol.ChunkId != int64(-i)) {
+			t.Errorf("replay binary %d|%+v", i, ol)
+		}
+		i++
+	})
+	slog.Close()
+	if i != 21 {
+		t.Fatalf("replay %d oplogs", i)
+	}
+
+	//truncated binary oplog
+	b := newOplog(OP_C, "1", 1, []byte("hello")).marshal()
+	var ol oplog
+	if nil == ol.unmarshal(b[4:len(b)-1]) {
+		t.Fatal("unmarshal truncated oplog")
+	}
+}
+
+func BenchmarkOplogMarshal(t *testing.B) {
+	ol := newOplog(OP_U, "26c03f00665862591f696a980b5ac", 100, []byte(`{"mid":"26c03f00665862591f696a980b5ac","topic":"trade","commit":true}`))
+	for i := 0; i < t.N; i++ {
+		ol.marshal()
+	}
+}
+
+func BenchmarkOplogMarshalGob(t *testing.B) {
+	ol := newOplog(OP_U, "26c03f00665862591f696a980b5ac", 100, []byte(`{"mid":"26c03f00665862591f696a980b5ac","topic":"trade","commit":true}`))
+	for i := 0; i < t.N; i++ {
+		gobOplog(ol)
+	}
+}
+
+func BenchmarkOplogUnmarshal(t *testing.B) {
+	b := newOplog(OP_U, "26c03f00665862591f696a980b5ac", 100, []byte(`{"mid":"26c03f00665862591f696a980b5ac","topic":"trade","commit":true}`)).marshal()
+	for i := 0; i < t.N; i++ {
+		var ol oplog
+		ol.unmarshal(b[4:])
+	}
+}
+
+func BenchmarkOplogUnmarshalGob(t *testing.B) {
+	b := gobOplog(newOplog(OP_U, "26c03f00665862591f696a980b5ac", 100, []byte(`{"mid":"26c03f00665862591f696a980b5ac","topic":"trade","commit":true}`)))
+	for i := 0; i < t.N; i++ {
+		var ol oplog
+		ol.unmarshal(b[4:])
+	}
+}
+
+//encoding of oplog appended with every message ,compared with BenchmarkAppend
+func BenchmarkAppendOplog(t *testing.B) {
+	ob := &opBody{MessageId: "26c03f00665862591f696a980b5ac", Commit: true, SuccGroups: []string{"s-mts-test"}}
+	for i := 0; i < t.N; i++ {
+		newOplog(OP_C, ob.MessageId, int64(i), ob.marshal()).marshal()
+	}
+}
+
+func BenchmarkAppendOplogGob(t *testing.B) {
+	ob := &opBody{MessageId: "26c03f00665862591f696a980b5ac", Commit: true, SuccGroups: []string{"s-mts-test"}}
+	for i := 0; i < t.N; i++ {
+		obd, _ := json.Marshal(ob)
+		gobOplog(newOplog(OP_C, ob.MessageId, int64(i), obd))
+	}
+}
+
 func BenchmarkAppend(t *testing.B) {
 	t.StopTimer()
 	cleanSnapshot("./snapshot/")
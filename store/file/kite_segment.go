@@ -3,6 +3,7 @@ package file
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	log "github.com/blackbeans/log4go"
 	"hash/crc32"
@@ -30,6 +31,13 @@ func (self ChunkFlag) String() string {
 
 var SEGMENT_LOG_SPLIT = []byte{'\r', '\n'}
 
+var (
+	ERROR_TORN_WRITE = errors.New("torn write")
+	ERROR_CHECKSUM   = errors.New("checksum mismatch")
+	ERROR_CORRUPT    = errors.New("corrupt record")
+	ERROR_BAD_LENGTH = errors.New("invalid record length")
+)
+
 const (
 	MAX_SEGMENT_SIZE = 64 * 1024 * 1024 //最大的分段大仙
 	// MAX_CHUNK_SIZE      = 64 * 1024        //最大的chunk
@@ -45,19 +53,21 @@ const (
 
 //消息文件
 type Segment struct {
-	path     string
-	name     string //basename_0000000000
-	rf       *os.File
-	wf       *os.File
-	bw       *bufio.Writer //
-	br       *bufio.Reader // data buffer
-	sid      int64         //segment id
-	offset   int64         //segment current offset
-	byteSize int32         //segment size
-	chunks   []*Chunk
-	isOpen   int32
-	slog     *SegmentLog //segment op log
-	latch    chan bool
+	path      string
+	name      string //basename_0000000000
+	rf        *os.File
+	wf        *os.File
+	bw        *bufio.Writer //
+	br        *bufio.Reader // data buffer
+	sid       int64         //segment id
+	offset    int64         //segment current offset
+	byteSize  int32         //segment size
+	chunks    []*Chunk
+	isOpen    int32
+	slog      *SegmentLog //segment op log
+	latch     chan bool
+	compacted bool  //replaced by a compacted segment
+	allocated int64 //last chunk id appended ,may be still in write channel
 	sync.RWMutex
 }
 
@@ -153,85 +163,77 @@ func (self *Segment) stat() (total, normal, del, expired int32) {
 //load check
 func (self *Segment) loadCheck() {
 
-	header := make([]byte, CHUNK_HEADER)
-	chunkId := int64(0)
 	fi, _ := self.rf.Stat()
 	offset := int64(0)
 	byteSize := int32(0)
 	for {
 
-		hl, err := io.ReadFull(self.br, header)
+		chunk, err := readChunk(self.br, fi.Size()-offset)
 		if nil != err {
 			if io.EOF != err {
-				log.Error("Segment|Load Segment|Read Header|FAIL|%s|%s", err, self.name)
-				continue
+				log.Error("Segment|Load Segment|FAIL|%s|%s|offset:%d", err, self.name, offset)
 			}
 			break
 		}
 
-		if hl <= 0 || hl < CHUNK_HEADER {
-			log.Error("Segment|Load Segment|Read Header|FAIL|%s|%d", self.name, hl)
-			break
-		}
-
-		//length
-		length := binary.BigEndian.Uint32(header[0:4])
-
-		al := offset + int64(length)
-		//checklength
-		if al > fi.Size() {
-			log.Error("Segment|Load Segment|FILE SIZE|%s|%d/%d|offset:%d|length:%d", self.name, al, fi.Size(), self.offset, length)
-			break
-		}
+		offset += int64(chunk.length)
 
-		//checksum
-		checksum := binary.BigEndian.Uint32(header[4:8])
+		//add byteSize
+		byteSize += chunk.length
 
-		//read data
-		l := length - CHUNK_HEADER
-		data := make([]byte, l)
-		dl, err := io.ReadFull(self.br, data)
-		if nil != err || dl < int(l) {
-			log.Error("Segment|Load Segment|Read Data|FAIL|%s|%s|%d/%d", err, self.name, l, dl)
-			break
-		}
+		chunk.offset = offset
+		chunk.sid = self.sid
+		self.chunks = append(self.chunks, chunk)
+		log.Error("Segment|Load Chunk|%s|%d", self.name, chunk.id)
 
-		csum := crc32.ChecksumIEEE(data)
-		//checkdata
-		if csum != checksum {
-			log.Error("Segment|Load Segment|Data Checksum|FAIL|%s|%d/%d", self.name, csum, checksum)
-			break
-		}
+	}
 
-		offset += int64(length)
+	self.offset = offset
+	self.byteSize = byteSize
 
-		//read chunkid
-		chunkId = int64(binary.BigEndian.Uint64(header[8:16]))
+}
 
-		//flag
-		flag := header[16]
+//read one chunk ,remain is the bytes left in file.
+//returns io.EOF at the end ,ERROR_TORN_WRITE if the chunk is incomplete
+func readChunk(br io.Reader, remain int64) (*Chunk, error) {
+	header := make([]byte, CHUNK_HEADER)
+	_, err := io.ReadFull(br, header)
+	if io.EOF == err {
+		return nil, io.EOF
+	} else if nil != err {
+		return nil, ERROR_TORN_WRITE
+	}
 
-		//add byteSize
-		byteSize += int32(length)
-
-		//create chunk
-		chunk := &Chunk{
-			offset:   offset,
-			length:   int32(length),
-			checksum: checksum,
-			id:       chunkId,
-			sid:      self.sid,
-			flag:     ChunkFlag(flag),
-			data:     data}
+	//length
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length < CHUNK_HEADER {
+		return nil, ERROR_BAD_LENGTH
+	}
 
-		self.chunks = append(self.chunks, chunk)
-		log.Error("Segment|Load Chunk|%s|%d", self.name, chunkId)
+	//checklength
+	if int64(length) > remain {
+		return nil, ERROR_TORN_WRITE
+	}
 
+	//read data
+	data := make([]byte, length-CHUNK_HEADER)
+	_, err = io.ReadFull(br, data)
+	if nil != err {
+		return nil, ERROR_TORN_WRITE
 	}
 
-	self.offset = offset
-	self.byteSize = byteSize
+	//checksum
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	if crc32.ChecksumIEEE(data) != checksum {
+		return nil, ERROR_CHECKSUM
+	}
 
+	return &Chunk{
+		length:   int32(length),
+		checksum: checksum,
+		id:       int64(binary.BigEndian.Uint64(header[8:16])),
+		flag:     ChunkFlag(header[16]),
+		data:     data}, nil
 }
 
 func (self *Segment) Delete(cid int64) {
@@ -249,6 +251,14 @@ func (self *Segment) Delete(cid int64) {
 	}
 }
 
+//mark chunk flag in memory only
+func (self *Segment) mark(cid int64, flag ChunkFlag) {
+	idx := int(cid - self.sid)
+	if idx >= 0 && idx < len(self.chunks) {
+		self.chunks[idx].flag = flag
+	}
+}
+
 //expired data
 func (self *Segment) Expired(cid int64) bool {
 	idx := int(cid - self.sid)
@@ -266,6 +276,15 @@ func (self *Segment) Expired(cid int64) bool {
 	return true
 }
 
+//whether the chunk is alive in the segment or still in write channel.
+//caller must hold the segment lock
+func (self *Segment) exists(cid int64) bool {
+	if cid >= self.sid+int64(len(self.chunks)) {
+		return cid <= self.allocated
+	}
+	return cid >= self.sid && nil != self.Get(cid)
+}
+
 //get chunk by chunkid
 func (self *Segment) Get(cid int64) *Chunk {
 	// log.Debug("Segment|Get|%d\n", len(self.chunks))
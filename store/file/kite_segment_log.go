@@ -80,39 +80,90 @@ func (self *SegmentLog) Open() error {
 
 //traverse oplog
 func (self *SegmentLog) Replay(do func(l *oplog)) {
+	self.ReplayFrom(0, 0, do)
+}
+
+//traverse oplog after the byte position ,count is the oplogs before it
+func (self *SegmentLog) ReplayFrom(pos int64, count int64, do func(l *oplog)) {
 
 	self.Open()
-	offset := 0
+	offset := count
+	if pos > 0 {
+		_, err := self.rf.Seek(pos, 0)
+		if nil != err {
+			log.Error("SegmentLog|Replay|Seek|FAIL|%s|%s|%d", err, self.path, pos)
+			return
+		}
+		self.br.Reset(self.rf)
+	}
 
 	for {
-		var length int32
-		err := binary.Read(self.br, binary.BigEndian, &length)
-		if nil != err {
-			log.Error("SegmentLog|Replay|LEN|%s", err)
+		ol, _, err := readOplog(self.br)
+		if ERROR_CORRUPT == err {
+			log.Error("SegmentLog|Replay|unmarshal|oplog|FAIL|%s", err)
+			continue
+		} else if nil != err {
+			if io.EOF != err {
+				log.Error("SegmentLog|Replay|FAIL|%s|%s", err, self.path)
+			}
 			break
 		}
+		do(ol)
+		offset++
 
-		tmp := make([]byte, length-4)
+	}
+	self.offset = offset
+}
 
-		err = binary.Read(self.br, binary.BigEndian, tmp)
-		if nil != err {
-			log.Error("SegmentLog|Replay|Data|%s", err)
-			break
+//traverse oplogs from the beginning with a new reader,
+//returns error if the tail record is torn
+func (self *SegmentLog) Scan(do func(l *oplog)) error {
+	f, err := os.Open(self.path)
+	if nil != err {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	for {
+		ol, _, err := readOplog(br)
+		if io.EOF == err {
+			return nil
+		} else if nil != err {
+			return err
 		}
+		do(ol)
+	}
+}
 
-		var ol oplog
-		r := bytes.NewReader(tmp)
-		deco := gob.NewDecoder(r)
-		err = deco.Decode(&ol)
-		if nil != err {
-			log.Error("SegmentLog|Replay|unmarshal|oplog|FAIL|%s", err)
-			continue
-		}
-		do(&ol)
-		offset++
+//read one length prefixed oplog and the bytes consumed.
+//returns io.EOF at the end ,ERROR_TORN_WRITE if the record is incomplete
+//and ERROR_CORRUPT if the record can't be decoded
+func readOplog(br io.Reader) (*oplog, int, error) {
+	head := make([]byte, 4)
+	_, err := io.ReadFull(br, head)
+	if io.EOF == err {
+		return nil, 0, io.EOF
+	} else if nil != err {
+		return nil, 0, ERROR_TORN_WRITE
+	}
+
+	length := int(binary.BigEndian.Uint32(head))
+	if length <= 4 || length > MAX_SEGMENT_SIZE {
+		return nil, 0, ERROR_BAD_LENGTH
+	}
+
+	tmp := make([]byte, length-4)
+	_, err = io.ReadFull(br, tmp)
+	if nil != err {
+		return nil, 0, ERROR_TORN_WRITE
+	}
 
+	var ol oplog
+	err = ol.unmarshal(tmp)
+	if nil != err {
+		return nil, length, ERROR_CORRUPT
 	}
-	self.offset = int64(offset)
+	return &ol, length, nil
 }
 
 //apend data
@@ -183,27 +234,77 @@ func newOplog(op byte, logicId string, chunkid int64, body []byte) *oplog {
 		Body:    body}
 }
 
+//oplog encoding version ,the first byte after the length.
+//gob starts with a uvarint which is either < 0x80 or >= 0xf8,
+//so a byte in [0x80,0xf8) marks the binary encoding
+const (
+	OPLOG_VERSION_BINARY = 0x81
+)
+
 //marshal oplog
+//length(4)|version(1)|time(varint)|op(1)|chunkid(varint)|logicid(uvarint+n)|body(uvarint+n)
 func (self *oplog) marshal() []byte {
+	size := 4 + 1 + binary.MaxVarintLen64 + 1 + binary.MaxVarintLen64 +
+		binary.MaxVarintLen64 + len(self.LogicId) + binary.MaxVarintLen64 + len(self.Body)
+	b := make([]byte, size)
+	n := 4
+	b[n] = OPLOG_VERSION_BINARY
+	n++
+	n += binary.PutVarint(b[n:], self.Time)
+	b[n] = self.Op
+	n++
+	n += binary.PutVarint(b[n:], self.ChunkId)
+	n += binary.PutUvarint(b[n:], uint64(len(self.LogicId)))
+	n += copy(b[n:], self.LogicId)
+	n += binary.PutUvarint(b[n:], uint64(len(self.Body)))
+	n += copy(b[n:], self.Body)
+	binary.BigEndian.PutUint32(b, uint32(n))
+	return b[:n]
+}
+
+//unmarshal data ,gob encoded oplogs written by old versions are still readable
+func (self *oplog) unmarshal(data []byte) error {
+	if len(data) <= 0 {
+		return ERROR_CORRUPT
+	}
+	if data[0] < 0x80 || data[0] >= 0xf8 {
+		r := bytes.NewReader(data)
+		dec := gob.NewDecoder(r)
+		return dec.Decode(self)
+	}
+	if data[0] != OPLOG_VERSION_BINARY {
+		//written by a newer version
+		return ERROR_CORRUPT
+	}
 
-	buff := new(bytes.Buffer)
+	data = data[1:]
+	t, n := binary.Varint(data)
+	if n <= 0 || len(data) < n+1 {
+		return ERROR_CORRUPT
+	}
+	self.Time = t
+	self.Op = data[n]
+	data = data[n+1:]
 
-	binary.Write(buff, binary.BigEndian, int32(0))
-	encoder := gob.NewEncoder(buff)
-	err := encoder.Encode(self)
-	if nil != err {
-		log.Error("oplog|marshal|fail|%s|%s", err, self)
-		return nil
+	cid, n := binary.Varint(data)
+	if n <= 0 {
+		return ERROR_CORRUPT
 	}
-	b := buff.Bytes()
-	binary.BigEndian.PutUint32(b, uint32(buff.Len()))
-	return b
-}
+	self.ChunkId = cid
+	data = data[n:]
 
-//unmarshal data
-func (self *oplog) unmarshal(data []byte) error {
-	r := bytes.NewReader(data)
-	dec := gob.NewDecoder(r)
-	return dec.Decode(self)
+	l, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < l {
+		return ERROR_CORRUPT
+	}
+	self.LogicId = string(data[n : n+int(l)])
+	data = data[n+int(l):]
 
+	l, n = binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) != l {
+		return ERROR_CORRUPT
+	}
+	self.Body = make([]byte, l)
+	copy(self.Body, data[n:])
+	return nil
 }
@@ -0,0 +1,90 @@
+package store
+
+import (
+	"context"
+	"errors"
+)
+
+var ERROR_STORE_FAIL = errors.New("KITE STORE OPERATION FAIL !")
+
+//支持context的存储操作,ctx取消或者到期后放弃未完成的操作
+type IKiteStoreContext interface {
+	QueryContext(ctx context.Context, messageId string) (*MessageEntity, error)
+	SaveContext(ctx context.Context, entity *MessageEntity) error
+	CommitContext(ctx context.Context, messageId string) error
+	RollbackContext(ctx context.Context, messageId string) error
+	DeleteContext(ctx context.Context, messageId string) error
+	ExpiredContext(ctx context.Context, messageId string) error
+
+	//根据kiteServer名称查询需要重投的消息 返回值为 是否还有更多、和本次返回的数据结果
+	PageQueryEntityContext(ctx context.Context, hashKey string, kiteServer string, nextDeliveryTime int64, startIdx, limit int) (bool, []*MessageEntity, error)
+}
+
+//存储实现了IKiteStoreContext时直接使用,否则在调用前检查ctx
+func WithContext(kitestore IKiteStore) IKiteStoreContext {
+	if s, ok := kitestore.(IKiteStoreContext); ok {
+		return s
+	}
+	return &contextStore{kitestore: kitestore}
+}
+
+type contextStore struct {
+	kitestore IKiteStore
+}
+
+func result(succ bool) error {
+	if !succ {
+		return ERROR_STORE_FAIL
+	}
+	return nil
+}
+
+func (self *contextStore) QueryContext(ctx context.Context, messageId string) (*MessageEntity, error) {
+	if err := ctx.Err(); nil != err {
+		return nil, err
+	}
+	return self.kitestore.Query(messageId), nil
+}
+
+func (self *contextStore) SaveContext(ctx context.Context, entity *MessageEntity) error {
+	if err := ctx.Err(); nil != err {
+		return err
+	}
+	return result(self.kitestore.Save(entity))
+}
+
+func (self *contextStore) CommitContext(ctx context.Context, messageId string) error {
+	if err := ctx.Err(); nil != err {
+		return err
+	}
+	return result(self.kitestore.Commit(messageId))
+}
+
+func (self *contextStore) RollbackContext(ctx context.Context, messageId string) error {
+	if err := ctx.Err(); nil != err {
+		return err
+	}
+	return result(self.kitestore.Rollback(messageId))
+}
+
+func (self *contextStore) DeleteContext(ctx context.Context, messageId string) error {
+	if err := ctx.Err(); nil != err {
+		return err
+	}
+	return result(self.kitestore.Delete(messageId))
+}
+
+func (self *contextStore) ExpiredContext(ctx context.Context, messageId string) error {
+	if err := ctx.Err(); nil != err {
+		return err
+	}
+	return result(self.kitestore.Expired(messageId))
+}
+
+func (self *contextStore) PageQueryEntityContext(ctx context.Context, hashKey string, kiteServer string, nextDeliveryTime int64, startIdx, limit int) (bool, []*MessageEntity, error) {
+	if err := ctx.Err(); nil != err {
+		return false, nil, err
+	}
+	more, entities := self.kitestore.PageQueryEntity(hashKey, kiteServer, nextDeliveryTime, startIdx, limit)
+	return more, entities, nil
+}
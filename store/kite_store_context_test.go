@@ -0,0 +1,28 @@
+package store
+
+import (
+	"context"
+	"testing"
+)
+
+func TestWithContext(t *testing.T) {
+	kitestore := WithContext(NewMockKiteStore())
+	if nil != kitestore.CommitContext(context.Background(), "1") {
+		t.Fail()
+		t.Log("TestWithContext|CommitContext|FAIL")
+	}
+
+	//取消后不再执行存储操作
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	entity, err := kitestore.QueryContext(ctx, "1")
+	if err != context.Canceled || nil != entity {
+		t.Fail()
+		t.Logf("TestWithContext|QueryContext|%s\n", err)
+	}
+	_, _, err = kitestore.PageQueryEntityContext(ctx, "00", "localhost:13800", 0, 0, 10)
+	if err != context.Canceled {
+		t.Fail()
+		t.Logf("TestWithContext|PageQueryEntityContext|%s\n", err)
+	}
+}
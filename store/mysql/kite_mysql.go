@@ -1,10 +1,12 @@
 package mysql
 
 import (
+	"context"
 	"fmt"
 	log "github.com/blackbeans/log4go"
 	"kiteq/protocol"
 	. "kiteq/store"
+	"sync"
 	"time"
 )
 
@@ -32,27 +34,31 @@ type KiteMysqlStore struct {
 	batchDelSize int
 	flushPeriod  time.Duration
 	stmtPools    map[batchType][][]*StmtPool //第一层dblevel 第二维table level
-	stop         bool
+	closeChan    chan bool
+	wg           sync.WaitGroup
 }
 
 func NewKiteMysql(options MysqlOptions) *KiteMysqlStore {
 
 	shard := newDbShard(options)
+	ins := newKiteSqlStore(shard, options.BatchUpSize, options.BatchDelSize, options.FlushPeriod)
+	ins.Start()
 
-	sqlwrapper := newSqlwrapper("kite_msg", shard, MessageEntity{})
+	log.Info("NewKiteMysql|KiteMysqlStore|SUCC|%s|%s...\n", options.Addr, options.SlaveAddr)
+	return ins
+}
 
-	ins := &KiteMysqlStore{
+//mysql和sqlite共用的SQL生成、转换和批量提交
+func newKiteSqlStore(shard DbShard, batchUpSize, batchDelSize int, flushPeriod time.Duration) *KiteMysqlStore {
+	sqlwrapper := newSqlwrapper("kite_msg", shard, MessageEntity{})
+	return &KiteMysqlStore{
 		dbshard:      shard,
 		convertor:    convertor{columns: sqlwrapper.columns},
 		sqlwrapper:   sqlwrapper,
-		batchUpSize:  options.BatchUpSize,
-		batchDelSize: options.BatchDelSize,
-		flushPeriod:  options.FlushPeriod,
-		stop:         false}
-	ins.Start()
-
-	log.Info("NewKiteMysql|KiteMysqlStore|SUCC|%s|%s...\n", options.Addr, options.SlaveAddr)
-	return ins
+		batchUpSize:  batchUpSize,
+		batchDelSize: batchDelSize,
+		flushPeriod:  flushPeriod,
+		closeChan:    make(chan bool)}
 }
 
 func (self *KiteMysqlStore) RecoverNum() int {
@@ -86,13 +92,18 @@ func (self *KiteMysqlStore) Monitor() string {
 }
 
 func (self *KiteMysqlStore) Query(messageId string) *MessageEntity {
+	entity, _ := self.QueryContext(context.Background(), messageId)
+	return entity
+}
+
+func (self *KiteMysqlStore) QueryContext(ctx context.Context, messageId string) (*MessageEntity, error) {
 
 	var entity *MessageEntity
 	s := self.sqlwrapper.hashQuerySQL(messageId)
-	rows, err := self.dbshard.FindSlave(messageId).Query(s, messageId)
+	rows, err := self.dbshard.FindSlave(messageId).QueryContext(ctx, s, messageId)
 	if nil != err {
 		log.Error("KiteMysqlStore|Query|FAIL|%s|%s\n", err, messageId)
-		return nil
+		return nil, err
 	}
 	defer rows.Close()
 
@@ -103,7 +114,7 @@ func (self *KiteMysqlStore) Query(messageId string) *MessageEntity {
 		err := rows.Scan(fc...)
 		if nil != err {
 			log.Error("KiteMysqlStore|Query|SCAN|FAIL|%s|%s\n", err, messageId)
-			return nil
+			return nil, err
 		}
 		self.convertor.Convert2Entity(fc, entity, filternothing)
 		switch entity.MsgType {
@@ -114,20 +125,27 @@ func (self *KiteMysqlStore) Query(messageId string) *MessageEntity {
 		}
 	}
 
-	return entity
+	return entity, nil
 }
 
 func (self *KiteMysqlStore) Save(entity *MessageEntity) bool {
+	return nil == self.SaveContext(context.Background(), entity)
+}
+
+func (self *KiteMysqlStore) SaveContext(ctx context.Context, entity *MessageEntity) error {
 	fvs := self.convertor.Convert2Params(entity)
 	s := self.sqlwrapper.hashSaveSQL(entity.MessageId)
-	result, err := self.dbshard.FindMaster(entity.MessageId).Exec(s, fvs...)
+	result, err := self.dbshard.FindMaster(entity.MessageId).ExecContext(ctx, s, fvs...)
 	if err != nil {
 		log.Error("KiteMysqlStore|SAVE|FAIL|%s|%s\n", err, entity.MessageId)
-		return false
+		return err
 	}
 
 	num, _ := result.RowsAffected()
-	return num == 1
+	if num != 1 {
+		return ERROR_STORE_FAIL
+	}
+	return nil
 }
 
 func (self *KiteMysqlStore) Commit(messageId string) bool {
@@ -144,6 +162,35 @@ func (self *KiteMysqlStore) Delete(messageId string) bool {
 
 func (self *KiteMysqlStore) Expired(messageId string) bool { return true }
 
+//提交和删除为异步批量执行,只在入队前检查ctx
+func (self *KiteMysqlStore) CommitContext(ctx context.Context, messageId string) error {
+	if err := ctx.Err(); nil != err {
+		return err
+	}
+	if !self.Commit(messageId) {
+		return ERROR_STORE_FAIL
+	}
+	return nil
+}
+
+func (self *KiteMysqlStore) RollbackContext(ctx context.Context, messageId string) error {
+	return self.DeleteContext(ctx, messageId)
+}
+
+func (self *KiteMysqlStore) DeleteContext(ctx context.Context, messageId string) error {
+	if err := ctx.Err(); nil != err {
+		return err
+	}
+	if !self.Delete(messageId) {
+		return ERROR_STORE_FAIL
+	}
+	return nil
+}
+
+func (self *KiteMysqlStore) ExpiredContext(ctx context.Context, messageId string) error {
+	return ctx.Err()
+}
+
 var filterbody = func(colname string) bool {
 	//不需要查询body
 	return colname == "body"
@@ -151,14 +198,19 @@ var filterbody = func(colname string) bool {
 
 //没有body的entity
 func (self *KiteMysqlStore) PageQueryEntity(hashKey string, kiteServer string, nextDeliveryTime int64, startIdx, limit int) (bool, []*MessageEntity) {
+	more, entities, _ := self.PageQueryEntityContext(context.Background(), hashKey, kiteServer, nextDeliveryTime, startIdx, limit)
+	return more, entities
+}
+
+func (self *KiteMysqlStore) PageQueryEntityContext(ctx context.Context, hashKey string, kiteServer string, nextDeliveryTime int64, startIdx, limit int) (bool, []*MessageEntity, error) {
 
 	s := self.sqlwrapper.hashPQSQL(hashKey)
 	// log.Println(s)
 	rows, err := self.dbshard.FindSlave(hashKey).
-		Query(s, kiteServer, time.Now().Unix(), nextDeliveryTime, startIdx, limit+1)
+		QueryContext(ctx, s, kiteServer, time.Now().Unix(), nextDeliveryTime, startIdx, limit+1)
 	if err != nil {
 		log.Error("KiteMysqlStore|Query|FAIL|%s|%s\n", err, hashKey)
-		return false, nil
+		return false, nil, err
 	}
 	defer rows.Close()
 
@@ -178,8 +230,8 @@ func (self *KiteMysqlStore) PageQueryEntity(hashKey string, kiteServer string, n
 	}
 
 	if len(results) > limit {
-		return true, results[:limit]
+		return true, results[:limit], nil
 	} else {
-		return false, results
+		return false, results, rows.Err()
 	}
 }
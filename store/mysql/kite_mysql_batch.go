@@ -71,8 +71,10 @@ func (self *KiteMysqlStore) startBatch(hash int,
 	chu chan *MessageEntity, chd, chcommit chan string) {
 
 	//启动的entity更新的携程
+	self.wg.Add(3)
 	go func(hashId int, ch chan *MessageEntity, batchSize int,
 		do func(sql int, d []*MessageEntity) bool) {
+		defer self.wg.Done()
 
 		//批量提交的池子
 		batchPool := make(chan []*MessageEntity, 8)
@@ -82,20 +84,36 @@ func (self *KiteMysqlStore) startBatch(hash int,
 		data := <-batchPool
 
 		timer := time.NewTimer(self.flushPeriod)
+		defer timer.Stop()
 		flush := false
-		for !self.stop {
+		for {
 			select {
 			case mid := <-ch:
 				data = append(data, mid)
 			case <-timer.C:
 				flush = true
+			case <-self.closeChan:
+				//停止时提交剩余的操作
+			drain:
+				for {
+					select {
+					case mid := <-ch:
+						data = append(data, mid)
+					default:
+						break drain
+					}
+				}
+				do(hashId, data)
+				return
 			}
 			//强制提交: 达到批量提交的阀值或者超时没有数据则提交
 			if len(data) >= batchSize || flush {
 				tmp := data
+				self.wg.Add(1)
 				go func() {
 					defer func() {
 						batchPool <- tmp[:0]
+						self.wg.Done()
 					}()
 					do(hashId, tmp)
 				}()
@@ -106,11 +124,11 @@ func (self *KiteMysqlStore) startBatch(hash int,
 				timer.Reset(self.flushPeriod)
 			}
 		}
-		timer.Stop()
 	}(hash, chu, self.batchUpSize, self.batchUpdate)
 
 	batchFun := func(hashid int, ch chan string, batchSize int,
 		do func(hashid int, d []string) bool) {
+		defer self.wg.Done()
 
 		//批量提交池子
 		batchPool := make(chan []string, 8)
@@ -120,21 +138,37 @@ func (self *KiteMysqlStore) startBatch(hash int,
 		data := make([]string, 0, batchSize)
 
 		timer := time.NewTimer(self.flushPeriod)
+		defer timer.Stop()
 		flush := false
-		for !self.stop {
+		for {
 			select {
 			case mid := <-ch:
 				data = append(data, mid)
 			case <-timer.C:
 				flush = true
+			case <-self.closeChan:
+				//停止时提交剩余的操作
+			drain:
+				for {
+					select {
+					case mid := <-ch:
+						data = append(data, mid)
+					default:
+						break drain
+					}
+				}
+				do(hashid, data)
+				return
 			}
 			//强制提交: 达到批量提交的阀值或者超时没有数据则提交
 			if len(data) >= batchSize || flush {
 
 				tmp := data
+				self.wg.Add(1)
 				go func() {
 					defer func() {
 						batchPool <- tmp[:0]
+						self.wg.Done()
 					}()
 					do(hashid, tmp)
 				}()
@@ -145,7 +179,6 @@ func (self *KiteMysqlStore) startBatch(hash int,
 				timer.Reset(self.flushPeriod)
 			}
 		}
-		timer.Stop()
 	}
 
 	//启动批量删除
@@ -155,23 +188,53 @@ func (self *KiteMysqlStore) startBatch(hash int,
 
 }
 
+//停止后批量提交已经退出,异步操作直接返回失败
+func (self *KiteMysqlStore) closed() bool {
+	select {
+	case <-self.closeChan:
+		return true
+	default:
+		return false
+	}
+}
+
 func (self *KiteMysqlStore) AsyncCommit(messageid string) bool {
+	if self.closed() {
+		return false
+	}
 	idx := self.dbshard.HashId(messageid)
-	self.batchComChan[idx] <- messageid
-	return true
-
+	select {
+	case self.batchComChan[idx] <- messageid:
+		return true
+	case <-self.closeChan:
+		return false
+	}
 }
 
 func (self *KiteMysqlStore) AsyncUpdate(entity *MessageEntity) bool {
+	if self.closed() {
+		return false
+	}
 	idx := self.dbshard.HashId(entity.MessageId)
-	self.batchUpChan[idx] <- entity
-	return true
-
+	select {
+	case self.batchUpChan[idx] <- entity:
+		return true
+	case <-self.closeChan:
+		return false
+	}
 }
+
 func (self *KiteMysqlStore) AsyncDelete(messageid string) bool {
+	if self.closed() {
+		return false
+	}
 	idx := self.dbshard.HashId(messageid)
-	self.batchDelChan[idx] <- messageid
-	return true
+	select {
+	case self.batchDelChan[idx] <- messageid:
+		return true
+	case <-self.closeChan:
+		return false
+	}
 }
 
 func (self *KiteMysqlStore) stmtPool(bt batchType, hash string) *StmtPool {
@@ -282,7 +345,9 @@ func (self *KiteMysqlStore) batchUpdate(hashId int, entity []*MessageEntity) boo
 }
 
 func (self *KiteMysqlStore) Stop() {
-	self.stop = true
+	close(self.closeChan)
+	//等待剩余的异步操作提交完成后再关闭stmt和db
+	self.wg.Wait()
 	for k, v := range self.stmtPools {
 		for _, s := range v {
 			for _, p := range s {
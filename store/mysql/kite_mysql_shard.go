@@ -20,6 +20,7 @@ type shardrange struct {
 }
 
 type DbShard struct {
+	driver      string //mysql或者sqlite3,用于生成对应的SQL
 	shardNum    int
 	hashNum     int
 	shardranges []shardrange
@@ -46,7 +47,7 @@ func newDbShard(options MysqlOptions) DbShard {
 		shardranges = append(shardranges, shardrange{i * hash, (i + 1) * hash, i, master, slave})
 	}
 
-	return DbShard{options.ShardNum, hash, shardranges}
+	return DbShard{"mysql", options.ShardNum, hash, shardranges}
 }
 
 func openDb(addr string, shardId int, idleConn, maxConn int) *sql.DB {
@@ -120,6 +121,8 @@ func (s DbShard) HashNum() int {
 func (s DbShard) Stop() {
 	for _, v := range s.shardranges {
 		v.master.Close()
-		v.slave.Close()
+		if v.slave != v.master {
+			v.slave.Close()
+		}
 	}
 }
@@ -98,7 +98,7 @@ func (self *sqlwrapper) initSQL() {
 	s := bytes.NewBuffer(buff)
 	s.WriteString("select ")
 	for i, v := range self.columns {
-		s.WriteString(v.columnName)
+		s.WriteString(quote(v.columnName))
 		if i < len(self.columns)-1 {
 			s.WriteString(",")
 		}
@@ -122,7 +122,7 @@ func (self *sqlwrapper) initSQL() {
 	s.WriteString(self.tablename)
 	s.WriteString("_{} (")
 	for i, v := range self.columns {
-		s.WriteString(v.columnName)
+		s.WriteString(quote(v.columnName))
 		if i < len(self.columns)-1 {
 			s.WriteString(",")
 		}
@@ -171,7 +171,7 @@ func (self *sqlwrapper) initSQL() {
 			continue
 		}
 		s.WriteString("a.")
-		s.WriteString(v.columnName)
+		s.WriteString(quote(v.columnName))
 		if i < len(self.columns)-1 {
 			s.WriteString(",")
 		}
@@ -183,7 +183,12 @@ func (self *sqlwrapper) initSQL() {
 	s.WriteString(" ( select  message_id  from ")
 	s.WriteString(self.tablename)
 	s.WriteString("_{}  ")
-	s.WriteString(" force index(idx_recover) ")
+	if self.dbshard.driver == "sqlite3" {
+		//sqlite的索引名称在库内唯一
+		s.WriteString(" indexed by idx_recover_{} ")
+	} else {
+		s.WriteString(" force index(idx_recover) ")
+	}
 	s.WriteString(" where kite_server=? and deliver_count<deliver_limit and expired_time>=? and next_deliver_time<=? ")
 	s.WriteString(" order by next_deliver_time asc  limit ?,?) b")
 	s.WriteString(" using (message_id) ")
@@ -204,7 +209,7 @@ func (self *sqlwrapper) initSQL() {
 	s.WriteString("update ")
 	s.WriteString(self.tablename)
 	s.WriteString("_{} ")
-	s.WriteString(" set commit=? ")
+	s.WriteString(" set `commit`=? ")
 	s.WriteString(" where message_id=?")
 
 	sql = s.String()
@@ -247,3 +252,8 @@ func (self *sqlwrapper) initSQL() {
 	}
 
 }
+
+//commit在sqlite中为关键字,列名统一加上反引号,mysql和sqlite都支持
+func quote(columnName string) string {
+	return "`" + columnName + "`"
+}
@@ -0,0 +1,70 @@
+package mysql
+
+import (
+	"database/sql"
+	log "github.com/blackbeans/log4go"
+	_ "github.com/mattn/go-sqlite3"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//sqlite的参数
+type SqliteOptions struct {
+	Path                      string
+	BatchUpSize, BatchDelSize int
+	FlushPeriod               time.Duration
+}
+
+//sqlite的建表语句,{}为hash后的表序号
+const SQLITE_TABLE_SQL = `
+CREATE TABLE IF NOT EXISTS kite_msg_{} (
+  header blob,
+  body blob,
+  msg_type integer,
+  message_id varchar(32) NOT NULL PRIMARY KEY,
+  topic varchar(255),
+  message_type varchar(255),
+  publish_group varchar(255),
+  "commit" tinyint(1),
+  expired_time bigint,
+  publish_time bigint,
+  deliver_count integer,
+  deliver_limit integer,
+  kite_server varchar(255),
+  fail_groups varchar(255),
+  succ_groups varchar(255),
+  next_deliver_time bigint
+);
+CREATE INDEX IF NOT EXISTS idx_recover_{} ON kite_msg_{} (next_deliver_time,kite_server,expired_time,deliver_count,deliver_limit);
+`
+
+//基于sqlite的存储,复用mysql的SQL生成、转换和批量提交
+//只有一个分库,SHARD_SEED个分表都在同一个文件中,需要调用Start启动批量提交
+func NewKiteSqlite(options SqliteOptions) *KiteMysqlStore {
+	shard := newSqliteShard(options.Path)
+	ins := newKiteSqlStore(shard, options.BatchUpSize, options.BatchDelSize, options.FlushPeriod)
+	log.Info("NewKiteSqlite|KiteMysqlStore|SUCC|%s...\n", options.Path)
+	return ins
+}
+
+func newSqliteShard(path string) DbShard {
+	//sqlite只允许一个写连接,统一使用一个连接避免database is locked
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if nil != err {
+		log.Error("NewKiteSqlite|OPEN FAIL|%s|%s\n", err, path)
+		panic(err)
+	}
+	db.SetMaxOpenConns(1)
+
+	for i := 0; i < SHARD_SEED; i++ {
+		_, err := db.Exec(strings.Replace(SQLITE_TABLE_SQL, "{}", strconv.Itoa(i), -1))
+		if nil != err {
+			log.Error("NewKiteSqlite|CREATE TABLE|FAIL|%s|%s|%d\n", err, path, i)
+			panic(err)
+		}
+	}
+
+	shardranges := []shardrange{shardrange{0, SHARD_SEED, 0, db, db}}
+	return DbShard{"sqlite3", 1, SHARD_SEED, shardranges}
+}
@@ -0,0 +1,118 @@
+package mysql
+
+import (
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"io/ioutil"
+	"kiteq/protocol"
+	"kiteq/store"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSqliteStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kiteq-sqlite")
+	defer os.RemoveAll(dir)
+
+	options := SqliteOptions{
+		Path:         dir + "/kiteq.db",
+		BatchUpSize:  10,
+		BatchDelSize: 10,
+		FlushPeriod:  10 * time.Millisecond}
+	kiteSqlite := NewKiteSqlite(options)
+	kiteSqlite.Start()
+
+	for i := 0; i < 10; i++ {
+		msg := &protocol.StringMessage{}
+		msg.Header = &protocol.Header{
+			MessageId:    proto.String(fmt.Sprintf("%x", i) + "26c03f00665862591f696a980b5ac"),
+			Topic:        proto.String("trade"),
+			MessageType:  proto.String("pay-succ"),
+			ExpiredTime:  proto.Int64(time.Now().Add(10 * time.Minute).Unix()),
+			DeliverLimit: proto.Int32(100),
+			GroupId:      proto.String("go-kite-test"),
+			Commit:       proto.Bool(false),
+			Fly:          proto.Bool(false)}
+		msg.Body = proto.String("hello world")
+
+		entity := store.NewMessageEntity(protocol.NewQMessage(msg))
+		entity.KiteServer = "kiteq-server"
+		entity.PublishTime = time.Now().Unix()
+		entity.NextDeliverTime = int64(100 - i)
+		if !kiteSqlite.Save(entity) {
+			t.Fatalf("save fail %s", entity.MessageId)
+		}
+	}
+
+	id := "026c03f00665862591f696a980b5ac"
+	entity := kiteSqlite.Query(id)
+	if nil == entity || entity.GetBody().(string) != "hello world" ||
+		entity.Header.GetMessageId() != id || entity.Commit {
+		t.Fatalf("query %v", entity)
+	}
+
+	//异步提交、更新、删除
+	kiteSqlite.Commit(id)
+	kiteSqlite.AsyncUpdate(&store.MessageEntity{
+		MessageId:       id,
+		DeliverCount:    1,
+		NextDeliverTime: 200,
+		SuccGroups:      []string{},
+		FailGroups:      []string{"s-mts-test"}})
+	kiteSqlite.Delete("126c03f00665862591f696a980b5ac")
+	time.Sleep(200 * time.Millisecond)
+
+	entity = kiteSqlite.Query(id)
+	if nil == entity || !entity.Commit || entity.DeliverCount != 1 ||
+		entity.FailGroups[0] != "s-mts-test" {
+		t.Fatalf("async update %v", entity)
+	}
+	if nil != kiteSqlite.Query("126c03f00665862591f696a980b5ac") {
+		t.Fatal("async delete fail")
+	}
+
+	//所有消息在同一个分表,按照下次投递时间排序
+	more, entities := kiteSqlite.PageQueryEntity("ac", "kiteq-server", 150, 0, 4)
+	if !more || len(entities) != 4 {
+		t.Fatalf("page query %t %d", more, len(entities))
+	}
+	for i, e := range entities {
+		if e.NextDeliverTime != int64(91+i) {
+			t.Fatalf("page query order %d %d", i, e.NextDeliverTime)
+		}
+	}
+	more, entities = kiteSqlite.PageQueryEntity("ac", "kiteq-server", 150, 4, 4)
+	if more || len(entities) != 4 {
+		t.Fatalf("page query tail %t %d", more, len(entities))
+	}
+
+	//Stop时提交还没有执行的异步操作
+	kiteSqlite.AsyncUpdate(&store.MessageEntity{
+		MessageId:       id,
+		DeliverCount:    2,
+		NextDeliverTime: 300,
+		SuccGroups:      []string{"s-mts-test"},
+		FailGroups:      []string{}})
+	kiteSqlite.Commit("226c03f00665862591f696a980b5ac")
+	kiteSqlite.Delete("326c03f00665862591f696a980b5ac")
+	kiteSqlite.Stop()
+	if kiteSqlite.AsyncDelete(id) {
+		t.Fatal("async delete after stop")
+	}
+
+	kiteSqlite = NewKiteSqlite(options)
+	kiteSqlite.Start()
+	defer kiteSqlite.Stop()
+	entity = kiteSqlite.Query(id)
+	if nil == entity || entity.DeliverCount != 2 || entity.NextDeliverTime != 300 ||
+		entity.SuccGroups[0] != "s-mts-test" {
+		t.Fatalf("async update not flushed on stop %v", entity)
+	}
+	if entity = kiteSqlite.Query("226c03f00665862591f696a980b5ac"); nil == entity || !entity.Commit {
+		t.Fatalf("async commit not flushed on stop %v", entity)
+	}
+	if nil != kiteSqlite.Query("326c03f00665862591f696a980b5ac") {
+		t.Fatal("async delete not flushed on stop")
+	}
+}
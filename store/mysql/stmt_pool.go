@@ -95,11 +95,16 @@ func (self *StmtPool) enhancedPool(size int) error {
 }
 
 func (self *StmtPool) evict() {
-	for self.running {
+	for {
 
 		select {
 		case <-time.After(self.idletime):
 			self.mutex.Lock()
+			//running由Shutdown在锁内修改
+			if !self.running {
+				self.mutex.Unlock()
+				return
+			}
 			for e := self.idlePool.Back(); nil != e; e = e.Prev() {
 				idlestmt := e.Value.(*IdleStmt)
 				//如果当前时间在过期时间之后并且活动的链接大于corepoolsize则关闭
@@ -227,16 +232,12 @@ func (self *StmtPool) Shutdown() {
 	self.mutex.Lock()
 	defer self.mutex.Unlock()
 	self.running = false
-	//等待五秒中结束
-	time.Sleep(1 * time.Second)
-	for i := 0; i < 3; {
-
-		if self.numWork <= 0 {
-			break
-		}
-
+	//等待工作中的stmt归还,最多三秒
+	for i := 0; i < 3 && self.numWork > 0; i++ {
 		log.Info("Statment Pool|CLOSEING|WORK POOL SIZE|:%d\n", self.numWork)
-		i++
+		self.mutex.Unlock()
+		time.Sleep(1 * time.Second)
+		self.mutex.Lock()
 	}
 
 	var idleStmt *IdleStmt